@@ -114,7 +114,14 @@ func genGetReqpos(kvs afind.KeyValueStorer, keys []string, meta afind.Meta, meta
 }
 
 func logmsgFind(q afind.FindQuery) string {
-	return fmt.Sprintf("find [%v]", q.PathRe)
+	msg := fmt.Sprintf("find [%v]", q.PathRe)
+	if len(q.ExcludePathRe) > 0 {
+		msg += fmt.Sprintf(" exclude %v", q.ExcludePathRe)
+	}
+	if len(q.Languages) > 0 {
+		msg += fmt.Sprintf(" languages %v", q.Languages)
+	}
+	return msg
 }
 
 func doFind(s *findServer, q afind.FindQuery, timeout time.Duration) (
@@ -128,6 +135,7 @@ func doFind(s *findServer, q afind.FindQuery, timeout time.Duration) (
 	fr = afind.NewFindResult()
 	fr.MaxMatches = q.MaxMatches
 	count := 0
+	var prev afind.Cursor
 	chQuery := make(chan par.RequestFunc, 100)
 	chResult := make(chan *afind.FindResult, 10)
 
@@ -141,6 +149,9 @@ func doFind(s *findServer, q afind.FindQuery, timeout time.Duration) (
 		fr.SetError(err)
 		goto done
 	}
+	// Shards not searched this time keep their previous position
+	prev, _ = afind.DecodeCursor(q.Cursor)
+	fr.Progress.Update(prev)
 
 	// Execute the requests
 	sw.Start("queryFind")
@@ -160,6 +171,8 @@ func doFind(s *findServer, q afind.FindQuery, timeout time.Duration) (
 	if count < 1 {
 		err = errs.NewRepoUnavailableError()
 	}
+	fr.Truncate(q.MaxMatches)
+	fr.Next = fr.Progress.Encode()
 	sw.Stop("queryFind")
 
 done:
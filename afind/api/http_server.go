@@ -23,17 +23,21 @@ func (s *webServer) Register() {
 		panic("server must be setup prior to Register being called")
 	}
 
-	svrRepos := &reposServer{s.repos}
+	svrRepos := &reposServer{&s.config, s.repos}
 	svrIndex := &indexServer{&s.config, s.repos, s.indexer}
-	svrSearch := &searchServer{&s.config, s.repos, s.searcher}
+	svrSearch := &searchServer{&s.config, s.repos, s.searcher, s.replicas, s.streams}
 	svrFind := &findServer{&s.config, s.repos, s.finder}
 
 	s.rtr.GET("/api/v1/repo", svrRepos.webGet)
 	s.rtr.GET("/api/v1/repo/:key", svrRepos.webGet)
 	s.rtr.DELETE("/api/v1/repo/:key", svrRepos.webDelete)
+	s.rtr.GET("/api/v1/repo/:key/snapshots", svrRepos.webSnapshots)
+	s.rtr.GET("/api/v1/expire", svrRepos.webExpire)
+	s.rtr.POST("/api/v1/expire", svrRepos.webExpire)
 
 	s.rtr.POST("/api/v1/index", svrIndex.webIndex)
 	s.rtr.POST("/api/v1/search", svrSearch.webSearch)
+	s.rtr.POST("/api/v1/search/stream", svrSearch.webSearchStream)
 	s.rtr.POST("/api/v1/find", svrFind.webFind)
 }
 
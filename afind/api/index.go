@@ -143,11 +143,20 @@ func doIndex(s *indexServer, req afind.IndexQuery, timeout time.Duration) (
 	sw.Start("*")
 	resp = afind.NewIndexResult()
 	log.Debug("index [%s] request %#v local=%v", req.Key, req, local)
-	// A repo cannot be updated or replaced. If a Repo with the same
-	// key already exists on this instance, return it immediately.
+	// A repo cannot be replaced, only updated. If a Repo with the
+	// same key already exists on this instance, return it
+	// immediately unless this is an update request.
+	update := false
 	if r := s.repos.Get(req.Key); r != nil {
-		resp.Repo = r.(*afind.Repo)
-		return
+		existing := r.(*afind.Repo)
+		if !req.Update || existing.State == afind.INDEXING {
+			resp.Repo = existing
+			return
+		}
+		// The existing Repo remains available for searching
+		// while it is updated.
+		req.Inherit(existing)
+		update = true
 	}
 
 	// Validate the request
@@ -156,13 +165,15 @@ func doIndex(s *indexServer, req afind.IndexQuery, timeout time.Duration) (
 		return
 	}
 
-	// Set a marker repo in the store, indicating we're presently indexing
-	tmprepo := afind.NewRepo()
-	tmprepo.Key = req.Key
-	tmprepo.State = afind.INDEXING
-	tmprepo.Root = req.Root
-	tmprepo.Meta.Update(req.Meta)
-	_ = s.repos.Set(req.Key, tmprepo)
+	if !update {
+		// Set a marker repo in the store, indicating we're presently indexing
+		tmprepo := afind.NewRepo()
+		tmprepo.Key = req.Key
+		tmprepo.State = afind.INDEXING
+		tmprepo.Root = req.Root
+		tmprepo.Meta.Update(req.Meta)
+		_ = s.repos.Set(req.Key, tmprepo)
+	}
 
 	// setup a request context
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -208,12 +219,12 @@ func doIndex(s *indexServer, req afind.IndexQuery, timeout time.Duration) (
 				if incoming.Repo.State == afind.OK {
 					// Set the repo if we have a valid one in the response
 					_ = s.repos.Set(incoming.Repo.Key, incoming.Repo)
-				} else if s.cfg.DeleteRepoOnError {
+				} else if s.cfg.DeleteRepoOnError && !update {
 					// Delete the not OK repo we received.
 					log.Warning("unexpected bad repo state: %#v", incoming)
 					_ = s.repos.Delete(req.Key)
 				}
-			} else {
+			} else if !update {
 				// There was no repo, so delete any temporary one
 				_ = s.repos.Delete(req.Key)
 			}
@@ -227,7 +238,9 @@ func doIndex(s *indexServer, req afind.IndexQuery, timeout time.Duration) (
 		// appropriate backend.
 		log.Debug("unservicable IndexQuery %#v local=%v", req, local)
 		err = errs.NewNoRpcClientError()
-		_ = s.repos.Delete(req.Key)
+		if !update {
+			_ = s.repos.Delete(req.Key)
+		}
 	}
 
 	log.Debug("index [%s] done (%v)", req.Key, sw.Stop("*"))
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/afind"
+	"github.com/andaru/afind/errs"
+	"github.com/savaki/par"
+)
+
+// Replica-aware search fan-out.
+//
+// Repo sharing the same value of a query's MetaReplicaKey are
+// replicas of one logical source. Only MetaReplicaMax of each group
+// of replicas are searched, preferring the least loaded and fastest
+// hosts, and the remaining replicas are tried in turn should one be
+// unavailable.
+
+const (
+	// weight of each new sample in the moving average latency
+	latencyWeight = 0.25
+	// latency penalty applied to a host when a request fails
+	latencyPenalty = 5 * time.Second
+)
+
+// replicaStats tracks the number of requests in flight and the
+// recent request latency for each host.
+type replicaStats struct {
+	*sync.Mutex
+	hosts map[string]*hostStats
+}
+
+type hostStats struct {
+	inflight int
+	latency  time.Duration // moving average
+}
+
+func newReplicaStats() *replicaStats {
+	return &replicaStats{&sync.Mutex{}, make(map[string]*hostStats)}
+}
+
+func (rs *replicaStats) get(host string) *hostStats {
+	hs, ok := rs.hosts[host]
+	if !ok {
+		hs = &hostStats{}
+		rs.hosts[host] = hs
+	}
+	return hs
+}
+
+// start records the start of a request to host
+func (rs *replicaStats) start(host string) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.get(host).inflight++
+}
+
+// done records the completion of a request to host. Failed requests
+// are penalised, so that other replicas are preferred.
+func (rs *replicaStats) done(host string, elapsed time.Duration, failed bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	hs := rs.get(host)
+	if hs.inflight > 0 {
+		hs.inflight--
+	}
+	if failed {
+		elapsed += latencyPenalty
+	}
+	if hs.latency == 0 {
+		hs.latency = elapsed
+	} else {
+		hs.latency += time.Duration(latencyWeight * float64(elapsed-hs.latency))
+	}
+}
+
+// order sorts the replicas from most to least preferred; those on
+// hosts with fewer requests in flight, then lower latency.
+func (rs *replicaStats) order(repos []*afind.Repo) {
+	rs.Lock()
+	defer rs.Unlock()
+	sort.Sort(byPreference{repos, rs})
+}
+
+type byPreference struct {
+	repos []*afind.Repo
+	rs    *replicaStats
+}
+
+func (p byPreference) Len() int      { return len(p.repos) }
+func (p byPreference) Swap(i, j int) { p.repos[i], p.repos[j] = p.repos[j], p.repos[i] }
+func (p byPreference) Less(i, j int) bool {
+	hi, hj := p.rs.get(p.repos[i].Host()), p.rs.get(p.repos[j].Host())
+	if hi.inflight != hj.inflight {
+		return hi.inflight < hj.inflight
+	} else if hi.latency != hj.latency {
+		return hi.latency < hj.latency
+	}
+	return p.repos[i].Key < p.repos[j].Key
+}
+
+// replicaGroups splits the repos into those which are not replicas
+// of any other, and groups of replicas sharing the value of key.
+func replicaGroups(repos []*afind.Repo, key string) (
+	single []*afind.Repo, groups [][]*afind.Repo) {
+
+	if key == "" {
+		return repos, nil
+	}
+	byValue := map[string][]*afind.Repo{}
+	values := []string{}
+	for _, repo := range repos {
+		value, ok := repo.Meta[key]
+		if !ok {
+			single = append(single, repo)
+			continue
+		}
+		if _, ok := byValue[value]; !ok {
+			values = append(values, value)
+		}
+		byValue[value] = append(byValue[value], repo)
+	}
+	for _, value := range values {
+		if group := byValue[value]; len(group) == 1 {
+			single = append(single, group[0])
+		} else {
+			groups = append(groups, group)
+		}
+	}
+	return
+}
+
+// replicaCandidates returns, for each replica to query, the
+// replicas to try in order. At most max replicas are queried (all,
+// if max is 0), and the remainder are spread across them as spares.
+func replicaCandidates(group []*afind.Repo, max int) [][]*afind.Repo {
+	if max <= 0 || max > len(group) {
+		max = len(group)
+	}
+	candidates := make([][]*afind.Repo, max)
+	for n, repo := range group {
+		candidates[n%max] = append(candidates[n%max], repo)
+	}
+	return candidates
+}
+
+// replicaFailed returns true if the result shows the replica was
+// unavailable, in which case another replica should be tried.
+func replicaFailed(sr *afind.SearchResult, repo *afind.Repo) bool {
+	for _, key := range []string{repo.Key, repo.Host()} {
+		if e, ok := sr.Errors[key]; ok && e != nil {
+			switch e.T {
+			case "no_repo_found", "timeout", "network_error",
+				"rpc_client_unavailable":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replicaSearch searches the first available of the candidate
+// replicas. Each attempt is given an equal share of the time
+// remaining in the request, and no further replicas are tried once
+// the request is done.
+func replicaSearch(s *searchServer, q afind.SearchQuery,
+	candidates []*afind.Repo, results chan *afind.SearchResult) par.RequestFunc {
+
+	return func(ctx context.Context) error {
+		var sr *afind.SearchResult
+		for n, repo := range candidates {
+			if ctx.Err() != nil {
+				// the search is over; don't try further replicas
+				break
+			}
+			this := afind.SearchQuery(q)
+			this.RepoKeys = []string{repo.Key}
+			this.Meta = afind.Meta{}
+			this.Meta.Update(q.Meta)
+			this.Meta.SetHost(repo.Host())
+
+			actx, cancel := ctx, context.CancelFunc(func() {})
+			if deadline, ok := ctx.Deadline(); ok {
+				share := deadline.Sub(time.Now()) / time.Duration(len(candidates)-n)
+				actx, cancel = context.WithTimeout(ctx, share)
+			}
+			if isLocal(s.cfg, repo.Host()) {
+				sr = searchLocalRepo(actx, s, this)
+			} else {
+				sr = searchRemote(actx, s, this)
+			}
+			cancel()
+			if !replicaFailed(sr, repo) {
+				break
+			}
+			log.Debug("%s replica %v unavailable (%d of %d)",
+				logmsgSearch(q), repo.Key, n+1, len(candidates))
+		}
+		if sr == nil {
+			sr = afind.NewSearchResult()
+			sr.Error = errs.NewRepoUnavailableError().Error()
+		}
+		select {
+		case <-ctx.Done():
+		default:
+			results <- sr
+		}
+		return nil
+	}
+}
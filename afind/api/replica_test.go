@@ -0,0 +1,178 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/afind"
+	"github.com/andaru/afind/errs"
+	"github.com/savaki/par"
+)
+
+func newReplica(key, host, value string) *afind.Repo {
+	r := newRepo(key)
+	r.Meta.SetHost(host)
+	if value != "" {
+		r.Meta["mirror"] = value
+	}
+	return r
+}
+
+func TestReplicaGroups(t *testing.T) {
+	repos := []*afind.Repo{
+		newReplica("a1", "h1", "a"),
+		newReplica("b1", "h1", "b"),
+		newReplica("a2", "h2", "a"),
+		newReplica("c1", "h1", ""),
+	}
+	single, groups := replicaGroups(repos, "")
+	eq(t, 4, len(single))
+	eq(t, 0, len(groups))
+
+	single, groups = replicaGroups(repos, "mirror")
+	// b1 has no other replica, and c1 has no replica key
+	eq(t, 2, len(single))
+	if eq(t, 1, len(groups)) {
+		eq(t, "a1", groups[0][0].Key)
+		eq(t, "a2", groups[0][1].Key)
+	}
+}
+
+func TestReplicaCandidates(t *testing.T) {
+	group := []*afind.Repo{
+		newReplica("1", "h1", "x"),
+		newReplica("2", "h2", "x"),
+		newReplica("3", "h3", "x"),
+	}
+	eq(t, 3, len(replicaCandidates(group, 0)))
+	eq(t, 3, len(replicaCandidates(group, 10)))
+
+	c := replicaCandidates(group, 1)
+	if eq(t, 1, len(c)) {
+		eq(t, 3, len(c[0]))
+	}
+	c = replicaCandidates(group, 2)
+	if eq(t, 2, len(c)) {
+		eq(t, []*afind.Repo{group[0], group[2]}, c[0])
+		eq(t, []*afind.Repo{group[1]}, c[1])
+	}
+}
+
+func TestReplicaStatsOrder(t *testing.T) {
+	rs := newReplicaStats()
+	group := []*afind.Repo{
+		newReplica("1", "slow", "x"),
+		newReplica("2", "busy", "x"),
+		newReplica("3", "fast", "x"),
+	}
+	rs.start("slow")
+	rs.done("slow", time.Second, false)
+	rs.start("fast")
+	rs.done("fast", time.Millisecond, false)
+	rs.start("busy")
+
+	rs.order(group)
+	eq(t, "fast", group[0].Host())
+	eq(t, "slow", group[1].Host())
+	eq(t, "busy", group[2].Host())
+
+	// Failures push a host to the back of the queue
+	rs.start("fast")
+	rs.done("fast", time.Millisecond, true)
+	rs.order(group)
+	eq(t, "slow", group[0].Host())
+}
+
+func TestReplicaFailed(t *testing.T) {
+	repo := newReplica("rep1", "testhost", "x")
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errs.NewRepoUnavailableError(), true},
+		{errs.NewTimeoutError("search"), true},
+		{errs.NewNoRpcClientError(), true},
+		{errs.NewValueError("re", "bad"), false},
+	} {
+		sr := afind.NewSearchResult()
+		sr.Errors[repo.Host()] = errs.NewStructError(tc.err)
+		eq(t, tc.want, replicaFailed(sr, repo))
+	}
+	eq(t, false, replicaFailed(afind.NewSearchResult(), repo))
+}
+
+func TestReplicaSearchFailover(t *testing.T) {
+	c := getTestConfig()
+	sys := newTestAfind(c)
+	s := &searchServer{&c, sys.repos, sys.searcher, newReplicaStats(), newSearchStreams()}
+
+	unavailable := afind.NewSearchResult()
+	unavailable.Errors["rep1"] = errs.NewStructError(errs.NewRepoUnavailableError())
+	ktSearchQueries["rep1_replicated"] = unavailable
+	available := afind.NewSearchResult()
+	available.AddFileRepoMatches("a.txt", "rep2", map[string]string{"1": "replicated"})
+	ktSearchQueries["rep2_replicated"] = available
+
+	testAddRepos(sys, map[string]*afind.Repo{
+		"rep1": newReplica("rep1", "testhost", "x"),
+		"rep2": newReplica("rep2", "testhost", "x"),
+	})
+
+	q := afind.NewSearchQuery("replicated", "", false, []string{})
+	q.MetaReplicaKey = "mirror"
+	q.MetaReplicaMax = 1
+	sr, err := doSearch(s, q, time.Second, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, 0, len(sr.Errors))
+	if _, ok := sr.Matches["a.txt"]["rep2"]; !ok {
+		t.Error("want match from replica rep2")
+	}
+}
+
+func TestReplicaSearchCancelled(t *testing.T) {
+	c := getTestConfig()
+	sys := newTestAfind(c)
+	s := &searchServer{&c, sys.repos, sys.searcher, newReplicaStats(), newSearchStreams()}
+	candidates := []*afind.Repo{
+		newReplica("rep1", "testhost", "x"),
+		newReplica("rep2", "testhost", "x"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := make(chan *afind.SearchResult, 1)
+	q := afind.NewSearchQuery("replicated", "", false, []string{})
+	if err := replicaSearch(s, q, candidates, results)(ctx); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	eq(t, 0, sys.searcher.called["Search"])
+	eq(t, 0, len(results))
+}
+
+func TestReplicaSearchMaxBackends(t *testing.T) {
+	c := getTestConfig()
+	c.MaxSearchReqBe = 1
+	sys := newTestAfind(c)
+	s := &searchServer{&c, sys.repos, sys.searcher, newReplicaStats(), newSearchStreams()}
+	testAddRepos(sys, map[string]*afind.Repo{
+		"a1": newReplica("a1", "remote1", "a"),
+		"a2": newReplica("a2", "remote2", "a"),
+		"b1": newReplica("b1", "remote1", "b"),
+		"b2": newReplica("b2", "remote2", "b"),
+	})
+
+	q := afind.NewSearchQuery("replicated", "", false, []string{})
+	q.MetaReplicaKey = "mirror"
+	q.MetaReplicaMax = 1
+	chQuery := make(chan par.RequestFunc)
+	go getSearchQueries(s, q, chQuery, make(chan *afind.SearchResult))
+	queries := 0
+	for range chQuery {
+		queries++
+	}
+	eq(t, 1, queries)
+}
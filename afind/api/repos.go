@@ -30,12 +30,27 @@ func (r *ReposClient) GetAll() (resp map[string]*afind.Repo, err error) {
 }
 
 func (r *ReposClient) Delete(key string) (err error) {
-	var resp *struct{}
-	err = r.client.Call(r.endpoint+".Delete", key, resp)
+	var resp struct{}
+	err = r.client.Call(r.endpoint+".Delete", key, &resp)
+	return
+}
+
+// Snapshots returns the snapshots kept of the Repo's index, oldest
+// first, or an error if there is no such Repo
+func (r *ReposClient) Snapshots(key string) (resp []afind.Snapshot, err error) {
+	err = r.client.Call(r.endpoint+".Snapshots", key, &resp)
+	return
+}
+
+// Expire evicts the Repo beyond the server's retention rules, or
+// if dryRun is true, reports those which would be evicted
+func (r *ReposClient) Expire(dryRun bool) (resp *afind.ExpiryReport, err error) {
+	err = r.client.Call(r.endpoint+".Expire", dryRun, &resp)
 	return
 }
 
 type reposServer struct {
+	cfg   *afind.Config
 	repos afind.KeyValueStorer
 }
 
@@ -60,17 +75,67 @@ func (s *reposServer) GetAll(args struct{}, reply *map[string]*afind.Repo) error
 }
 
 func (s *reposServer) Delete(args string, reply *struct{}) error {
-	_ = s.repos.Delete(args)
+	_ = s.delete(args)
 	reply = &struct{}{}
 	return nil
 }
 
+// delete deletes the Repo key, and removes the snapshots of a Repo
+// on this host
+func (s *reposServer) delete(key string) error {
+	repo, _ := s.repos.Get(key).(*afind.Repo)
+	if err := s.repos.Delete(key); err != nil {
+		return err
+	}
+	if repo != nil && s.cfg.IsHostLocal(repo.Host()) {
+		if err := repo.RemoveSnapshots(); err != nil {
+			log.Warning("delete repo [%v] cannot remove snapshots: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *reposServer) Snapshots(args string, reply *[]afind.Snapshot) error {
+	snapshots, err := s.snapshots(args)
+	*reply = snapshots
+	return err
+}
+
+// snapshots returns the snapshots of the Repo key
+func (s *reposServer) snapshots(key string) ([]afind.Snapshot, error) {
+	r := s.repos.Get(key)
+	if r == nil {
+		return nil, errs.NewRepoUnavailableError()
+	}
+	snapshots := r.(*afind.Repo).Snapshots
+	if snapshots == nil {
+		snapshots = []afind.Snapshot{}
+	}
+	return snapshots, nil
+}
+
+func (s *reposServer) Expire(args bool, reply *afind.ExpiryReport) error {
+	*reply = *afind.ExpireRepos(s.cfg, s.repos, args)
+	return nil
+}
+
+// webExpire reports the Repo to be evicted for GET requests, and
+// evicts them for POST requests
+func (s *reposServer) webExpire(rw http.ResponseWriter, req *http.Request,
+	ps httprouter.Params) {
+
+	setJson(rw)
+	report := afind.ExpireRepos(s.cfg, s.repos, req.Method != "POST")
+	rw.WriteHeader(200)
+	_ = json.NewEncoder(rw).Encode(report)
+}
+
 func (s *reposServer) webDelete(rw http.ResponseWriter, req *http.Request,
 	ps httprouter.Params) {
 
 	setJson(rw)
 	key := ps.ByName("key")
-	if err := s.repos.Delete(key); err == nil {
+	if err := s.delete(key); err == nil {
 		rw.WriteHeader(200)
 	} else {
 		enc := json.NewEncoder(rw)
@@ -79,6 +144,22 @@ func (s *reposServer) webDelete(rw http.ResponseWriter, req *http.Request,
 	}
 }
 
+// webSnapshots lists the snapshots of a Repo
+func (s *reposServer) webSnapshots(rw http.ResponseWriter, req *http.Request,
+	ps httprouter.Params) {
+
+	setJson(rw)
+	enc := json.NewEncoder(rw)
+	snapshots, err := s.snapshots(ps.ByName("key"))
+	if err != nil {
+		rw.WriteHeader(404)
+		_ = enc.Encode(errs.NewStructError(err))
+		return
+	}
+	rw.WriteHeader(200)
+	_ = enc.Encode(snapshots)
+}
+
 func (s *reposServer) webGet(rw http.ResponseWriter, req *http.Request,
 	ps httprouter.Params) {
 
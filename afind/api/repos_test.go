@@ -1,7 +1,11 @@
 package api
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/andaru/afind/afind"
 )
@@ -91,3 +95,101 @@ func TestReposGet(t *testing.T) {
 	}
 
 }
+
+func TestReposDeleteSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_api_delete")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	sys := newRpcServer(t, getTestConfig())
+	addr := sys.rpcServer.l.Addr().String()
+	defer sys.rpcServer.CloseNoErr()
+
+	// the snapshots of local Repo are removed, and those of other
+	// hosts' Repo left to their hosts
+	snapshots := map[string]string{}
+	for key, host := range map[string]string{"local": "testhost", "remote": "otherhost"} {
+		repo := newRepo(key)
+		repo.SetHost(host)
+		repo.IndexPath = dir
+		snapshots[key] = filepath.Join(dir, key+".snapshots")
+		_ = os.MkdirAll(filepath.Join(snapshots[key], "1"), 0755)
+		testAddRepos(sys, map[string]*afind.Repo{key: repo})
+	}
+	cl, err := NewRpcClient(addr)
+	if err != nil {
+		t.Fatal("unexpected client error:", err)
+	}
+	repos := NewReposClient(cl)
+	for _, key := range []string{"local", "remote"} {
+		if err = repos.Delete(key); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if _, err = os.Stat(snapshots["local"]); !os.IsNotExist(err) {
+		t.Error("want the local Repo's snapshots removed, got", err)
+	}
+	if _, err = os.Stat(snapshots["remote"]); err != nil {
+		t.Error("want the remote Repo's snapshots kept, got", err)
+	}
+}
+
+func TestReposExpire(t *testing.T) {
+	c := getTestConfig()
+	c.Retention = []afind.RetentionRule{{MaxRepos: 1}}
+	sys := newRpcServer(t, c)
+	addr := sys.rpcServer.l.Addr().String()
+	defer sys.rpcServer.CloseNoErr()
+
+	for n, key := range []string{"old", "new"} {
+		repo := newRepo(key)
+		repo.TimeUpdated = time.Now().Add(time.Duration(n) * time.Hour)
+		testAddRepos(sys, map[string]*afind.Repo{key: repo})
+	}
+	cl, err := NewRpcClient(addr)
+	if err != nil {
+		t.Fatal("unexpected client error:", err)
+	}
+	report, err := NewReposClient(cl).Expire(true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !report.DryRun || len(report.Expired) != 1 || report.Expired[0].Key != "old" {
+		t.Errorf("want dry run expiring old, got %#v", report)
+	}
+	if sys.repos.Size() != 2 {
+		t.Error("want no repos deleted by a dry run, got", sys.repos.Size())
+	}
+}
+
+func TestReposSnapshots(t *testing.T) {
+	sys := newRpcServer(t, getTestConfig())
+	addr := sys.rpcServer.l.Addr().String()
+	defer sys.rpcServer.CloseNoErr()
+
+	repo := newRepo("snaps")
+	repo.Snapshots = []afind.Snapshot{
+		{ID: 1, Label: "v1", NumShards: 1},
+		{ID: 2, Label: "v2", NumShards: 1},
+	}
+	testAddRepos(sys, map[string]*afind.Repo{"snaps": repo, "plain": newRepo("plain")})
+	cl, err := NewRpcClient(addr)
+	if err != nil {
+		t.Fatal("unexpected client error:", err)
+	}
+	repos := NewReposClient(cl)
+	snapshots, err := repos.Snapshots("snaps")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Label != "v1" || snapshots[1].Label != "v2" {
+		t.Errorf("want snapshots v1, v2, got %#v", snapshots)
+	}
+	if snapshots, err = repos.Snapshots("plain"); err != nil || len(snapshots) != 0 {
+		t.Errorf("want no snapshots, got %#v (error %v)", snapshots, err)
+	}
+	if _, err = repos.Snapshots("not here"); err == nil {
+		t.Error("want error for a missing repo, got none")
+	}
+}
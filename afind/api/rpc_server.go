@@ -38,9 +38,9 @@ func (s *RpcServer) Register() {
 	if s.repos == nil || s.indexer == nil || s.searcher == nil {
 		panic("server must be setup prior to Register being called")
 	}
-	_ = s.server.RegisterName(EPRepos, &reposServer{s.repos})
+	_ = s.server.RegisterName(EPRepos, &reposServer{&s.config, s.repos})
 	_ = s.server.RegisterName(EPIndexer, &indexServer{&s.config, s.repos, s.indexer})
-	_ = s.server.RegisterName(EPSearcher, &searchServer{&s.config, s.repos, s.searcher})
+	_ = s.server.RegisterName(EPSearcher, &searchServer{&s.config, s.repos, s.searcher, s.replicas, s.streams})
 	_ = s.server.RegisterName(EPFinder, &findServer{&s.config, s.repos, s.finder})
 }
 
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/rpc"
+	"strings"
 	"time"
 
 	"code.google.com/p/go.net/context"
@@ -32,12 +33,19 @@ func (s *SearcherClient) Search(
 	query afind.SearchQuery) (sr *afind.SearchResult, err error) {
 
 	sr = afind.NewSearchResult()
-	searchCall := s.client.Go(s.endpoint+".Search", query, sr, nil)
+	err = s.call(ctx, s.endpoint+".Search", query, sr)
+	return
+}
+
+func (s *SearcherClient) call(ctx context.Context, method string,
+	args interface{}, reply interface{}) (err error) {
+
+	call := s.client.Go(method, args, reply, nil)
 	select {
 	case <-ctx.Done():
 		err = errs.NewTimeoutError("search")
-	case reply := <-searchCall.Done:
-		err = reply.Error
+	case done := <-call.Done:
+		err = done.Error
 	}
 	return
 }
@@ -84,10 +92,36 @@ func getSearchQueries(
 	maxBe := s.cfg.MaxSearchReqBe
 
 	defer close(chQuery)
+	// Skip repos the query cannot match
+	matching := make([]*afind.Repo, 0, len(repos))
+	for _, repo := range repos {
+		if q.MayMatchRepo(repo) {
+			matching = append(matching, repo)
+		}
+	}
+	repos = matching
 	if len(repos) < 1 {
 		return
 	}
 
+	// Replicas are queried separately from other repos, with
+	// failover to other replicas in the same group.
+	repos, groups := replicaGroups(repos, q.MetaReplicaKey)
+	for _, group := range groups {
+		s.replicas.order(group)
+		for _, candidates := range replicaCandidates(group, q.MetaReplicaMax) {
+			if maxBe > 0 && countBe >= maxBe {
+				log.Warning("%s max backend requests (%d)", logmsgSearch(q), maxBe)
+				return
+			}
+			count++
+			if !isLocal(s.cfg, candidates[0].Host()) {
+				countBe++
+			}
+			chQuery <- replicaSearch(s, q, candidates, chResult)
+		}
+	}
+
 	hosts := map[string][]string{}
 	for _, repo := range repos {
 		host := repo.Host()
@@ -132,12 +166,14 @@ type searchServer struct {
 	cfg      *afind.Config
 	repos    afind.KeyValueStorer
 	searcher afind.Searcher
+	replicas *replicaStats
+	streams  *searchStreams
 }
 
 func (s *searchServer) Search(args afind.SearchQuery,
 	reply *afind.SearchResult) (err error) {
 	timeout := timeoutSearch(args, s.cfg)
-	sr, err := doSearch(s, args, timeout)
+	sr, err := doSearch(s, args, timeout, nil)
 	if err != nil {
 		sr.Error = err.Error()
 	}
@@ -167,7 +203,7 @@ func (s *searchServer) webSearch(rw http.ResponseWriter, req *http.Request,
 	sr.Recurse = true
 
 	// Perform the search
-	if resp, err := doSearch(s, sr, timeoutSearch(sr, s.cfg)); err == nil {
+	if resp, err := doSearch(s, sr, timeoutSearch(sr, s.cfg), nil); err == nil {
 		rw.WriteHeader(200)
 		_ = enc.Encode(resp)
 	} else {
@@ -180,14 +216,7 @@ func localSearch(s *searchServer, req afind.SearchQuery,
 	results chan *afind.SearchResult) par.RequestFunc {
 
 	return func(ctx context.Context) error {
-		sr, err := s.searcher.Search(ctx, req)
-		if err != nil {
-			if len(req.RepoKeys) > 0 {
-				sr.Errors[req.RepoKeys[0]] = errs.NewStructError(err)
-			} else {
-				sr.Error = err.Error()
-			}
-		}
+		sr := searchLocalRepo(ctx, s, req)
 		select {
 		case <-ctx.Done():
 			return nil
@@ -198,22 +227,30 @@ func localSearch(s *searchServer, req afind.SearchQuery,
 	}
 }
 
+// searchLocalRepo searches the single Repo in the request locally
+func searchLocalRepo(ctx context.Context, s *searchServer,
+	req afind.SearchQuery) *afind.SearchResult {
+
+	start := time.Now()
+	host := s.cfg.Host()
+	s.replicas.start(host)
+	sr, err := s.searcher.Search(ctx, req)
+	if err != nil {
+		if len(req.RepoKeys) > 0 {
+			sr.Errors[req.RepoKeys[0]] = errs.NewStructError(err)
+		} else {
+			sr.Error = err.Error()
+		}
+	}
+	s.replicas.done(host, time.Since(start), err != nil || len(sr.Errors) > 0)
+	return sr
+}
+
 func remoteSearch(s *searchServer, req afind.SearchQuery,
 	results chan *afind.SearchResult) par.RequestFunc {
 
-	addr := getAddress(req.Meta, s.cfg.PortRpc())
 	return func(ctx context.Context) error {
-		sr := afind.NewSearchResult()
-		cl, err := NewRpcClient(addr)
-		if err == nil {
-			client := NewSearcherClient(cl)
-			defer client.Close()
-			sr, err = client.Search(ctx, req)
-		}
-		if err != nil {
-			sr.Errors[req.Meta.Host()] = errs.NewStructError(err)
-		}
-
+		sr := searchRemote(ctx, s, req)
 		select {
 		case <-ctx.Done():
 		default:
@@ -223,6 +260,28 @@ func remoteSearch(s *searchServer, req afind.SearchQuery,
 	}
 }
 
+// searchRemote sends the request to the afindd on the request's host
+func searchRemote(ctx context.Context, s *searchServer,
+	req afind.SearchQuery) *afind.SearchResult {
+
+	addr := getAddress(req.Meta, s.cfg.PortRpc())
+	start := time.Now()
+	host := req.Meta.Host()
+	s.replicas.start(host)
+	sr := afind.NewSearchResult()
+	cl, err := NewRpcClient(addr)
+	if err == nil {
+		client := NewSearcherClient(cl)
+		defer client.Close()
+		sr, err = client.Search(ctx, req)
+	}
+	if err != nil {
+		sr.Errors[host] = errs.NewStructError(err)
+	}
+	s.replicas.done(host, time.Since(start), err != nil)
+	return sr
+}
+
 func timeoutSearch(req afind.SearchQuery, cfg *afind.Config) time.Duration {
 	if req.Timeout == 0 {
 		return cfg.GetTimeoutSearch()
@@ -232,17 +291,37 @@ func timeoutSearch(req afind.SearchQuery, cfg *afind.Config) time.Duration {
 
 func logmsgSearch(req afind.SearchQuery) string {
 	msg := "search [" + req.Re + "]"
+	if req.Query != "" {
+		msg = "search query [" + req.Query + "]"
+	}
 	if req.IgnoreCase {
 		msg += " ignore-case"
+	} else if req.SmartCase {
+		msg += " smart-case"
+	}
+	if req.Literal {
+		msg += " literal"
+	}
+	if req.Word {
+		msg += " word"
 	}
 	if req.PathRe != "" {
 		msg += " path-re [" + req.PathRe + "]"
 	}
+	if len(req.ExcludePathRe) > 0 {
+		msg += " exclude [" + strings.Join(req.ExcludePathRe, "] [") + "]"
+	}
+	if len(req.Languages) > 0 {
+		msg += " languages [" + strings.Join(req.Languages, " ") + "]"
+	}
 	return msg
 }
 
-func doSearch(s *searchServer, req afind.SearchQuery, timeout time.Duration) (
-	resp *afind.SearchResult, err error) {
+// doSearch performs the search, merging the results of each backend
+// and local search into resp. If emit is not nil, it is called with
+// each of those results as they arrive.
+func doSearch(s *searchServer, req afind.SearchQuery, timeout time.Duration,
+	emit func(*afind.SearchResult)) (resp *afind.SearchResult, err error) {
 
 	sw := stopwatch.New()
 	sw.Start("total")
@@ -252,6 +331,7 @@ func doSearch(s *searchServer, req afind.SearchQuery, timeout time.Duration) (
 	resp = afind.NewSearchResult()
 	resp.MaxMatches = req.MaxMatches
 	updateRepos := map[string]*afind.Repo{}
+	var prev afind.Cursor
 
 	// Start filling the query channel
 	chQuery := make(chan par.RequestFunc, 100)
@@ -261,12 +341,18 @@ func doSearch(s *searchServer, req afind.SearchQuery, timeout time.Duration) (
 	// Get a request context
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	if !req.NoDedup {
+		ctx = afind.WithSearchDedup(ctx)
+	}
 
 	err = req.Normalize()
 	if err != nil {
 		resp.SetError(err)
 		goto done
 	}
+	// Shards not searched this time keep their previous position
+	prev, _ = afind.DecodeCursor(req.Cursor)
+	resp.Progress.Update(prev)
 
 	// Execute the requests concurrently
 	go func() {
@@ -286,6 +372,9 @@ func doSearch(s *searchServer, req afind.SearchQuery, timeout time.Duration) (
 			updateRepos[key] = repo
 		}
 		resp.Update(in)
+		if emit != nil {
+			emit(in)
+		}
 		if resp.EnoughResults() {
 			log.Debug("%s finished early (%d matches)",
 				msg, resp.NumMatches)
@@ -294,6 +383,16 @@ func doSearch(s *searchServer, req afind.SearchQuery, timeout time.Duration) (
 		}
 	}
 
+	// Report files with identical contents once, then rank the
+	// files found, keeping only the best if there were more
+	// matches than requested
+	if !req.NoDedup {
+		resp.Dedup()
+	}
+	resp.Rank()
+	resp.Truncate(req.MaxMatches, prev)
+	resp.Next = resp.Progress.Encode()
+
 done:
 	// Update our knowledge about Repo found in the responses
 	for key, repo := range updateRepos {
@@ -16,13 +16,18 @@ type baseServer struct {
 	finder   afind.Finder
 	config   afind.Config
 
+	// search load and latency per host, to select replicas
+	replicas *replicaStats
+	// streaming searches in progress for RPC clients
+	streams *searchStreams
+
 	quit chan struct{}
 }
 
 // NewServer creates a new base server from the components provided
 func NewServer(rs afind.KeyValueStorer, ix afind.Indexer,
 	sr afind.Searcher, f afind.Finder, c *afind.Config) *baseServer {
-	return &baseServer{rs, ix, sr, f, *c, make(chan struct{}, 1)}
+	return &baseServer{rs, ix, sr, f, *c, newReplicaStats(), newSearchStreams(), make(chan struct{}, 1)}
 }
 
 func (base *baseServer) Quit() {
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/afind"
+	"github.com/andaru/afind/errs"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Streaming search.
+//
+// A streaming search sends the matches of each file to the client
+// as soon as they are returned by a backend, followed by a final
+// frame summarising the search. Over HTTP, the frames are sent as
+// newline delimited JSON. The RPC API cannot stream, so clients
+// start the search with StartStream and then call NextFrames until
+// the final frame has been returned. RPC streams whose frames are not
+// collected for streamIdleTimeout are discarded.
+//
+// Frames are sent in the order the backends return them, rather than
+// ranked, so with MaxMatches set, the matches streamed are the first
+// found rather than the best. No more than MaxMatches are streamed,
+// though the summary counts every match found. Unless the query has
+// NoDedup set, a file identical to one already streamed, with the
+// same lines matching, is not streamed but listed in the summary's
+// Duplicates under the file streamed. The summary's Next continues
+// the search, as for other searches.
+
+const (
+	// frames buffered for each RPC stream
+	streamBuffer = 100
+	// RPC streams are abandoned if the client does not collect
+	// frames for this long
+	streamIdleTimeout = 30 * time.Second
+	// the default maximum number of frames per NextFrames reply
+	streamMaxFrames = 100
+)
+
+// SearchStreamArgs are the arguments to the NextFrames RPC
+type SearchStreamArgs struct {
+	Id  uint64
+	Max int
+}
+
+// SearchStreamReply is the reply to the NextFrames RPC. Done is true
+// when the final frame is included in Frames.
+type SearchStreamReply struct {
+	Frames []*afind.SearchFrame
+	Done   bool
+}
+
+// searchStream is a streaming search in progress for an RPC client
+type searchStream struct {
+	frames chan *afind.SearchFrame
+	used   time.Time // when frames were last collected
+}
+
+// searchStreams holds the streaming searches in progress for RPC
+// clients, by id.
+type searchStreams struct {
+	*sync.Mutex
+	last    uint64
+	streams map[uint64]*searchStream
+	now     func() time.Time
+}
+
+func newSearchStreams() *searchStreams {
+	return &searchStreams{&sync.Mutex{}, 0, make(map[uint64]*searchStream), time.Now}
+}
+
+// add starts a new stream, first discarding those left idle by
+// their clients.
+func (ss *searchStreams) add() (uint64, chan *afind.SearchFrame) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.reap()
+	ss.last++
+	ch := make(chan *afind.SearchFrame, streamBuffer)
+	ss.streams[ss.last] = &searchStream{ch, ss.now()}
+	return ss.last, ch
+}
+
+// reap discards the streams whose frames have not been collected
+// for streamIdleTimeout. The search of each is left to finish, as
+// with no one collecting its frames, it soon times out.
+func (ss *searchStreams) reap() {
+	idle := ss.now().Add(-streamIdleTimeout)
+	for id, st := range ss.streams {
+		if st.used.Before(idle) {
+			log.Warning("search stream %d abandoned by client", id)
+			delete(ss.streams, id)
+		}
+	}
+}
+
+func (ss *searchStreams) get(id uint64) chan *afind.SearchFrame {
+	ss.Lock()
+	defer ss.Unlock()
+	st, ok := ss.streams[id]
+	if !ok {
+		return nil
+	}
+	st.used = ss.now()
+	return st.frames
+}
+
+func (ss *searchStreams) remove(id uint64) {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.streams, id)
+}
+
+// streamSearch performs the search, calling send with each frame,
+// until MaxMatches matches have been sent. The final frame holds the
+// search summary.
+func streamSearch(s *searchServer, req afind.SearchQuery,
+	send func(*afind.SearchFrame)) {
+
+	var sent uint64
+	firsts := make(map[string]afind.FileRef) // the file streamed, by DedupKey
+	dups := make(map[string]map[string][]afind.FileRef)
+	sr, err := doSearch(s, req, timeoutSearch(req, s.cfg),
+		func(in *afind.SearchResult) {
+			for _, frame := range in.Frames() {
+				if key := frame.DedupKey(); key != "" && !req.NoDedup {
+					if first, ok := firsts[key]; ok {
+						if dups[first.File] == nil {
+							dups[first.File] = make(map[string][]afind.FileRef)
+						}
+						dups[first.File][first.RepoKey] = append(dups[first.File][first.RepoKey],
+							afind.FileRef{File: frame.File, RepoKey: frame.RepoKey})
+						continue
+					}
+					firsts[key] = afind.FileRef{File: frame.File, RepoKey: frame.RepoKey}
+				}
+				if req.MaxMatches > 0 {
+					if sent >= req.MaxMatches {
+						return
+					}
+					frame = frame.Truncated(int(req.MaxMatches - sent))
+				}
+				sent += uint64(len(frame.Matches))
+				send(frame)
+			}
+		})
+	if err != nil {
+		sr.SetError(err)
+	}
+	summary := sr.Summary()
+	if len(dups) > 0 {
+		summary.Duplicates = dups
+	}
+	send(&afind.SearchFrame{Summary: summary})
+}
+
+// StartStream starts a streaming search, replying with the stream
+// id to pass to NextFrames.
+func (s *searchServer) StartStream(args afind.SearchQuery, reply *uint64) error {
+	id, ch := s.streams.add()
+	go func() {
+		defer close(ch)
+		abandoned := false
+		streamSearch(s, args, func(frame *afind.SearchFrame) {
+			if abandoned {
+				return
+			}
+			select {
+			case ch <- frame:
+			case <-time.After(streamIdleTimeout):
+				log.Warning("search stream %d abandoned by client", id)
+				abandoned = true
+				s.streams.remove(id)
+			}
+		})
+	}()
+	*reply = id
+	return nil
+}
+
+// NextFrames replies with the next frames of the stream, waiting
+// until at least one is available.
+func (s *searchServer) NextFrames(args SearchStreamArgs, reply *SearchStreamReply) error {
+	ch := s.streams.get(args.Id)
+	if ch == nil {
+		return errs.NewValueError("id", "no such search stream")
+	}
+	max := args.Max
+	if max <= 0 {
+		max = streamMaxFrames
+	}
+	reply.Frames = make([]*afind.SearchFrame, 0)
+	for len(reply.Frames) < max {
+		var frame *afind.SearchFrame
+		var ok bool
+		if len(reply.Frames) == 0 {
+			frame, ok = <-ch
+		} else {
+			select {
+			case frame, ok = <-ch:
+			default:
+				return nil
+			}
+		}
+		if !ok {
+			reply.Done = true
+			s.streams.remove(args.Id)
+			return nil
+		}
+		reply.Frames = append(reply.Frames, frame)
+		if frame.Summary != nil {
+			reply.Done = true
+			s.streams.remove(args.Id)
+			return nil
+		}
+	}
+	return nil
+}
+
+// SearchStream performs a streaming search, calling fn with each
+// frame as it arrives, and returns the summary from the final frame.
+func (s *SearcherClient) SearchStream(
+	ctx context.Context,
+	query afind.SearchQuery,
+	fn func(*afind.SearchFrame)) (sr *afind.SearchResult, err error) {
+
+	var id uint64
+	if err = s.call(ctx, s.endpoint+".StartStream", query, &id); err != nil {
+		return
+	}
+	for {
+		reply := &SearchStreamReply{}
+		args := SearchStreamArgs{Id: id}
+		if err = s.call(ctx, s.endpoint+".NextFrames", args, reply); err != nil {
+			return
+		}
+		for _, frame := range reply.Frames {
+			if frame.Summary != nil {
+				sr = frame.Summary
+			} else {
+				fn(frame)
+			}
+		}
+		if reply.Done {
+			break
+		}
+	}
+	if sr == nil {
+		err = errs.NewInternalError("search stream ended without a summary")
+	}
+	return
+}
+
+// Streaming search HTTP handler
+
+func (s *searchServer) webSearchStream(rw http.ResponseWriter,
+	req *http.Request, ps httprouter.Params) {
+
+	dec := json.NewDecoder(req.Body)
+	enc := json.NewEncoder(rw)
+	sr := afind.SearchQuery{}
+	sr.Meta = make(afind.Meta)
+
+	// Parse the query
+	if err := dec.Decode(&sr); err != nil {
+		setJson(rw)
+		rw.WriteHeader(403)
+		_ = enc.Encode(
+			errs.NewStructError(errs.InvalidRequestError(err.Error())))
+		return
+	}
+	// Allow single recursive query to perform master->backend resolution
+	sr.Recurse = true
+
+	rw.Header().Add("Content-Type", "application/x-ndjson; charset=utf-8")
+	rw.WriteHeader(200)
+	flusher, _ := rw.(http.Flusher)
+	streamSearch(s, sr, func(frame *afind.SearchFrame) {
+		_ = enc.Encode(frame)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
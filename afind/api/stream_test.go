@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/afind"
+)
+
+func setupStreamRepos(sys testSystem) {
+	for _, key := range []string{"stream1", "stream2"} {
+		repo := newRepo(key)
+		repo.Root = "/"
+		repo.NumShards = 1
+		testAddRepos(sys, map[string]*afind.Repo{key: repo})
+
+		result := afind.NewSearchResult()
+		result.AddFileRepoMatches(
+			key+".txt", key, map[string]string{"1": "streaming"})
+		result.AddFileRepoContext(
+			key+".txt", key, map[string]string{"2": "context"})
+		ktSearchQueries[key+"_streaming"] = result
+	}
+}
+
+func checkStreamFrames(t *testing.T, frames []*afind.SearchFrame, summary *afind.SearchResult) {
+	if len(frames) != 2 {
+		t.Fatal("want 2 frames, got", len(frames))
+	}
+	for _, frame := range frames {
+		if frame.File != frame.RepoKey+".txt" {
+			t.Error("unexpected file", frame.File, "for repo", frame.RepoKey)
+		}
+		if frame.Matches["1"] != "streaming" {
+			t.Errorf("unexpected matches %#v", frame.Matches)
+		}
+		if frame.Context["2"] != "context" {
+			t.Errorf("unexpected context %#v", frame.Context)
+		}
+	}
+	if summary == nil {
+		t.Fatal("want a summary, got none")
+	}
+	if summary.NumMatches != 2 {
+		t.Error("want 2 matches in summary, got", summary.NumMatches)
+	}
+	if len(summary.Matches) != 0 {
+		t.Error("want no matches in summary, got", len(summary.Matches))
+	}
+	if summary.Durations.Search == 0 {
+		t.Error("want a non-zero wallclock search time, got 0")
+	}
+}
+
+func TestSearchStreamRpc(t *testing.T) {
+	sys := newRpcServer(t, getTestConfig())
+	addr := sys.rpcServer.l.Addr().String()
+	defer sys.rpcServer.CloseNoErr()
+	setupStreamRepos(sys)
+
+	cl, err := NewRpcClient(addr)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	afindd := NewSearcherClient(cl)
+	defer afindd.Close()
+
+	frames := []*afind.SearchFrame{}
+	query := afind.NewSearchQuery("streaming", "", false, []string{})
+	summary, err := afindd.SearchStream(context.Background(), query,
+		func(frame *afind.SearchFrame) {
+			frames = append(frames, frame)
+		})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	checkStreamFrames(t, frames, summary)
+
+	// The stream is gone once complete
+	reply := &SearchStreamReply{}
+	if err = afindd.call(context.Background(), EPSearcher+".NextFrames",
+		SearchStreamArgs{Id: 1}, reply); err == nil {
+		t.Error("want an error for a completed stream")
+	}
+}
+
+func TestSearchStreamHttp(t *testing.T) {
+	c := getTestConfig()
+	sys := newTestAfind(c)
+	setupStreamRepos(sys)
+	server := NewWebServer(NewServer(sys.repos, sys.indexer, sys.searcher, sys.finder, &c))
+	server.Register()
+
+	body := strings.NewReader(`{"re": "streaming"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/search/stream", body)
+	rw := httptest.NewRecorder()
+	server.rtr.ServeHTTP(rw, req)
+	if rw.Code != 200 {
+		t.Fatal("want status 200, got", rw.Code)
+	}
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/x-ndjson") {
+		t.Error("unexpected content type", ct)
+	}
+
+	frames := []*afind.SearchFrame{}
+	var summary *afind.SearchResult
+	scanner := bufio.NewScanner(rw.Body)
+	for scanner.Scan() {
+		frame := &afind.SearchFrame{}
+		if err := json.Unmarshal(scanner.Bytes(), frame); err != nil {
+			t.Fatal("unexpected error decoding frame:", err)
+		}
+		if frame.Summary != nil {
+			summary = frame.Summary
+		} else {
+			frames = append(frames, frame)
+		}
+	}
+	checkStreamFrames(t, frames, summary)
+}
+
+func TestSearchStreamMaxMatches(t *testing.T) {
+	c := getTestConfig()
+	sys := newTestAfind(c)
+	setupStreamRepos(sys)
+	server := NewWebServer(NewServer(sys.repos, sys.indexer, sys.searcher, sys.finder, &c))
+	server.Register()
+
+	body := strings.NewReader(`{"re": "streaming", "max_matches": 1}`)
+	req, _ := http.NewRequest("POST", "/api/v1/search/stream", body)
+	rw := httptest.NewRecorder()
+	server.rtr.ServeHTTP(rw, req)
+	frames := 0
+	scanner := bufio.NewScanner(rw.Body)
+	for scanner.Scan() {
+		frame := &afind.SearchFrame{}
+		if err := json.Unmarshal(scanner.Bytes(), frame); err != nil {
+			t.Fatal("unexpected error decoding frame:", err)
+		}
+		if frame.Summary == nil {
+			frames++
+		}
+	}
+	eq(t, 1, frames)
+}
+
+func TestSearchStreamsReap(t *testing.T) {
+	ss := newSearchStreams()
+	now := time.Now()
+	ss.now = func() time.Time { return now }
+	idle, _ := ss.add()
+	used, _ := ss.add()
+
+	now = now.Add(streamIdleTimeout)
+	if ss.get(used) == nil {
+		t.Fatal("want stream", used)
+	}
+	now = now.Add(time.Second)
+	_, _ = ss.add()
+	if ss.get(idle) != nil {
+		t.Error("want idle stream discarded")
+	}
+	if ss.get(used) == nil {
+		t.Error("want recently used stream kept")
+	}
+}
+
+func init() {
+	// identical files in two repos, set up before any test's
+	// searches are left running
+	for _, key := range []string{"dedup1", "dedup2"} {
+		result := afind.NewSearchResult()
+		result.AddFileRepoMatches(
+			key+".txt", key, map[string]string{"1": "streaming"})
+		result.Sums = map[string]map[string]string{
+			key + ".txt": {key: "samesum"}}
+		ktSearchQueries[key+"_streaming"] = result
+	}
+}
+
+func TestSearchStreamDedup(t *testing.T) {
+	c := getTestConfig()
+	sys := newTestAfind(c)
+	for _, key := range []string{"dedup1", "dedup2"} {
+		repo := newRepo(key)
+		repo.Root = "/"
+		repo.NumShards = 1
+		testAddRepos(sys, map[string]*afind.Repo{key: repo})
+	}
+
+	var frames []*afind.SearchFrame
+	var summary *afind.SearchResult
+	server := &searchServer{&c, sys.repos, sys.searcher, newReplicaStats(), newSearchStreams()}
+	query := afind.NewSearchQuery("streaming", "", false, []string{})
+	streamSearch(server, query,
+		func(f *afind.SearchFrame) {
+			if f.Summary != nil {
+				summary = f.Summary
+			} else {
+				frames = append(frames, f)
+			}
+		})
+	if len(frames) != 1 {
+		t.Fatal("want 1 frame, got", len(frames))
+	}
+	if summary == nil {
+		t.Fatal("want a summary, got none")
+	}
+	first, other := frames[0].RepoKey, "dedup2"
+	if first == "dedup2" {
+		other = "dedup1"
+	}
+	eq(t, []afind.FileRef{{File: other + ".txt", RepoKey: other}},
+		summary.Duplicates[first+".txt"][first])
+
+	frames, summary = nil, nil
+	query = afind.NewSearchQuery("streaming", "", false, []string{})
+	query.NoDedup = true
+	streamSearch(server, query,
+		func(f *afind.SearchFrame) {
+			if f.Summary != nil {
+				summary = f.Summary
+			} else {
+				frames = append(frames, f)
+			}
+		})
+	eq(t, 2, len(frames))
+	eq(t, 0, len(summary.Duplicates))
+}
@@ -0,0 +1,54 @@
+package afind
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/andaru/afind/archivefs"
+	"github.com/andaru/afind/walkablefs"
+)
+
+// Indexing archives.
+//
+// The Root of an IndexQuery may name a zip, jar or tar archive
+// (optionally gzip or bzip2 compressed) rather than a directory, and
+// its members are then indexed, and searched, without unpacking the
+// archive. Dirs and Files are paths within the archive. Compressed
+// tar archives are decompressed once into the server's ArchiveCache
+// directory, where they are kept until the archive changes, or
+// reconciliation finds no Repo indexed from it. Open archives are
+// cached, so that searching a Repo's shards reads the archive's
+// members list only once.
+
+// isArchive returns true if root is an archive file, rather than a
+// directory
+func isArchive(root string) bool {
+	if !archivefs.IsArchive(root) {
+		return false
+	}
+	fi, err := os.Stat(root)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// archiveFileSystem returns the file system of the archive at root,
+// and the function to call once done with it
+func archiveFileSystem(cfg *Config, root string) (
+	walkablefs.WalkableFileSystem, func(), error) {
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a changed archive is opened afresh
+	key := root + "@" + strconv.FormatInt(fi.Size(), 10) + "@" +
+		strconv.FormatInt(fi.ModTime().UnixNano(), 10)
+	return cachedFileSystem(key,
+		func() (walkablefs.WalkableFileSystem, io.Closer, error) {
+			a, err := archivefs.Open(root, cfg.GetArchiveCache())
+			if err != nil {
+				return nil, nil, err
+			}
+			return a.FileSystem(), a, nil
+		})
+}
@@ -0,0 +1,126 @@
+package afind
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+)
+
+// writeTestArchive writes the files to a zip or tar.gz archive
+func writeTestArchive(t *testing.T, name string, files map[string]string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if strings.HasSuffix(name, ".zip") {
+		zw := zip.NewWriter(f)
+		for fname, content := range files {
+			w, err := zw.Create(fname)
+			if err == nil {
+				_, err = w.Write([]byte(content))
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+		}
+		err = zw.Close()
+	} else {
+		gz := gzip.NewWriter(f)
+		tw := tar.NewWriter(gz)
+		for fname, content := range files {
+			hdr := &tar.Header{Name: fname, Mode: 0644, Size: int64(len(content))}
+			if err = tw.WriteHeader(hdr); err == nil {
+				_, err = tw.Write([]byte(content))
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+		}
+		if err = tw.Close(); err == nil {
+			err = gz.Close()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestIndexArchive(t *testing.T) {
+	for _, suffix := range []string{".zip", ".tar.gz"} {
+		testIndexArchive(t, suffix)
+	}
+}
+
+func testIndexArchive(t *testing.T, suffix string) {
+	dir, err := ioutil.TempDir("", "afind_archive")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "src"+suffix)
+	writeTestArchive(t, root, map[string]string{
+		"src/a.go":   "package a // archived\n",
+		"src/b/b.go": "package b\n",
+		"doc/README": "readme\n",
+	})
+
+	c := &Config{
+		IndexRoot:    filepath.Join(dir, "ix"),
+		NumShards:    2,
+		ArchiveCache: filepath.Join(dir, "cache"),
+	}
+	repos := newDb()
+	ix := NewIndexer(c, repos)
+	query := NewIndexQuery("archive")
+	query.Root = root
+	query.Dirs = []string{"src"}
+	resp, err := ix.Index(context.Background(), query)
+	if err != nil || resp.Error != nil {
+		t.Fatal(suffix, "unexpected error:", err, resp.Error)
+	}
+	eq(t, OK, resp.Repo.State)
+	eq(t, 2, resp.Repo.NumFiles)
+	_ = repos.Set(resp.Repo.Key, resp.Repo)
+
+	search := func(re string) string {
+		sr, err := NewSearcher(c, repos).Search(context.Background(),
+			NewSearchQuery(re, "", false, []string{"archive"}))
+		if err != nil {
+			t.Fatal(suffix, "unexpected error:", err)
+		}
+		found := []string{}
+		for name, byRepo := range sr.Matches {
+			for _, line := range byRepo["archive"] {
+				found = append(found, name+":"+strings.TrimSpace(line))
+			}
+		}
+		sort.Strings(found)
+		return strings.Join(found, " ")
+	}
+	eq(t, "src/a.go:package a // archived src/b/b.go:package b", search("package"))
+
+	// a changed archive is read afresh
+	writeTestArchive(t, root, map[string]string{
+		"src/a.go":   "package a // replaced\n",
+		"src/b/b.go": "package b\n",
+	})
+	eq(t, "src/a.go:package a // replaced", search("package a"))
+
+	// archives that cannot be read are reported
+	_ = ioutil.WriteFile(root, []byte("not an archive"), 0644)
+	resp, _ = ix.Index(context.Background(), query)
+	if resp.Error == nil {
+		t.Error(suffix, "want error indexing a corrupt archive")
+	}
+}
@@ -2,6 +2,8 @@ package afind
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type ByteSize float64
@@ -36,3 +38,24 @@ func (b ByteSize) MarshalText() ([]byte, error) {
 func (b ByteSize) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%.f", b)), nil
 }
+
+// ParseByteSize parses a size such as "512", "64KB" or "1.5GB", as
+// produced by String
+func ParseByteSize(s string) (ByteSize, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	unit := ByteSize(1)
+	for _, u := range []struct {
+		suffix string
+		size   ByteSize
+	}{{"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB}, {"B", 1}} {
+		if strings.HasSuffix(text, u.suffix) {
+			text, unit = strings.TrimSuffix(text, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return ByteSize(n) * unit, nil
+}
@@ -42,3 +42,25 @@ func TestByteSize(t *testing.T) {
 	check(1024*1024*1024, "1.00GB")
 	check(1024*1024*1024*1024, "1.00TB")
 }
+
+func TestParseByteSize(t *testing.T) {
+	check := func(s string, exp ByteSize) {
+		bs, err := ParseByteSize(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+		} else if bs != exp {
+			t.Errorf("%q: got %v, want %v", s, bs, exp)
+		}
+	}
+	check("0", 0)
+	check("1000", 1000)
+	check("1000B", 1000)
+	check("64KB", 64*KB)
+	check("1.5gb", 1.5*GB)
+	check("2TB", 2*TB)
+	for _, s := range []string{"", "GB", "-1", "10XB"} {
+		if _, err := ParseByteSize(s); err == nil {
+			t.Errorf("%q: want error, got none", s)
+		}
+	}
+}
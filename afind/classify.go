@@ -0,0 +1,184 @@
+package afind
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// File classification.
+//
+// Before a file is added to an index shard, it is read to find
+// whether it can, and should, be indexed. The index writer silently
+// drops files which are too large, are not valid UTF-8, have very
+// long lines or too many distinct trigrams, so these are detected
+// first and recorded, along with binary files and (unless the
+// server's IndexGenerated is set) generated and minified files.
+
+// File categories not indexed
+const (
+	skipTooLarge     = "too_large"
+	skipBinary       = "binary"
+	skipLongLines    = "long_lines"
+	skipManyTrigrams = "too_many_trigrams"
+	skipGenerated    = "generated"
+	skipMinified     = "minified"
+)
+
+const (
+	// limits of the index writer
+	maxIndexFileSize = 1 << 30
+	maxLineLength    = 2000
+	maxTextTrigrams  = 20000
+
+	// files with a NUL byte this near their start are binary
+	binarySniffLength = 8000
+	// generated file markers are looked for this near the start
+	generatedSniffLength = 1024
+	// files at least this large, with lines this long on average,
+	// are minified
+	minifiedMinSize    = 4096
+	minifiedLineLength = 250
+
+	// the number of skipped files of each category kept as a sample
+	skippedSampleSize = 10
+	// files up to this size are read only once to be classified
+	// and indexed
+	classifyBufferSize = 1 << 20
+)
+
+var (
+	generatedRegexp = regexp.MustCompile(
+		`DO NOT EDIT|@generated`)
+	minifiedNameRegexp = regexp.MustCompile(`[.-]min\.(js|css)$`)
+)
+
+// classifier decides whether files are indexed
+type classifier struct {
+	maxSize   int64
+	generated bool // if true, index generated and minified files
+}
+
+func newClassifier(cfg *Config) classifier {
+	return classifier{
+		maxSize:   int64(cfg.GetIndexMaxFileSize()),
+		generated: cfg.IndexGenerated,
+	}
+}
+
+// tooLarge returns true if a file of size bytes is not indexed
+func (c classifier) tooLarge(size int64) bool {
+	return size > c.maxSize
+}
+
+// classify reads the file named name, returning the category of
+// file it belongs to if it is not to be indexed, else "".
+func (c classifier) classify(name string, r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, 0, generatedSniffLength)
+	trigrams := make(map[uint32]struct{})
+	var n, lines, lineLen int64
+	var tv uint32
+	binary, invalid, long := false, false, false
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		n++
+		if len(head) < cap(head) {
+			head = append(head, b)
+		}
+		if b == 0 && n <= binarySniffLength {
+			binary = true
+			break
+		}
+		// as for index.IndexWriter.Add
+		tv = (tv << 8) & (1<<24 - 1)
+		tv |= uint32(b)
+		if n >= 3 {
+			if trigrams[tv] = struct{}{}; len(trigrams) > maxTextTrigrams {
+				break
+			}
+		}
+		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
+			invalid = true
+			break
+		}
+		if lineLen++; lineLen > maxLineLength {
+			long = true
+			break
+		}
+		if b == '\n' {
+			lineLen = 0
+			lines++
+		}
+	}
+	if lineLen > 0 {
+		lines++
+	}
+	switch {
+	case binary || invalid:
+		return skipBinary, nil
+	case long:
+		return skipLongLines, nil
+	case len(trigrams) > maxTextTrigrams:
+		return skipManyTrigrams, nil
+	case c.generated:
+		return "", nil
+	case generatedRegexp.Match(head):
+		return skipGenerated, nil
+	case minifiedNameRegexp.MatchString(name):
+		return skipMinified, nil
+	case n >= minifiedMinSize && n/lines >= minifiedLineLength:
+		return skipMinified, nil
+	}
+	return "", nil
+}
+
+// validUTF8 reports whether the byte pair can appear in a valid
+// sequence of UTF-8-encoded code points, as index.IndexWriter does.
+func validUTF8(c1, c2 uint32) bool {
+	switch {
+	case c1 < 0x80:
+		// 1-byte, must be followed by 1-byte or first of multi-byte
+		return c2 < 0x80 || 0xc0 <= c2 && c2 < 0xf8
+	case c1 < 0xc0:
+		// continuation byte, can be followed by nearly anything
+		return c2 < 0xf8
+	case c1 < 0xf8:
+		// first of multi-byte, must be followed by continuation byte
+		return 0x80 <= c2 && c2 < 0xc0
+	}
+	return false
+}
+
+// skippedSummary counts the files skipped of each category, and
+// returns a sample of the names of each.
+func skippedSummary(shards []manifestShard) (
+	counts map[string]int, sample map[string][]string) {
+
+	names := make(map[string][]string)
+	for _, shard := range shards {
+		for name, sf := range shard.Skipped {
+			names[sf.Reason] = append(names[sf.Reason], name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	counts = make(map[string]int)
+	sample = make(map[string][]string)
+	for reason, files := range names {
+		counts[reason] = len(files)
+		sort.Strings(files)
+		if len(files) > skippedSampleSize {
+			files = files[:skippedSampleSize]
+		}
+		sample[reason] = files
+	}
+	return
+}
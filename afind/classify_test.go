@@ -0,0 +1,143 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestClassify(t *testing.T) {
+	cl := classifier{maxSize: 100}
+	check := func(name, text, want string) {
+		got, err := cl.classify(name, strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if got != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+	check("a.go", "package a\n", "")
+	check("empty", "", "")
+	check("a.bin", "ELF\x00\x01\x02", skipBinary)
+	check("latin1.txt", "caf\xe9 au lait\n", skipBinary)
+	check("utf8.txt", "café au lait\n", "")
+	check("long.txt", "short\n"+strings.Repeat("x", maxLineLength+1)+"\n", skipLongLines)
+	check("gen.go", "// Code generated by protoc-gen-go. DO NOT EDIT.\npackage a\n", skipGenerated)
+	check("gen.java", "/* @generated */\nclass A {}\n", skipGenerated)
+	check("app.min.js", "var a=1;\n", skipMinified)
+	check("app.js", strings.Repeat(strings.Repeat("a=1;", 100)+"\n", 20), skipMinified)
+	check("app.js", strings.Repeat("var a = 1;\n", 500), "")
+
+	// more distinct three character words than trigrams allowed
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	var text []byte
+	for i := 0; i <= maxTextTrigrams; i++ {
+		n := len(chars)
+		text = append(text, chars[i%n], chars[i/n%n], chars[i/n/n%n], ' ')
+		if i%100 == 0 {
+			text = append(text, '\n')
+		}
+	}
+	check("trigrams.txt", string(text), skipManyTrigrams)
+
+	cl.generated = true
+	check("gen.go", "// Code generated by protoc-gen-go. DO NOT EDIT.\npackage a\n", "")
+	check("a.bin", "ELF\x00\x01\x02", skipBinary)
+
+	eq(t, true, cl.tooLarge(101))
+	eq(t, false, cl.tooLarge(100))
+}
+
+func TestClassifyFile(t *testing.T) {
+	small := "package a\n"
+	large := strings.Repeat("var a = 1;\n", classifyBufferSize/10)
+	fs := &countingFS{walkablefs.New(mapfs.New(map[string]string{
+		"small.go": small,
+		"large.js": large,
+		"gen.go":   "// DO NOT EDIT\npackage a\n",
+	})), &sync.Mutex{}, map[string]int{}}
+	cl := classifier{maxSize: 1 << 30}
+	for _, tc := range []struct {
+		name, want, text string
+		opened           int
+	}{
+		{"small.go", "", small, 1},
+		{"large.js", "", large, 2},
+		{"gen.go", skipGenerated, "", 1},
+	} {
+		fi, _ := fs.Lstat(tc.name)
+		reason, r := classifyFile(fs, tc.name, fileStamp{Size: fi.Size()}, cl)
+		eq(t, tc.want, reason)
+		if r != nil {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Error("unexpected error:", err)
+			}
+			_ = r.Close()
+			eq(t, tc.text, string(b))
+		}
+		eq(t, tc.opened, fs.opened[tc.name])
+	}
+}
+
+func TestIndexerSkippedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_skipped")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.go":       "package a\n",
+		"b.go":       "package b\n",
+		"a.png":      "\x89PNG\x00\x00",
+		"big.txt":    strings.Repeat("big\n", 100),
+		"gen.go":     "// Code generated by stringer. DO NOT EDIT.\npackage a\n",
+		"app.min.js": "var a=1;\n",
+	}
+	c := &Config{IndexRoot: dir, NumShards: 2, IndexMaxFileSize: 256}
+	ix := NewIndexer(c, newDb())
+	query := NewIndexQuery("skip")
+	query.Dirs = []string{"."}
+	query.Root = "/"
+	resp, err := ix.Index(testSearchContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	repo := resp.Repo
+	eq(t, OK, repo.State)
+	eq(t, 2, repo.NumFiles)
+	eq(t, 4, len(repo.SkippedFiles))
+	eq(t, 1, repo.SkippedFiles[skipBinary])
+	eq(t, 1, repo.SkippedFiles[skipTooLarge])
+	eq(t, 1, repo.SkippedFiles[skipGenerated])
+	eq(t, 1, repo.SkippedFiles[skipMinified])
+	eq(t, "a.png", repo.SkippedSample[skipBinary][0])
+
+	// Skipped files do not cause shards to be rebuilt unless changed
+	m, err := readManifest(repo.IndexPath, "skip")
+	if err != nil {
+		t.Fatal("unexpected error reading manifest:", err)
+	}
+	_ = query.Normalize()
+	filter, _ := newIndexFilter(c, query.IndexRules, getMockFs(files))
+	names, stamps, _ := ix.scanner(getMockFs(files), &query, filter)
+	eq(t, 0, len(planUpdate(m, names, stamps)))
+
+	// Once small enough, the file is indexed by an update
+	files["big.txt"] = "big\n"
+	query.Update = true
+	resp, err = ix.Index(testSearchContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, resp.Repo.NumFiles)
+	eq(t, 3, len(resp.Repo.SkippedFiles))
+	eq(t, 0, resp.Repo.SkippedFiles[skipTooLarge])
+}
@@ -3,6 +3,7 @@ package afind
 import (
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -22,6 +23,44 @@ type Config struct {
 	MaxSearchReqBe    int    // Maximum number of backend requests per query
 	DeleteRepoOnError bool   // If True, delete Repo from afindd on ERROR
 
+	// Regexps and globs matching file names never indexed, in
+	// addition to each IndexQuery's rules (see excludes.go)
+	IndexExclude     []string
+	IndexExcludeGlob []string
+
+	// Files larger than this are not indexed (see classify.go).
+	// If not provided, the index writer's limit is used.
+	IndexMaxFileSize ByteSize
+	// If true, generated and minified files are indexed
+	IndexGenerated bool
+	// The directory IndexQuery FilesFrom lists must be in. If
+	// empty, FilesFrom lists are not accepted.
+	FilesFromDir string
+
+	// If non-zero, the repo database is reconciled with the index
+	// files on disk this often, as well as at startup (see
+	// reconcile.go). If ReconcileRemoveOrphans is true, index files
+	// under IndexRoot belonging to no Repo are removed.
+	ReconcileInterval      time.Duration
+	ReconcileRemoveOrphans bool
+
+	// The maximum number of scheduled re-indexing requests run at
+	// once (see refresh.go)
+	RefreshParallel int
+
+	// How often Repo in watch mode are updated when their files
+	// cannot be watched for changes (see watch.go)
+	WatchRescan time.Duration
+
+	// Where compressed tar archives indexed are decompressed to
+	// (see archive.go)
+	ArchiveCache string
+
+	// Limits on the Repo kept, applied every RetentionInterval
+	// if non-zero (see retention.go)
+	Retention         []RetentionRule
+	RetentionInterval time.Duration
+
 	// Default index, search and find timeouts, in seconds
 	// If not provided, the defaults below will be used, see
 	// defaultTimeout* constants.
@@ -91,6 +130,34 @@ func (c *Config) GetTimeoutFind() time.Duration {
 	return c.TimeoutFind
 }
 
+func (c *Config) GetIndexMaxFileSize() ByteSize {
+	if c.IndexMaxFileSize <= 0 || c.IndexMaxFileSize > maxIndexFileSize {
+		return maxIndexFileSize
+	}
+	return c.IndexMaxFileSize
+}
+
+func (c *Config) GetRefreshParallel() int {
+	if c.RefreshParallel <= 0 {
+		return defaultRefreshParallel
+	}
+	return c.RefreshParallel
+}
+
+func (c *Config) GetWatchRescan() time.Duration {
+	if c.WatchRescan <= 0 {
+		return defaultWatchRescan
+	}
+	return c.WatchRescan
+}
+
+func (c *Config) GetArchiveCache() string {
+	if c.ArchiveCache == "" {
+		return filepath.Join(os.TempDir(), "afind_archives")
+	}
+	return c.ArchiveCache
+}
+
 func (c *Config) GetTimeoutTcpKeepAlive() time.Duration {
 	if c.TimeoutTcpKeepAlive == 0 {
 		c.TimeoutTcpKeepAlive = defaultTimeoutTcpKeepAlive
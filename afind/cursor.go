@@ -0,0 +1,251 @@
+package afind
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/andaru/afind/errs"
+)
+
+// Pagination of search and find results.
+//
+// A Cursor records which matches have been returned from each shard
+// of each Repo, so that the query for the next page of results can
+// skip them. Clients treat the cursor as an opaque string, returned
+// in the Next attribute of a SearchResult or FindResult and passed
+// in the Cursor attribute of the query for the next page. Next is
+// empty once every shard has been exhausted.
+//
+// Positions are only meaningful in the index they were found in, so
+// each records the generation of its Repo's index, and a cursor from
+// an earlier generation is rejected once the Repo is re-indexed.
+
+const (
+	// the position of an exhausted shard
+	lastPostingId = math.MaxUint32
+	// the line returned when all lines of a file have been
+	allLines = math.MaxInt32
+)
+
+// ShardPosition records the matches returned from a shard. All
+// matches in files with a posting ID less than Id have been
+// returned, as have the matches in file Id on or before Line, and the
+// matches in later files on or before the line given by Seen.
+type ShardPosition struct {
+	Id   uint32         `json:"id"`
+	Line int            `json:"line,omitempty"`
+	Seen map[uint32]int `json:"seen,omitempty"`
+	Gen  int64          `json:"gen,omitempty"` // the Repo's index generation
+}
+
+// Done returns true if the shard is exhausted
+func (p ShardPosition) Done() bool {
+	return p.Id == lastPostingId
+}
+
+// returned returns the last line of the file id which has been
+// returned; 0 if none, or allLines if the whole file has been.
+func (p ShardPosition) returned(id uint32) int {
+	if id < p.Id {
+		return allLines
+	} else if id == p.Id {
+		return p.Line
+	}
+	return p.Seen[id]
+}
+
+// unreturn returns the position with only the matches on or before
+// line in file id returned. found gives the last matching line of
+// each file found in the shard since prev, the position before.
+func (p ShardPosition) unreturn(id uint32, line int,
+	found map[uint32]int, prev ShardPosition) ShardPosition {
+
+	seen := make(map[uint32]int)
+	for fid, l := range p.Seen {
+		seen[fid] = l
+	}
+	if id < p.Id {
+		// Files from id up to p.Id are no longer covered by Id,
+		// so those with matches are now recorded in seen
+		if p.Line > 0 && !p.Done() {
+			seen[p.Id] = p.Line
+		}
+		for fid, l := range prev.Seen {
+			if fid > id && fid < p.Id {
+				seen[fid] = l
+			}
+		}
+		for fid, l := range found {
+			if fid > id && fid < p.Id {
+				seen[fid] = l
+			}
+		}
+		p.Id, p.Line = id, line
+	} else if id == p.Id {
+		p.Line = line
+	} else if line > 0 {
+		seen[id] = line
+	} else {
+		delete(seen, id)
+	}
+	delete(seen, p.Id)
+	p.Seen = nil
+	if len(seen) > 0 {
+		p.Seen = seen
+	}
+	return p
+}
+
+// Cursor holds the position reached in each shard of each Repo, by
+// Repo key and shard number.
+type Cursor map[string]map[int]ShardPosition
+
+// DecodeCursor decodes the cursor from its string form. An empty
+// string decodes to an empty cursor.
+func DecodeCursor(s string) (Cursor, error) {
+	c := Cursor{}
+	if s == "" {
+		return c, nil
+	}
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return nil, errs.NewValueError("cursor", "invalid cursor")
+	}
+	return c, nil
+}
+
+// Encode returns the string form of the cursor, or an empty string
+// if all of the shards in the cursor are exhausted.
+func (c Cursor) Encode() string {
+	done := true
+	for _, shards := range c {
+		for _, p := range shards {
+			done = done && p.Done()
+		}
+	}
+	if done {
+		return ""
+	}
+	b, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// Position returns the position in the shard of the Repo key. The
+// zero position, at the start of the shard, is returned if the
+// cursor has no position for the shard.
+func (c Cursor) Position(key string, shard int) ShardPosition {
+	return c[key][shard]
+}
+
+// generation returns the generation of the Repo's index, which
+// changes each time it is indexed
+func (r *Repo) generation() int64 {
+	return r.TimeUpdated.UnixNano()
+}
+
+// checkGeneration returns an error if the cursor has positions in an
+// earlier generation of the Repo's index.
+func (c Cursor) checkGeneration(repo *Repo) error {
+	gen := repo.generation()
+	for _, p := range c[repo.Key] {
+		if p.Gen != gen {
+			return errs.NewValueError("cursor",
+				"repo "+repo.Key+" has been re-indexed since the cursor was returned")
+		}
+	}
+	return nil
+}
+
+// setGeneration records the generation of the Repo key's index in
+// each of its positions
+func (c Cursor) setGeneration(key string, gen int64) {
+	for shard, p := range c[key] {
+		p.Gen = gen
+		c[key][shard] = p
+	}
+}
+
+// Set sets the position in the shard of the Repo key
+func (c Cursor) Set(key string, shard int, p ShardPosition) {
+	if _, ok := c[key]; !ok {
+		c[key] = make(map[int]ShardPosition)
+	}
+	c[key][shard] = p
+}
+
+// Update sets the positions in the cursor from other
+func (c Cursor) Update(other Cursor) {
+	for key, shards := range other {
+		for shard, p := range shards {
+			c.Set(key, shard, p)
+		}
+	}
+}
+
+// FileSource locates a file in the shards of a Repo
+type FileSource struct {
+	Shard int    `json:"shard"`
+	Id    uint32 `json:"id"`
+}
+
+// foundLines returns the last matching line of each file found, by
+// Repo key, shard and posting ID.
+func (r *SearchResult) foundLines() map[string]map[int]map[uint32]int {
+	found := make(map[string]map[int]map[uint32]int)
+	add := func(key string, source FileSource, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		if _, ok := found[key]; !ok {
+			found[key] = make(map[int]map[uint32]int)
+		}
+		if _, ok := found[key][source.Shard]; !ok {
+			found[key][source.Shard] = make(map[uint32]int)
+		}
+		found[key][source.Shard][source.Id], _ = strconv.Atoi(lines[len(lines)-1])
+	}
+	for name, rsources := range r.Sources {
+		for key, source := range rsources {
+			add(key, source, sortedLines(r.Matches[name][key]))
+		}
+	}
+	// duplicates had the lines of the file reported
+	for name, rdups := range r.Duplicates {
+		for key, dups := range rdups {
+			lines := sortedLines(r.Matches[name][key])
+			for _, d := range dups {
+				if source, ok := r.Sources[d.File][d.RepoKey]; ok {
+					add(d.RepoKey, source, lines)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// unreturnFileRepo moves back the Progress of the shard holding the
+// file in the Repo, so that only its matches on or before line last
+// are returned. If last is 0, none of the matches found are.
+func (r *SearchResult) unreturnFileRepo(name, key string, last int,
+	found map[string]map[int]map[uint32]int, prev Cursor) {
+
+	source, ok := r.Sources[name][key]
+	if !ok {
+		return
+	}
+	pos, ok := r.Progress[key][source.Shard]
+	if !ok {
+		return
+	}
+	before := prev.Position(key, source.Shard)
+	if last == 0 {
+		last = before.returned(source.Id)
+	}
+	r.Progress.Set(key, source.Shard,
+		pos.unreturn(source.Id, last, found[key][source.Shard], before))
+}
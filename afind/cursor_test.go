@@ -0,0 +1,176 @@
+package afind
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorEncoding(t *testing.T) {
+	c, err := DecodeCursor("")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	eq(t, 0, len(c))
+	eq(t, "", c.Encode())
+
+	c.Set("key1", 0, ShardPosition{Id: 12, Line: 3, Seen: map[uint32]int{14: 2}})
+	c.Set("key1", 1, ShardPosition{Id: lastPostingId})
+	s := c.Encode()
+	if s == "" {
+		t.Fatal("want a cursor, got none")
+	}
+	d, err := DecodeCursor(s)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	p := d.Position("key1", 0)
+	eq(t, uint32(12), p.Id)
+	eq(t, 3, p.Line)
+	eq(t, 2, p.Seen[14])
+	eq(t, true, d.Position("key1", 1).Done())
+	eq(t, false, d.Position("key2", 0).Done())
+
+	// exhausted cursors encode to nothing
+	c.Set("key1", 0, ShardPosition{Id: lastPostingId})
+	eq(t, "", c.Encode())
+
+	if _, err = DecodeCursor("not a cursor"); err == nil {
+		t.Error("want an error decoding an invalid cursor")
+	}
+}
+
+func TestShardPositionUnreturn(t *testing.T) {
+	prev := ShardPosition{Id: 2, Line: 5, Seen: map[uint32]int{9: 4}}
+	found := map[uint32]int{2: 10, 3: 7, 5: 1, 9: 8}
+	done := ShardPosition{Id: lastPostingId}
+
+	// file 5 was not returned
+	p := done.unreturn(5, 0, found, prev)
+	eq(t, uint32(5), p.Id)
+	eq(t, 0, p.Line)
+	eq(t, allLines, p.returned(3))
+	eq(t, 8, p.returned(9))
+	eq(t, 0, p.returned(5))
+
+	// and only the lines up to 6 of file 2
+	p = p.unreturn(2, 6, found, prev)
+	eq(t, uint32(2), p.Id)
+	eq(t, 6, p.returned(2))
+	eq(t, 7, p.returned(3))
+	eq(t, 0, p.returned(5))
+	eq(t, 8, p.returned(9))
+	eq(t, allLines, p.returned(1))
+
+	// files after Id are recorded in Seen
+	p = p.unreturn(9, 4, found, prev)
+	eq(t, 4, p.returned(9))
+	p = p.unreturn(3, 0, found, prev)
+	eq(t, uint32(2), p.Id)
+	eq(t, 0, p.returned(3))
+}
+
+func TestSearchPages(t *testing.T) {
+	files := map[string]string{
+		"a.txt":          "foo\nbar\nfoo\nfoo\n",
+		"b/c/d.txt":      "foo\n",
+		"b/test/foo.txt": "foo foo\nfoo\n",
+		"func.go":        "func foo() {\n}\n",
+		"z.txt":          "bar\nfoo\nbar\n",
+	}
+	test := searchSetupIndex(files, t)
+	test.sr = NewSearcher(test.config, test.db)
+
+	all := map[string]bool{}
+	query := NewSearchQuery("foo", "", false, []string{kixKey1})
+	query.MaxMatches = 3
+	for page := 0; page < 10; page++ {
+		prev, _ := DecodeCursor(query.Cursor)
+		sr, err := test.sr.Search(test.ctx, query)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		// merge and paginate the results as the API server does
+		progress := Cursor{}
+		progress.Update(prev)
+		progress.Update(sr.Progress)
+		sr.Progress = progress
+		sr.Rank()
+		sr.Truncate(query.MaxMatches, prev)
+		sr.Next = sr.Progress.Encode()
+
+		if sr.NumMatches > query.MaxMatches {
+			t.Error("want at most 3 matches, got", sr.NumMatches)
+		}
+		for name, rmatches := range sr.Matches {
+			for line := range rmatches[kixKey1] {
+				if all[name+":"+line] {
+					t.Error("match returned twice:", name+":"+line)
+				}
+				all[name+":"+line] = true
+			}
+		}
+		if sr.Next == "" {
+			break
+		}
+		if sr.NumMatches == 0 {
+			t.Fatal("empty page before the last")
+		}
+		query.Cursor = sr.Next
+	}
+	eq(t, 8, len(all))
+	eq(t, true, all["func.go:1"])
+	eq(t, true, all["a.txt:4"])
+}
+
+func TestCursorGeneration(t *testing.T) {
+	files := map[string]string{"a.txt": "foo\n", "b.txt": "foo\n"}
+	test := searchSetupIndex(files, t)
+	test.sr = NewSearcher(test.config, test.db)
+
+	query := NewSearchQuery("foo", "", false, []string{kixKey1})
+	sr, err := test.sr.Search(test.ctx, query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, "", sr.Error)
+	repo := test.db.Get(kixKey1).(*Repo)
+	eq(t, repo.generation(), sr.Progress.Position(kixKey1, 0).Gen)
+	// an unfinished cursor, from before the Repo is re-indexed
+	sr.Progress.Set(kixKey1, 0, ShardPosition{Id: 1, Gen: repo.generation()})
+	query.Cursor = sr.Progress.Encode()
+	sr, _ = test.sr.Search(test.ctx, query)
+	eq(t, "", sr.Error)
+
+	reindexed := *repo
+	reindexed.TimeUpdated = repo.TimeUpdated.Add(time.Second)
+	_ = test.db.Set(kixKey1, &reindexed)
+	sr, _ = test.sr.Search(test.ctx, query)
+	if !strings.Contains(sr.Error, "re-indexed") {
+		t.Error("want a cursor error, got", sr.Error)
+	}
+	fr, _ := NewFinder(test.config, test.db).Find(test.ctx,
+		FindQuery{PathRe: ".", RepoKeys: []string{kixKey1}, Cursor: query.Cursor})
+	if fr.Error == nil {
+		t.Error("want a cursor error finding files")
+	}
+}
+
+func TestFindResultTruncate(t *testing.T) {
+	fr := NewFindResult()
+	for n, name := range []string{"a", "b", "c"} {
+		other := NewFindResult()
+		other.Matches[name] = map[string]int{"key1": 1}
+		other.Sources[name] = map[string]FileSource{"key1": {0, uint32(n + 4)}}
+		other.NumMatches = 1
+		fr.Update(other)
+	}
+	fr.Progress.Set("key1", 0, ShardPosition{Id: lastPostingId})
+
+	fr.Truncate(2)
+	eq(t, uint64(2), fr.NumMatches)
+	eq(t, 2, len(fr.Matches))
+	_, ok := fr.Matches["c"]
+	eq(t, false, ok)
+	eq(t, uint32(6), fr.Progress.Position("key1", 0).Id)
+}
@@ -2,8 +2,12 @@ package afind
 
 import (
 	"encoding/json"
-	"io"
+	"fmt"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -15,6 +19,7 @@ type KeyValueStorer interface {
 	Delete(key string) error
 	Size() int
 	ForEach(f IterFunc)
+	ForEachPrefix(prefix string, f IterFunc)
 }
 
 // An optionally file backed key/value store implementing
@@ -24,27 +29,102 @@ type db struct {
 
 	R map[string]*Repo `json:"repo"` // map of repo key to repo
 
-	bfn string             // backing filename
-	bs  io.ReadWriteCloser // backing store
+	bfn string // backing filename
+}
+
+// The backing file.
+//
+// The database is written to a temporary file which is synced to
+// disk and then renamed over the backing file, so that the backing
+// file always holds a complete database. Each change costs a sync,
+// so servers with many Repo may prefer the log backend (logdb.go).
+// The file as it was at each of the last dbBackups startups is kept
+// as the backing filename suffixed with .1 (the newest), .2 and so
+// on.
+//
+// Files written before the format was versioned have no version,
+// and are migrated when read. A backing file which cannot be read
+// is never replaced; the server refuses to start instead.
+
+// dbFile is the on-disk form of the database
+type dbFile struct {
+	Version int              `json:"version"`
+	R       map[string]*Repo `json:"repo"`
 }
 
 const (
 	writeOptions = os.O_CREATE | os.O_TRUNC | os.O_RDWR
 	writeMode    = 0644
 	writeDirMode = 0755
+
+	// the current version of the database file format
+	dbVersion = 1
+	// the number of previous versions of the database kept
+	dbBackups = 3
 )
 
+// dbMigrations upgrade a database file from the version given by
+// the index in the slice to the next version, if anything but the
+// version itself must change.
+var dbMigrations = []func(*dbFile) error{
+	nil, // 0: unversioned files, in the same format as version 1
+}
+
+func dbBackupName(name string, n int) string {
+	return name + "." + strconv.Itoa(n)
+}
+
 // caller must hold the mutex when calling
 func (d *db) flush() error {
 	if d.bfn == "" {
 		return nil
 	}
-	file, err := os.OpenFile(d.bfn, writeOptions, writeMode)
+	tmp := d.bfn + ".new"
+	file, err := os.OpenFile(tmp, writeOptions, writeMode)
 	if err != nil {
 		return err
 	}
-	enc := json.NewEncoder(file)
-	return enc.Encode(d)
+	err = json.NewEncoder(file).Encode(dbFile{Version: dbVersion, R: d.R})
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, d.bfn); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	syncDir(path.Dir(d.bfn))
+	return nil
+}
+
+// rotateDbBackups shifts the backups of the database file name,
+// and links the current file as the newest backup.
+func rotateDbBackups(name string) {
+	if _, err := os.Stat(name); err != nil {
+		return
+	}
+	for n := dbBackups; n > 1; n-- {
+		_ = os.Rename(dbBackupName(name, n-1), dbBackupName(name, n))
+	}
+	_ = os.Remove(dbBackupName(name, 1))
+	if err := os.Link(name, dbBackupName(name, 1)); err != nil {
+		log.Debug("cannot back up database %v: %v", name, err)
+	}
+}
+
+// syncDir syncs the directory dir, so that a file renamed into it
+// persists after a crash
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		_ = f.Sync()
+		_ = f.Close()
+	}
 }
 
 // caller must hold the mutex, and read is only called once at the
@@ -54,22 +134,43 @@ func (d *db) read() error {
 		return nil // todo: really it's an error...
 	}
 	file, err := os.Open(d.bfn)
-	if err == nil {
-		d.bs = file
-	} else {
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	df := dbFile{}
+	if err = json.NewDecoder(file).Decode(&df); err != nil {
 		return err
 	}
-	dec := json.NewDecoder(d.bs)
-	return dec.Decode(d)
+	if err = migrateDb(&df); err != nil {
+		return err
+	}
+	if df.R != nil {
+		d.R = df.R
+	}
+	return nil
+}
+
+// migrateDb upgrades the database file to the current version
+func migrateDb(df *dbFile) error {
+	if df.Version > dbVersion {
+		return fmt.Errorf("database version %d is newer than supported (%d)",
+			df.Version, dbVersion)
+	}
+	for ; df.Version < dbVersion; df.Version++ {
+		if migrate := dbMigrations[df.Version]; migrate != nil {
+			if err := migrate(df); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (d *db) close() error {
-	if err := d.flush(); err != nil {
-		return err
-	} else {
-		_ = d.bs.Close()
-		return nil
-	}
+	return d.flush()
 }
 
 func (d *db) Size() int {
@@ -98,25 +199,17 @@ func (d *db) Set(key string, value interface{}) error {
 	}
 	d.Lock()
 	defer d.Unlock()
-	flush := func() {
-		_ = d.flush()
-	}
-	defer flush()
 
 	d.R[key] = value.(*Repo)
-	return nil
+	return d.flush()
 }
 
 func (d *db) Delete(key string) error {
 	d.Lock()
 	defer d.Unlock()
-	flush := func() {
-		_ = d.flush()
-	}
-	defer flush()
 
 	delete(d.R, key)
-	return nil
+	return d.flush()
 }
 
 // An iteration function wrapper. Retrun false to
@@ -124,7 +217,34 @@ func (d *db) Delete(key string) error {
 type IterFunc func(key string, value interface{}) bool
 
 func (d *db) ForEach(f IterFunc) {
-	for key, _ := range d.R {
+	d.RLock()
+	keys := make([]string, 0, len(d.R))
+	for key := range d.R {
+		keys = append(keys, key)
+	}
+	d.RUnlock()
+	for _, key := range keys {
+		if v := d.Get(key); v != nil {
+			if !f(key, v) {
+				return
+			}
+		}
+	}
+}
+
+// ForEachPrefix calls f for each Repo whose key starts with
+// prefix, in key order
+func (d *db) ForEachPrefix(prefix string, f IterFunc) {
+	d.RLock()
+	keys := []string{}
+	for key := range d.R {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	d.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
 		if v := d.Get(key); v != nil {
 			if !f(key, v) {
 				return
@@ -134,7 +254,7 @@ func (d *db) ForEach(f IterFunc) {
 }
 
 func newDb() *db {
-	return &db{&sync.RWMutex{}, make(map[string]*Repo), "", nil}
+	return &db{&sync.RWMutex{}, make(map[string]*Repo), ""}
 }
 
 func NewDb() *db {
@@ -142,6 +262,8 @@ func NewDb() *db {
 }
 
 func (d *db) getSizes() (index, data ByteSize) {
+	d.RLock()
+	defer d.RUnlock()
 	for _, v := range d.R {
 		index += ByteSize(v.SizeIndex)
 		data += ByteSize(v.SizeData)
@@ -149,20 +271,26 @@ func (d *db) getSizes() (index, data ByteSize) {
 	return
 }
 
-func NewJsonBackedDb(filename string) *db {
+// NewJsonBackedDb returns a database backed by the JSON file
+// filename, loading any Repo stored in it. An error is returned if
+// the file exists but cannot be read.
+func NewJsonBackedDb(filename string) (*db, error) {
 	return newJsonBackedDb(filename)
 }
 
-func newJsonBackedDb(filename string) *db {
-	var err error
-	newDb := &db{&sync.RWMutex{}, make(map[string]*Repo),
-		filename, nil}
-	if err = newDb.read(); err == nil {
+func newJsonBackedDb(filename string) (*db, error) {
+	newDb := &db{&sync.RWMutex{}, make(map[string]*Repo), filename}
+	if err := newDb.read(); os.IsNotExist(err) {
+		log.Warning("Creating new JSON backing store: %s", filename)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read database %s: %v "+
+			"(restore it from a backup %s, or remove it to start afresh)",
+			filename, err, dbBackupName(filename, 1))
+	} else {
 		sizeIndex, sizeData := newDb.getSizes()
 		log.Info("Loaded database (%d repos; %s data/%s index)",
 			len(newDb.R), sizeData, sizeIndex)
-	} else {
-		log.Warning("Creating new JSON backing store: %s", filename)
+		rotateDbBackups(filename)
 	}
-	return newDb
+	return newDb, nil
 }
@@ -1,12 +1,19 @@
 package afind
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path"
+	"strconv"
 	"testing"
 )
 
 func TestDbGetSetDelete(t *testing.T) {
-	db := newDb()
+	forEachDb(t, testDbGetSetDelete)
+}
+
+func testDbGetSetDelete(t *testing.T, db KeyValueStorer) {
 	key := "TestDbGetSetDelete"
 	if db.Get(key) != nil {
 		t.Error("should get nil for not present keys")
@@ -34,7 +41,10 @@ func TestDbGetSetDelete(t *testing.T) {
 }
 
 func TestForEach(t *testing.T) {
-	d := newDb()
+	forEachDb(t, testForEach)
+}
+
+func testForEach(t *testing.T, d KeyValueStorer) {
 	repos := map[string]*Repo{
 		`1_001`: &Repo{Key: `1_001`},
 		`1_002`: &Repo{Key: `1_002`},
@@ -69,8 +79,36 @@ func TestForEach(t *testing.T) {
 	}
 }
 
-func TestDbSize(t *testing.T) {
+func TestForEachConcurrentSet(t *testing.T) {
 	d := newDb()
+	for n := 0; n < 100; n++ {
+		key := strconv.Itoa(n)
+		_ = d.Set(key, &Repo{Key: key})
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 100; n < 1100; n++ {
+			key := strconv.Itoa(n)
+			_ = d.Set(key, &Repo{Key: key})
+			_ = d.Delete(key)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		d.ForEach(func(key string, value interface{}) bool { return true })
+	}
+}
+
+func TestDbSize(t *testing.T) {
+	forEachDb(t, testDbSize)
+}
+
+func testDbSize(t *testing.T, d KeyValueStorer) {
 	repos := map[string]*Repo{
 		`1_001`: &Repo{Key: `1_001`},
 		`1_002`: &Repo{Key: `1_002`},
@@ -88,8 +126,14 @@ func TestDbSize(t *testing.T) {
 func TestBackedDb(t *testing.T) {
 	fn := "./backed.json"
 	_ = os.Remove(fn)
-	d := newJsonBackedDb(fn)
+	d, err := newJsonBackedDb(fn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
 	defer os.Remove(fn)
+	for n := 1; n <= dbBackups; n++ {
+		defer os.Remove(dbBackupName(fn, n))
+	}
 
 	d.Set("1", &Repo{Key: "1"})
 	fi, err := os.Stat(fn)
@@ -102,7 +146,10 @@ func TestBackedDb(t *testing.T) {
 
 	// Now cause the database to be re-read from disk and confirm
 	// the value still exists within.
-	d2 := newJsonBackedDb(fn)
+	d2, err := newJsonBackedDb(fn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
 	v := d2.Get("1")
 	if value, ok := v.(*Repo); !ok {
 		t.Logf("%#v", v)
@@ -119,7 +166,10 @@ func TestBackedDb(t *testing.T) {
 
 func TestDbConstructors(t *testing.T) {
 	memdb := NewDb()
-	filedb := NewJsonBackedDb("./test_db_constructor.json")
+	filedb, err := NewJsonBackedDb("./test_db_constructor.json")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
 	if memdb.Size() != 0 || filedb.Size() != 0 {
 		t.Error("expected empty Size() from file and mem db")
 	}
@@ -142,3 +192,71 @@ func TestDbBadCases(t *testing.T) {
 		t.Error("want error from d.flush(), got nil")
 	}
 }
+
+func TestDbPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_db")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "repos.json")
+
+	// The database is reopened after each change
+	for _, key := range []string{"1", "2", "3", "4"} {
+		d, err := newJsonBackedDb(fn)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if err = d.Set(key, &Repo{Key: key}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	// The file is versioned, no temporary file remains, and the
+	// versions found at startup are kept as backups
+	df := dbFile{}
+	b, _ := ioutil.ReadFile(fn)
+	if err = json.Unmarshal(b, &df); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, dbVersion, df.Version)
+	eq(t, 4, len(df.R))
+	if _, err = os.Stat(fn + ".new"); err == nil {
+		t.Error("want no temporary file")
+	}
+	for n := 1; n <= dbBackups; n++ {
+		b, err = ioutil.ReadFile(dbBackupName(fn, n))
+		if err != nil {
+			t.Fatal("want backup", n, "got", err)
+		}
+		df = dbFile{}
+		_ = json.Unmarshal(b, &df)
+		eq(t, 4-n, len(df.R))
+	}
+	if _, err = os.Stat(dbBackupName(fn, dbBackups+1)); err == nil {
+		t.Error("want at most", dbBackups, "backups")
+	}
+
+	// Unversioned files are migrated
+	legacy := `{"repo": {"old": {"key": "old", "state": "OK"}}}`
+	if err = ioutil.WriteFile(fn, []byte(legacy), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	d, err := newJsonBackedDb(fn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 1, d.Size())
+	eq(t, OK, d.Get("old").(*Repo).State)
+
+	// Unreadable and newer databases are refused, and left alone
+	for _, text := range []string{`{"repo": {"trunc`, `{"version": 99, "repo": {}}`} {
+		if err = ioutil.WriteFile(fn, []byte(text), 0644); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err = newJsonBackedDb(fn); err == nil {
+			t.Errorf("database %q: want error, got none", text)
+		}
+		b, _ = ioutil.ReadFile(fn)
+		eq(t, text, string(b))
+	}
+}
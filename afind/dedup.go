@@ -0,0 +1,338 @@
+package afind
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+// Deduplication of identical files.
+//
+// Forks and branches of the same sources hold many files with
+// identical contents. The indexer records the sum of each file's
+// content in the Repo's manifest: its git blob id, so that files
+// indexed from git and from disk have the same sums. A search greps
+// each content once, sharing the lines found between the Repo and
+// paths holding it, and reports them once: the file first by Repo key
+// and name holds the lines in Matches, and lists the others in
+// Duplicates. Files changed on disk since they were indexed are
+// grepped and reported separately. Queries with NoDedup set report
+// every file separately. Streaming searches report files as they are
+// found, with their Sum, so clients may group them instead.
+
+const (
+	// the number of Repo manifests kept for searches
+	manifestCacheSize = 64
+)
+
+// contentSum computes the sum of a file's content as it is written
+type contentSum struct {
+	h    hash.Hash
+	size int64 // expected
+	n    int64 // written
+	sum  string
+}
+
+// newContentSum returns the sum of the content of the file with the
+// stamp. The blob id of files read from git is already known.
+func newContentSum(stamp fileStamp) *contentSum {
+	if stamp.Hash != "" {
+		return &contentSum{sum: stamp.Hash}
+	}
+	h := sha1.New()
+	_, _ = h.Write([]byte("blob " + strconv.FormatInt(stamp.Size, 10) + "\x00"))
+	return &contentSum{h: h, size: stamp.Size}
+}
+
+func (c *contentSum) Write(b []byte) (int, error) {
+	if c.h != nil {
+		_, _ = c.h.Write(b)
+		c.n += int64(len(b))
+	}
+	return len(b), nil
+}
+
+// String returns the sum, or "" if the file was not the size its
+// stamp said, having changed while read
+func (c *contentSum) String() string {
+	if c.h == nil {
+		return c.sum
+	} else if c.n != c.size {
+		return ""
+	}
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// FileRef names a file of a Repo
+type FileRef struct {
+	File    string `json:"file"`
+	RepoKey string `json:"repo_key"`
+}
+
+type byFileRef []FileRef
+
+func (r byFileRef) Len() int      { return len(r) }
+func (r byFileRef) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byFileRef) Less(i, j int) bool {
+	if r[i].RepoKey != r[j].RepoKey {
+		return r[i].RepoKey < r[j].RepoKey
+	}
+	return r[i].File < r[j].File
+}
+
+// blobGrep is the result of grepping one content
+type blobGrep struct {
+	done    chan struct{}
+	ok      bool
+	n       int
+	matches fileMap
+	context fileMap
+	found   []bool
+}
+
+// blobGreps holds the content grepped by a search, by sum
+type blobGreps struct {
+	mu    *sync.Mutex
+	greps map[string]*blobGrep
+}
+
+// WithSearchDedup returns a context in which the searches of files
+// with identical contents share their results. It is used for each
+// search query, unless the query has NoDedup set.
+func WithSearchDedup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, "SearchDedup",
+		&blobGreps{mu: &sync.Mutex{}, greps: make(map[string]*blobGrep)})
+}
+
+func searchDedup(ctx context.Context) *blobGreps {
+	if bg, ok := ctx.Value("SearchDedup").(*blobGreps); ok {
+		return bg
+	}
+	return nil
+}
+
+// claim returns the grep of the content, and true if the caller is
+// the first to claim it and so must grep it and publish the result
+func (bg *blobGreps) claim(sum string) (*blobGrep, bool) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if g, ok := bg.greps[sum]; ok {
+		return g, false
+	}
+	g := &blobGrep{done: make(chan struct{})}
+	bg.greps[sum] = g
+	return g, true
+}
+
+func copyLines(lines fileMap) fileMap {
+	c := make(fileMap, len(lines))
+	for k, v := range lines {
+		c[k] = v
+	}
+	return c
+}
+
+func (g *blobGrep) publish(ok bool, n int, matches, context fileMap, found []bool) {
+	if ok {
+		g.ok, g.n = true, n
+		g.matches, g.context = copyLines(matches), copyLines(context)
+		g.found = append([]bool(nil), found...)
+	}
+	close(g.done)
+}
+
+// contentSum returns the sum of the file's content, or "" if unknown
+// or the file has changed since it was indexed
+func (s *grep) contentSum(name string) string {
+	stamp, ok := s.stamp(name)
+	if !ok || stamp.Sum == "" {
+		return ""
+	}
+	fi, err := s.fs.Lstat(name)
+	if err != nil || stamp.changed(newFileStamp(fi)) {
+		return ""
+	}
+	return stamp.Sum
+}
+
+// grepFile greps the file, returning the number of matching lines,
+// the matching lines, the lines of context and the sum of the file's
+// content. Files whose content has already been grepped by the
+// search are not read again.
+func (s *grep) grepFile(ctx context.Context, name string) (
+	int, fileMap, fileMap, string, error) {
+
+	sum := ""
+	if s.greps != nil {
+		sum = s.contentSum(name)
+	}
+	if sum == "" {
+		n, matches, context, err := s.readfile(name)
+		return n, matches, context, "", err
+	}
+	g, first := s.greps.claim(sum)
+	if first {
+		n, matches, context, err := s.readfile(name)
+		g.publish(err == nil, n, matches, context, s.found)
+		return n, matches, context, sum, err
+	}
+	select {
+	case <-g.done:
+	case <-ctx.Done():
+		return 0, nil, nil, "", nil
+	}
+	if !g.ok {
+		// the first reader failed; this copy may yet be readable
+		n, matches, context, err := s.readfile(name)
+		return n, matches, context, sum, err
+	}
+	if s.found != nil {
+		copy(s.found, g.found)
+	}
+	return g.n, copyLines(g.matches), copyLines(g.context), sum, nil
+}
+
+// cachedManifest is a manifest read, with the time its file was
+// modified when read
+type cachedManifest struct {
+	mtime time.Time
+	m     *manifest
+}
+
+// manifestCache holds the manifests of the Repo recently searched,
+// whose file stamps tell searches the sums of the files' contents,
+// or, read from the Repo's symbols files, their symbols
+type manifestCache struct {
+	mu        *sync.Mutex
+	manifests map[string]cachedManifest
+	name      func(ixpath, key string) string
+	read      func(ixpath, key string) (*manifest, error)
+}
+
+var (
+	searchManifests = &manifestCache{
+		mu:        &sync.Mutex{},
+		manifests: make(map[string]cachedManifest),
+		name:      manifestName,
+		read:      readManifest,
+	}
+	searchSymbols = &manifestCache{
+		mu:        &sync.Mutex{},
+		manifests: make(map[string]cachedManifest),
+		name:      symbolsName,
+		read:      readSymbols,
+	}
+)
+
+// get returns the manifest of the Repo, reading it again if it has
+// been replaced, or nil if it cannot be read
+func (c *manifestCache) get(repo *Repo) *manifest {
+	name := c.name(repo.IndexPath, repo.Key)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	cm, ok := c.manifests[name]
+	c.mu.Unlock()
+	if ok && cm.mtime.Equal(fi.ModTime()) {
+		return cm.m
+	}
+	m, err := c.read(repo.IndexPath, repo.Key)
+	if err != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.manifests) >= manifestCacheSize {
+		for old := range c.manifests {
+			delete(c.manifests, old)
+			break
+		}
+	}
+	c.manifests[name] = cachedManifest{fi.ModTime(), m}
+	return m
+}
+
+// shardStamps returns the stamps of the files in the Repo's shard
+func shardStamps(repo *Repo, shard int) map[string]fileStamp {
+	m := searchManifests.get(repo)
+	if m == nil || shard >= len(m.Shards) {
+		return nil
+	}
+	return m.Shards[shard].Files
+}
+
+func (r *SearchResult) addFileRepoSum(fname, repokey, sum string) {
+	if r.Sums == nil {
+		r.Sums = make(map[string]map[string]string)
+	}
+	if _, ok := r.Sums[fname]; !ok {
+		r.Sums[fname] = make(map[string]string)
+	}
+	r.Sums[fname][repokey] = sum
+}
+
+func (r *SearchResult) addFileRepoDuplicates(fname, repokey string, dups []FileRef) {
+	if len(dups) == 0 {
+		return
+	}
+	if r.Duplicates == nil {
+		r.Duplicates = make(map[string]map[string][]FileRef)
+	}
+	if _, ok := r.Duplicates[fname]; !ok {
+		r.Duplicates[fname] = make(map[string][]FileRef)
+	}
+	r.Duplicates[fname][repokey] = append(r.Duplicates[fname][repokey], dups...)
+}
+
+// Dedup reports the files in Matches with identical contents and
+// lines found once: the file first by Repo key and name keeps its
+// lines, and the others are moved to its Duplicates.
+// DedupKey returns the key shared by frames of files with identical
+// content and the same lines matching, as grouped by Dedup, or "" if
+// the content of the frame's file is not known
+func (f *SearchFrame) DedupKey() string {
+	if f.Sum == "" {
+		return ""
+	}
+	return f.Sum + " " + strings.Join(sortedLines(f.Matches), ",")
+}
+
+func (r *SearchResult) Dedup() {
+	groups := make(map[string][]FileRef)
+	for name, rsums := range r.Sums {
+		for key, sum := range rsums {
+			matches, ok := r.Matches[name][key]
+			if !ok {
+				continue
+			}
+			// files whose lines differ, e.g., as some were
+			// returned on an earlier page, are kept apart
+			group := sum + " " + strings.Join(sortedLines(matches), ",")
+			groups[group] = append(groups[group], FileRef{name, key})
+		}
+	}
+	for _, refs := range groups {
+		if len(refs) < 2 {
+			continue
+		}
+		sort.Sort(byFileRef(refs))
+		first := refs[0]
+		for _, ref := range refs[1:] {
+			dups := append([]FileRef{ref}, r.Duplicates[ref.File][ref.RepoKey]...)
+			r.addFileRepoDuplicates(first.File, first.RepoKey, dups)
+			r.NumMatches -= uint64(len(r.Matches[ref.File][ref.RepoKey]))
+			r.removeLines(ref.File, ref.RepoKey)
+		}
+		sort.Sort(byFileRef(r.Duplicates[first.File][first.RepoKey]))
+	}
+}
@@ -0,0 +1,150 @@
+package afind
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+func TestContentSum(t *testing.T) {
+	content := []byte("hello\n")
+	sum := newContentSum(fileStamp{Size: int64(len(content))})
+	_, _ = sum.Write(content)
+	// the git blob id of the content
+	eq(t, "ce013625030ba8dba906f756967f9e9ca394464a", sum.String())
+
+	// content of the wrong size has no sum
+	sum = newContentSum(fileStamp{Size: 100})
+	_, _ = sum.Write(content)
+	eq(t, "", sum.String())
+
+	// files read from git have their blob id
+	sum = newContentSum(fileStamp{Size: 6, Hash: "abc"})
+	_, _ = sum.Write([]byte("other\n"))
+	eq(t, "abc", sum.String())
+}
+
+// countingFS counts the files opened
+type countingFS struct {
+	walkablefs.WalkableFileSystem
+	mu     *sync.Mutex
+	opened map[string]int
+}
+
+func (fs *countingFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	fs.mu.Lock()
+	fs.opened[name]++
+	fs.mu.Unlock()
+	return fs.WalkableFileSystem.Open(name)
+}
+
+func TestSearchDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_dedup")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(src, 0755)
+	for name, content := range map[string]string{
+		"a.go": "package a // shared\n",
+		"b.go": "package b // shared too\n",
+	} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+	}
+	// both forks are indexed from the same files
+	fs := &countingFS{walkablefs.New(vfs.OS(src)), &sync.Mutex{}, map[string]int{}}
+	ctx := context.WithValue(context.Background(), "FileSystem", fs)
+	c := &Config{IndexRoot: filepath.Join(dir, "ix"), NumShards: 1}
+	repos := newDb()
+	ix := NewIndexer(c, repos)
+	for _, key := range []string{"fork1", "fork2"} {
+		query := NewIndexQuery(key)
+		query.Root = src
+		query.Dirs = []string{"."}
+		resp, err := ix.Index(ctx, query)
+		if err != nil || resp.Error != nil {
+			t.Fatal("unexpected error:", err, resp.Error)
+		}
+		_ = repos.Set(key, resp.Repo)
+	}
+	m, err := readManifest(filepath.Join(c.IndexRoot, "fork1"), "fork1")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 40, len(m.Shards[0].Files["a.go"].Sum))
+
+	search := func(ctx context.Context, re string) *SearchResult {
+		fs.opened = map[string]int{}
+		sr := NewSearchResult()
+		for _, key := range []string{"fork1", "fork2"} {
+			r, err := NewSearcher(c, repos).Search(ctx,
+				NewSearchQuery(re, "", false, []string{key}))
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			sr.Update(r)
+		}
+		return sr
+	}
+	// without deduplication, each fork's file is grepped
+	sr := search(ctx, "shared$")
+	eq(t, 2, fs.opened["a.go"])
+	eq(t, 0, len(sr.Sums))
+	eq(t, uint64(2), sr.NumMatches)
+
+	// with it, the content is grepped once, and reported once
+	sr = search(WithSearchDedup(ctx), "shared$")
+	eq(t, 1, fs.opened["a.go"])
+	eq(t, 2, len(sr.Sums["a.go"]))
+	eq(t, uint64(2), sr.NumMatches)
+	sr.Dedup()
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, 1, len(sr.Matches["a.go"]))
+	eq(t, "package a // shared\n", sr.Matches["a.go"]["fork1"]["1"])
+	eq(t, "[{a.go fork2}]", fmt.Sprint(sr.Duplicates["a.go"]["fork1"]))
+
+	// files changed since they were indexed are not shared
+	_ = ioutil.WriteFile(filepath.Join(src, "b.go"),
+		[]byte("package b // shared too, and changed\n"), 0644)
+	sr = search(WithSearchDedup(ctx), "package b")
+	eq(t, 2, fs.opened["b.go"])
+	eq(t, 0, len(sr.Sums))
+}
+
+func TestSearchResultDedup(t *testing.T) {
+	sr := NewSearchResult()
+	add := func(name, key, sum string, lines fileMap) {
+		sr.AddFileRepoMatches(name, key, lines)
+		sr.addFileRepoSum(name, key, sum)
+		sr.addFileRepoSource(name, key, FileSource{0, 1})
+	}
+	add("a.go", "r3", "s1", fileMap{"1": "one"})
+	add("a.go", "r2", "s1", fileMap{"1": "one"})
+	add("vendor/a.go", "r2", "s1", fileMap{"1": "one"})
+	// the lines of another page of results are kept apart
+	add("a.go", "r1", "s1", fileMap{"2": "two"})
+	add("b.go", "r1", "s2", fileMap{"1": "one"})
+	// duplicates found by another afindd are merged
+	sr.addFileRepoDuplicates("a.go", "r3", []FileRef{{"a.go", "r4"}})
+
+	sr.Dedup()
+	eq(t, uint64(3), sr.NumMatches)
+	eq(t, "[{vendor/a.go r2} {a.go r3} {a.go r4}]", fmt.Sprint(sr.Duplicates["a.go"]["r2"]))
+	eq(t, 2, len(sr.Matches["a.go"]))
+	eq(t, 1, len(sr.Duplicates))
+	eq(t, 0, len(sr.Matches["vendor/a.go"]))
+	// where the duplicates were found is kept for paging
+	eq(t, FileSource{0, 1}, sr.Sources["vendor/a.go"]["r2"])
+
+	sr.removeFileRepo("a.go", "r2")
+	eq(t, 0, len(sr.Duplicates))
+	eq(t, 0, len(sr.Sources["vendor/a.go"]))
+}
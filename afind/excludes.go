@@ -1,5 +1,16 @@
 package afind
 
+import (
+	"bufio"
+	"io"
+	"path"
+	stdregexp "regexp"
+	"strings"
+
+	"github.com/andaru/afind/errs"
+	"github.com/andaru/afind/walkablefs"
+)
+
 var IndexPathExcludes = newPathMatcher()
 
 const (
@@ -8,7 +19,322 @@ const (
 
 func init() {
 	IndexPathExcludes.AddExtension(indexPathSuffix)
+	IndexPathExcludes.AddExtension(manifestSuffix)
+	IndexPathExcludes.AddExtension(symbolsSuffix)
 	IndexPathExcludes.AddExtension(".git")
 	IndexPathExcludes.AddExtension(".hg")
 	IndexPathExcludes.AddExtension(".svn")
 }
+
+// Index exclusions.
+//
+// Files found when indexing a Repo are skipped if they match any of
+// the built-in IndexPathExcludes, the server's IndexExclude regexps
+// or IndexExcludeGlob globs, the query's exclusion rules, or the
+// patterns of a .gitignore or .ignore file found in the directory
+// being walked or any directory above it. If the query has inclusion
+// rules, files must also match one of them.
+//
+// Globs use the .gitignore syntax: a glob containing a '/' (other
+// than at the end) is matched against the path relative to Root (or
+// the directory of the ignore file), otherwise against the name at
+// any depth. '**' matches any number of directories, and a trailing
+// '/' matches only directories. Regexps are matched against the path
+// relative to Root.
+
+// ignoreFileNames are the files read for exclusion patterns during
+// the walk. Patterns in later files take precedence.
+var ignoreFileNames = []string{".gitignore", ".ignore"}
+
+// IndexRules select which of the files found are indexed
+type IndexRules struct {
+	// If not empty, only files matching one of these globs or
+	// regular expressions are indexed
+	Include   []string `json:"include,omitempty"`
+	IncludeRe []string `json:"include_re,omitempty"`
+	// Files and directories matching any of these globs or
+	// regular expressions are not indexed
+	Exclude   []string `json:"exclude,omitempty"`
+	ExcludeRe []string `json:"exclude_re,omitempty"`
+	// If true, .gitignore and .ignore files are not honored
+	NoIgnoreFiles bool `json:"no_ignore_files,omitempty"`
+}
+
+// IsEmpty returns true if the rules are all unset
+func (r IndexRules) IsEmpty() bool {
+	return len(r.Include) == 0 && len(r.IncludeRe) == 0 &&
+		len(r.Exclude) == 0 && len(r.ExcludeRe) == 0 && !r.NoIgnoreFiles
+}
+
+// indexRule is a compiled glob or regexp, named for reporting
+type indexRule struct {
+	name    string
+	re      *stdregexp.Regexp
+	dirOnly bool
+	negate  bool // for ignore file patterns
+}
+
+func (r indexRule) match(name string, isDir bool) bool {
+	return (isDir || !r.dirOnly) && r.re.MatchString(name)
+}
+
+// indexFilter decides which of the files found when indexing are
+// skipped, counting the files and directories skipped by each rule.
+type indexFilter struct {
+	fs          walkablefs.WalkableFileSystem
+	exclude     []indexRule
+	include     []indexRule
+	ignoreFiles bool
+	// ignore file patterns by the directory they were found in
+	ignores map[string][]indexRule
+
+	skipped map[string]int
+}
+
+// newIndexFilter compiles the server's and query's rules
+func newIndexFilter(cfg *Config, rules IndexRules,
+	fs walkablefs.WalkableFileSystem) (f *indexFilter, err error) {
+
+	f = &indexFilter{
+		fs:          fs,
+		ignoreFiles: !rules.NoIgnoreFiles,
+		ignores:     make(map[string][]indexRule),
+		skipped:     make(map[string]int),
+	}
+	if f.exclude, err = compileIndexRules(
+		"noindex", cfg.IndexExclude, cfg.IndexExcludeGlob); err != nil {
+		return nil, err
+	}
+	exclude, err := compileIndexRules("exclude", rules.ExcludeRe, rules.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	f.exclude = append(f.exclude, exclude...)
+	if f.include, err = compileIndexRules(
+		"include", rules.IncludeRe, rules.Include); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// validate returns an error if any of the rules do not compile
+func (r IndexRules) validate() error {
+	if _, err := compileIndexRules("exclude", r.ExcludeRe, r.Exclude); err != nil {
+		return err
+	}
+	_, err := compileIndexRules("include", r.IncludeRe, r.Include)
+	return err
+}
+
+// compileIndexRules compiles the regexps and globs, naming each
+// rule for the field they were given in.
+func compileIndexRules(field string, res, globs []string) ([]indexRule, error) {
+	rules := []indexRule{}
+	for _, s := range res {
+		re, err := stdregexp.Compile(s)
+		if err != nil {
+			return nil, errs.NewValueError(field, s+": "+err.Error())
+		}
+		rules = append(rules, indexRule{name: field + ":" + s, re: re})
+	}
+	for _, s := range globs {
+		rule, err := compileGlob(s)
+		if err != nil {
+			return nil, errs.NewValueError(field, s+": "+err.Error())
+		}
+		rule.name = field + ":" + s
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// compileGlob compiles the .gitignore style glob
+func compileGlob(glob string) (rule indexRule, err error) {
+	if strings.HasSuffix(glob, "/") {
+		glob, rule.dirOnly = strings.TrimSuffix(glob, "/"), true
+	}
+	if glob == "" {
+		return rule, errs.NewValueError("glob", "must not be empty")
+	}
+	prefix := "(?:^|/)"
+	if strings.Contains(glob, "/") {
+		prefix, glob = "^", strings.TrimPrefix(glob, "/")
+	}
+	rule.re, err = stdregexp.Compile(prefix + globRegexp(glob) + "$")
+	return
+}
+
+// globRegexp returns the regular expression text for the glob
+func globRegexp(glob string) string {
+	r := []rune(glob)
+	var re []string
+	for i := 0; i < len(r); i++ {
+		switch c := r[i]; c {
+		case '*':
+			if i+1 < len(r) && r[i+1] == '*' {
+				i++
+				if i+1 < len(r) && r[i+1] == '/' {
+					// zero or more directories
+					i++
+					re = append(re, "(?:.*/)?")
+				} else {
+					re = append(re, ".*")
+				}
+			} else {
+				re = append(re, "[^/]*")
+			}
+		case '?':
+			re = append(re, "[^/]")
+		case '[':
+			// character class, taken verbatim if terminated
+			j := i + 1
+			if j < len(r) && (r[j] == '!' || r[j] == '^') {
+				j++
+			}
+			if j < len(r) && r[j] == ']' {
+				j++
+			}
+			for j < len(r) && r[j] != ']' {
+				j++
+			}
+			if j >= len(r) {
+				re = append(re, `\[`)
+				continue
+			}
+			class := string(r[i+1 : j])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re = append(re, "["+class+"]")
+			i = j
+		case '\\':
+			if i+1 < len(r) {
+				i++
+				c = r[i]
+			}
+			re = append(re, stdregexp.QuoteMeta(string(c)))
+		default:
+			re = append(re, stdregexp.QuoteMeta(string(c)))
+		}
+	}
+	return strings.Join(re, "")
+}
+
+// parseIgnoreFile parses the patterns of an ignore file
+func parseIgnoreFile(name string, r io.Reader) []indexRule {
+	rules := []indexRule{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := false
+		if strings.HasPrefix(line, "!") {
+			line, negate = line[1:], true
+		}
+		rule, err := compileGlob(line)
+		if err != nil {
+			// skip patterns we cannot use, as git does
+			continue
+		}
+		rule.name, rule.negate = "ignore:"+name, negate
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ignoreRules returns the rules of the ignore files in the
+// directory dir (relative to Root), reading them if not yet read.
+func (f *indexFilter) ignoreRules(dir string) []indexRule {
+	if rules, ok := f.ignores[dir]; ok {
+		return rules
+	}
+	rules := []indexRule{}
+	for _, base := range ignoreFileNames {
+		name := path.Join(dir, base)
+		r, err := f.fs.Open("/" + name)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, parseIgnoreFile(name, r)...)
+		_ = r.Close()
+	}
+	f.ignores[dir] = rules
+	return rules
+}
+
+// ignored returns the rule of the ignore files which ignores the
+// file or directory name, if any.
+func (f *indexFilter) ignored(name string, isDir bool) (rule string, ignored bool) {
+	dirs := []string{""}
+	for i, c := range name {
+		if c == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	// the patterns of the deepest ignore file and the last
+	// pattern within it matching take precedence
+	for _, dir := range dirs {
+		rel := name
+		if dir != "" {
+			rel = name[len(dir)+1:]
+		}
+		for _, r := range f.ignoreRules(dir) {
+			if r.match(rel, isDir) {
+				rule, ignored = r.name, !r.negate
+			}
+		}
+	}
+	return
+}
+
+// skip returns true if the file or directory found in the walk is
+// not to be indexed. Walked directories are always searched for
+// files to include.
+func (f *indexFilter) skip(name string, isDir bool) bool {
+	return f.check(name, isDir, f.ignoreFiles)
+}
+
+// skipFile returns true if the file named in the query is not to be
+// indexed. Ignore files do not apply to files named explicitly.
+func (f *indexFilter) skipFile(name string) bool {
+	return f.check(name, false, false)
+}
+
+func (f *indexFilter) check(name string, isDir, ignoreFiles bool) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return false
+	}
+	rule := ""
+	if IndexPathExcludes.MatchFile(name) {
+		rule = "builtin"
+	}
+	for _, r := range f.exclude {
+		if rule != "" {
+			break
+		} else if r.match(name, isDir) {
+			rule = r.name
+		}
+	}
+	if rule == "" && ignoreFiles {
+		if ignore, ok := f.ignored(name, isDir); ok {
+			rule = ignore
+		}
+	}
+	if rule == "" && !isDir && len(f.include) > 0 {
+		rule = "include"
+		for _, r := range f.include {
+			if r.match(name, false) {
+				rule = ""
+				break
+			}
+		}
+	}
+	if rule == "" {
+		return false
+	}
+	f.skipped[rule]++
+	return true
+}
@@ -0,0 +1,141 @@
+package afind
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestCompileGlob(t *testing.T) {
+	check := func(glob, name string, isDir, want bool) {
+		rule, err := compileGlob(glob)
+		if err != nil {
+			t.Fatalf("glob %q: unexpected error: %v", glob, err)
+		}
+		if got := rule.match(name, isDir); got != want {
+			t.Errorf("glob %q name %q: want %v, got %v", glob, name, want, got)
+		}
+	}
+	check("*.o", "foo.o", false, true)
+	check("*.o", "a/b/foo.o", false, true)
+	check("*.o", "foo.c", false, false)
+	check("/foo", "foo", false, true)
+	check("/foo", "a/foo", false, false)
+	check("a/*.c", "a/x.c", false, true)
+	check("a/*.c", "a/b/x.c", false, false)
+	check("a/**/x.c", "a/x.c", false, true)
+	check("a/**/x.c", "a/b/c/x.c", false, true)
+	check("**/build", "x/build", true, true)
+	check("build/", "x/build", true, true)
+	check("build/", "x/build", false, false)
+	check("a/**", "a/b/c", false, true)
+	check("file?.[ch]", "file1.h", false, true)
+	check("file[!0-9].c", "file1.c", false, false)
+	check("file[!0-9].c", "filex.c", false, true)
+	check(`\#foo`, "#foo", false, true)
+	check("[abc", "[abc", false, true)
+
+	if _, err := compileGlob("/"); err == nil {
+		t.Error("want error for empty glob, got none")
+	}
+}
+
+func TestIndexFilter(t *testing.T) {
+	files := map[string]string{
+		".gitignore":       "*.o\n# comment\n/build/\n!keep.o\n",
+		"src/.ignore":      "gen_*.go\n",
+		"src/main.go":      "package main\n",
+		"src/gen_x.go":     "package main\n",
+		"src/main.o":       "binary\n",
+		"src/keep.o":       "binary\n",
+		"other/gen_y.go":   "package other\n",
+		"build/out":        "out\n",
+		"vendor/lib/lib.c": "int lib;\n",
+		"notes.txt":        "notes\n",
+	}
+	cfg := &Config{IndexExclude: []string{`\.txt$`}}
+	rules := IndexRules{Exclude: []string{"vendor/"}}
+	f, err := newIndexFilter(cfg, rules, getMockFs(files))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, false, f.skip("/src", true))
+	eq(t, false, f.skip("/src/main.go", false))
+	eq(t, true, f.skip("/src/gen_x.go", false))
+	eq(t, false, f.skip("/other/gen_y.go", false))
+	eq(t, true, f.skip("/src/main.o", false))
+	eq(t, false, f.skip("/src/keep.o", false))
+	eq(t, true, f.skip("/build", true))
+	eq(t, true, f.skip("/vendor", true))
+	eq(t, true, f.skip("/notes.txt", false))
+	eq(t, true, f.skip("/src/x.afindex", false))
+	// ignore files do not apply to files named in the query
+	eq(t, false, f.skipFile("src/main.o"))
+
+	eq(t, 1, f.skipped["ignore:src/.ignore"])
+	eq(t, 2, f.skipped["ignore:.gitignore"])
+	eq(t, 1, f.skipped["exclude:vendor/"])
+	eq(t, 1, f.skipped[`noindex:\.txt$`])
+	eq(t, 1, f.skipped["builtin"])
+
+	rules = IndexRules{Include: []string{"*.go"}, NoIgnoreFiles: true}
+	if f, err = newIndexFilter(&Config{}, rules, getMockFs(files)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, false, f.skip("/src/gen_x.go", false))
+	eq(t, false, f.skip("/build", true))
+	eq(t, true, f.skip("/build/out", false))
+	eq(t, 1, f.skipped["include"])
+
+	rules = IndexRules{ExcludeRe: []string{"foo["}}
+	if _, err = newIndexFilter(&Config{}, rules, getMockFs(files)); err == nil {
+		t.Error("want error for invalid regexp, got none")
+	}
+}
+
+func TestIndexerExcludes(t *testing.T) {
+	files := map[string]string{
+		".gitignore":    "*.log\n",
+		"a.go":          "package a\n",
+		"a_test.go":     "package a\n",
+		"debug.log":     "log\n",
+		"vendor/v.go":   "package v\n",
+		"vendor/w.go":   "package w\n",
+		"docs/index.md": "docs\n",
+	}
+	ix := NewIndexer(&Config{IndexExcludeGlob: []string{"*_test.go"}}, newDb())
+	query := NewIndexQuery("excl")
+	query.Dirs = []string{"."}
+	query.Root = "/"
+	query.Exclude = []string{"vendor/"}
+	query.IncludeRe = []string{`\.(go|log)$`}
+	resp, err := ix.Index(testIndexContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, OK, resp.Repo.State)
+	eq(t, 1, resp.Repo.NumFiles)
+	rules := []string{}
+	for rule := range resp.Skipped {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	want := []string{"exclude:vendor/", "ignore:.gitignore", "include", "noindex:*_test.go"}
+	eq(t, len(want), len(rules))
+	for n := range want {
+		eq(t, want[n], rules[n])
+	}
+	// .gitignore and docs/index.md are not included
+	eq(t, 2, resp.Skipped["include"])
+
+	// the rules are kept with the Repo for updates
+	update := NewIndexQuery("excl")
+	update.Inherit(resp.Repo)
+	eq(t, "vendor/", update.Exclude[0])
+
+	query.Key = "bad"
+	query.Exclude = []string{""}
+	resp, _ = ix.Index(testIndexContext(getMockFs(files)), query)
+	if resp.Error == nil {
+		t.Error("want error for empty exclusion glob, got none")
+	}
+}
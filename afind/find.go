@@ -1,6 +1,8 @@
 package afind
 
 import (
+	stdregexp "regexp"
+	"sort"
 	"time"
 
 	"code.google.com/p/go.net/context"
@@ -26,8 +28,21 @@ type Finder interface {
 type FindQuery struct {
 	// The path regular expression
 	PathRe string `json:"path_re"`
+	// files with names matching any of these regular expressions
+	// are not found
+	ExcludePathRe []string `json:"exclude_path_re,omitempty"`
 	// if true, perform case insensitive searches
 	IgnoreCase bool `json:"i"`
+	// if true, PathRe is a fixed string rather than a regular expression
+	Literal bool `json:"literal,omitempty"`
+	// if true, PathRe must match whole words
+	Word bool `json:"word,omitempty"`
+	// if true, perform case insensitive searches unless PathRe
+	// contains an uppercase letter
+	SmartCase bool `json:"smart_case,omitempty"`
+	// Find only files of these languages (e.g., "go"), if not
+	// empty (see language.go)
+	Languages []string `json:"languages,omitempty"`
 
 	// Repository filtering attributes
 	// Search only these repositories if not empty
@@ -41,6 +56,10 @@ type FindQuery struct {
 	// Maximum number of files to return
 	MaxMatches uint64 `json:"max_matches"`
 
+	// The Next cursor of the previous page of results, to
+	// continue from where that page ended
+	Cursor string `json:"cursor,omitempty"`
+
 	// Recursion flag, as per IndexQuery/SearchQuery
 	Recurse bool `json:"-"`
 
@@ -74,13 +93,24 @@ type FindResult struct {
 	NumMatches uint64 `json:"num_matches"`
 	// Maximum number of files to return
 	MaxMatches uint64 `json:"max_matches"`
+
+	// The cursor to pass in the query for the next page of
+	// results, if there may be more
+	Next string `json:"next,omitempty"`
+
+	// The position reached in each shard searched, and where in
+	// the shards each file was found, used to produce Next
+	Progress Cursor                           `json:"-"`
+	Sources  map[string]map[string]FileSource `json:"-"`
 }
 
 // NewFindResult returns a pointer to an initialized FindResult
 func NewFindResult() *FindResult {
 	return &FindResult{
-		Matches: map[string]map[string]int{},
-		Errors:  map[string]*errs.StructError{},
+		Matches:  map[string]map[string]int{},
+		Errors:   map[string]*errs.StructError{},
+		Progress: Cursor{},
+		Sources:  map[string]map[string]FileSource{},
 	}
 }
 
@@ -112,6 +142,70 @@ func (fr *FindResult) Update(other *FindResult) {
 		}
 	}
 	fr.NumMatches += other.NumMatches
+	if fr.Progress == nil {
+		fr.Progress = Cursor{}
+	}
+	fr.Progress.Update(other.Progress)
+	if fr.Sources == nil {
+		fr.Sources = map[string]map[string]FileSource{}
+	}
+	for file, rsources := range other.Sources {
+		if _, ok := fr.Sources[file]; !ok {
+			fr.Sources[file] = map[string]FileSource{}
+		}
+		for repo, source := range rsources {
+			fr.Sources[file][repo] = source
+		}
+	}
+}
+
+// Truncate limits the result to max files, removing those last in
+// Repo key, shard and posting order, and moving back the Progress of
+// the shards they were found in so that the next page of results
+// includes them. Truncate does nothing if max is 0.
+func (fr *FindResult) Truncate(max uint64) {
+	if max == 0 || fr.NumMatches <= max {
+		return
+	}
+	files := make([]foundFile, 0, fr.NumMatches)
+	for name, repos := range fr.Matches {
+		for key := range repos {
+			files = append(files, foundFile{name, key, fr.Sources[name][key]})
+		}
+	}
+	sort.Sort(byFound(files))
+	for _, f := range files[max:] {
+		delete(fr.Matches[f.name], f.key)
+		if len(fr.Matches[f.name]) == 0 {
+			delete(fr.Matches, f.name)
+		}
+		if pos, ok := fr.Progress[f.key][f.source.Shard]; ok && f.source.Id < pos.Id {
+			fr.Progress.Set(f.key, f.source.Shard,
+				ShardPosition{Id: f.source.Id, Gen: pos.Gen})
+		}
+	}
+	fr.NumMatches = max
+}
+
+type foundFile struct {
+	name   string
+	key    string
+	source FileSource
+}
+
+type byFound []foundFile
+
+func (f byFound) Len() int      { return len(f) }
+func (f byFound) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byFound) Less(i, j int) bool {
+	if f[i].key != f[j].key {
+		return f[i].key < f[j].key
+	} else if f[i].source.Shard != f[j].source.Shard {
+		return f[i].source.Shard < f[j].source.Shard
+	} else if f[i].source.Id != f[j].source.Id {
+		return f[i].source.Id < f[j].source.Id
+	}
+	return f[i].name < f[j].name
 }
 
 // The Finder implementation
@@ -141,7 +235,11 @@ func mustCompile(pattern string) *regexp.Regexp {
 }
 
 func (f finder) Find(ctx context.Context, query FindQuery) (fr *FindResult, err error) {
-	var reg *regexp.Regexp
+	var reg, exclude *regexp.Regexp
+	var filter *stdregexp.Regexp
+	var langs languageSet
+	var cursor Cursor
+	gens := make(map[string]int64) // the index generation of each Repo
 
 	log.Info("find [%s] keys %v", query.PathRe, query.RepoKeys)
 	sw := stopwatch.New()
@@ -149,7 +247,7 @@ func (f finder) Find(ctx context.Context, query FindQuery) (fr *FindResult, err
 
 	fr = NewFindResult()
 	chQuery := make(chan par.RequestFunc, 100)
-	chResult := make(chan fnamerepo, 10)
+	chResult := make(chan *FindResult, 10)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -165,15 +263,36 @@ func (f finder) Find(ctx context.Context, query FindQuery) (fr *FindResult, err
 		goto done
 	}
 
-	if query.IgnoreCase {
-		query.PathRe = "(?i)" + query.PathRe
+	// As for search, whole word matches are found with a filter
+	reg, err = regexp.Compile(buildPattern(query.PathRe, query.Literal,
+		false, query.IgnoreCase, query.SmartCase))
+	if err == nil && query.Word {
+		filter, err = stdregexp.Compile(buildPattern(query.PathRe, query.Literal,
+			true, query.IgnoreCase, query.SmartCase))
+	}
+	if err == nil {
+		exclude, err = excludeRegexp(query.ExcludePathRe)
+	}
+	if err == nil {
+		langs, err = newLanguageSet(query.Languages)
 	}
-
-	reg, err = regexp.Compile(query.PathRe)
 	if err != nil {
 		fr.Error = errs.NewStructError(err)
 		goto done
 	}
+	if cursor, err = DecodeCursor(query.Cursor); err != nil {
+		fr.Error = errs.NewStructError(err)
+		goto done
+	}
+
+	for _, key := range query.RepoKeys {
+		if v := f.repos.Get(key); v != nil {
+			if err = cursor.checkGeneration(v.(*Repo)); err != nil {
+				fr.Error = errs.NewStructError(err)
+				goto done
+			}
+		}
+	}
 
 	// concurrently perform queries across all mentioned repo
 
@@ -182,8 +301,15 @@ func (f finder) Find(ctx context.Context, query FindQuery) (fr *FindResult, err
 			fr.Errors[key] = kRepoUnavailableError
 		} else {
 			repo := v.(*Repo)
-			for _, fn := range repo.Shards() {
-				chQuery <- shardFind(fn, repo.Key, reg, chResult)
+			gens[key] = repo.generation()
+			for n, fn := range repo.Shards() {
+				pos := cursor.Position(repo.Key, n)
+				if pos.Done() || !langs.mayMatchRepo(repo) {
+					fr.Progress.Set(repo.Key, n, ShardPosition{Id: lastPostingId})
+					continue
+				}
+				chQuery <- shardFind(fn, repo, n, pos,
+					query.MaxMatches, reg, filter, exclude, langs, chResult)
 			}
 		}
 
@@ -197,11 +323,10 @@ func (f finder) Find(ctx context.Context, query FindQuery) (fr *FindResult, err
 	}()
 
 	for in := range chResult {
-		if _, ok := fr.Matches[in.fname]; !ok {
-			fr.Matches[in.fname] = map[string]int{}
-		}
-		fr.Matches[in.fname][in.repo]++
-		fr.NumMatches++
+		fr.Update(in)
+	}
+	for key, gen := range gens {
+		fr.Progress.setGeneration(key, gen)
 	}
 done:
 	elapsed := sw.Stop("*")
@@ -212,30 +337,60 @@ done:
 	return
 }
 
-type fnamerepo struct {
-	fname string
-	repo  string
-}
+// shardFind finds files in the index shard number shard of the Repo
+// from the position pos, stopping once max files are found. If
+// filter is not nil, file names must match both re and filter, if
+// exclude is not nil, must not match exclude, and if langs is not
+// nil, the files must be of one of the languages.
+func shardFind(fn string, repo *Repo, shard int, pos ShardPosition, max uint64,
+	re *regexp.Regexp, filter *stdregexp.Regexp, exclude *regexp.Regexp,
+	langs languageSet, results chan *FindResult) par.RequestFunc {
 
-func shardFind(fn string, key string, re *regexp.Regexp, results chan fnamerepo) par.RequestFunc {
+	key := repo.Key
 	return func(ctx context.Context) (err error) {
 		ix, err := index.Open(fn)
 		if err != nil {
 			return
 		}
+		var stamps map[string]fileStamp
+		if langs != nil {
+			stamps = shardStamps(repo, shard)
+		}
+		fr := NewFindResult()
+		next := ShardPosition{Id: lastPostingId}
 		q := index.RegexpQuery(regexpAll.Syntax)
 		post := ix.PostingQuery(q)
 		for _, id := range post {
-			name := ix.Name(id)
-			if re.MatchString(name, true, true) < 0 {
+			if id < pos.Id {
 				continue
 			}
+			if max > 0 && fr.NumMatches >= max {
+				next.Id = id
+				break
+			}
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				results <- fnamerepo{name, key}
 			}
+			name := ix.Name(id)
+			if re.MatchString(name, true, true) < 0 {
+				continue
+			} else if filter != nil && !filter.MatchString(name) {
+				continue
+			} else if exclude != nil && exclude.MatchString(name, true, true) >= 0 {
+				continue
+			} else if langs != nil && !langs[fileLanguage(name, stamps[name])] {
+				continue
+			}
+			fr.Matches[name] = map[string]int{key: 1}
+			fr.Sources[name] = map[string]FileSource{key: {shard, id}}
+			fr.NumMatches++
+		}
+		fr.Progress.Set(key, shard, next)
+		select {
+		case <-ctx.Done():
+		case results <- fr:
 		}
 		return
 	}
@@ -247,5 +402,14 @@ func (q *FindQuery) Normalize() error {
 	if len(q.PathRe) < 3 {
 		return errs.NewValueError("path_re", "must be at least 3 characters")
 	}
+	if _, err := excludeRegexp(q.ExcludePathRe); err != nil {
+		return err
+	}
+	if _, err := newLanguageSet(q.Languages); err != nil {
+		return err
+	}
+	if _, err := DecodeCursor(q.Cursor); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,99 @@
+package afind
+
+import (
+	"io"
+	"sync"
+
+	"github.com/andaru/afind/walkablefs"
+)
+
+const (
+	// the number of git commit trees and archives kept open
+	fsCacheSize = 8
+)
+
+// cachedFS is an open file system, such as a git commit's tree
+type cachedFS struct {
+	key     string
+	fs      walkablefs.WalkableFileSystem
+	closer  io.Closer
+	users   int  // the requests using it
+	evicted bool // close when no longer used
+}
+
+// fsCache keeps the file systems most recently used open, as each
+// shard of a Repo is searched separately, and opening a large git
+// repository or archive (reading its pack indexes or listing its
+// members) is not cheap.
+type fsCache struct {
+	mu      *sync.Mutex
+	size    int
+	entries []*cachedFS // most recently used first
+}
+
+var openFileSystems = newFSCache(fsCacheSize)
+
+func newFSCache(size int) *fsCache {
+	return &fsCache{mu: &sync.Mutex{}, size: size}
+}
+
+// acquire returns the file system of the key, calling open if it is
+// not already open. It must be released once used.
+func (c *fsCache) acquire(key string,
+	open func() (walkablefs.WalkableFileSystem, io.Closer, error)) (*cachedFS, error) {
+
+	c.mu.Lock()
+	for i, e := range c.entries {
+		if e.key == key {
+			copy(c.entries[1:i+1], c.entries[:i])
+			c.entries[0] = e
+			e.users++
+			c.mu.Unlock()
+			return e, nil
+		}
+	}
+	c.mu.Unlock()
+
+	// open without holding the lock; should another request open
+	// the same key meanwhile, both are cached until evicted
+	fs, closer, err := open()
+	if err != nil {
+		return nil, err
+	}
+	e := &cachedFS{key: key, fs: fs, closer: closer, users: 1}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append([]*cachedFS{e}, c.entries...)
+	for len(c.entries) > c.size {
+		old := c.entries[len(c.entries)-1]
+		c.entries = c.entries[:len(c.entries)-1]
+		old.evicted = true
+		if old.users == 0 {
+			_ = old.closer.Close()
+		}
+	}
+	return e, nil
+}
+
+func (c *fsCache) release(e *cachedFS) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.users--
+	if e.evicted && e.users == 0 {
+		_ = e.closer.Close()
+	}
+}
+
+// cachedFileSystem returns the file system of the key from the
+// cache, and the function to release it
+func cachedFileSystem(key string,
+	open func() (walkablefs.WalkableFileSystem, io.Closer, error)) (
+	walkablefs.WalkableFileSystem, func(), error) {
+
+	e, err := openFileSystems.acquire(key, open)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.fs, func() { openFileSystems.release(e) }, nil
+}
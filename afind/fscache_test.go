@@ -0,0 +1,54 @@
+package afind
+
+import (
+	"io"
+	"testing"
+
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+type testCloser struct {
+	closed int
+}
+
+func (c *testCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestFSCache(t *testing.T) {
+	cache := newFSCache(2)
+	closers := map[string]*testCloser{}
+	opened := 0
+	acquire := func(key string) *cachedFS {
+		e, err := cache.acquire(key,
+			func() (walkablefs.WalkableFileSystem, io.Closer, error) {
+				opened++
+				closers[key] = &testCloser{}
+				fs := walkablefs.New(mapfs.New(map[string]string{key: key}))
+				return fs, closers[key], nil
+			})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return e
+	}
+	e0 := acquire("zero")
+	e1 := acquire("one")
+	cache.release(e1)
+	eq(t, e1, acquire("one"))
+	eq(t, 2, opened)
+	cache.release(e1)
+	// the least recently used file system is evicted, but closed
+	// only once released
+	e2 := acquire("two")
+	eq(t, 2, len(cache.entries))
+	eq(t, true, e0.evicted)
+	eq(t, 0, closers["zero"].closed)
+	cache.release(e0)
+	eq(t, 1, closers["zero"].closed)
+	cache.release(e2)
+	eq(t, 0, closers["one"].closed)
+	eq(t, 0, closers["two"].closed)
+}
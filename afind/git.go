@@ -0,0 +1,66 @@
+package afind
+
+import (
+	"io"
+
+	"github.com/andaru/afind/gitfs"
+	"github.com/andaru/afind/walkablefs"
+)
+
+// Indexing git revisions.
+//
+// An IndexQuery with a Ref indexes that revision (a branch, tag or
+// commit) of the git repository at Root, which may be bare. Files
+// are read from the repository's object database, not a checkout.
+// The commit the Ref resolved to is recorded in the Repo's Meta as
+// "git_commit", and searches read files from that commit's tree, so
+// results agree with the index even once the Ref has moved on.
+// Updates resolve the Ref afresh, rebuilding only the shards whose
+// files' contents have changed.
+
+// GitCommit returns the `git_commit` key of the metadata: for Repo
+// indexed from a git Ref, the id of the commit indexed.
+func (m Meta) GitCommit() string {
+	return m["git_commit"]
+}
+
+// openGitRef opens the git repository at root, returning it and the
+// file system of the commit ref resolves to. The caller must close
+// the repository.
+func openGitRef(root, ref string) (
+	*gitfs.Repository, walkablefs.WalkableFileSystem, gitfs.ID, error) {
+
+	repo, err := gitfs.Open(root)
+	if err != nil {
+		return nil, nil, gitfs.ID{}, err
+	}
+	commit, err := repo.Resolve(ref)
+	var fs walkablefs.WalkableFileSystem
+	if err == nil {
+		fs, err = repo.FileSystem(commit)
+	}
+	if err != nil {
+		_ = repo.Close()
+		return nil, nil, commit, err
+	}
+	return repo, fs, commit, nil
+}
+
+// gitFileSystem returns the tree of the commit indexed for a Repo
+// indexed from a git revision, opened with the repository
+func gitFileSystem(repo *Repo) (walkablefs.WalkableFileSystem, io.Closer, error) {
+	commit, err := gitfs.ParseID(repo.Meta.GitCommit())
+	if err != nil {
+		return nil, nil, err
+	}
+	gitrepo, err := gitfs.Open(repo.Root)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, err := gitrepo.FileSystem(commit)
+	if err != nil {
+		_ = gitrepo.Close()
+		return nil, nil, err
+	}
+	return fs, gitrepo, nil
+}
@@ -0,0 +1,140 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+)
+
+// gitCommit writes the files to the work tree at dir and commits
+// them, returning the commit id
+func gitCommit(t *testing.T, dir string, files map[string]string) string {
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+			"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		_ = os.MkdirAll(dir, 0755)
+		git("init", "-q")
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		_ = os.MkdirAll(filepath.Dir(name), 0755)
+		_ = ioutil.WriteFile(name, []byte(content), 0644)
+	}
+	git("add", "-A")
+	git("commit", "-q", "-m", "commit")
+	return git("rev-parse", "HEAD")
+}
+
+func TestIndexGitRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "afind_git")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	first := gitCommit(t, src, map[string]string{
+		"a.go":     "package a // first\n",
+		"b/b.go":   "package b\n",
+		"c/c.go":   "package c\n",
+		"d/README": "readme\n",
+	})
+	// the work tree differs from the commit
+	_ = ioutil.WriteFile(filepath.Join(src, "a.go"), []byte("package a // dirty\n"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(src, "untracked.go"), []byte("package u\n"), 0644)
+
+	c := &Config{IndexRoot: filepath.Join(dir, "ix"), NumShards: 2}
+	repos := newDb()
+	ix := NewIndexer(c, repos)
+	query := NewIndexQuery("git")
+	query.Root = src
+	query.Dirs = []string{"."}
+	query.Ref = "HEAD"
+	resp, err := ix.Index(context.Background(), query)
+	if err != nil || resp.Error != nil {
+		t.Fatal("unexpected error:", err, resp.Error)
+	}
+	repo := resp.Repo
+	eq(t, OK, repo.State)
+	eq(t, 4, repo.NumFiles)
+	eq(t, "HEAD", repo.Ref)
+	eq(t, first, repo.Meta.GitCommit())
+	_ = repos.Set(repo.Key, repo)
+
+	search := func(re string) string {
+		sr, err := NewSearcher(c, repos).Search(context.Background(),
+			NewSearchQuery(re, "", false, []string{"git"}))
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		found := []string{}
+		for name, byRepo := range sr.Matches {
+			for _, line := range byRepo["git"] {
+				found = append(found, name+":"+strings.TrimSpace(line))
+			}
+		}
+		return strings.Join(found, " ")
+	}
+	// the file searched is the one in the commit, not the work tree
+	eq(t, "a.go:package a // first", search("package a"))
+	eq(t, "", search("package u"))
+
+	// an update indexes the new commit (adding untracked.go and
+	// changing a.go), leaving the other files' stamps as they were
+	ixpath := filepath.Join(c.IndexRoot, "git")
+	before, _ := readManifest(ixpath, "git")
+	second := gitCommit(t, src, map[string]string{"a.go": "package a // second\n"})
+	update := NewIndexQuery("git")
+	update.Update = true
+	update.Inherit(repo)
+	resp, err = ix.Index(context.Background(), update)
+	if err != nil || resp.Error != nil {
+		t.Fatal("unexpected error:", err, resp.Error)
+	}
+	eq(t, second, resp.Repo.Meta.GitCommit())
+	eq(t, 5, resp.Repo.NumFiles)
+	after, _ := readManifest(ixpath, "git")
+	unchanged := 0
+	for n := range after.Shards {
+		for name, stamp := range after.Shards[n].Files {
+			if old, ok := before.Shards[n].Files[name]; ok && !old.changed(stamp) {
+				unchanged++
+			}
+		}
+	}
+	eq(t, 3, unchanged)
+
+	// searches of the original Repo still read the original commit
+	eq(t, "a.go:package a // first", search("package a"))
+	_ = repos.Set(repo.Key, resp.Repo)
+	eq(t, "a.go:package a // second", search("package a"))
+
+	// bad revisions are rejected
+	query.Ref = "missing"
+	resp, _ = ix.Index(context.Background(), query)
+	if resp.Error == nil {
+		t.Error("want error indexing an unknown revision")
+	}
+	query.Ref = "../config"
+	if err = query.Normalize(); err == nil {
+		t.Error("want error normalizing an invalid revision")
+	}
+}
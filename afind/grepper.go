@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"io"
 	"os"
+	stdregexp "regexp"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"code.google.com/p/go.net/context"
 	"github.com/andaru/afind/errs"
@@ -27,9 +30,29 @@ type grep struct {
 	err      error
 
 	// local private data
-	ctxPre  int
-	ctxPost int
-	ctxBoth int
+	searchContext SearchContext
+
+	// if not nil, matching lines must also match filter
+	filter *stdregexp.Regexp
+	// if not nil, files with names matching exclude are not searched
+	exclude *regexp.Regexp
+	// if not nil, only files of these languages are searched
+	langs languageSet
+
+	// for boolean queries, the Repo searched, and the content
+	// terms of the query found in the current file
+	repo  *Repo
+	query *boolQuery
+	found []bool
+
+	// for searches sharing the greps of identical files
+	greps *blobGreps
+
+	// the shard searched, and the stamps of its files, read from
+	// the Repo's manifest when needed
+	shard      int
+	stamps     map[string]fileStamp
+	stampsRead bool
 
 	fs vfs.FileSystem
 }
@@ -41,35 +64,90 @@ func newGrep(ixfilename, root string, fs vfs.FileSystem) *grep {
 	return &grep{filename: ixfilename, root: root, fs: fs}
 }
 
-// builds regular expressions for text and pathname matching
-func buildRegexps(query *SearchQuery) (re, pathre *regexp.Regexp, err error) {
-	pattern := "(?m)" + query.Re
-	if query.IgnoreCase {
-		pattern = "(?i)" + pattern
+// returns the text regular expression for the query. The whole
+// word option is applied only if word is true.
+func searchPattern(query *SearchQuery, word bool) string {
+	return "(?m)" + buildPattern(query.Re, query.Literal,
+		word && query.Word, query.IgnoreCase, query.SmartCase)
+}
+
+// builds regular expressions for text and pathname matching. The
+// codesearch matcher does not support word boundaries, so for whole
+// word searches, lines matched by re must also match filter.
+func buildRegexps(query *SearchQuery) (
+	re, pathre *regexp.Regexp, filter *stdregexp.Regexp, err error) {
+
+	if re, err = regexp.Compile(searchPattern(query, false)); err != nil {
+		return
+	}
+	if query.Word {
+		if filter, err = stdregexp.Compile(searchPattern(query, true)); err != nil {
+			return
+		}
 	}
-	re, err = regexp.Compile(pattern)
 	if query.PathRe != "" {
 		pathre, err = regexp.Compile(query.PathRe)
 	}
 	return
 }
 
-func (s *grep) search(ctx context.Context, query SearchQuery) (
-	resp *SearchResult, err error) {
+// compile sets up the regular expressions for the query, returning
+// the path regexp and, if the query asks for positions, the regexp
+// to find them with.
+func (s *grep) compile(query *SearchQuery) (
+	pathre *regexp.Regexp, posre *stdregexp.Regexp, err error) {
+
+	if s.exclude, err = excludeRegexp(query.ExcludePathRe); err != nil {
+		return
+	}
+	if s.langs, err = newLanguageSet(query.Languages); err != nil {
+		return
+	}
+	posPattern := searchPattern(query, true)
+	if query.Query != "" {
+		s.query, err = parseQuery(query.Query,
+			query.Literal, query.Word, query.IgnoreCase, query.SmartCase)
+		if err != nil {
+			return
+		}
+		if s.Regexp, err = regexp.Compile(s.query.pattern()); err != nil {
+			return
+		}
+		if query.PathRe != "" {
+			if pathre, err = regexp.Compile(query.PathRe); err != nil {
+				return
+			}
+		}
+		posPattern = s.query.reportPattern()
+	} else if s.Regexp, pathre, s.filter, err = buildRegexps(query); err != nil {
+		return
+	}
+	if query.Positions {
+		// codesearch's regexp reports only the matching line, so
+		// use the standard library for the positions within it
+		posre, err = stdregexp.Compile(posPattern)
+	}
+	return
+}
+
+// search searches the index shard number shard, from the position
+// pos reached by the previous page of results.
+func (s *grep) search(ctx context.Context, query SearchQuery,
+	shard int, pos ShardPosition) (resp *SearchResult, err error) {
 
 	sw := stopwatch.New()
 	resp = NewSearchResult()
 	key := query.firstKey()
+	s.shard = shard
 	var post []uint32
 	var ix *index.Index
 	var q *index.Query
 
 	// Setup the RE2 expression text based on query options
-	re, pathre, err := buildRegexps(&query)
+	pathre, posre, err := s.compile(&query)
 	if err != nil {
 		goto done
 	}
-	s.Regexp = re
 
 	// Attempt to open the index file
 	if ix, err = index.Open(s.filename); err != nil {
@@ -79,14 +157,28 @@ func (s *grep) search(ctx context.Context, query SearchQuery) (
 
 	// Perform the posting query to get candidate files to grep
 	sw.Start("posting")
-	q = index.RegexpQuery(re.Syntax)
+	if s.query != nil {
+		if q, err = s.query.indexQuery(); err != nil {
+			goto done
+		}
+	} else {
+		q = index.RegexpQuery(s.Regexp.Syntax)
+	}
 	post = ix.PostingQuery(q)
 	// Optionally filter the path names in the posting query results
-	if pathre != nil {
+	if pathre != nil || s.exclude != nil || s.query != nil || s.langs != nil {
 		files := make([]uint32, 0, len(post))
 		for _, id_ := range post {
 			name := ix.Name(id_)
-			if pathre.MatchString(name, true, true) < 0 {
+			lang := s.language(name)
+			if pathre != nil && pathre.MatchString(name, true, true) < 0 {
+				continue
+			} else if s.exclude != nil && s.exclude.MatchString(name, true, true) >= 0 {
+				continue
+			} else if s.langs != nil && !s.langs[*lang] {
+				continue
+			} else if s.query != nil && s.query.eval(
+				queryEnv{repo: s.repo, name: &name, lang: lang}) == tsFalse {
 				continue
 			}
 			files = append(files, id_)
@@ -96,9 +188,7 @@ func (s *grep) search(ctx context.Context, query SearchQuery) (
 	resp.Durations.PostingQuery = sw.Stop("posting")
 
 	// Setup context parameters
-	s.ctxPre = query.Context.Pre
-	s.ctxPost = query.Context.Post
-	s.ctxBoth = query.Context.Both
+	s.searchContext = query.Context
 
 	// Now grep each candidate file to get the final matches
 	for _, id_ := range post {
@@ -110,8 +200,28 @@ func (s *grep) search(ctx context.Context, query SearchQuery) (
 		default:
 		}
 
+		// skip the matches already returned
+		returned := pos.returned(id_)
+		if returned == allLines {
+			continue
+		}
 		name := ix.Name(id_)
-		if n, matches, e := s.readfile(name); n == 0 {
+		if s.changedSinceSnapshot(name) {
+			continue
+		}
+		if s.query != nil {
+			s.found = make([]bool, len(s.query.terms))
+		}
+		n, matches, context, sum, e := s.grepFile(ctx, name)
+		if s.query != nil && s.query.eval(
+			queryEnv{repo: s.repo, name: &name, lang: s.language(name), found: s.found}) != tsTrue {
+			continue
+		}
+		if returned > 0 {
+			n = dropLines(matches, returned)
+			dropLines(context, returned)
+		}
+		if n == 0 {
 			continue
 		} else if e != nil && !os.IsNotExist(e) && !os.IsPermission(e) {
 			err = e
@@ -119,17 +229,52 @@ func (s *grep) search(ctx context.Context, query SearchQuery) (
 			resp.Matches[name] = make(map[string]map[string]string)
 			resp.Matches[name][key] = matches
 			resp.NumMatches += uint64(n)
+			if len(context) > 0 {
+				resp.Context[name] = make(map[string]map[string]string)
+				resp.Context[name][key] = context
+			}
+			if posre != nil {
+				resp.AddFileRepoPositions(name, key, matchPositions(posre, matches))
+			}
+			resp.addFileRepoSource(name, key, FileSource{shard, id_})
+			if sum != "" {
+				resp.addFileRepoSum(name, key, sum)
+			}
 		}
 	}
+	// All matches found in the shard are returned, unless the
+	// results are truncated
+	resp.Progress.Set(key, shard, ShardPosition{Id: lastPostingId})
 
 done:
 	return
 }
 
-func (s *grep) readfile(name string) (int, map[string]string, error) {
+// stamp returns the stamp of the file in the Repo's manifest
+func (s *grep) stamp(name string) (fileStamp, bool) {
+	if !s.stampsRead && s.repo != nil {
+		s.stamps = shardStamps(s.repo, s.shard)
+	}
+	s.stampsRead = true
+	stamp, ok := s.stamps[name]
+	return stamp, ok
+}
+
+// language returns the language of the file, or nil if the query
+// does not need it
+func (s *grep) language(name string) *string {
+	if s.langs == nil && (s.query == nil || !s.query.usesLang) {
+		return nil
+	}
+	stamp, _ := s.stamp(name)
+	lang := fileLanguage(name, stamp)
+	return &lang
+}
+
+func (s *grep) readfile(name string) (int, map[string]string, map[string]string, error) {
 	f, err := s.fs.Open(name)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
 	}
 	defer func() {
 		_ = f.Close()
@@ -137,8 +282,22 @@ func (s *grep) readfile(name string) (int, map[string]string, error) {
 	return s.reader(f, name)
 }
 
+// a line of context, held until we know it is to be reported
+type ctxLine struct {
+	lineno int
+	text   string
+}
+
+// reader greps the reader's content, returning the number of
+// matching lines, the matching lines and the lines of context
+// surrounding the matching lines, both keyed by line number.
+//
+// Context is tracked across reads of the buffer, so context lines
+// on either side of the buffer boundary are reported. Overlapping
+// context windows of nearby matches are merged, and lines which
+// match are never reported as context.
 func (s *grep) reader(r io.Reader, name string) (
-	int, map[string]string, error) {
+	int, map[string]string, map[string]string, error) {
 
 	if s.buf == nil {
 		s.buf = make([]byte, 1<<20)
@@ -152,8 +311,39 @@ func (s *grep) reader(r io.Reader, name string) (
 		beginText = true
 		endText   = false
 		matches   = make(map[string]string)
+		context   = make(map[string]string)
+
+		npre, npost = s.searchContext.Lines()
+		before      []ctxLine // lines preceding the next match
+		after       int       // trailing context lines still to report
 	)
 
+	// skipLines handles a run of lines without matches starting at
+	// line number first, reporting any trailing context owed to the
+	// previous match and retaining leading context for the next.
+	skipLines := func(b []byte, first int) {
+		for _, line := range getNextLines(b, after) {
+			context[strconv.Itoa(first)] = string(line)
+			b = b[len(line):]
+			first++
+			after--
+		}
+		if npre == 0 || len(b) == 0 {
+			return
+		}
+		lines := getPreCtx(b, npre, 0, len(b))
+		if len(lines) >= npre {
+			before = before[:0]
+		}
+		last := first + countLines(b) - 1
+		for n := len(lines) - 1; n >= 0; n-- {
+			before = append(before, ctxLine{last - n, string(lines[n])})
+		}
+		if len(before) > npre {
+			before = before[len(before)-npre:]
+		}
+	}
+
 	for {
 		n, rerr := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
@@ -179,50 +369,29 @@ func (s *grep) reader(r io.Reader, name string) (
 			if lineEnd > end {
 				lineEnd = end
 			}
+			skipLines(buf[chunkStart:lineStart], lineno)
 			lineno += countNL(buf[chunkStart:lineStart])
-			if lineStart != lineEnd {
-				// We had a real match, record it
+			if lineStart != lineEnd && !s.accept(buf[lineStart:lineEnd]) {
+				// Not a match after all, but may be context
+				skipLines(buf[lineStart:lineEnd], lineno)
+			} else if lineStart != lineEnd {
+				// We had a real match, record it and the
+				// leading context before it
+				for _, line := range before {
+					context[strconv.Itoa(line.lineno)] = line.text
+				}
+				before = before[:0]
 				matches[strconv.Itoa(lineno)] = string(buf[lineStart:lineEnd])
 				nmatches++
+				after = npost
 			} else {
 				s.Match = false
 			}
 
-			// Set context bounds; if both pre/post and both are set, pick the biggest
-			npre := s.ctxBoth
-			if s.ctxPre > npre {
-				npre = s.ctxPre
-			}
-			npost := s.ctxBoth
-			if s.ctxPost > npost {
-				npost = s.ctxPost
-			}
-
-			if npre > 0 && s.Match {
-				prectx := getPreCtx(buf, 3, chunkStart, lineStart)
-				if len(prectx) > 0 {
-					ctxline := lineno
-					for _, b := range prectx {
-						ctxline--
-						matches[strconv.Itoa(ctxline)] = string(b)
-					}
-				}
-			}
-
-			if npost > 0 && s.Match {
-				postctx := getPostCtx(buf, 3, m1, end)
-				if len(postctx) > 0 {
-					ctxline := lineno
-					for _, b := range postctx {
-						ctxline++
-						matches[strconv.Itoa(ctxline)] = string(b)
-					}
-				}
-			}
-
 			lineno++
 			chunkStart = lineEnd
 		}
+		skipLines(buf[chunkStart:end], lineno)
 		if rerr == nil {
 			lineno += countNL(buf[chunkStart:end])
 		}
@@ -236,7 +405,69 @@ func (s *grep) reader(r io.Reader, name string) (
 		}
 	}
 
-	return nmatches, matches, err
+	return nmatches, matches, context, err
+}
+
+// matchPositions returns the positions of every match and submatch
+// of re in each of the matching lines, keyed by line number.
+func matchPositions(re *stdregexp.Regexp, matches map[string]string) map[string][]MatchPosition {
+	result := make(map[string][]MatchPosition)
+	names := re.SubexpNames()
+	for lineno, text := range matches {
+		line := []byte(strings.TrimSuffix(text, "\n"))
+		positions := make([]MatchPosition, 0)
+		for _, loc := range re.FindAllSubmatchIndex(line, -1) {
+			for group := 0; group*2 < len(loc); group++ {
+				start, end := loc[group*2], loc[group*2+1]
+				if start < 0 {
+					// optional group did not participate
+					continue
+				}
+				runeStart := utf8.RuneCount(line[:start])
+				positions = append(positions, MatchPosition{
+					Group:     group,
+					Name:      names[group],
+					Start:     start,
+					End:       end,
+					RuneStart: runeStart,
+					RuneEnd:   runeStart + utf8.RuneCount(line[start:end]),
+				})
+			}
+		}
+		if len(positions) > 0 {
+			result[lineno] = positions
+		}
+	}
+	return result
+}
+
+// dropLines removes the lines numbered on or before last, returning
+// the number of lines remaining.
+func dropLines(lines map[string]string, last int) int {
+	for l := range lines {
+		if n, err := strconv.Atoi(l); err == nil && n <= last {
+			delete(lines, l)
+		}
+	}
+	return len(lines)
+}
+
+// accept returns true if the line matched by Regexp is to be
+// reported as a match. For boolean queries, the terms matching the
+// line are recorded.
+func (s *grep) accept(line []byte) bool {
+	line = bytes.TrimSuffix(line, nl)
+	if s.query == nil {
+		return s.filter == nil || s.filter.Match(line)
+	}
+	report := false
+	for n, term := range s.query.terms {
+		if term.re.Match(line) {
+			s.found[n] = true
+			report = report || s.query.report[n]
+		}
+	}
+	return report
 }
 
 // helper function to count the number of newlines in a byte slice
@@ -255,6 +486,16 @@ func countNL(b []byte) int {
 	return n
 }
 
+// countLines counts the lines in b, including any final line
+// without a trailing newline.
+func countLines(b []byte) int {
+	n := countNL(b)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
 // helper function to get the proceeding context
 
 func getPreCtx(b []byte, n, chunkstart, linestart int) [][]byte {
@@ -280,28 +521,18 @@ func getPreCtx(b []byte, n, chunkstart, linestart int) [][]byte {
 	return result
 }
 
-func getPostCtx(b []byte, n, chunkstart, end int) [][]byte {
+// helper function to get up to the first n lines of b
+
+func getNextLines(b []byte, n int) [][]byte {
 	result := make([][]byte, 0)
-	// shortcut for zero lines of context
-	if n == 0 {
-		return result
-	}
-	ctxstart := chunkstart
-	for n >= 0 {
-		if ctxstart >= end {
-			break
-		}
-		newctxstart := bytes.Index(b[chunkstart:end], nl) + 1 + ctxstart
-		if newctxstart > end {
-			newctxstart = end
+	for n > 0 && len(b) > 0 {
+		end := bytes.IndexByte(b, '\n') + 1
+		if end == 0 {
+			end = len(b)
 		}
-		result = append(result, b[ctxstart:newctxstart])
-		ctxstart = newctxstart
+		result = append(result, b[:end])
+		b = b[end:]
 		n--
 	}
-	// Strip the first line, which includes the match
-	if len(result) > 0 {
-		result = result[1:]
-	}
 	return result
 }
@@ -1,6 +1,9 @@
 package afind
 
 import (
+	"reflect"
+	stdregexp "regexp"
+	"strings"
 	"testing"
 )
 
@@ -64,42 +67,141 @@ func TestGetPreCtx(t *testing.T) {
 
 }
 
-func TestGetPostCtx(t *testing.T) {
+func TestGetNextLines(t *testing.T) {
 	var b []byte
 	b = []byte(string("foo\nbar\nbaz"))
-	v := getPostCtx(b, 0, 4, len(b))
+	v := getNextLines(b, 0)
 	if len(v) != 0 {
-		t.Error("want 0 line of post context, got", len(v))
+		t.Error("want 0 lines, got", len(v))
 	}
 
-	b = []byte(string("foo\nbar\nbaz"))
-	v = getPostCtx(b, 1, 4, len(b))
+	v = getNextLines(b, 1)
 	if len(v) != 1 {
-		t.Error("want 1 line of post context, got", len(v))
+		t.Error("want 1 line, got", len(v))
 	}
-	eq(t, "baz", string(v[0]))
+	eq(t, "foo\n", string(v[0]))
 
-	b = []byte(string("foo\nbar\nbaz\nqux\n"))
-	v = getPostCtx(b, 1, 4, len(b))
-	if len(v) != 1 {
-		t.Error("want 1 line of post context, got", len(v))
+	b = []byte(string("foo\nbar\nbaz"))
+	v = getNextLines(b, 1000)
+	if len(v) != 3 {
+		t.Error("want 3 lines, got", len(v))
 	}
-	eq(t, "baz\n", string(v[0]))
+	eq(t, "foo\n", string(v[0]))
+	eq(t, "bar\n", string(v[1]))
+	eq(t, "baz", string(v[2]))
 
-	b = []byte(string("foo\nbar\nbaz\nqux\n"))
-	v = getPostCtx(b, 2, 4, len(b))
+	b = []byte(string("\n\nqux\n"))
+	v = getNextLines(b, 2)
 	if len(v) != 2 {
-		t.Error("want 2 lines of post context, got", len(v))
+		t.Error("want 2 lines, got", len(v))
 	}
-	eq(t, "baz\n", string(v[0]))
-	eq(t, "qux\n", string(v[1]))
+	eq(t, "\n", string(v[0]))
+	eq(t, "\n", string(v[1]))
+}
 
-	b = []byte(string("foo\nbar\nbaz\nqux\n"))
-	v = getPostCtx(b, 1000, 0, len(b))
-	if len(v) != 3 {
-		t.Error("want 3 lines of post context, got", len(v))
+func TestCountLines(t *testing.T) {
+	eq(t, 0, countLines([]byte("")))
+	eq(t, 1, countLines([]byte("foo")))
+	eq(t, 1, countLines([]byte("foo\n")))
+	eq(t, 2, countLines([]byte("foo\nbar")))
+	eq(t, 2, countLines([]byte("\n\n")))
+}
+
+func eqLines(t *testing.T, want, got map[string]string) {
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %#v, got %#v", want, got)
+	}
+}
+
+// testGrep returns a grep for re reporting both lines of context,
+// with pre and post, unless negative, overriding both
+func testGrep(re string, bufsize int, pre, post, both int) *grep {
+	g := newGrep("", "/", nil)
+	g.Regexp = mustCompile("(?m)" + re)
+	g.buf = make([]byte, bufsize)
+	g.searchContext.Both = both
+	if pre >= 0 {
+		g.searchContext.Pre, g.searchContext.PreSet = pre, true
+	}
+	if post >= 0 {
+		g.searchContext.Post, g.searchContext.PostSet = post, true
+	}
+	return g
+}
+
+func TestGrepContext(t *testing.T) {
+	text := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+
+	// A single match, with two lines either side
+	g := testGrep("five", 1<<20, -1, -1, 2)
+	n, matches, context, err := g.reader(strings.NewReader(text), "")
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	eq(t, 1, n)
+	eqLines(t, map[string]string{"5": "five\n"}, matches)
+	eqLines(t, map[string]string{
+		"3": "three\n", "4": "four\n", "6": "six\n", "7": "seven\n"}, context)
+
+	// Explicit leading and trailing context override both
+	g = testGrep("five", 1<<20, 1, 3, 2)
+	_, _, context, _ = g.reader(strings.NewReader(text), "")
+	eqLines(t, map[string]string{
+		"4": "four\n", "6": "six\n", "7": "seven\n", "8": "eight\n"}, context)
+
+	// even when zero
+	g = testGrep("five", 1<<20, 0, -1, 2)
+	_, _, context, _ = g.reader(strings.NewReader(text), "")
+	eqLines(t, map[string]string{"6": "six\n", "7": "seven\n"}, context)
+
+	// Overlapping windows are merged, and matching lines are never
+	// reported as context. The small buffer also forces context to
+	// be found across buffer boundaries.
+	for _, size := range []int{8, 16, 1 << 20} {
+		g = testGrep("(two|four|nine)", size, -1, -1, 2)
+		n, matches, context, _ = g.reader(strings.NewReader(text), "")
+		eq(t, 3, n)
+		eqLines(t, map[string]string{
+			"2": "two\n", "4": "four\n", "9": "nine\n"}, matches)
+		eqLines(t, map[string]string{
+			"1": "one\n", "3": "three\n", "5": "five\n", "6": "six\n",
+			"7": "seven\n", "8": "eight\n", "10": "ten\n"}, context)
+	}
+
+	// No context requested, none returned
+	g = testGrep("ten", 16, -1, -1, 0)
+	n, matches, context, _ = g.reader(strings.NewReader(text), "")
+	eq(t, 1, n)
+	eqLines(t, map[string]string{"10": "ten\n"}, matches)
+	eqLines(t, map[string]string{}, context)
+
+	// Final lines without a newline are reported
+	g = testGrep("two", 16, -1, 2, 0)
+	_, _, context, _ = g.reader(strings.NewReader("one\ntwo\nthree"), "")
+	eqLines(t, map[string]string{"3": "three"}, context)
+}
+
+func TestMatchPositions(t *testing.T) {
+	re := stdregexp.MustCompile(`(?m)(?P<word>f(o+))|(bar)`)
+	pos := matchPositions(re, map[string]string{
+		"1": "foo and bar\n",
+		"2": "héllo fooo\n",
+	})
+	if !reflect.DeepEqual(pos["1"], []MatchPosition{
+		{Group: 0, Start: 0, End: 3, RuneStart: 0, RuneEnd: 3},
+		{Group: 1, Name: "word", Start: 0, End: 3, RuneStart: 0, RuneEnd: 3},
+		{Group: 2, Start: 1, End: 3, RuneStart: 1, RuneEnd: 3},
+		{Group: 0, Start: 8, End: 11, RuneStart: 8, RuneEnd: 11},
+		{Group: 3, Start: 8, End: 11, RuneStart: 8, RuneEnd: 11},
+	}) {
+		t.Errorf("unexpected positions for line 1: %#v", pos["1"])
+	}
+	// byte and rune offsets differ after a multi-byte rune
+	if !reflect.DeepEqual(pos["2"], []MatchPosition{
+		{Group: 0, Start: 7, End: 11, RuneStart: 6, RuneEnd: 10},
+		{Group: 1, Name: "word", Start: 7, End: 11, RuneStart: 6, RuneEnd: 10},
+		{Group: 2, Start: 8, End: 11, RuneStart: 7, RuneEnd: 10},
+	}) {
+		t.Errorf("unexpected positions for line 2: %#v", pos["2"])
 	}
-	eq(t, "bar\n", string(v[0]))
-	eq(t, "baz\n", string(v[1]))
-	eq(t, "qux\n", string(v[2]))
 }
@@ -1,16 +1,22 @@
 package afind
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.net/context"
 	"github.com/andaru/afind/errs"
+	"github.com/andaru/afind/gitfs"
 	"github.com/andaru/afind/utils"
 	"github.com/andaru/afind/walkablefs"
 	"github.com/andaru/codesearch/index"
@@ -25,7 +31,10 @@ type Indexer interface {
 	//
 	// If a Repo with the same Key as the request exists, an error
 	// is returned along with the existing Repo in the response
-	// (to allow backends to cache-fill frontends).
+	// (to allow backends to cache-fill frontends), unless the
+	// request is an update. Updates re-index only the files which
+	// have been added, changed or removed since the Repo was last
+	// indexed, atomically replacing the affected shards.
 	Index(context.Context, IndexQuery) (*IndexResult, error)
 }
 
@@ -36,11 +45,43 @@ type Indexer interface {
 // over a socket. The default value for 'host' is obtained from
 // the request context's config (from RepoMeta["host"])
 type IndexQuery struct {
-	Key   string   `json:"key"`  // The Key for the new Repo
-	Root  string   `json:"root"` // The root path for all Dirs
-	Dirs  []string `json:"dirs"` // Sub directories of Root to index
-	Files []string // Individual files to index. No impl, so not yet JSON tagged
-	Meta  Meta     `json:"meta"` // Metadata set on the Repo
+	Key   string   `json:"key"`   // The Key for the new Repo
+	Root  string   `json:"root"`  // The root path for all Dirs
+	Dirs  []string `json:"dirs"`  // Sub directories of Root to index
+	Files []string `json:"files"` // Individual files of Root to index
+	Meta  Meta     `json:"meta"`  // Metadata set on the Repo
+
+	// The name of a file on the server listing more files of Root
+	// to index, one per line, for lists too large to send
+	FilesFrom string `json:"files_from,omitempty"`
+
+	// If set, Root is a git repository, and the files of this
+	// revision (a branch, tag or commit) are indexed, rather than
+	// the files in Root (see git.go)
+	Ref string `json:"ref,omitempty"`
+
+	// Rules selecting the files indexed, in addition to the
+	// server's exclusions
+	IndexRules
+
+	// If true, also record the symbols defined in the files, for
+	// symbol searches (see symbols.go). Updates keep the symbol
+	// index of a Repo which has one.
+	Symbols bool `json:"symbols,omitempty"`
+
+	// The label of the snapshot taken of the Repo's index, for
+	// Repo keeping snapshots (see snapshot.go). If empty, the
+	// snapshot is labelled by the commit indexed or the time.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// If true, update an existing Repo with the same Key. Only
+	// shards containing added, changed or removed files are
+	// rebuilt. If the Repo does not exist, it is created.
+	Update bool `json:"update"`
+	// For updates, the files and directories of Root changed since
+	// the Repo was last indexed, if known. Only these are scanned
+	// for changes, rather than all of Root.
+	Changed []string `json:"changed,omitempty"`
 
 	// Recursive query: set to have afindd search recursively one hop
 	// JSON payloads cannot set recursion (the HTTP request handler
@@ -57,6 +98,10 @@ type IndexQuery struct {
 type IndexResult struct {
 	Repo  *Repo             `json:"repo"`
 	Error *errs.StructError `json:"error,omitempty"`
+
+	// The number of files and directories skipped by each
+	// exclusion rule
+	Skipped map[string]int `json:"skipped,omitempty"`
 }
 
 const (
@@ -74,8 +119,8 @@ func (ir *IndexResult) SetError(err error) {
 }
 
 // NewIndexQuery creates a new, keyed but otherwise empty IndexQuery.
-// There must be at least one entry in Dirs or Files when the query is
-// sent.
+// There must be at least one entry in Dirs or Files, or a FilesFrom
+// list, when the query is sent.
 func NewIndexQuery(key string) IndexQuery {
 	return IndexQuery{
 		Key:   key,
@@ -90,13 +135,35 @@ func (r *IndexQuery) Normalize() error {
 	// Validate
 	if r.Key == "" {
 		return errs.NewValueError("key", "Value must not be empty")
-	} else if len(r.Dirs) == 0 && len(r.Files) == 0 {
+	} else if len(r.Dirs) == 0 && len(r.Files) == 0 && r.FilesFrom == "" {
 		return errs.NewValueError(
 			"dirs",
 			"Must provide at least one `files` or `dirs` to index")
 	} else if !path.IsAbs(r.Root) {
 		return errs.NewValueError(
 			"root", "Value must be an absolute path name")
+	} else if r.FilesFrom != "" && !path.IsAbs(r.FilesFrom) {
+		return errs.NewValueError(
+			"files_from", "Value must be an absolute path name")
+	} else if err := r.IndexRules.validate(); err != nil {
+		return err
+	} else if r.Ref != "" && gitfs.CheckRefName(r.Ref) != nil {
+		return errs.NewValueError("ref", gitfs.CheckRefName(r.Ref).Error())
+	} else if err := r.Meta.validateRefresh(); err != nil {
+		return errs.NewValueError("meta", err.Error())
+	} else if err := r.Meta.validateSnapshots(); err != nil {
+		return errs.NewValueError("meta", err.Error())
+	} else if r.Snapshot != "" && r.Meta.Snapshots() == 0 {
+		return errs.NewValueError(
+			"snapshot", "The Repo must keep snapshots (set its snapshots metadata)")
+	} else if len(r.Changed) > 0 && !r.Update {
+		return errs.NewValueError("changed", "Only updates may list changed files")
+	}
+	for i, name := range r.Changed {
+		var err error
+		if r.Changed[i], err = relativePath("changed", name); err != nil {
+			return err
+		}
 	}
 	// Confirm all sub directories provided are not absolute, and remove
 	// any duplicate paths to avoid duplicate indexing of files.
@@ -105,6 +172,11 @@ func (r *IndexQuery) Normalize() error {
 		if dir != "/" && path.IsAbs(dir) {
 			return errs.NewValueError(
 				"dirs", "Dirs must not be absolute paths")
+		} else if dir != "/" {
+			var err error
+			if dir, err = relativePath("dirs", dir); err != nil {
+				return err
+			}
 		}
 		// We require a relative path, but FileSystem uses a rooted
 		// path, so '.' needs to be seen as '/'.
@@ -118,9 +190,76 @@ func (r *IndexQuery) Normalize() error {
 		dirs = append(dirs, dir)
 	}
 	r.Dirs = dirs
+	// Likewise for files, which are also removed if within one of
+	// the Dirs, as the files are found when the Dirs are walked.
+	seen = map[string]struct{}{}
+	files := []string{}
+	for _, name := range r.Files {
+		name, err := relativePath("files", name)
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[name]; ok || inDirs(name, r.Dirs) {
+			continue
+		}
+		seen[name] = struct{}{}
+		files = append(files, name)
+	}
+	r.Files = files
 	return nil
 }
 
+// relativePath cleans the path name, returning an error about the
+// field if the path is absolute or refers to a path outside Root.
+func relativePath(field, name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", errs.NewValueError(
+			field, "Paths must not be absolute: "+name)
+	}
+	name = path.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", errs.NewValueError(
+			field, "Paths must not refer outside of root: "+name)
+	}
+	return name, nil
+}
+
+// inDirs returns true if the file name is within one of the
+// normalized dirs.
+func inDirs(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir == "/" || name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Inherit fills any unset Root, Ref, Dirs and Files of the query
+// from an existing Repo, and merges the query Meta over the Repo's
+// metadata. Used to update an existing Repo.
+func (r *IndexQuery) Inherit(repo *Repo) {
+	if r.Root == "" {
+		r.Root = repo.Root
+	}
+	if r.Ref == "" {
+		r.Ref = repo.Ref
+	}
+	if len(r.Dirs) == 0 && len(r.Files) == 0 && r.FilesFrom == "" {
+		r.Dirs = append([]string{}, repo.Dirs...)
+		r.Files = append([]string{}, repo.Files...)
+		r.FilesFrom = repo.FilesFrom
+	}
+	if r.IndexRules.IsEmpty() && repo.Rules != nil {
+		r.IndexRules = *repo.Rules
+	}
+	r.Symbols = r.Symbols || repo.Symbols
+	meta := make(Meta)
+	meta.Update(repo.Meta)
+	meta.Update(r.Meta)
+	r.Meta = meta
+}
+
 // Returns a pointer to a new indexing Result
 func NewIndexResult() *IndexResult {
 	return &IndexResult{}
@@ -130,12 +269,13 @@ func NewIndexResult() *IndexResult {
 
 // indexer carries our private Indexer implementation
 type indexer struct {
-	cfg    *Config
-	shards []index.IndexWriter
-	root   string // normalized root directory
-	repos  KeyValueStorer
-	writer index.IndexWriter
-	names  chan string
+	cfg   *Config
+	root  string // normalized root directory
+	repos KeyValueStorer
+	busy  *keySet // keys of Repo currently being indexed
+	// the Root on disk, if the files are read from it, in which
+	// the files listed must be found
+	localRoot string
 }
 
 // NewIndexer returns a new Indexer implementation given a
@@ -145,10 +285,9 @@ func NewIndexer(
 	repos KeyValueStorer) indexer {
 
 	return indexer{
-		cfg:    cfg,
-		shards: []index.IndexWriter{},
-		repos:  repos,
-		names:  make(chan string),
+		cfg:   cfg,
+		repos: repos,
+		busy:  newKeySet(),
 	}
 }
 
@@ -169,6 +308,12 @@ func getIndexWriter(ctx context.Context, name string) (index.IndexWriter, error)
 	return getLocalIndexWriter(name)
 }
 
+// indexOnDisk returns true unless the context overloads the index
+// writers, in which case no shard or manifest files are on disk.
+func indexOnDisk(ctx context.Context) bool {
+	return ctx.Value("IndexWriterFunc") == nil
+}
+
 func getLocalIndexWriter(name string) (ixw index.IndexWriter, err error) {
 	dirname := path.Dir(name)
 	err = os.MkdirAll(dirname, 0755)
@@ -199,8 +344,104 @@ func getFileSystem(ctx context.Context, root string) walkablefs.WalkableFileSyst
 	return walkablefs.New(vfs.OS(root))
 }
 
+// repoFileSystem returns the file system to read the Repo's files
+// from, and the function to call once done with it. Repo indexed
+// from a git revision are read from the commit indexed, and those
+// whose Root is an archive from the archive.
+func repoFileSystem(ctx context.Context, cfg *Config, repo *Repo) (
+	walkablefs.WalkableFileSystem, func(), error) {
+
+	switch {
+	case repo.Ref != "":
+		return cachedFileSystem(repo.Root+"@"+repo.Meta.GitCommit(),
+			func() (walkablefs.WalkableFileSystem, io.Closer, error) {
+				return gitFileSystem(repo)
+			})
+	case isArchive(repo.Root):
+		return archiveFileSystem(cfg, repo.Root)
+	}
+	return getFileSystem(ctx, repo.Root), func() {}, nil
+}
+
 func shardName(key string, n int) string {
-	return key + "-" + strconv.Itoa(n) + ".afindex"
+	return key + "-" + strconv.Itoa(n) + indexPathSuffix
+}
+
+// shardTempName is the name a shard is written to prior to being
+// swapped into place by swapShard.
+func shardTempName(key string, n int) string {
+	return key + "-" + strconv.Itoa(n) + ".new" + indexPathSuffix
+}
+
+// shardBackupName is the name a shard is kept under while its
+// replacement is swapped into place, until the swap is complete.
+func shardBackupName(key string, n int) string {
+	return key + "-" + strconv.Itoa(n) + ".old" + indexPathSuffix
+}
+
+// swapShard atomically replaces the shard file name with the newly
+// written shard file tmp, so that concurrent searches see either the
+// old or the new shard, and never a partially written one.
+func swapShard(ctx context.Context, tmp, name string) error {
+	if !indexOnDisk(ctx) {
+		return nil
+	}
+	return os.Rename(tmp, name)
+}
+
+// swapShards swaps the newly written shards of the builds into place
+// together. Should any swap fail, the shards already swapped are
+// restored from their backups, so that the shards on disk continue
+// to match the Repo's manifest.
+func swapShards(ctx context.Context, root, key string, builds []*shardBuild) (err error) {
+	if !indexOnDisk(ctx) {
+		return nil
+	}
+	swapped := []*shardBuild{}
+	for _, b := range builds {
+		name := path.Join(root, shardName(key, b.n))
+		backup := path.Join(root, shardBackupName(key, b.n))
+		_ = os.Remove(backup)
+		if err = os.Link(name, backup); err != nil && !os.IsNotExist(err) {
+			break
+		}
+		if err = swapShard(ctx, path.Join(root, shardTempName(key, b.n)), name); err != nil {
+			_ = os.Remove(backup)
+			break
+		}
+		swapped = append(swapped, b)
+	}
+	for _, b := range swapped {
+		name := path.Join(root, shardName(key, b.n))
+		backup := path.Join(root, shardBackupName(key, b.n))
+		if err == nil {
+			_ = os.Remove(backup)
+		} else if rerr := os.Rename(backup, name); os.IsNotExist(rerr) {
+			// there was no shard before
+			_ = os.Remove(name)
+		} else if rerr != nil {
+			log.Warning("index [%v] cannot restore shard %d: %v", key, b.n, rerr)
+		}
+	}
+	return err
+}
+
+// shardBuild is a single index shard being (re)built
+type shardBuild struct {
+	n       int
+	writer  index.IndexWriter
+	pending []string               // files to add, when not shared
+	files   map[string]fileStamp   // files added to the shard
+	skipped map[string]skippedFile // files not added to the shard
+	symbols map[string][]Symbol    // symbols found, if recorded
+}
+
+func newShardBuild(n int) *shardBuild {
+	return &shardBuild{
+		n:       n,
+		files:   make(map[string]fileStamp),
+		skipped: make(map[string]skippedFile),
+	}
 }
 
 // Index executes the indexing request (on this machine, in this
@@ -208,8 +449,8 @@ func shardName(key string, n int) string {
 func (i indexer) Index(ctx context.Context, req IndexQuery) (
 	resp *IndexResult, err error) {
 
-	log.Info("index [%v] root [%v] len_dirs=%v len_files=%v",
-		req.Key, req.Root, len(req.Dirs), len(req.Files))
+	log.Info("index [%v] root [%v] len_dirs=%v len_files=%v update=%v",
+		req.Key, req.Root, len(req.Dirs), len(req.Files), req.Update)
 	start := time.Now()
 	// Setup the response
 	resp = NewIndexResult()
@@ -218,63 +459,203 @@ func (i indexer) Index(ctx context.Context, req IndexQuery) (
 		resp.Error = errs.NewStructError(err)
 		return
 	}
+	// Only one indexing request per Repo may run at any one time
+	if !i.busy.add(req.Key) {
+		err = errs.NewRepoIndexingError(req.Key)
+		log.Info("index [%v] error: %v", req.Key, err)
+		resp.Error = errs.NewStructError(err)
+		return
+	}
+	defer i.busy.remove(req.Key)
 
-	// create index shards
 	var nshards int
 	if nshards = i.cfg.NumShards; nshards == 0 {
 		nshards = 1
 	}
 	nshards = utils.MinInt(nshards, maxShards)
-	i.shards = make([]index.IndexWriter, nshards)
 	i.root = getRoot(i.cfg, &req)
 
-	for n := range i.shards {
-		name := path.Join(i.root, shardName(req.Key, n))
-		ixw, err := getIndexWriter(ctx, name)
-		if err != nil {
-			resp.Error = errs.NewStructError(err)
+	fs := getFileSystem(ctx, req.Root)
+	repo := newRepoFromQuery(&req, i.root)
+	repo.SetMeta(i.cfg.RepoMeta, req.Meta)
+	resp.Repo = repo
+	if req.Ref != "" {
+		// read the files of the revision from the git repository
+		gitrepo, treefs, commit, gerr := openGitRef(req.Root, req.Ref)
+		if gerr != nil {
+			log.Info("index [%v] error: %v", req.Key, gerr)
+			resp.Error = errs.NewStructError(errs.NewValueError("ref", gerr.Error()))
+			return resp, nil
+		}
+		defer func() {
+			_ = gitrepo.Close()
+		}()
+		fs = treefs
+		repo.Meta["git_commit"] = commit.String()
+		log.Info("index [%v] ref [%v] commit %v", req.Key, req.Ref, commit)
+	} else if isArchive(req.Root) {
+		// read the files from within the archive
+		afs, release, aerr := archiveFileSystem(i.cfg, req.Root)
+		if aerr != nil {
+			log.Info("index [%v] error: %v", req.Key, aerr)
+			resp.Error = errs.NewStructError(errs.NewValueError("root", aerr.Error()))
 			return resp, nil
 		}
-		i.shards[n] = ixw
+		defer release()
+		fs = afs
 	}
 
-	fs := getFileSystem(ctx, i.root)
-	repo := newRepoFromQuery(&req, i.root)
-	repo.SetMeta(i.cfg.RepoMeta, req.Meta)
-	resp.Repo = repo
+	if req.FilesFrom != "" {
+		if err = checkFilesFrom(i.cfg, req.FilesFrom); err != nil {
+			log.Info("index [%v] error: %v", req.Key, err)
+			resp.Error = errs.NewStructError(err)
+			return resp, nil
+		}
+	}
+	if req.Ref == "" && !isArchive(req.Root) && ctx.Value("FileSystem") == nil {
+		i.localRoot = req.Root
+	}
 
 	// Add query Files and scan Dirs for files to index
-	names, err := i.scanner(fs, &req)
-	ch := make(chan int, nshards)
-	chnames := make(chan string, 100)
-	go func() {
-		for _, name := range names {
-			chnames <- name
-		}
-		close(chnames)
-	}()
-	reqch := make(chan par.RequestFunc, nshards)
-	for _, shard := range i.shards {
-		reqch <- indexShard(&i, &req, shard, fs, chnames, ch)
+	filter, err := newIndexFilter(i.cfg, req.IndexRules, fs)
+	if err != nil {
+		log.Info("index [%v] error: %v", req.Key, err)
+		resp.Error = errs.NewStructError(err)
+		return resp, nil
+	}
+	var old *manifest
+	var merr error
+	if req.Update && indexOnDisk(ctx) {
+		old, merr = readManifest(i.root, req.Key)
+	}
+	var names []string
+	var stamps map[string]fileStamp
+	if old != nil && len(req.Changed) > 0 && req.FilesFrom == "" {
+		names, stamps, err = i.scanChanged(fs, &req, filter, old)
+	} else {
+		names, stamps, err = i.scanner(fs, &req, filter)
+	}
+	if err != nil {
+		log.Info("index [%v] error: %v", req.Key, err)
+		resp.Error = errs.NewStructError(err)
+		return resp, nil
+	}
+	if len(filter.skipped) > 0 {
+		resp.Skipped = filter.skipped
+		log.Debug("index [%v] skipped %v", req.Key, filter.skipped)
 	}
-	close(reqch)
-	err = par.Requests(reqch).WithConcurrency(nshards).DoWithContext(ctx)
-	close(ch)
 
-	// Await results, each indicating the number of files scanned
-	for num := range ch {
-		repo.NumFiles += num
+	// Work out which shards to build. Updates only rebuild the
+	// shards with added, changed or removed files, if the Repo's
+	// manifest is available and the number of shards is unchanged.
+	mf := newManifest(nshards)
+	var builds []*shardBuild
+	full := true
+	if req.Update && indexOnDisk(ctx) {
+		if merr != nil {
+			log.Info("index [%v] full rebuild, no manifest: %v", req.Key, merr)
+		} else if len(old.Shards) != nshards {
+			log.Info("index [%v] full rebuild, shards changed (%d to %d)",
+				req.Key, len(old.Shards), nshards)
+		} else if old.Symbols != req.Symbols {
+			log.Info("index [%v] full rebuild, symbols changed (%v to %v)",
+				req.Key, old.Symbols, req.Symbols)
+		} else if serr := i.readSymbols(old, req.Key); serr != nil {
+			log.Info("index [%v] full rebuild, no symbols: %v", req.Key, serr)
+		} else {
+			mf, builds, full = old, planUpdate(old, names, stamps), false
+			log.Info("index [%v] update rebuilding %d of %d shards",
+				req.Key, len(builds), nshards)
+		}
+	}
+	if full {
+		builds = make([]*shardBuild, nshards)
+		for n := range builds {
+			builds[n] = newShardBuild(n)
+		}
+	}
+	mf.Symbols = req.Symbols
+	if req.Symbols {
+		for _, b := range builds {
+			b.symbols = make(map[string][]Symbol)
+		}
+	}
+
+	// create index shards
+	for _, b := range builds {
+		name := path.Join(i.root, shardTempName(req.Key, b.n))
+		if b.writer, err = getIndexWriter(ctx, name); err != nil {
+			resp.Error = errs.NewStructError(err)
+			return resp, nil
+		}
+	}
+
+	reqch := make(chan par.RequestFunc, len(builds))
+	cl := newClassifier(i.cfg)
+	if full {
+		// All shards share the one channel of names
+		chnames := make(chan string, 100)
+		go feedNames(ctx, names, chnames)
+		for _, b := range builds {
+			reqch <- indexShard(b, fs, stamps, cl, chnames)
+		}
+	} else {
+		for _, b := range builds {
+			chnames := make(chan string, len(b.pending))
+			go feedNames(ctx, b.pending, chnames)
+			reqch <- indexShard(b, fs, stamps, cl, chnames)
+		}
+	}
+	close(reqch)
+	if len(builds) > 0 {
+		err = par.Requests(reqch).WithConcurrency(len(builds)).DoWithContext(ctx)
+	}
+	if err == nil && ctx.Err() != nil {
+		err = errs.NewTimeoutError("index")
 	}
 
-	repo.NumShards = len(i.shards)
 	// Flush our index shard files
-	for _, shard := range i.shards {
-		shard.Flush()
-		repo.SizeIndex += ByteSize(shard.IndexBytes())
-		repo.SizeData += ByteSize(shard.DataBytes())
-		log.Debug("index flush %v (data) %v (index)",
-			repo.SizeData, repo.SizeIndex)
+	for _, b := range builds {
+		b.writer.Flush()
+		shard := &mf.Shards[b.n]
+		shard.Files = b.files
+		shard.Skipped = b.skipped
+		shard.Symbols = b.symbols
+		shard.SizeIndex = ByteSize(b.writer.IndexBytes())
+		shard.SizeData = ByteSize(b.writer.DataBytes())
+		log.Debug("index flush shard %d %v (data) %v (index)",
+			b.n, shard.SizeData, shard.SizeIndex)
 	}
+	// Swap the new shards into place, then record the manifest. A
+	// manifest which cannot be replaced is removed, as it no longer
+	// describes the shards, and the next update rebuilds them all.
+	if err == nil {
+		err = swapShards(ctx, i.root, req.Key, builds)
+	}
+	if err != nil && indexOnDisk(ctx) {
+		for _, b := range builds {
+			_ = os.Remove(path.Join(i.root, shardTempName(req.Key, b.n)))
+		}
+	}
+	if err == nil && indexOnDisk(ctx) {
+		if merr := writeManifest(i.root, req.Key, mf); merr != nil {
+			log.Warning("index [%v] cannot write manifest: %v", req.Key, merr)
+			_ = os.Remove(manifestName(i.root, req.Key))
+			_ = os.Remove(symbolsName(i.root, req.Key))
+		}
+	}
+
+	repo.NumShards = nshards
+	for _, shard := range mf.Shards {
+		repo.NumFiles += len(shard.Files)
+		repo.SizeIndex += shard.SizeIndex
+		repo.SizeData += shard.SizeData
+		for _, syms := range shard.Symbols {
+			repo.NumSymbols += len(syms)
+		}
+	}
+	repo.SkippedFiles, repo.SkippedSample = skippedSummary(mf.Shards)
+	repo.Languages = languageCounts(mf.Shards)
 	repo.ElapsedIndexing = time.Since(start)
 	repo.TimeUpdated = time.Now().UTC()
 
@@ -288,11 +669,90 @@ func (i indexer) Index(ctx context.Context, req IndexQuery) (
 		msg = "ok " + fmt.Sprintf(
 			"(%v files, %v data, %v index)",
 			repo.NumFiles, repo.SizeData, repo.SizeIndex)
+		if len(repo.SkippedFiles) > 0 {
+			msg += fmt.Sprintf(" skipped %v", repo.SkippedFiles)
+		}
+		if indexOnDisk(ctx) {
+			i.snapshot(repo, &req, full || len(builds) > 0)
+		}
 	}
 	log.Info("index [%v] %v [%v]", req.Key, msg, repo.ElapsedIndexing)
 	return
 }
 
+// readSymbols adds the symbols recorded to the manifest, if it has
+// a symbol index
+func (i *indexer) readSymbols(m *manifest, key string) error {
+	if !m.Symbols {
+		return nil
+	}
+	return m.addSymbols(i.root, key)
+}
+
+// planUpdate compares the manifest against the files presently found
+// in the Repo, returning builds for the shards which must be rebuilt.
+// New files are added to the shards with the fewest files.
+func planUpdate(m *manifest, names []string, stamps map[string]fileStamp) []*shardBuild {
+	dirty := make(map[int]bool)
+	seen := make(map[string]bool)
+	counts := make([]int, len(m.Shards))
+	for n, shard := range m.Shards {
+		counts[n] = len(shard.Files) + len(shard.Skipped)
+		for name, stamp := range shard.Files {
+			seen[name] = true
+			if now, ok := stamps[name]; !ok || now.changed(stamp) {
+				// removed or changed
+				dirty[n] = true
+			}
+		}
+		for name, sf := range shard.Skipped {
+			seen[name] = true
+			if now, ok := stamps[name]; !ok || now.changed(sf.Stamp) {
+				dirty[n] = true
+			}
+		}
+	}
+
+	added := make([][]string, len(m.Shards))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		n := 0
+		for j := range counts {
+			if counts[j] < counts[n] {
+				n = j
+			}
+		}
+		counts[n]++
+		added[n] = append(added[n], name)
+		dirty[n] = true
+	}
+
+	builds := []*shardBuild{}
+	for n, shard := range m.Shards {
+		if !dirty[n] {
+			continue
+		}
+		b := newShardBuild(n)
+		for name := range shard.Files {
+			if _, ok := stamps[name]; ok {
+				b.pending = append(b.pending, name)
+			}
+		}
+		for name := range shard.Skipped {
+			if _, ok := stamps[name]; ok {
+				b.pending = append(b.pending, name)
+			}
+		}
+		sort.Strings(b.pending)
+		b.pending = append(b.pending, added[n]...)
+		builds = append(builds, b)
+	}
+	return builds
+}
+
 var (
 	strPathSeparator = string(os.PathSeparator)
 )
@@ -301,53 +761,245 @@ func trimLeadingSlash(name string) string {
 	return strings.TrimPrefix(name, strPathSeparator)
 }
 
-// The scanner returns files eligible for indexing
-func (i *indexer) scanner(fs walkablefs.WalkableFileSystem, query *IndexQuery) ([]string, error) {
-	var err error
+// The scanner returns files eligible for indexing, along with the
+// stamp of each file used to detect changes in later updates. Files
+// and directories skipped by the filter are not indexed. An error is
+// returned if the query's FilesFrom list cannot be read.
+func (i *indexer) scanner(fs walkablefs.WalkableFileSystem, query *IndexQuery,
+	filter *indexFilter) ([]string, map[string]fileStamp, error) {
 
 	var names []string
+	stamps := make(map[string]fileStamp)
+	add := func(name string, info os.FileInfo) {
+		if _, ok := stamps[name]; !ok {
+			stamps[name] = newFileStamp(info)
+			names = append(names, name)
+		}
+	}
+
+	addFile := func(name string) {
+		// Only add files that we can stat to the list
+		name = trimLeadingSlash(name)
+		if filter.skipFile(name) {
+			return
+		}
+		fi, err := fs.Lstat(name)
+		if err != nil || fi.Mode()&os.ModeType != 0 {
+			return
+		}
+		if i.localRoot != "" && !inRoot(i.localRoot, name) {
+			log.Info("index [%v] skip %v: outside root", query.Key, name)
+			return
+		}
+		add(name, fi)
+	}
 
 	// First, add any specific files in the request
 	for _, name := range query.Files {
-		// Only add files that we can stat to the list
-		if fi, err := fs.Lstat(trimLeadingSlash(name)); err == nil && !fi.IsDir() {
-			names = append(names, name)
+		addFile(name)
+	}
+	if query.FilesFrom != "" {
+		err := readFileList(query.FilesFrom, func(name string) {
+			if !inDirs(name, query.Dirs) {
+				addFile(name)
+			}
+		})
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
 	// For each of the Dirs, walk the contents
-	for _, path := range query.Dirs {
+	for _, dir := range query.Dirs {
+		if i.localRoot != "" && !inRoot(i.localRoot, dir) {
+			log.Info("index [%v] skip %v: outside root", query.Key, dir)
+			continue
+		}
 		walker := func(p string, info os.FileInfo, werr error) error {
 			if werr != nil {
 				return werr
 			} else if info == nil {
 				return nil
-			} else if IndexPathExcludes.MatchFile(p) {
-				// Skip excluded extensions and dirs
+			} else if filter.skip(p, info.IsDir()) {
+				// Skip excluded files and dirs
 				if info.IsDir() {
 					return filepath.SkipDir
 				}
 			} else if !info.IsDir() && info.Mode()&os.ModeType == 0 {
-				names = append(names, trimLeadingSlash(p))
+				add(trimLeadingSlash(p), info)
 			}
 			return nil
 		}
-		err = fs.Walk(path, walker)
+		// Walk from the root of the FileSystem
+		if err := fs.Walk(path.Join("/", dir), walker); err != nil {
+			log.Debug("index walk %v error: %v", dir, err)
+		}
+	}
+	return names, stamps, nil
+}
+
+// scanChanged returns the files eligible for indexing and their
+// stamps, as for scanner, given the manifest of the Repo's files and
+// the names of the query's Changed files and directories. Only
+// those are scanned, the files of the manifest standing for the rest.
+func (i *indexer) scanChanged(fs walkablefs.WalkableFileSystem, query *IndexQuery,
+	filter *indexFilter, m *manifest) ([]string, map[string]fileStamp, error) {
+
+	isChanged := func(name string) bool {
+		for _, c := range query.Changed {
+			if isChangedUnder(name, c) {
+				return true
+			}
+		}
+		return false
+	}
+	// scan the changed files and directories of the query's own, and
+	// the whole of the query's Dirs and Files within those changed
+	sub := *query
+	sub.Files, sub.Dirs = nil, nil
+	for _, name := range query.Changed {
+		if !inDirs(name, query.Dirs) && !containsString(query.Files, name) {
+			for _, dir := range query.Dirs {
+				if isChangedUnder(dir, name) && !containsString(sub.Dirs, dir) {
+					sub.Dirs = append(sub.Dirs, dir)
+				}
+			}
+			for _, file := range query.Files {
+				if _, err := fs.Lstat(file); err == nil &&
+					isChangedUnder(file, name) && !containsString(sub.Files, file) {
+					sub.Files = append(sub.Files, file)
+				}
+			}
+			continue
+		}
+		if fi, err := fs.Lstat(name); err == nil && fi.IsDir() {
+			sub.Dirs = append(sub.Dirs, name)
+		} else if err == nil {
+			sub.Files = append(sub.Files, name)
+		}
+	}
+	names, stamps, err := i.scanner(fs, &sub, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, shard := range m.Shards {
+		for name, stamp := range shard.Files {
+			if _, ok := stamps[name]; !ok && !isChanged(name) {
+				stamps[name] = stamp
+				names = append(names, name)
+			}
+		}
+		for name, sf := range shard.Skipped {
+			if _, ok := stamps[name]; !ok && !isChanged(name) {
+				stamps[name] = sf.Stamp
+				names = append(names, name)
+			}
+		}
+	}
+	return names, stamps, nil
+}
+
+// isChangedUnder returns true if the file name is within the changed
+// path
+func isChangedUnder(name, changed string) bool {
+	return changed == "." || name == changed || strings.HasPrefix(name, changed+"/")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// inRoot returns true if the file name, relative to root, is found
+// within root once any symbolic links in its path are followed.
+func inRoot(root, name string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkFilesFrom returns an error unless the FilesFrom list is in
+// the configured directory, once any symbolic links are followed.
+func checkFilesFrom(cfg *Config, name string) error {
+	if cfg.FilesFromDir == "" {
+		return errs.NewValueError("files_from", "Lists of files are not accepted")
+	}
+	dir, err := filepath.EvalSymlinks(cfg.FilesFromDir)
+	if err == nil {
+		name, err = filepath.EvalSymlinks(name)
+	}
+	if err != nil {
+		return errs.NewValueError("files_from", "Cannot read list of files")
+	}
+	if filepath.Dir(name) != dir {
+		return errs.NewValueError("files_from",
+			"List of files must be in "+cfg.FilesFromDir)
+	}
+	return nil
+}
+
+// readFileList reads the list of files to index, one per line,
+// calling add with each file name. Blank lines are ignored.
+func readFileList(name string, add func(string)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		// the lines are not reported, lest the list be a file
+		// the client cannot otherwise read
+		file, err := relativePath("files_from", text)
+		if err != nil {
+			return errs.NewValueError("files_from", name+":"+strconv.Itoa(line)+
+				": Paths must be relative, and not refer outside of root")
+		}
+		add(file)
+	}
+	return scanner.Err()
+}
+
+// feedNames sends names to the channel until done or the context
+// expires, then closes the channel.
+func feedNames(ctx context.Context, names []string, ch chan string) {
+	defer close(ch)
+	for _, name := range names {
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- name:
+		}
 	}
-	return names, err
 }
 
 func indexShard(
-	i *indexer,
-	q *IndexQuery,
-	writer index.IndexWriter,
+	b *shardBuild,
 	fs walkablefs.WalkableFileSystem,
-	in chan string,
-	out chan int) par.RequestFunc {
+	stamps map[string]fileStamp,
+	cl classifier,
+	in chan string) par.RequestFunc {
 
 	// While there are files to add, add them to the specified shard.
 	return func(ctx context.Context) error {
-		numFiles := 0
 		for name := range in {
 			select {
 			case <-ctx.Done():
@@ -355,18 +1007,105 @@ func indexShard(
 			default:
 			}
 
-			r, err := fs.Open(name)
-			if err == nil {
-				writer.Add(name, r)
+			reason, r := classifyFile(fs, name, stamps[name], cl)
+			if reason != "" {
+				b.skipped[name] = skippedFile{stamps[name], reason}
+				continue
+			}
+			if r != nil {
+				stamp := stamps[name]
+				sum := newContentSum(stamp)
+				head := newHeadWriter(shebangLength)
+				w := io.MultiWriter(sum, head)
+				var content *bytes.Buffer
+				if b.symbols != nil && stamp.Size <= maxSymbolFileSize {
+					content = bytes.NewBuffer(make([]byte, 0, stamp.Size))
+					w = io.MultiWriter(sum, head, content)
+				}
+				b.writer.Add(name, io.TeeReader(r, w))
+				// the index may not read all of the file
+				_, _ = io.Copy(w, r)
 				_ = r.Close()
-				numFiles++
+				stamp.Sum = sum.String()
+				stamp.Lang = detectLanguage(name, head.head)
+				b.files[name] = stamp
+				if content != nil {
+					if syms := extractSymbols(name, stamp.Lang, content.Bytes()); len(syms) > 0 {
+						b.symbols[name] = syms
+					}
+				}
 			}
 		}
-		select {
-		case <-ctx.Done():
-		default:
-			out <- numFiles
-		}
 		return nil
 	}
 }
+
+// classifyFile returns the category of the file if it is not to be
+// indexed, else "" and a reader of the file's contents to index, or
+// nil if the file cannot be read. Files of up to classifyBufferSize
+// bytes are read once, and indexed from memory; larger files are
+// read again to be indexed.
+func classifyFile(fs walkablefs.WalkableFileSystem, name string,
+	stamp fileStamp, cl classifier) (string, io.ReadCloser) {
+
+	if cl.tooLarge(stamp.Size) {
+		return skipTooLarge, nil
+	}
+	r, err := fs.Open(name)
+	if err != nil {
+		return "", nil
+	}
+	var src io.Reader = r
+	var buf *bytes.Buffer
+	if stamp.Size <= classifyBufferSize {
+		buf = bytes.NewBuffer(make([]byte, 0, stamp.Size))
+		src = io.TeeReader(r, buf)
+	}
+	reason, err := cl.classify(name, src)
+	if err != nil {
+		log.Debug("index cannot classify %v: %v", name, err)
+		reason, buf = "", nil
+	}
+	if reason != "" || buf == nil {
+		_ = r.Close()
+		if reason != "" {
+			return reason, nil
+		}
+		if r, err = fs.Open(name); err != nil {
+			return "", nil
+		}
+		return "", r
+	}
+	// classify may stop short of the end of the file
+	return "", struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(buf, r), r}
+}
+
+// keySet is a set of string keys, safe for concurrent use
+type keySet struct {
+	*sync.Mutex
+	keys map[string]struct{}
+}
+
+func newKeySet() *keySet {
+	return &keySet{&sync.Mutex{}, make(map[string]struct{})}
+}
+
+// add adds the key to the set, returning false if already present
+func (ks *keySet) add(key string) bool {
+	ks.Lock()
+	defer ks.Unlock()
+	if _, ok := ks.keys[key]; ok {
+		return false
+	}
+	ks.keys[key] = struct{}{}
+	return true
+}
+
+func (ks *keySet) remove(key string) {
+	ks.Lock()
+	defer ks.Unlock()
+	delete(ks.keys, key)
+}
@@ -1,9 +1,14 @@
 package afind
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
 	"strings"
 	"testing"
 
+	"code.google.com/p/go.net/context"
 	"github.com/andaru/afind/errs"
 	"github.com/andaru/afind/walkablefs"
 	"golang.org/x/tools/godoc/vfs/mapfs"
@@ -166,3 +171,328 @@ func TestIndexerSharding(t *testing.T) {
 		t.Error("want 2 files, got", resp.Repo.NumFiles)
 	}
 }
+
+func TestIndexerUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_update")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.go": "package a\n",
+		"b.go": "package b\n",
+		"c.go": "package c\n",
+	}
+	c := &Config{IndexRoot: dir, NumShards: 2}
+	ix := NewIndexer(c, newDb())
+	query := NewIndexQuery("upd")
+	query.Dirs = []string{"."}
+	query.Root = "/"
+	resp, err := ix.Index(testSearchContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, resp.Repo.NumFiles)
+	eq(t, OK, resp.Repo.State)
+
+	// An update with no changes rebuilds nothing
+	ixpath := path.Join(dir, "upd")
+	m, err := readManifest(ixpath, "upd")
+	if err != nil {
+		t.Fatal("unexpected error reading manifest:", err)
+	}
+	_ = query.Normalize()
+	filter, _ := newIndexFilter(c, query.IndexRules, getMockFs(files))
+	names, stamps, _ := ix.scanner(getMockFs(files), &query, filter)
+	eq(t, 0, len(planUpdate(m, names, stamps)))
+
+	// Remove, change and add a file, then update the Repo
+	delete(files, "a.go")
+	files["b.go"] = "package b // changed\n"
+	files["d.go"] = "package d\n"
+	query.Update = true
+	resp, err = ix.Index(testSearchContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, resp.Repo.NumFiles)
+	eq(t, OK, resp.Repo.State)
+
+	m, err = readManifest(ixpath, "upd")
+	if err != nil {
+		t.Fatal("unexpected error reading manifest:", err)
+	}
+	indexed := map[string]fileStamp{}
+	for _, shard := range m.Shards {
+		for name, stamp := range shard.Files {
+			indexed[name] = stamp
+		}
+	}
+	eq(t, 3, len(indexed))
+	if _, ok := indexed["a.go"]; ok {
+		t.Error("want a.go removed from the index")
+	}
+	eq(t, int64(len(files["b.go"])), indexed["b.go"].Size)
+
+	// Only the final shards remain on disk
+	for n := 0; n < 2; n++ {
+		if _, err := os.Stat(path.Join(ixpath, shardName("upd", n))); err != nil {
+			t.Error("want shard", n, "on disk, got", err)
+		}
+		if _, err := os.Stat(path.Join(ixpath, shardTempName("upd", n))); err == nil {
+			t.Error("want no temporary shard", n, "on disk")
+		}
+	}
+}
+
+func TestIndexerUpdateChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_changed")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.go":     "package a\n",
+		"b.go":     "package b\n",
+		"c/c.go":   "package c\n",
+		"c/d/d.go": "package d\n",
+	}
+	ix := NewIndexer(&Config{IndexRoot: dir, NumShards: 2}, newDb())
+	query := NewIndexQuery("changed")
+	query.Dirs = []string{"."}
+	query.Root = "/"
+	if _, err = ix.Index(testSearchContext(getMockFs(files)), query); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	ixpath := path.Join(dir, "changed")
+	before, _ := readManifest(ixpath, "changed")
+	shardOf := func(m *manifest, name string) int {
+		for n, shard := range m.Shards {
+			if _, ok := shard.Files[name]; ok {
+				return n
+			}
+		}
+		return -1
+	}
+	stat := func(n int) os.FileInfo {
+		fi, _ := os.Stat(path.Join(ixpath, shardName("changed", n)))
+		return fi
+	}
+	other := 1 - shardOf(before, "a.go")
+	untouched := stat(other)
+	var unlisted string
+	for name := range before.Shards[other].Files {
+		unlisted = name
+	}
+
+	// only the changed files are looked at: the change to a file in
+	// the other shard is not seen, and that shard is not rebuilt
+	files["a.go"] = "package a // changed\n"
+	files[unlisted] += "// changed\n"
+	query.Update = true
+	query.Changed = []string{"a.go"}
+	resp, err := ix.Index(testSearchContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 4, resp.Repo.NumFiles)
+	after, _ := readManifest(ixpath, "changed")
+	eq(t, int64(len(files["a.go"])), after.Shards[shardOf(after, "a.go")].Files["a.go"].Size)
+	eq(t, before.Shards[other].Files[unlisted], after.Shards[other].Files[unlisted])
+	eq(t, true, os.SameFile(untouched, stat(other)))
+
+	// a removed directory removes its files
+	delete(files, "c/c.go")
+	delete(files, "c/d/d.go")
+	query.Changed = []string{"c"}
+	if resp, err = ix.Index(testSearchContext(getMockFs(files)), query); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 2, resp.Repo.NumFiles)
+
+	// a changed parent of the Repo's Dirs rescans them whole
+	files["c/d/d.go"] = "package d\n"
+	files["c/d/e.go"] = "package d\n"
+	sub := NewIndexQuery("ancestor")
+	sub.Dirs = []string{"c/d"}
+	sub.Root = "/"
+	if _, err = ix.Index(testSearchContext(getMockFs(files)), sub); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	files["c/d/f.go"] = "package d\n"
+	sub.Update = true
+	sub.Changed = []string{"c"}
+	if resp, err = ix.Index(testSearchContext(getMockFs(files)), sub); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, resp.Repo.NumFiles)
+
+	// changed files are only listed by updates
+	query.Update = false
+	if err = query.Normalize(); err == nil {
+		t.Error("want an error listing changed files without update")
+	}
+}
+
+func TestSwapShardsRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_swap")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	read := func(name string) string {
+		b, _ := ioutil.ReadFile(path.Join(dir, name))
+		return string(b)
+	}
+	_ = ioutil.WriteFile(path.Join(dir, shardName("key", 0)), []byte("old0"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, shardTempName("key", 0)), []byte("new0"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, shardTempName("key", 1)), []byte("new1"), 0644)
+	// shard 2 was never written, so cannot be swapped
+	builds := []*shardBuild{newShardBuild(0), newShardBuild(1), newShardBuild(2)}
+	ctx := context.Background()
+	if err := swapShards(ctx, dir, "key", builds); err == nil {
+		t.Fatal("want error swapping a missing shard")
+	}
+	// the swapped shards are rolled back
+	eq(t, "old0", read(shardName("key", 0)))
+	for n := range builds {
+		if n > 0 {
+			if _, err := os.Stat(path.Join(dir, shardName("key", n))); err == nil {
+				t.Error("want no shard", n, "on disk")
+			}
+		}
+		if _, err := os.Stat(path.Join(dir, shardBackupName("key", n))); err == nil {
+			t.Error("want no backup of shard", n, "on disk")
+		}
+	}
+
+	_ = ioutil.WriteFile(path.Join(dir, shardTempName("key", 0)), []byte("new0"), 0644)
+	if err := swapShards(ctx, dir, "key", builds[:1]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, "new0", read(shardName("key", 0)))
+	if _, err := os.Stat(path.Join(dir, shardBackupName("key", 0))); err == nil {
+		t.Error("want no backup of shard 0 on disk")
+	}
+}
+
+func TestNormalizeFiles(t *testing.T) {
+	q := NewIndexQuery("key")
+	q.Root = "/"
+	q.Dirs = []string{"src/", "./lib"}
+	q.Files = []string{"README", "./README", "src/foo.go", "lib", "doc/../Makefile"}
+	if err := q.Normalize(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sort.Strings(q.Dirs)
+	eq(t, 2, len(q.Dirs))
+	eq(t, "lib", q.Dirs[0])
+	eq(t, "src", q.Dirs[1])
+	eq(t, 2, len(q.Files))
+	eq(t, "README", q.Files[0])
+	eq(t, "Makefile", q.Files[1])
+
+	for _, bad := range []IndexQuery{
+		{Key: "key", Root: "/", Files: []string{"/etc/passwd"}},
+		{Key: "key", Root: "/", Files: []string{"../etc/passwd"}},
+		{Key: "key", Root: "/", Files: []string{"src/../../etc/passwd"}},
+		{Key: "key", Root: "/", Dirs: []string{"src/../.."}},
+		{Key: "key", Root: "/", FilesFrom: "relative/list"},
+	} {
+		if err := bad.Normalize(); err == nil || !errs.IsValueError(err) {
+			t.Errorf("query %#v: want a ValueError, got %v", bad, err)
+		}
+	}
+
+	// A files list alone is enough
+	q = NewIndexQuery("key")
+	q.Root = "/"
+	q.FilesFrom = "/tmp/list"
+	if err := q.Normalize(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestIndexerFilesFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_files")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	list := path.Join(dir, "list")
+	_ = ioutil.WriteFile(list,
+		[]byte("a.go\n\nsub/b.go\r\n./sub/b.go\nmissing.go\ndir/c.go\n"), 0644)
+
+	files := map[string]string{
+		"a.go":     "package a\n",
+		"sub/b.go": "package b\n",
+		"dir/c.go": "package c\n",
+		"dir/d.go": "package d\n",
+		"other.go": "package other\n",
+	}
+	ix := NewIndexer(&Config{FilesFromDir: dir}, newDb())
+	query := NewIndexQuery("list")
+	query.Root = "/"
+	query.Dirs = []string{"dir"}
+	query.FilesFrom = list
+	resp, err := ix.Index(testIndexContext(getMockFs(files)), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, OK, resp.Repo.State)
+	eq(t, 4, resp.Repo.NumFiles)
+	eq(t, list, resp.Repo.FilesFrom)
+
+	// Paths outside of Root in the list fail the request, without
+	// the line being reported
+	if err = ioutil.WriteFile(list, []byte("a.go\n../x\n"), 0644); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	query.Key = "badlist"
+	resp, _ = ix.Index(testIndexContext(getMockFs(files)), query)
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), ":2:") {
+		t.Error("want an error about line 2 of the list, got", resp.Error)
+	} else if strings.Contains(resp.Error.Error(), "../x") {
+		t.Error("want the line not reported, got", resp.Error)
+	}
+
+	// Lists outside of the configured directory are refused
+	for _, c := range []*Config{{}, {FilesFromDir: path.Join(dir, "sub")}} {
+		query.Key = "otherlist"
+		resp, _ = NewIndexer(c, newDb()).Index(testIndexContext(getMockFs(files)), query)
+		if resp.Error == nil || resp.Error.T != "value_error" {
+			t.Error("want a value error, got", resp.Error)
+		}
+	}
+}
+
+func TestIndexerSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_symlinks")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	root := path.Join(dir, "root")
+	_ = os.MkdirAll(path.Join(root, "sub"), 0755)
+	_ = os.MkdirAll(path.Join(dir, "secret"), 0755)
+	_ = ioutil.WriteFile(path.Join(root, "sub", "a.go"), []byte("package a\n"), 0644)
+	_ = ioutil.WriteFile(path.Join(dir, "secret", "key"), []byte("secret\n"), 0644)
+	_ = os.Symlink(path.Join(dir, "secret"), path.Join(root, "link"))
+	_ = os.Symlink(path.Join(dir, "secret", "key"), path.Join(root, "key"))
+
+	eq(t, true, inRoot(root, "sub/a.go"))
+	eq(t, false, inRoot(root, "link/key"))
+
+	ix := NewIndexer(&Config{IndexRoot: path.Join(dir, "ix")}, newDb())
+	query := NewIndexQuery("links")
+	query.Root = root
+	query.Files = []string{"sub/a.go", "link/key", "key"}
+	query.Dirs = []string{"link"}
+	resp, err := ix.Index(context.Background(), query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, OK, resp.Repo.State)
+	eq(t, 1, resp.Repo.NumFiles)
+}
@@ -0,0 +1,330 @@
+package afind
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andaru/afind/errs"
+)
+
+// Language detection.
+//
+// The indexer records the language of each file indexed in the
+// Repo's manifest, and the number of files of each language in the
+// Repo's Languages. The language is found from the file's name
+// (e.g., Makefile or Dockerfile), else its extension, else the
+// interpreter named by a "#!" line at its start. Searches and finds
+// may be limited to files of some languages with the query's
+// Languages, or a boolean query's lang: terms. Files of Repo indexed
+// before languages were recorded are classified by name alone.
+
+const (
+	// the most bytes of a file's first line read for a "#!" line
+	shebangLength = 256
+)
+
+// languages by file extension, in lower case
+var languageExtensions = map[string]string{
+	".go":      "go",
+	".c":       "c",
+	".h":       "c",
+	".cc":      "cpp",
+	".cpp":     "cpp",
+	".cxx":     "cpp",
+	".c++":     "cpp",
+	".hh":      "cpp",
+	".hpp":     "cpp",
+	".hxx":     "cpp",
+	".h++":     "cpp",
+	".m":       "objc",
+	".mm":      "objc",
+	".java":    "java",
+	".kt":      "kotlin",
+	".kts":     "kotlin",
+	".scala":   "scala",
+	".groovy":  "groovy",
+	".gradle":  "groovy",
+	".cs":      "csharp",
+	".fs":      "fsharp",
+	".py":      "python",
+	".pyi":     "python",
+	".pyw":     "python",
+	".rb":      "ruby",
+	".rake":    "ruby",
+	".gemspec": "ruby",
+	".pl":      "perl",
+	".pm":      "perl",
+	".php":     "php",
+	".js":      "javascript",
+	".mjs":     "javascript",
+	".cjs":     "javascript",
+	".jsx":     "javascript",
+	".ts":      "typescript",
+	".tsx":     "typescript",
+	".sh":      "shell",
+	".bash":    "shell",
+	".zsh":     "shell",
+	".ksh":     "shell",
+	".rs":      "rust",
+	".swift":   "swift",
+	".dart":    "dart",
+	".lua":     "lua",
+	".hs":      "haskell",
+	".erl":     "erlang",
+	".hrl":     "erlang",
+	".ex":      "elixir",
+	".exs":     "elixir",
+	".clj":     "clojure",
+	".cljs":    "clojure",
+	".cljc":    "clojure",
+	".el":      "lisp",
+	".lisp":    "lisp",
+	".ml":      "ocaml",
+	".mli":     "ocaml",
+	".r":       "r",
+	".sql":     "sql",
+	".s":       "assembly",
+	".asm":     "assembly",
+	".html":    "html",
+	".htm":     "html",
+	".css":     "css",
+	".scss":    "css",
+	".less":    "css",
+	".xml":     "xml",
+	".json":    "json",
+	".yaml":    "yaml",
+	".yml":     "yaml",
+	".toml":    "toml",
+	".md":      "markdown",
+	".rst":     "rst",
+	".tex":     "tex",
+	".proto":   "protobuf",
+	".thrift":  "thrift",
+	".mk":      "make",
+	".cmake":   "cmake",
+	".bzl":     "bazel",
+	".bazel":   "bazel",
+	".tf":      "terraform",
+	".vim":     "vim",
+	".ps1":     "powershell",
+	".bat":     "batch",
+	".cmd":     "batch",
+}
+
+// languages by file name, for files named by convention
+var languageNames = map[string]string{
+	"Makefile":       "make",
+	"makefile":       "make",
+	"GNUmakefile":    "make",
+	"Dockerfile":     "dockerfile",
+	"Containerfile":  "dockerfile",
+	"CMakeLists.txt": "cmake",
+	"BUILD":          "bazel",
+	"WORKSPACE":      "bazel",
+	"Rakefile":       "ruby",
+	"Gemfile":        "ruby",
+	"Jenkinsfile":    "groovy",
+	"Vagrantfile":    "ruby",
+}
+
+// languages by the interpreter of "#!" lines, without version
+var languageInterpreters = map[string]string{
+	"sh":      "shell",
+	"bash":    "shell",
+	"zsh":     "shell",
+	"ksh":     "shell",
+	"dash":    "shell",
+	"ash":     "shell",
+	"python":  "python",
+	"perl":    "perl",
+	"ruby":    "ruby",
+	"node":    "javascript",
+	"nodejs":  "javascript",
+	"php":     "php",
+	"lua":     "lua",
+	"Rscript": "r",
+	"make":    "make",
+}
+
+// other names for languages in queries
+var languageAliases = map[string]string{
+	"golang":      "go",
+	"c++":         "cpp",
+	"cxx":         "cpp",
+	"objective-c": "objc",
+	"c#":          "csharp",
+	"cs":          "csharp",
+	"f#":          "fsharp",
+	"py":          "python",
+	"rb":          "ruby",
+	"js":          "javascript",
+	"ts":          "typescript",
+	"sh":          "shell",
+	"bash":        "shell",
+	"rs":          "rust",
+	"kt":          "kotlin",
+	"md":          "markdown",
+	"yml":         "yaml",
+	"proto":       "protobuf",
+	"makefile":    "make",
+	"docker":      "dockerfile",
+	"starlark":    "bazel",
+	"hcl":         "terraform",
+}
+
+// the languages detected
+var knownLanguages = func() map[string]bool {
+	known := make(map[string]bool)
+	for _, m := range []map[string]string{
+		languageExtensions, languageNames, languageInterpreters} {
+		for _, lang := range m {
+			known[lang] = true
+		}
+	}
+	return known
+}()
+
+// detectLanguage returns the language of the file from its name and
+// the start of its content, if known, else ""
+func detectLanguage(name string, head []byte) string {
+	base := path.Base(name)
+	if lang, ok := languageNames[base]; ok {
+		return lang
+	} else if strings.HasPrefix(base, "Dockerfile.") || strings.HasSuffix(base, ".dockerfile") {
+		return "dockerfile"
+	}
+	if lang, ok := languageExtensions[strings.ToLower(path.Ext(base))]; ok {
+		return lang
+	}
+	return shebangLanguage(head)
+}
+
+// shebangLanguage returns the language of the interpreter named in
+// the "#!" line at the start of head, if any
+func shebangLanguage(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	fields := strings.Fields(string(head[2:]))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		// #!/usr/bin/env [-S] [NAME=value] interpreter
+		interp = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+				interp = path.Base(f)
+				break
+			}
+		}
+	}
+	// python3, python3.11
+	return languageInterpreters[strings.TrimRight(interp, "0123456789.")]
+}
+
+// fileLanguage returns the language of the indexed file with the
+// stamp, classifying it by name if its language was not recorded
+func fileLanguage(name string, stamp fileStamp) string {
+	if stamp.Lang != "" {
+		return stamp.Lang
+	}
+	return detectLanguage(name, nil)
+}
+
+// languageCounts counts the files indexed of each language
+func languageCounts(shards []manifestShard) map[string]int {
+	counts := make(map[string]int)
+	for _, shard := range shards {
+		for name, stamp := range shard.Files {
+			if lang := fileLanguage(name, stamp); lang != "" {
+				counts[lang]++
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	return counts
+}
+
+// normalizeLanguage returns the name of the language, or false if
+// not a language detected
+func normalizeLanguage(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := languageAliases[name]; ok {
+		name = alias
+	}
+	return name, knownLanguages[name]
+}
+
+// languageSet is the set of languages a query is limited to
+type languageSet map[string]bool
+
+// newLanguageSet returns the set of the languages, or nil if there
+// are none
+func newLanguageSet(names []string) (languageSet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := make(languageSet)
+	for _, name := range names {
+		lang, ok := normalizeLanguage(name)
+		if !ok {
+			return nil, errs.NewValueError("languages",
+				"unknown language "+name+" (known: "+
+					strings.Join(languageList(), ", ")+")")
+		}
+		set[lang] = true
+	}
+	return set, nil
+}
+
+// mayMatchRepo returns false if the Repo is known to have no files of
+// the languages
+func (s languageSet) mayMatchRepo(repo *Repo) bool {
+	if s == nil || repo.Languages == nil {
+		return true
+	}
+	for lang := range s {
+		if repo.Languages[lang] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// languageList returns the languages detected, sorted
+func languageList() []string {
+	list := make([]string, 0, len(knownLanguages))
+	for lang := range knownLanguages {
+		list = append(list, lang)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// headWriter keeps the start of the content written to it
+type headWriter struct {
+	head []byte
+}
+
+func newHeadWriter(n int) *headWriter {
+	return &headWriter{head: make([]byte, 0, n)}
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	if room := cap(w.head) - len(w.head); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.head = append(w.head, b[:room]...)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,142 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		name, head, want string
+	}{
+		{"foo.go", "", "go"},
+		{"src/foo.CPP", "", "cpp"},
+		{"Makefile", "", "make"},
+		{"build/Dockerfile.dev", "", "dockerfile"},
+		{"app.dockerfile", "", "dockerfile"},
+		{"bin/run", "#!/usr/bin/env python3\nprint()\n", "python"},
+		{"bin/run", "#!/usr/bin/env -S LANG=C perl -w\n", "perl"},
+		{"configure", "#!/bin/sh\n", "shell"},
+		{"script.py", "#!/bin/sh\n", "python"},
+		{"bin/run", "#!/usr/bin/unknown\n", ""},
+		{"README", "Read me\n", ""},
+	} {
+		if got := detectLanguage(tc.name, []byte(tc.head)); got != tc.want {
+			t.Errorf("%s: want language %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestNewLanguageSet(t *testing.T) {
+	set, err := newLanguageSet([]string{"Go", "golang", "py"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 2, len(set))
+	eq(t, true, set["go"])
+	eq(t, true, set["python"])
+
+	set, err = newLanguageSet(nil)
+	eq(t, true, set == nil && err == nil)
+
+	if _, err = newLanguageSet([]string{"go", "klingon"}); err == nil {
+		t.Error("want error for unknown language, got none")
+	}
+
+	repo := NewRepo()
+	set, _ = newLanguageSet([]string{"python"})
+	// Repo indexed before languages were counted may match
+	eq(t, true, set.mayMatchRepo(repo))
+	repo.Languages = map[string]int{"go": 2}
+	eq(t, false, set.mayMatchRepo(repo))
+	repo.Languages["python"] = 1
+	eq(t, true, set.mayMatchRepo(repo))
+}
+
+func TestLanguageFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_language")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	for name, content := range map[string]string{
+		"main.go":  "package main // TODO\n",
+		"util.py":  "# TODO: package\n",
+		"bin/tool": "#!/usr/bin/env python\n# TODO\n",
+		"Makefile": "all: # TODO\n",
+	} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+	}
+	ctx := context.WithValue(context.Background(), "FileSystem",
+		walkablefs.New(vfs.OS(src)))
+	c := &Config{IndexRoot: filepath.Join(dir, "ix"), NumShards: 1}
+	repos := newDb()
+	query := NewIndexQuery("lang")
+	query.Root = src
+	query.Dirs = []string{"."}
+	resp, err := NewIndexer(c, repos).Index(ctx, query)
+	if err != nil || resp.Error != nil {
+		t.Fatal("unexpected error:", err, resp.Error)
+	}
+	_ = repos.Set("lang", resp.Repo)
+	eq(t, 1, resp.Repo.Languages["go"])
+	eq(t, 2, resp.Repo.Languages["python"])
+	eq(t, 1, resp.Repo.Languages["make"])
+	eq(t, 3, len(resp.Repo.Languages))
+
+	search := func(q SearchQuery) *SearchResult {
+		sr, err := NewSearcher(c, repos).Search(ctx, q)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		} else if sr.Error != "" {
+			t.Fatal("unexpected error:", sr.Error)
+		}
+		return sr
+	}
+	sq := NewSearchQuery("TODO", "", false, []string{"lang"})
+	eq(t, uint64(4), search(sq).NumMatches)
+	sq.Languages = []string{"py"}
+	sr := search(sq)
+	eq(t, uint64(2), sr.NumMatches)
+	eq(t, "# TODO\n", sr.Matches["bin/tool"]["lang"]["2"])
+	_, ok := sr.Matches["main.go"]
+	eq(t, false, ok)
+
+	// Repo without files of the languages are not searched
+	sq.Languages = []string{"rust"}
+	eq(t, false, sq.MayMatchRepo(resp.Repo))
+
+	sq = NewSearchQuery("", "", false, []string{"lang"})
+	sq.Query = "package lang:golang"
+	sr = search(sq)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "package main // TODO\n", sr.Matches["main.go"]["lang"]["1"])
+	sq.Query = "TODO -lang:python -lang:go"
+	sr = search(sq)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "all: # TODO\n", sr.Matches["Makefile"]["lang"]["1"])
+	sq.Query = "TODO lang:klingon"
+	if err := sq.Normalize(); err == nil {
+		t.Error("want error for unknown language, got none")
+	}
+
+	fq := NewFindQuery()
+	fq.PathRe = "."
+	fq.RepoKeys = []string{"lang"}
+	fq.Languages = []string{"python"}
+	fr, err := NewFinder(c, repos).Find(ctx, fq)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, uint64(2), fr.NumMatches)
+	_, ok = fr.Matches["bin/tool"]
+	eq(t, true, ok)
+}
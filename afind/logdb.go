@@ -0,0 +1,369 @@
+package afind
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The log-structured database.
+//
+// logDb is a KeyValueStorer for servers holding many Repo. Rather
+// than rewriting the whole database on each change, as db does, each
+// Set or Delete appends a single record to the log file and syncs it.
+// The latest record for each key wins when the log is read at
+// startup. A record partially written when the server crashed is
+// discarded; any other unreadable record stops the server starting.
+//
+// The log grows as Repo are updated, so it is compacted (rewritten
+// with one record per live key, then renamed over the log) once it
+// holds more than logDbCompactRatio times as many records as keys.
+// A failed compaction is logged and retried on the next write.
+//
+// Only writes are per-key: every Repo is still held in memory, as
+// for db, and the whole log is read at startup. Memory use and
+// startup time therefore grow with the number of Repo, which suits
+// tens of thousands of Repo but not a database larger than memory.
+
+const (
+	// the current version of the log file format
+	logDbVersion = 1
+
+	// the log is compacted when it holds this many times as many
+	// records as live keys, and at least logDbCompactMin records
+	logDbCompactRatio = 4
+	logDbCompactMin   = 1000
+)
+
+// Database backends selectable by OpenDb
+const (
+	DbBackendJson = "json"
+	DbBackendLog  = "log"
+)
+
+// logHeader is the first line of the log file
+type logHeader struct {
+	Version int `json:"log_version"`
+}
+
+// logRecord is a line of the log file. A record without a Repo
+// deletes the key.
+type logRecord struct {
+	Key  string `json:"key"`
+	Repo *Repo  `json:"repo,omitempty"`
+}
+
+// logDb is a KeyValueStorer backed by an append-only log file,
+// iterated in key order.
+type logDb struct {
+	*sync.RWMutex
+
+	r    map[string]*Repo
+	keys []string // the keys of r, sorted
+
+	name    string   // the log filename
+	file    *os.File // the log, open for appending
+	records int      // the number of records in the log
+}
+
+// NewLogBackedDb returns a database backed by the log file
+// filename, loading any Repo stored in it. An error is returned if
+// the file exists but cannot be read.
+func NewLogBackedDb(filename string) (*logDb, error) {
+	return newLogBackedDb(filename)
+}
+
+func newLogBackedDb(filename string) (*logDb, error) {
+	d := &logDb{
+		RWMutex: &sync.RWMutex{},
+		r:       make(map[string]*Repo),
+		name:    filename,
+	}
+	err := d.read()
+	if os.IsNotExist(err) {
+		log.Warning("Creating new log backing store: %s", filename)
+		err = d.create()
+	} else if err == nil {
+		log.Info("Loaded database (%d repos from %d log records)",
+			len(d.r), d.records)
+		if cerr := d.maybeCompact(); cerr != nil {
+			log.Warning("Cannot compact database %s: %v", filename, cerr)
+		}
+	} else {
+		return nil, fmt.Errorf("cannot read database %s: %v "+
+			"(remove it to start afresh)", filename, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// OpenDb returns a database of the backend type given, backed by
+// filename. If filename is empty, the database is held in memory.
+func OpenDb(backend, filename string) (KeyValueStorer, error) {
+	switch {
+	case filename == "":
+		return newDb(), nil
+	case backend == DbBackendJson || backend == "":
+		return newJsonBackedDb(filename)
+	case backend == DbBackendLog:
+		return newLogBackedDb(filename)
+	}
+	return nil, fmt.Errorf("unknown database backend %q (want %s or %s)",
+		backend, DbBackendJson, DbBackendLog)
+}
+
+// read loads the log, truncating a partially written final record,
+// and opens it for appending.
+func (d *logDb) read() error {
+	file, err := os.OpenFile(d.name, os.O_RDWR, writeMode)
+	if err != nil {
+		return err
+	}
+	good, err := d.load(file)
+	if err == nil {
+		// drop anything after the last complete record
+		err = file.Truncate(good)
+	}
+	if err == nil {
+		_, err = file.Seek(good, os.SEEK_SET)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	d.file = file
+	return nil
+}
+
+// load reads the records of the log, returning the offset of the
+// end of the last complete record.
+func (d *logDb) load(r io.Reader) (good int64, err error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return 0, fmt.Errorf("empty log")
+	} else if err != nil {
+		return 0, fmt.Errorf("incomplete log header")
+	}
+	hdr := logHeader{}
+	if err = json.Unmarshal(line, &hdr); err != nil || hdr.Version == 0 {
+		return 0, fmt.Errorf("invalid log header")
+	} else if hdr.Version > logDbVersion {
+		return 0, fmt.Errorf("log version %d is newer than supported (%d)",
+			hdr.Version, logDbVersion)
+	}
+	good = int64(len(line))
+	for n := 2; ; n++ {
+		line, err = br.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial record was being written at a crash
+			return good, nil
+		} else if err != nil {
+			return good, err
+		}
+		rec := logRecord{}
+		if err = json.Unmarshal(line, &rec); err != nil {
+			if _, perr := br.Peek(1); perr == io.EOF {
+				// the final record was incompletely synced
+				return good, nil
+			}
+			return good, fmt.Errorf("line %d: %v", n, err)
+		}
+		d.apply(rec)
+		d.records++
+		good += int64(len(line))
+	}
+}
+
+// create writes a new, empty log
+func (d *logDb) create() (err error) {
+	if d.file, err = os.OpenFile(d.name, writeOptions, writeMode); err != nil {
+		return err
+	}
+	if err = d.append(logHeader{Version: logDbVersion}); err == nil {
+		syncDir(path.Dir(d.name))
+	}
+	return err
+}
+
+// apply updates the in-memory Repo with the record
+func (d *logDb) apply(rec logRecord) {
+	_, exists := d.r[rec.Key]
+	i := sort.SearchStrings(d.keys, rec.Key)
+	switch {
+	case rec.Repo != nil && !exists:
+		d.keys = append(d.keys, "")
+		copy(d.keys[i+1:], d.keys[i:])
+		d.keys[i] = rec.Key
+		d.r[rec.Key] = rec.Repo
+	case rec.Repo != nil:
+		d.r[rec.Key] = rec.Repo
+	case exists:
+		d.keys = append(d.keys[:i], d.keys[i+1:]...)
+		delete(d.r, rec.Key)
+	}
+}
+
+// append writes the line to the log and syncs it
+func (d *logDb) append(line interface{}) error {
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if _, err = d.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// caller must hold the mutex
+func (d *logDb) write(rec logRecord) error {
+	if d.file == nil {
+		return fmt.Errorf("database %s is closed", d.name)
+	}
+	if err := d.append(rec); err != nil {
+		return err
+	}
+	d.apply(rec)
+	d.records++
+	// the record is durable, so failing to compact is not an error
+	if err := d.maybeCompact(); err != nil {
+		log.Warning("Cannot compact database %s: %v", d.name, err)
+	}
+	return nil
+}
+
+// caller must hold the mutex
+func (d *logDb) maybeCompact() error {
+	if d.records < logDbCompactMin || d.records < logDbCompactRatio*len(d.r) {
+		return nil
+	}
+	return d.compact()
+}
+
+// Compact rewrites the log with a single record for each key
+func (d *logDb) Compact() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.compact()
+}
+
+// caller must hold the mutex
+func (d *logDb) compact() error {
+	tmp := d.name + ".new"
+	file, err := os.OpenFile(tmp, writeOptions, writeMode)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	err = enc.Encode(logHeader{Version: logDbVersion})
+	for _, key := range d.keys {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(logRecord{Key: key, Repo: d.r[key]})
+	}
+	if err == nil {
+		_, err = buf.WriteTo(file)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, d.name)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	syncDir(path.Dir(d.name))
+	log.Info("Compacted database %s (%d records to %d)",
+		d.name, d.records, len(d.keys))
+	_ = d.file.Close()
+	d.file, d.records = file, len(d.keys)
+	return nil
+}
+
+func (d *logDb) close() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.file != nil {
+		err = d.file.Close()
+		d.file = nil
+	}
+	return
+}
+
+func (d *logDb) Size() int {
+	d.RLock()
+	defer d.RUnlock()
+	return len(d.r)
+}
+
+func (d *logDb) Get(key string) interface{} {
+	d.RLock()
+	defer d.RUnlock()
+	if repo, ok := d.r[key]; ok {
+		return repo
+	}
+	return nil
+}
+
+func (d *logDb) Set(key string, value interface{}) error {
+	if value == nil {
+		return d.Delete(key)
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.write(logRecord{Key: key, Repo: value.(*Repo)})
+}
+
+func (d *logDb) Delete(key string) error {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.r[key]; !ok {
+		return nil
+	}
+	return d.write(logRecord{Key: key})
+}
+
+// ForEach calls f for each Repo, in key order
+func (d *logDb) ForEach(f IterFunc) {
+	d.ForEachPrefix("", f)
+}
+
+// ForEachPrefix calls f for each Repo whose key starts with
+// prefix, in key order. f may modify the database.
+func (d *logDb) ForEachPrefix(prefix string, f IterFunc) {
+	d.RLock()
+	i := sort.SearchStrings(d.keys, prefix)
+	d.RUnlock()
+	for {
+		d.RLock()
+		if i >= len(d.keys) || !strings.HasPrefix(d.keys[i], prefix) {
+			d.RUnlock()
+			return
+		}
+		key := d.keys[i]
+		value := d.r[key]
+		d.RUnlock()
+		if !f(key, value) {
+			return
+		}
+		// continue after key, wherever it is now
+		d.RLock()
+		i = sort.Search(len(d.keys), func(n int) bool { return d.keys[n] > key })
+		d.RUnlock()
+	}
+}
@@ -0,0 +1,206 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// forEachDb runs the test against each database backend
+func forEachDb(t *testing.T, test func(*testing.T, KeyValueStorer)) {
+	test(t, newDb())
+
+	dir, err := ioutil.TempDir("", "afind_logdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := newLogBackedDb(path.Join(dir, "repos.log"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer d.close()
+	test(t, d)
+}
+
+func TestForEachPrefix(t *testing.T) {
+	forEachDb(t, func(t *testing.T, d KeyValueStorer) {
+		for _, key := range []string{"b_2", "a_1", "b_1", "c_1", "b"} {
+			d.Set(key, &Repo{Key: key})
+		}
+		keys := []string{}
+		d.ForEachPrefix("b", func(key string, value interface{}) bool {
+			keys = append(keys, key)
+			return true
+		})
+		eq(t, "b b_1 b_2", strings.Join(keys, " "))
+
+		// the database may be changed during iteration
+		keys = []string{}
+		d.ForEachPrefix("", func(key string, value interface{}) bool {
+			keys = append(keys, key)
+			d.Delete(key)
+			return true
+		})
+		eq(t, 5, len(keys))
+		eq(t, 0, d.Size())
+	})
+}
+
+func TestLogDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_logdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "repos.log")
+
+	d, err := newLogBackedDb(fn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, key := range []string{"1", "2", "3"} {
+		if err = d.Set(key, &Repo{Key: key, State: INDEXING}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	_ = d.Set("2", &Repo{Key: "2", State: OK})
+	_ = d.Delete("3")
+	eq(t, 5, d.records)
+	_ = d.close()
+	if err = d.Set("4", &Repo{Key: "4"}); err == nil {
+		t.Error("want error writing a closed database, got none")
+	}
+
+	// The latest record of each key is loaded, ignoring a record
+	// partially written at a crash
+	f, _ := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"key": "5", "repo": {"ke`)
+	_ = f.Close()
+	if d, err = newLogBackedDb(fn); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 2, d.Size())
+	eq(t, OK, d.Get("2").(*Repo).State)
+	eq(t, nil, d.Get("3"))
+	eq(t, nil, d.Get("5"))
+	_ = d.Set("6", &Repo{Key: "6"})
+	_ = d.close()
+	if d, err = newLogBackedDb(fn); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, d.Size())
+
+	// Compaction leaves one record per key
+	if err = d.Compact(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, d.records)
+	_ = d.Set("7", &Repo{Key: "7"})
+	_ = d.close()
+	b, _ := ioutil.ReadFile(fn)
+	eq(t, 5, strings.Count(string(b), "\n"))
+	if d, err = newLogBackedDb(fn); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 4, d.Size())
+	_ = d.close()
+
+	// Logs which cannot be read are refused, and left alone
+	for _, text := range []string{
+		"",
+		`{"log_version": 99}` + "\n",
+		`{"log_version": 1}` + "\n" + `{"key": "1", "re` + "\n" + `{"key": "2"}` + "\n",
+	} {
+		if err = ioutil.WriteFile(fn, []byte(text), 0644); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err = newLogBackedDb(fn); err == nil {
+			t.Errorf("log %q: want error, got none", text)
+		}
+		b, _ = ioutil.ReadFile(fn)
+		eq(t, text, string(b))
+	}
+}
+
+func TestLogDbCompactsAutomatically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_logdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := newLogBackedDb(path.Join(dir, "repos.log"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer d.close()
+	for n := 0; n < logDbCompactMin; n++ {
+		_ = d.Set("key", &Repo{Key: "key", NumFiles: n})
+	}
+	if d.records >= logDbCompactMin {
+		t.Error("want log compacted, got", d.records, "records")
+	}
+	eq(t, logDbCompactMin-1, d.Get("key").(*Repo).NumFiles)
+}
+
+func TestOpenDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_logdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	if d, err := OpenDb(DbBackendLog, ""); err != nil {
+		t.Error("unexpected error:", err)
+	} else if _, ok := d.(*db); !ok {
+		t.Error("want in-memory database without a file")
+	}
+	if d, err := OpenDb(DbBackendLog, path.Join(dir, "repos.log")); err != nil {
+		t.Error("unexpected error:", err)
+	} else if _, ok := d.(*logDb); !ok {
+		t.Error("want log database")
+	}
+	if d, err := OpenDb("", path.Join(dir, "repos.json")); err != nil {
+		t.Error("unexpected error:", err)
+	} else if _, ok := d.(*db); !ok {
+		t.Error("want JSON database")
+	}
+	if _, err := OpenDb("btree", path.Join(dir, "repos")); err == nil {
+		t.Error("want error for unknown backend, got none")
+	}
+}
+
+func TestLogDbCompactFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_logdb")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "repos.log")
+	d, err := newLogBackedDb(fn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer d.close()
+	// the compacted log cannot be created in place of a directory
+	if err = os.Mkdir(fn+".new", 0755); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	d.records = logDbCompactMin
+	if err = d.Set("key", &Repo{Key: "key"}); err != nil {
+		t.Error("want no error from Set, got", err)
+	}
+	if d.records <= logDbCompactMin {
+		t.Error("want log not compacted, got", d.records, "records")
+	}
+
+	d2, err := newLogBackedDb(fn)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer d2.close()
+	if d2.Get("key") == nil {
+		t.Error("want key stored, got none")
+	}
+}
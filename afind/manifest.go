@@ -0,0 +1,221 @@
+package afind
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andaru/afind/gitfs"
+)
+
+// A manifest records which files were indexed into each shard of a
+// Repo, and the size and modification time of each file when it was
+// indexed. The manifest is written next to the Repo's shards, and is
+// used to update a Repo incrementally, rebuilding only the shards
+// whose files have been added, changed or removed. The symbols
+// defined in the files, which only symbol searches and updates need,
+// are kept apart in the Repo's symbols file, so that searches
+// reading the manifest do not read them too.
+type manifest struct {
+	Version int             `json:"version"`
+	Shards  []manifestShard `json:"shards"`
+
+	// If true, the symbols defined in the files were recorded
+	Symbols bool `json:"symbols,omitempty"`
+}
+
+// manifestShard describes the contents of a single index shard
+type manifestShard struct {
+	Files     map[string]fileStamp `json:"files"`
+	SizeIndex ByteSize             `json:"size_index"`
+	SizeData  ByteSize             `json:"size_data"`
+
+	// Files assigned to the shard but not indexed
+	Skipped map[string]skippedFile `json:"skipped,omitempty"`
+
+	// The symbols defined in the files (see symbols.go), if the
+	// Repo has a symbol index. Written to the symbols file.
+	Symbols map[string][]Symbol `json:"-"`
+}
+
+// symbolsFile is the content of a Repo's symbols file, with the
+// symbols of each shard's files
+type symbolsFile struct {
+	Version int                   `json:"version"`
+	Shards  []map[string][]Symbol `json:"shards"`
+}
+
+// skippedFile records why a file was not indexed
+type skippedFile struct {
+	Stamp  fileStamp `json:"stamp"`
+	Reason string    `json:"reason"`
+}
+
+// fileStamp is used to detect changes in indexed files
+type fileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+
+	// For files read from git, the blob id. As all files of a
+	// commit have the commit's time, changes are found by id.
+	Hash string `json:"hash,omitempty"`
+
+	// The sum of the file's content when indexed (see dedup.go),
+	// equal for files with identical contents. Only set for files
+	// indexed.
+	Sum string `json:"sum,omitempty"`
+
+	// The language of the file (see language.go), if known. Only
+	// set for files indexed.
+	Lang string `json:"lang,omitempty"`
+}
+
+const (
+	manifestVersion = 1
+	manifestSuffix  = ".afmanifest"
+	symbolsSuffix   = ".afsymbols"
+)
+
+var (
+	errManifestVersion = errors.New("unsupported manifest version")
+	errSymbolsShards   = errors.New("symbols file shards differ from the manifest")
+)
+
+func newManifest(nshards int) *manifest {
+	m := &manifest{Version: manifestVersion, Shards: make([]manifestShard, nshards)}
+	for n := range m.Shards {
+		m.Shards[n].Files = make(map[string]fileStamp)
+	}
+	return m
+}
+
+func newFileStamp(fi os.FileInfo) fileStamp {
+	stamp := fileStamp{Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+	if id, ok := fi.Sys().(gitfs.ID); ok {
+		stamp.Hash = id.String()
+	}
+	return stamp
+}
+
+// changed returns true if the file appears to have changed since
+// the stamp was taken.
+func (s fileStamp) changed(other fileStamp) bool {
+	if s.Hash != "" || other.Hash != "" {
+		return s.Hash != other.Hash
+	}
+	return s.Size != other.Size || !s.ModTime.Equal(other.ModTime)
+}
+
+func manifestName(ixpath, key string) string {
+	return path.Join(ixpath, key+manifestSuffix)
+}
+
+// readManifest reads the manifest for the Repo key in ixpath.
+func readManifest(ixpath, key string) (*manifest, error) {
+	f, err := os.Open(manifestName(ixpath, key))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	m := &manifest{}
+	if err = json.NewDecoder(f).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Version != manifestVersion {
+		return nil, errManifestVersion
+	}
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest for the Repo key,
+// and its symbols file. The symbols file is written first, so the
+// manifest never refers to symbols which were not recorded.
+func writeManifest(ixpath, key string, m *manifest) error {
+	if !m.Symbols {
+		if err := os.Remove(symbolsName(ixpath, key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		s := &symbolsFile{Version: manifestVersion,
+			Shards: make([]map[string][]Symbol, len(m.Shards))}
+		for n, shard := range m.Shards {
+			s.Shards[n] = shard.Symbols
+		}
+		if err := writeJSONFile(symbolsName(ixpath, key),
+			symbolsName(ixpath, key+".new"), s); err != nil {
+			return err
+		}
+	}
+	return writeJSONFile(manifestName(ixpath, key),
+		manifestName(ixpath, key+".new"), m)
+}
+
+func symbolsName(ixpath, key string) string {
+	return path.Join(ixpath, key+symbolsSuffix)
+}
+
+// readSymbols reads the symbols file for the Repo key in ixpath,
+// returning a manifest with only the shards' symbols.
+func readSymbols(ixpath, key string) (*manifest, error) {
+	f, err := os.Open(symbolsName(ixpath, key))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	s := &symbolsFile{}
+	if err = json.NewDecoder(f).Decode(s); err != nil {
+		return nil, err
+	}
+	if s.Version != manifestVersion {
+		return nil, errManifestVersion
+	}
+	m := &manifest{Version: s.Version, Symbols: true,
+		Shards: make([]manifestShard, len(s.Shards))}
+	for n, syms := range s.Shards {
+		m.Shards[n].Symbols = syms
+	}
+	return m, nil
+}
+
+// addSymbols reads the symbols of the manifest's shards from the
+// Repo's symbols file
+func (m *manifest) addSymbols(ixpath, key string) error {
+	s, err := readSymbols(ixpath, key)
+	if err != nil {
+		return err
+	}
+	if len(s.Shards) != len(m.Shards) {
+		return errSymbolsShards
+	}
+	for n := range m.Shards {
+		m.Shards[n].Symbols = s.Shards[n].Symbols
+	}
+	return nil
+}
+
+// writeJSONFile atomically replaces the file name with the JSON
+// encoding of v, written first to tmp.
+func writeJSONFile(name, tmp string, v interface{}) error {
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(v)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
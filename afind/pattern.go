@@ -0,0 +1,91 @@
+package afind
+
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"github.com/andaru/afind/errs"
+	"github.com/andaru/codesearch/regexp"
+)
+
+// Search and find pattern options.
+//
+// Patterns are regular expressions unless the query asks for a
+// literal (fixed string) match. Whole word matching surrounds the
+// pattern with word boundaries, and smart case matching ignores
+// case unless the pattern contains an uppercase letter.
+//
+// Files whose names match any of a query's exclusion patterns are
+// neither searched nor found.
+
+// buildPattern returns the regular expression for the pattern with
+// the options applied.
+func buildPattern(pattern string, literal, word, ignoreCase, smartCase bool) string {
+	insensitive := ignoreCase || (smartCase && !hasUpper(pattern, literal))
+	if literal {
+		pattern = stdregexp.QuoteMeta(pattern)
+	}
+	if word {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if insensitive {
+		pattern = "(?i)" + pattern
+	}
+	return pattern
+}
+
+// excludeRegexp returns the regular expression matching the file
+// names excluded by any of the patterns, or nil if there are none.
+func excludeRegexp(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	subs := make([]string, len(patterns))
+	for n, pattern := range patterns {
+		if pattern == "" {
+			return nil, errs.NewValueError("exclude_path_re", "must not be empty")
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, errs.NewValueError("exclude_path_re", pattern+": "+err.Error())
+		}
+		subs[n] = "(?:" + pattern + ")"
+	}
+	return regexp.Compile(strings.Join(subs, "|"))
+}
+
+// hasUpper returns true if the pattern matches any uppercase letter
+// literally. Escapes such as \S and \W do not count.
+func hasUpper(pattern string, literal bool) bool {
+	if literal {
+		return hasUpperRunes([]rune(pattern))
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		// the pattern will fail to compile anyway
+		return hasUpperRunes([]rune(pattern))
+	}
+	return hasUpperLiteral(re)
+}
+
+func hasUpperLiteral(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpLiteral && hasUpperRunes(re.Rune) {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasUpperLiteral(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasUpperRunes(runes []rune) bool {
+	for _, r := range runes {
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
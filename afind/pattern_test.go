@@ -0,0 +1,127 @@
+package afind
+
+import (
+	"testing"
+)
+
+func TestBuildPattern(t *testing.T) {
+	eq(t, `foo.bar(`, buildPattern(`foo.bar(`, false, false, false, false))
+	eq(t, `foo\.bar\(`, buildPattern(`foo.bar(`, true, false, false, false))
+	eq(t, `\b(?:foo)\b`, buildPattern(`foo`, false, true, false, false))
+	eq(t, `(?i)\b(?:foo\.bar)\b`, buildPattern(`foo.bar`, true, true, true, false))
+	eq(t, `(?i)foo`, buildPattern(`foo`, false, false, false, true))
+	eq(t, `Foo`, buildPattern(`Foo`, false, false, false, true))
+	// ignore case wins over smart case
+	eq(t, `(?i)Foo`, buildPattern(`Foo`, false, false, true, true))
+}
+
+func TestHasUpper(t *testing.T) {
+	eq(t, false, hasUpper(`foo`, false))
+	eq(t, true, hasUpper(`fOo`, false))
+	eq(t, false, hasUpper(`foo\S+\W`, false))
+	eq(t, true, hasUpper(`foo\S+\WX`, false))
+	eq(t, true, hasUpper(`\S`, true))
+	eq(t, true, hasUpper(`Ünïcode`, false))
+}
+
+func TestSearchPatternOptions(t *testing.T) {
+	files := map[string]string{
+		"call.c":  "x = foo.bar(1);\n",
+		"other.c": "foo_bar(2);\nfooXbar(3);\n",
+		"word.c":  "food\nFOO\nfoo\n",
+	}
+	test := searchSetupIndex(files, t)
+	test.sr = NewSearcher(test.config, test.db)
+	search := func(q SearchQuery) *SearchResult {
+		sr, err := test.sr.Search(test.ctx, q)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return sr
+	}
+
+	query := NewSearchQuery("foo.bar(", "", false, []string{kixKey1})
+	query.Literal = true
+	sr := search(query)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "x = foo.bar(1);\n", sr.Matches["call.c"][kixKey1]["1"])
+
+	query = NewSearchQuery("foo", "", false, []string{kixKey1})
+	query.Word = true
+	query.Context.Both = 1
+	sr = search(query)
+	eq(t, uint64(2), sr.NumMatches)
+	eq(t, "foo\n", sr.Matches["word.c"][kixKey1]["3"])
+	// lines only matching without word boundaries can be context
+	eq(t, "FOO\n", sr.Context["word.c"][kixKey1]["2"])
+
+	query = NewSearchQuery("foo", "", false, []string{kixKey1})
+	query.Word = true
+	query.SmartCase = true
+	sr = search(query)
+	eq(t, uint64(3), sr.NumMatches)
+
+	query = NewSearchQuery("FOO", "", false, []string{kixKey1})
+	query.SmartCase = true
+	sr = search(query)
+	eq(t, uint64(1), sr.NumMatches)
+}
+
+func TestExcludeRegexp(t *testing.T) {
+	re, err := excludeRegexp(nil)
+	if re != nil || err != nil {
+		t.Errorf("want nil regexp and error, got %v, %v", re, err)
+	}
+	if _, err = excludeRegexp([]string{`_test\.go$`, ""}); err == nil {
+		t.Error("want error for empty pattern, got none")
+	}
+	if _, err = excludeRegexp([]string{`foo[`}); err == nil {
+		t.Error("want error for invalid pattern, got none")
+	}
+	re, err = excludeRegexp([]string{`_test\.go$`, `^vendor/`})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, true, re.MatchString("foo/foo_test.go", true, true) >= 0)
+	eq(t, true, re.MatchString("vendor/foo.go", true, true) >= 0)
+	eq(t, false, re.MatchString("foo/vendor/foo.go", true, true) >= 0)
+}
+
+func TestExcludePaths(t *testing.T) {
+	files := map[string]string{
+		"foo.go":         "foo\n",
+		"foo_test.go":    "foo\n",
+		"vendor/foo.go":  "foo\n",
+		"foo/vendor.txt": "foo\n",
+	}
+	test := searchSetupIndex(files, t)
+	test.sr = NewSearcher(test.config, test.db)
+	exclude := []string{`_test\.go$`, `^vendor/`}
+
+	query := NewSearchQuery("foo", "", false, []string{kixKey1})
+	query.ExcludePathRe = exclude
+	sr, err := test.sr.Search(test.ctx, query)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, uint64(2), sr.NumMatches)
+	eq(t, "foo\n", sr.Matches["foo.go"][kixKey1]["1"])
+	eq(t, "foo\n", sr.Matches["foo/vendor.txt"][kixKey1]["1"])
+
+	fq := NewFindQuery()
+	fq.PathRe = "foo"
+	fq.ExcludePathRe = exclude
+	fq.RepoKeys = []string{kixKey1}
+	fr, err := NewFinder(test.config, test.db).Find(test.ctx, fq)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, uint64(2), fr.NumMatches)
+	_, ok := fr.Matches["foo/vendor.txt"]
+	eq(t, true, ok)
+
+	query.ExcludePathRe = []string{""}
+	if err = query.Normalize(); err == nil {
+		t.Error("want error for empty exclusion, got none")
+	}
+}
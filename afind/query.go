@@ -0,0 +1,547 @@
+package afind
+
+import (
+	stdregexp "regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"github.com/andaru/afind/errs"
+	"github.com/andaru/codesearch/index"
+)
+
+// Boolean search queries.
+//
+// A SearchQuery's Query combines regular expression terms with AND,
+// OR and NOT, to find files containing some terms but not others:
+//
+//	foo bar            files containing both foo and bar
+//	foo OR bar         files containing either foo or bar
+//	foo -bar           files containing foo but not bar
+//	(foo OR bar) baz   terms may be grouped with parentheses
+//
+// Terms separated only by space are combined with AND, and NOT may
+// be written instead of a leading '-'. Terms may be qualified to
+// match against the file name, Repo key or Repo metadata rather
+// than the file content:
+//
+//	file:\.go$         file names matching the regexp
+//	-file:_test\.go$   file names not matching the regexp
+//	repo:^mainline     Repo keys matching the regexp
+//	meta:project=main  Repo with metadata project matching "main"
+//	lang:go            files of the language (see language.go)
+//
+// Quote terms containing spaces, or starting with '-', with double
+// quotes. The lines reported are those matching any of the content
+// terms not negated, so a query must include at least one.
+
+type queryOp int
+
+const (
+	queryTerm queryOp = iota
+	queryAnd
+	queryOr
+	queryNot
+)
+
+// term fields
+const (
+	fieldContent = ""
+	fieldFile    = "file"
+	fieldRepo    = "repo"
+	fieldMeta    = "meta"
+	fieldLang    = "lang"
+)
+
+// queryNode is a node in the parsed query tree
+type queryNode struct {
+	op  queryOp
+	sub []*queryNode
+
+	// term attributes
+	field   string
+	value   string
+	metaKey string
+	re      *stdregexp.Regexp
+	// for content terms, the index of the term in boolQuery.terms
+	term int
+}
+
+// boolQuery is a parsed and compiled boolean query
+type boolQuery struct {
+	root *queryNode
+	// the content terms, and whether lines matching each are
+	// reported (i.e., the term is not negated)
+	terms  []*queryNode
+	report []bool
+	// the content term patterns without word boundaries
+	patterns []string
+	// true if the query has lang: terms
+	usesLang bool
+}
+
+// tristate is the result of evaluating a query without all of the
+// information needed, such as the file content
+type tristate int
+
+const (
+	tsFalse tristate = iota
+	tsTrue
+	tsUnknown
+)
+
+func tsNot(v tristate) tristate {
+	switch v {
+	case tsTrue:
+		return tsFalse
+	case tsFalse:
+		return tsTrue
+	}
+	return tsUnknown
+}
+
+// queryEnv holds what is known when evaluating a query. The Repo,
+// file name, file language and content terms found are unknown if
+// nil.
+type queryEnv struct {
+	repo  *Repo
+	name  *string
+	lang  *string
+	found []bool
+}
+
+func newQueryError(msg string) error {
+	return errs.NewValueError("query", msg)
+}
+
+// parseQuery parses and compiles the boolean query, applying the
+// pattern options to each term.
+func parseQuery(query string, literal, word, ignoreCase, smartCase bool) (
+	*boolQuery, error) {
+
+	p := &queryParser{tokens: tokenizeQuery(query)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, newQueryError("unexpected " + p.tokens[p.pos].text)
+	}
+	if root == nil {
+		return nil, newQueryError("must not be empty")
+	}
+	q := &boolQuery{root: root}
+	if err = q.compile(root, false, literal, word, ignoreCase, smartCase); err != nil {
+		return nil, err
+	}
+	reported := false
+	for _, r := range q.report {
+		reported = reported || r
+	}
+	if !reported {
+		return nil, newQueryError("must include a content term that is not negated")
+	}
+	return q, nil
+}
+
+func (q *boolQuery) compile(n *queryNode, negated bool,
+	literal, word, ignoreCase, smartCase bool) (err error) {
+
+	switch n.op {
+	case queryNot:
+		return q.compile(n.sub[0], !negated, literal, word, ignoreCase, smartCase)
+	case queryAnd, queryOr:
+		for _, sub := range n.sub {
+			if err = q.compile(sub, negated, literal, word, ignoreCase, smartCase); err != nil {
+				return
+			}
+		}
+		return
+	}
+	switch n.field {
+	case fieldContent:
+		n.term = len(q.terms)
+		q.terms = append(q.terms, n)
+		q.report = append(q.report, !negated)
+		q.patterns = append(q.patterns,
+			buildPattern(n.value, literal, false, ignoreCase, smartCase))
+		n.re, err = stdregexp.Compile("(?m)" +
+			buildPattern(n.value, literal, word, ignoreCase, smartCase))
+	case fieldMeta:
+		kv := strings.SplitN(n.value, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return newQueryError("meta: terms must be of the form meta:key=value")
+		}
+		n.metaKey = kv[0]
+		n.re, err = stdregexp.Compile(kv[1])
+	case fieldLang:
+		lang, ok := normalizeLanguage(n.value)
+		if !ok {
+			return newQueryError("unknown language " + n.value)
+		}
+		n.value, q.usesLang = lang, true
+	default:
+		n.re, err = stdregexp.Compile(n.value)
+	}
+	if err != nil {
+		err = newQueryError(n.field + ":" + n.value + ": " + err.Error())
+	}
+	return
+}
+
+// pattern returns the regular expression matching lines which match
+// any of the content terms, without word boundaries.
+func (q *boolQuery) pattern() string {
+	subs := make([]string, len(q.patterns))
+	for n, p := range q.patterns {
+		subs[n] = "(?:" + p + ")"
+	}
+	return "(?m)" + strings.Join(subs, "|")
+}
+
+// reportPattern returns the regular expression matching the parts
+// of lines reported as matches.
+func (q *boolQuery) reportPattern() string {
+	subs := []string{}
+	for n, t := range q.terms {
+		if q.report[n] {
+			subs = append(subs, "(?:"+t.re.String()+")")
+		}
+	}
+	return strings.Join(subs, "|")
+}
+
+// indexQuery returns the trigram index query which narrows the
+// files searched to those which may match the query.
+func (q *boolQuery) indexQuery() (*index.Query, error) {
+	return q.nodeIndexQuery(q.root)
+}
+
+func (q *boolQuery) nodeIndexQuery(n *queryNode) (*index.Query, error) {
+	switch n.op {
+	case queryAnd, queryOr:
+		op := index.QAnd
+		if n.op == queryOr {
+			op = index.QOr
+		}
+		iq := &index.Query{Op: op}
+		for _, sub := range n.sub {
+			siq, err := q.nodeIndexQuery(sub)
+			if err != nil {
+				return nil, err
+			}
+			iq.Sub = append(iq.Sub, siq)
+		}
+		return iq, nil
+	case queryTerm:
+		if n.field == fieldContent {
+			re, err := syntax.Parse(q.patterns[n.term], syntax.Perl)
+			if err != nil {
+				return nil, newQueryError(err.Error())
+			}
+			return index.RegexpQuery(re), nil
+		}
+	}
+	// Files not containing a term, and qualifiers, cannot be
+	// found using the index
+	return &index.Query{Op: index.QAll}, nil
+}
+
+// eval evaluates the query with what is known in env
+func (q *boolQuery) eval(env queryEnv) tristate {
+	return q.evalNode(q.root, env)
+}
+
+func (q *boolQuery) evalNode(n *queryNode, env queryEnv) tristate {
+	switch n.op {
+	case queryNot:
+		return tsNot(q.evalNode(n.sub[0], env))
+	case queryAnd:
+		result := tsTrue
+		for _, sub := range n.sub {
+			switch q.evalNode(sub, env) {
+			case tsFalse:
+				return tsFalse
+			case tsUnknown:
+				result = tsUnknown
+			}
+		}
+		return result
+	case queryOr:
+		result := tsFalse
+		for _, sub := range n.sub {
+			switch q.evalNode(sub, env) {
+			case tsTrue:
+				return tsTrue
+			case tsUnknown:
+				result = tsUnknown
+			}
+		}
+		return result
+	}
+	var match bool
+	switch n.field {
+	case fieldContent:
+		if env.found == nil {
+			return tsUnknown
+		}
+		match = env.found[n.term]
+	case fieldFile:
+		if env.name == nil {
+			return tsUnknown
+		}
+		match = n.re.MatchString(*env.name)
+	case fieldRepo:
+		if env.repo == nil {
+			return tsUnknown
+		}
+		match = n.re.MatchString(env.repo.Key)
+	case fieldMeta:
+		if env.repo == nil {
+			return tsUnknown
+		}
+		value, ok := env.repo.Meta[n.metaKey]
+		match = ok && n.re.MatchString(value)
+	case fieldLang:
+		if env.lang == nil {
+			// Repo without files of the language have none to match
+			if env.repo != nil && env.repo.Languages != nil &&
+				env.repo.Languages[n.value] == 0 {
+				return tsFalse
+			}
+			return tsUnknown
+		}
+		match = *env.lang == n.value
+	}
+	if match {
+		return tsTrue
+	}
+	return tsFalse
+}
+
+// Query parsing
+
+// queryToken is a query term or operator. For quoted terms, text
+// is the quoted string and prefix holds any '-' or field before it.
+type queryToken struct {
+	text   string
+	quoted bool
+	prefix string
+}
+
+// tokenizeQuery splits the query into terms, operators and
+// parentheses. Parentheses within a term are part of the term if
+// they are balanced or escaped.
+func tokenizeQuery(s string) []queryToken {
+	tokens := []queryToken{}
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		switch {
+		case unicode.IsSpace(r[i]):
+			i++
+		case r[i] == '(' || r[i] == ')':
+			tokens = append(tokens, queryToken{text: string(r[i])})
+			i++
+		case r[i] == '-' && i+1 < len(r) && r[i+1] == '(':
+			// negated group
+			tokens = append(tokens, queryToken{text: "NOT"})
+			i++
+		default:
+			depth := 0
+			text := []rune{}
+			token := queryToken{}
+		word:
+			for i < len(r) {
+				switch c := r[i]; {
+				case c == '"' && isQuotePrefix(string(text)):
+					// quoted term, or quoted value of a field
+					value, n := readQuoted(r[i+1:])
+					token.prefix, token.quoted = string(text), true
+					text = value
+					i += n + 1
+					break word
+				case c == '\\' && i+1 < len(r):
+					text = append(text, c, r[i+1])
+					i += 2
+				case unicode.IsSpace(c):
+					break word
+				case c == '(':
+					depth++
+					text = append(text, c)
+					i++
+				case c == ')':
+					if depth == 0 {
+						break word
+					}
+					depth--
+					text = append(text, c)
+					i++
+				default:
+					text = append(text, c)
+					i++
+				}
+			}
+			token.text = string(text)
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// isQuotePrefix returns true if a quote following prefix starts a
+// quoted string
+func isQuotePrefix(prefix string) bool {
+	prefix = strings.TrimPrefix(prefix, "-")
+	switch prefix {
+	case "", fieldFile + ":", fieldRepo + ":", fieldMeta + ":", fieldLang + ":":
+		return true
+	}
+	return false
+}
+
+// readQuoted reads a quoted string up to the closing quote,
+// returning the string and the number of runes read.
+func readQuoted(r []rune) ([]rune, int) {
+	text := []rune{}
+	for i := 0; i < len(r); i++ {
+		switch r[i] {
+		case '\\':
+			if i+1 < len(r) && r[i+1] == '"' {
+				text = append(text, '"')
+				i++
+			} else {
+				text = append(text, r[i])
+			}
+		case '"':
+			return text, i + 1
+		default:
+			text = append(text, r[i])
+		}
+	}
+	return text, len(r)
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return queryToken{}, false
+}
+
+func (p *queryParser) isOp(t queryToken, op string) bool {
+	return !t.quoted && t.text == op
+}
+
+func (p *queryParser) parseOr() (*queryNode, error) {
+	n, err := p.parseAnd()
+	if err != nil || n == nil {
+		return n, err
+	}
+	or := &queryNode{op: queryOr, sub: []*queryNode{n}}
+	for {
+		t, ok := p.peek()
+		if !ok || !p.isOp(t, "OR") {
+			break
+		}
+		p.pos++
+		sub, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		} else if sub == nil {
+			return nil, newQueryError("OR must be followed by a term")
+		}
+		or.sub = append(or.sub, sub)
+	}
+	if len(or.sub) == 1 {
+		return n, nil
+	}
+	return or, nil
+}
+
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	and := &queryNode{op: queryAnd}
+	for {
+		t, ok := p.peek()
+		if !ok || p.isOp(t, "OR") || p.isOp(t, ")") {
+			break
+		}
+		if p.isOp(t, "AND") {
+			p.pos++
+			continue
+		}
+		sub, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and.sub = append(and.sub, sub)
+	}
+	switch len(and.sub) {
+	case 0:
+		return nil, nil
+	case 1:
+		return and.sub[0], nil
+	}
+	return and, nil
+}
+
+func (p *queryParser) parseUnary() (*queryNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, newQueryError("unexpected end of query")
+	}
+	p.pos++
+	switch {
+	case p.isOp(t, "NOT"):
+		sub, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNode{op: queryNot, sub: []*queryNode{sub}}, nil
+	case p.isOp(t, "("):
+		sub, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || !p.isOp(t, ")") {
+			return nil, newQueryError("missing )")
+		} else if sub == nil {
+			return nil, newQueryError("empty ()")
+		}
+		p.pos++
+		return sub, nil
+	case p.isOp(t, ")"):
+		return nil, newQueryError("unexpected )")
+	}
+	return parseTerm(t), nil
+}
+
+// parseTerm parses a term with an optional leading '-' and field
+func parseTerm(t queryToken) *queryNode {
+	spec := t.text
+	if t.quoted {
+		spec = t.prefix
+	}
+	negated := false
+	if strings.HasPrefix(spec, "-") && (t.quoted || len(spec) > 1) {
+		spec, negated = spec[1:], true
+	}
+	n := &queryNode{op: queryTerm, field: fieldContent, value: spec}
+	if t.quoted {
+		// quoted values are taken verbatim
+		n.field, n.value = strings.TrimSuffix(spec, ":"), t.text
+	} else if i := strings.Index(spec, ":"); i > 0 {
+		switch field := spec[:i]; field {
+		case fieldFile, fieldRepo, fieldMeta, fieldLang:
+			n.field, n.value = field, spec[i+1:]
+		}
+	}
+	if negated {
+		return &queryNode{op: queryNot, sub: []*queryNode{n}}
+	}
+	return n
+}
@@ -0,0 +1,170 @@
+package afind
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/andaru/codesearch/index"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	tokens := tokenizeQuery(`foo (bar OR "a b") -file:"x \"y\"" f(x) \)`)
+	texts := []string{}
+	for _, tok := range tokens {
+		texts = append(texts, tok.text)
+	}
+	want := []string{"foo", "(", "bar", "OR", "a b", ")", `x "y"`, "f(x)", `\)`}
+	if !reflect.DeepEqual(want, texts) {
+		t.Errorf("want %#v, got %#v", want, texts)
+	}
+	eq(t, true, tokens[4].quoted)
+	eq(t, "", tokens[4].prefix)
+	eq(t, true, tokens[6].quoted)
+	eq(t, "-file:", tokens[6].prefix)
+	eq(t, false, tokens[7].quoted)
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"",
+		"-foo",
+		"NOT foo",
+		"file:foo",
+		"-bar OR -baz file:x",
+		"(foo",
+		"foo )",
+		"()",
+		"foo OR",
+		"foo meta:bar",
+		"foo[",
+	} {
+		if _, err := parseQuery(q, false, false, false, false); err == nil {
+			t.Errorf("query %q: want error, got none", q)
+		}
+	}
+	for _, q := range []string{
+		"foo",
+		"foo -bar",
+		"foo NOT bar",
+		"foo AND bar",
+		"(foo OR bar) -(baz qux)",
+		"foo -bar OR -baz file:x",
+		`"foo bar" file:\.go$`,
+		"foo meta:project=main",
+		"-",
+	} {
+		if _, err := parseQuery(q, false, false, false, false); err != nil {
+			t.Errorf("query %q: unexpected error: %v", q, err)
+		}
+	}
+}
+
+func TestQueryEval(t *testing.T) {
+	q, err := parseQuery(`(foo OR bar) -baz file:\.go$ repo:^main meta:project=x`,
+		false, false, false, false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, len(q.terms))
+	if !reflect.DeepEqual([]bool{true, true, false}, q.report) {
+		t.Error("want foo and bar reported, got", q.report)
+	}
+
+	repo := newRepo("mainline")
+	repo.Meta["project"] = "xyz"
+	other := newRepo("branch")
+	goName, cName := "a.go", "a.c"
+
+	eq(t, tsUnknown, q.eval(queryEnv{}))
+	eq(t, tsUnknown, q.eval(queryEnv{repo: repo}))
+	eq(t, tsFalse, q.eval(queryEnv{repo: other}))
+	eq(t, tsUnknown, q.eval(queryEnv{repo: repo, name: &goName}))
+	eq(t, tsFalse, q.eval(queryEnv{repo: repo, name: &cName}))
+
+	env := queryEnv{repo: repo, name: &goName}
+	env.found = []bool{true, false, false}
+	eq(t, tsTrue, q.eval(env))
+	env.found = []bool{false, true, false}
+	eq(t, tsTrue, q.eval(env))
+	env.found = []bool{false, false, false}
+	eq(t, tsFalse, q.eval(env))
+	env.found = []bool{true, true, true}
+	eq(t, tsFalse, q.eval(env))
+}
+
+func TestQueryIndexQuery(t *testing.T) {
+	q, err := parseQuery(`foo (bar OR baz) -qux file:x`, false, false, false, false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	iq, err := q.indexQuery()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, index.QAnd, iq.Op)
+	eq(t, 4, len(iq.Sub))
+	eq(t, index.QOr, iq.Sub[1].Op)
+	eq(t, 2, len(iq.Sub[1].Sub))
+	// negated terms and qualifiers do not narrow the files
+	eq(t, index.QAll, iq.Sub[2].Op)
+	eq(t, index.QAll, iq.Sub[3].Op)
+}
+
+func TestSearchBoolQuery(t *testing.T) {
+	files := map[string]string{
+		"a.go":      "foo\nbar\n",
+		"b.go":      "foo only\n",
+		"b_test.go": "foo and bar\n",
+		"c.go":      "bar baz\n",
+	}
+	test := searchSetupIndex(files, t)
+	test.sr = NewSearcher(test.config, test.db)
+	search := func(q string) *SearchResult {
+		query := NewSearchQuery("", "", false, []string{kixKey1})
+		query.Query = q
+		sr, err := test.sr.Search(test.ctx, query)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if sr.Error != "" {
+			t.Fatal("unexpected error:", sr.Error)
+		}
+		return sr
+	}
+
+	sr := search("foo bar")
+	eq(t, uint64(3), sr.NumMatches)
+	eq(t, "foo\n", sr.Matches["a.go"][kixKey1]["1"])
+	eq(t, "bar\n", sr.Matches["a.go"][kixKey1]["2"])
+	eq(t, "foo and bar\n", sr.Matches["b_test.go"][kixKey1]["1"])
+
+	sr = search("foo -bar")
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "foo only\n", sr.Matches["b.go"][kixKey1]["1"])
+
+	sr = search("foo OR baz")
+	eq(t, uint64(4), sr.NumMatches)
+	eq(t, "bar baz\n", sr.Matches["c.go"][kixKey1]["1"])
+
+	sr = search(`foo bar -file:_test\.go$`)
+	eq(t, uint64(2), sr.NumMatches)
+	_, ok := sr.Matches["b_test.go"]
+	eq(t, false, ok)
+
+	sr = search("foo repo:^nomatch")
+	eq(t, uint64(0), sr.NumMatches)
+
+	// negated terms are not reported, nor are their positions
+	query := NewSearchQuery("", "", false, []string{kixKey1})
+	query.Query = "bar -foo"
+	query.Positions = true
+	sr, _ = test.sr.Search(test.ctx, query)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, 3, sr.Positions["c.go"][kixKey1]["1"][0].End)
+	eq(t, 1, len(sr.Positions["c.go"][kixKey1]["1"]))
+
+	query.Query = "-bar"
+	if err := query.Normalize(); err == nil {
+		t.Error("want error for query without content terms, got none")
+	}
+}
@@ -0,0 +1,241 @@
+package afind
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ranking of search results.
+//
+// Each file in a SearchResult is scored using signals from its
+// matches, its path and its Repo, and the result's Ranked slice
+// orders the files from best to worst. Files with equal scores are
+// ordered by Repo key and then by file name, so the order is stable.
+
+const (
+	// score for the number of matching lines, applied with
+	// diminishing returns
+	rankWeightMatches = 1.0
+	// bonus for a match in a line that looks like a definition
+	rankWeightDefinition = 2.0
+	// penalty for each directory in the file's path
+	rankWeightDepth = 0.25
+	// penalty for test files
+	rankPenaltyTest = 1.5
+)
+
+var (
+	// lines which probably define the name matched
+	definitionRegexp = regexp.MustCompile(
+		`^\s*(export\s+)?((public|private|protected|static|async|pub)\s+)*` +
+			`(func|def|class|type|struct|interface|enum|trait|impl|fn|` +
+			`module|package|namespace|const|var|let|#\s*define)\b`)
+	// file paths which probably contain tests
+	testPathRegexp = regexp.MustCompile(
+		`(^|/)(tests?|testdata|spec)/|(_test|_spec|\.test|\.spec)\.[^/]+$|(^|/)test_[^/]+$`)
+)
+
+// RankedFile is a file with matches and its rank score
+type RankedFile struct {
+	File    string  `json:"file"`
+	RepoKey string  `json:"repo_key"`
+	Score   float64 `json:"score"`
+}
+
+type byRank []RankedFile
+
+func (r byRank) Len() int      { return len(r) }
+func (r byRank) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRank) Less(i, j int) bool {
+	if r[i].Score != r[j].Score {
+		return r[i].Score > r[j].Score
+	} else if r[i].RepoKey != r[j].RepoKey {
+		return r[i].RepoKey < r[j].RepoKey
+	}
+	return r[i].File < r[j].File
+}
+
+// isDefinition returns true if the line looks like a definition
+func isDefinition(line string) bool {
+	return definitionRegexp.MatchString(line)
+}
+
+// isTestPath returns true if the path looks like that of a test
+func isTestPath(name string) bool {
+	return testPathRegexp.MatchString(name)
+}
+
+// rankScore scores the matches in the named file of a Repo with the
+// supplied metadata. Higher scores are better.
+func rankScore(name string, matches map[string]string, meta Meta) float64 {
+	score := rankWeightMatches * math.Log2(1+float64(len(matches)))
+	for _, line := range matches {
+		if isDefinition(line) {
+			score += rankWeightDefinition
+			break
+		}
+	}
+	score -= rankWeightDepth * float64(strings.Count(strings.Trim(name, "/"), "/"))
+	if isTestPath(name) {
+		score -= rankPenaltyTest
+	}
+	return score + meta.Priority()
+}
+
+// Rank scores the files in the result, setting Ranked to the files
+// in order from best to worst.
+func (r *SearchResult) Rank() {
+	r.Ranked = make([]RankedFile, 0, len(r.Matches))
+	for name, rmatches := range r.Matches {
+		for key, matches := range rmatches {
+			meta := Meta{}
+			if repo, ok := r.Repos[key]; ok && repo != nil {
+				meta = repo.Meta
+			}
+			r.Ranked = append(r.Ranked, RankedFile{
+				File:    name,
+				RepoKey: key,
+				Score:   rankScore(name, matches, meta),
+			})
+		}
+	}
+	sort.Sort(byRank(r.Ranked))
+}
+
+// Truncate limits the result to the best ranked max matching lines,
+// removing the matches of lower ranked files. Where only some of a
+// file's matching lines can be kept, those earliest in the file are
+// kept. The result must have been ranked. Truncate does nothing if
+// max is 0.
+//
+// The Progress of the shards containing the matches removed is moved
+// back so the next page of results includes them. prev is the cursor
+// the result was produced from.
+func (r *SearchResult) Truncate(max uint64, prev Cursor) {
+	if max == 0 || r.NumMatches <= max {
+		return
+	}
+	found := r.foundLines()
+	var count uint64
+	ranked := make([]RankedFile, 0, len(r.Ranked))
+	for _, rf := range r.Ranked {
+		matches := r.Matches[rf.File][rf.RepoKey]
+		dups := r.Duplicates[rf.File][rf.RepoKey]
+		if count >= max {
+			r.unreturnFileRepo(rf.File, rf.RepoKey, 0, found, prev)
+			for _, d := range dups {
+				r.unreturnFileRepo(d.File, d.RepoKey, 0, found, prev)
+			}
+			r.removeFileRepo(rf.File, rf.RepoKey)
+			continue
+		}
+		if remain := max - count; uint64(len(matches)) > remain {
+			last := r.truncateFileRepo(rf.File, rf.RepoKey, remain)
+			r.unreturnFileRepo(rf.File, rf.RepoKey, last, found, prev)
+			for _, d := range dups {
+				r.unreturnFileRepo(d.File, d.RepoKey, last, found, prev)
+			}
+		}
+		count += uint64(len(matches))
+		ranked = append(ranked, rf)
+	}
+	r.Ranked = ranked
+	r.NumMatches = count
+}
+
+// truncateFileRepo keeps only the first max matching lines of the
+// file in the Repo, and the context before the first line removed,
+// returning the last line kept.
+func (r *SearchResult) truncateFileRepo(name, key string, max uint64) int {
+	matches := r.Matches[name][key]
+	all := sortedLines(matches)
+	last, _ := strconv.Atoi(all[max-1])
+	lines := all[max:]
+	first, _ := strconv.Atoi(lines[0])
+	for _, lineno := range lines {
+		delete(matches, lineno)
+		delete(r.Positions[name][key], lineno)
+		delete(r.Symbols[name][key], lineno)
+	}
+	for lineno := range r.Context[name][key] {
+		if n, err := strconv.Atoi(lineno); err == nil && n > first {
+			delete(r.Context[name][key], lineno)
+		}
+	}
+	return last
+}
+
+// removeFileRepo removes all lines found in the file in the Repo,
+// and in its duplicates
+func (r *SearchResult) removeFileRepo(name, key string) {
+	for _, d := range r.Duplicates[name][key] {
+		r.removeSource(d.File, d.RepoKey)
+	}
+	r.removeLines(name, key)
+	r.removeSource(name, key)
+}
+
+// removeLines removes the lines of the file in the Repo, leaving
+// where it was found
+func (r *SearchResult) removeLines(name, key string) {
+	for _, m := range []map[string]map[string]map[string]string{r.Matches, r.Context} {
+		if rm, ok := m[name]; ok {
+			delete(rm, key)
+			if len(rm) == 0 {
+				delete(m, name)
+			}
+		}
+	}
+	if rp, ok := r.Positions[name]; ok {
+		delete(rp, key)
+		if len(rp) == 0 {
+			delete(r.Positions, name)
+		}
+	}
+	if rs, ok := r.Symbols[name]; ok {
+		delete(rs, key)
+		if len(rs) == 0 {
+			delete(r.Symbols, name)
+		}
+	}
+	if rs, ok := r.Sums[name]; ok {
+		delete(rs, key)
+		if len(rs) == 0 {
+			delete(r.Sums, name)
+		}
+	}
+	if rd, ok := r.Duplicates[name]; ok {
+		delete(rd, key)
+		if len(rd) == 0 {
+			delete(r.Duplicates, name)
+		}
+	}
+}
+
+func (r *SearchResult) removeSource(name, key string) {
+	if rs, ok := r.Sources[name]; ok {
+		delete(rs, key)
+		if len(rs) == 0 {
+			delete(r.Sources, name)
+		}
+	}
+}
+
+// sortedLines returns the line numbers of the lines in order
+func sortedLines(lines map[string]string) []string {
+	nums := make([]int, 0, len(lines))
+	for l := range lines {
+		if n, err := strconv.Atoi(l); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	result := make([]string, len(nums))
+	for i, n := range nums {
+		result[i] = strconv.Itoa(n)
+	}
+	return result
+}
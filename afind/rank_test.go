@@ -0,0 +1,126 @@
+package afind
+
+import (
+	"testing"
+)
+
+func TestIsDefinition(t *testing.T) {
+	for _, line := range []string{
+		"func foo() {",
+		"  def foo(self):",
+		"export class Foo {",
+		"pub fn foo() -> u32 {",
+		"#define FOO 1",
+		"type Foo struct {",
+	} {
+		if !isDefinition(line) {
+			t.Errorf("want %q to be a definition", line)
+		}
+	}
+	for _, line := range []string{
+		"	x := foo()",
+		"// the func foo",
+		"functional(foo)",
+	} {
+		if isDefinition(line) {
+			t.Errorf("want %q not to be a definition", line)
+		}
+	}
+}
+
+func TestIsTestPath(t *testing.T) {
+	for _, name := range []string{
+		"afind/rank_test.go", "test/foo.c", "src/tests/foo.py",
+		"lib/foo.spec.js", "test_foo.py", "pkg/testdata/x"} {
+		if !isTestPath(name) {
+			t.Errorf("want %q to be a test path", name)
+		}
+	}
+	for _, name := range []string{
+		"afind/rank.go", "contest/foo.c", "attest.py"} {
+		if isTestPath(name) {
+			t.Errorf("want %q not to be a test path", name)
+		}
+	}
+}
+
+func newRankedResult() *SearchResult {
+	r := NewSearchResult()
+	r.AddFileRepoMatches("a/b/c/deep.go", "key1",
+		map[string]string{"10": "x := foo()\n"})
+	r.AddFileRepoMatches("shallow.go", "key1",
+		map[string]string{"10": "x := foo()\n"})
+	r.AddFileRepoMatches("shallow_test.go", "key1",
+		map[string]string{"10": "x := foo()\n"})
+	r.AddFileRepoMatches("defn.go", "key1",
+		map[string]string{"10": "x := foo()\n", "20": "func foo() {\n"})
+	r.AddFileRepoMatches("shallow.go", "key2",
+		map[string]string{"10": "x := foo()\n"})
+	r.AddFileRepoContext("defn.go", "key1",
+		map[string]string{"19": "\n", "21": "}\n"})
+	return r
+}
+
+func rankOrder(r *SearchResult) []string {
+	order := []string{}
+	for _, rf := range r.Ranked {
+		order = append(order, rf.RepoKey+":"+rf.File)
+	}
+	return order
+}
+
+func TestRank(t *testing.T) {
+	r := newRankedResult()
+	r.Rank()
+	eqStrings(t, []string{
+		"key1:defn.go", "key1:shallow.go", "key2:shallow.go",
+		"key1:a/b/c/deep.go", "key1:shallow_test.go"}, rankOrder(r))
+
+	// Repo priority outranks the other signals
+	repo := NewRepo()
+	repo.Key = "key2"
+	repo.Meta["priority"] = "10"
+	r.Repos["key2"] = repo
+	r.Rank()
+	eqStrings(t, []string{
+		"key2:shallow.go", "key1:defn.go", "key1:shallow.go",
+		"key1:a/b/c/deep.go", "key1:shallow_test.go"}, rankOrder(r))
+}
+
+func TestTruncate(t *testing.T) {
+	r := newRankedResult()
+	r.Rank()
+	r.Truncate(0, nil)
+	eq(t, uint64(6), r.NumMatches)
+
+	// Keeps the first line of the best file only
+	r.Truncate(1, nil)
+	eq(t, uint64(1), r.NumMatches)
+	eqStrings(t, []string{"key1:defn.go"}, rankOrder(r))
+	eq(t, 1, len(r.Matches))
+	eq(t, "x := foo()\n", r.Matches["defn.go"]["key1"]["10"])
+	// context after the first line removed is also removed
+	eq(t, 1, len(r.Context["defn.go"]["key1"]))
+	eq(t, "\n", r.Context["defn.go"]["key1"]["19"])
+
+	r = newRankedResult()
+	r.Rank()
+	r.Truncate(3, nil)
+	eq(t, uint64(3), r.NumMatches)
+	eqStrings(t, []string{"key1:defn.go", "key1:shallow.go"}, rankOrder(r))
+	eq(t, 2, len(r.Matches))
+	eq(t, 2, len(r.Context["defn.go"]["key1"]))
+}
+
+func eqStrings(t *testing.T, want, got []string) {
+	if len(want) != len(got) {
+		t.Errorf("want %v, got %v", want, got)
+		return
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("want %v, got %v", want, got)
+			return
+		}
+	}
+}
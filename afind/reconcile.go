@@ -0,0 +1,267 @@
+package afind
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andaru/afind/archivefs"
+	"github.com/andaru/codesearch/index"
+)
+
+// Repo database reconciliation.
+//
+// The repo database and the index files on disk can disagree after a
+// crash, or when index files are removed by hand. A reconciliation
+// pass, run when the server starts and optionally periodically,
+// brings them back into line:
+//
+// - Repo on this host whose shards are missing or cannot be opened
+//   are marked ERROR, and ERROR Repo whose shards are once again
+//   usable are marked OK. If DeleteRepoOnError is set, such Repo
+//   are instead deleted, with their snapshots, as a search finding
+//   them unavailable would.
+// - Repo on this host left INDEXING by a crash are deleted, as a
+//   failed indexing request does, with any snapshots left by an
+//   earlier Repo of the same key. After startup, Repo are only
+//   considered stale if seen INDEXING for longer than the index
+//   timeout. Other hosts' Repo are left to their own hosts.
+// - Shard and manifest files under IndexRoot belonging to no Repo
+//   are reported as orphans, and removed if ReconcileRemoveOrphans
+//   is set. After startup, files modified within the index timeout
+//   are left alone, as they may belong to an indexing request.
+// - Archives decompressed into the ArchiveCache for no Repo's Root
+//   are removed, leaving recent extractions alone likewise.
+
+// A Reconciler brings the repo database into line with the index
+// files on disk
+type Reconciler interface {
+	Reconcile() *ReconcileReport
+}
+
+// ReconcileReport describes the changes made by a reconciliation
+// pass, by Repo key
+type ReconcileReport struct {
+	Checked  int               `json:"checked"`            // local Repo checked
+	Broken   map[string]string `json:"broken,omitempty"`   // unusable, with the reason
+	Deleted  []string          `json:"deleted,omitempty"`  // broken Repo deleted
+	Restored []string          `json:"restored,omitempty"` // ERROR Repo now OK
+	Stale    []string          `json:"stale,omitempty"`    // INDEXING Repo deleted
+	Orphans  []string          `json:"orphans,omitempty"`  // index files of no Repo
+	Removed  []string          `json:"removed,omitempty"`  // orphans removed
+	// archive extractions of no Repo removed
+	Extractions []string `json:"extractions,omitempty"`
+}
+
+// String summarizes the report for logging
+func (r *ReconcileReport) String() string {
+	return fmt.Sprintf("%d checked, %d broken (%d deleted), %d restored, "+
+		"%d stale, %d orphan files (%d removed), %d extractions removed",
+		r.Checked, len(r.Broken), len(r.Deleted), len(r.Restored),
+		len(r.Stale), len(r.Orphans), len(r.Removed), len(r.Extractions))
+}
+
+// reconciler runs reconciliation passes, remembering which Repo were
+// seen INDEXING by earlier passes
+type reconciler struct {
+	cfg      *Config
+	repos    KeyValueStorer
+	started  bool
+	indexing map[string]time.Time // first seen INDEXING
+	now      func() time.Time
+}
+
+// NewReconciler returns a reconciler of the repo store with the
+// index files on disk. Its first pass assumes the server has just
+// started.
+func NewReconciler(cfg *Config, repos KeyValueStorer) *reconciler {
+	return &reconciler{
+		cfg:      cfg,
+		repos:    repos,
+		indexing: make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Reconcile runs a reconciliation pass
+func (r *reconciler) Reconcile() *ReconcileReport {
+	startup := !r.started
+	r.started = true
+	report := &ReconcileReport{Broken: make(map[string]string)}
+
+	repos := []*Repo{}
+	r.repos.ForEach(func(key string, value interface{}) bool {
+		repos = append(repos, value.(*Repo))
+		return true
+	})
+	owned := make(map[string]bool)
+	archives := []string{}
+	indexing := make(map[string]time.Time)
+	for _, repo := range repos {
+		if archivefs.IsArchive(repo.Root) {
+			archives = append(archives, repo.Root)
+		}
+		for _, name := range repoIndexFiles(repo) {
+			owned[filepath.Clean(name)] = true
+		}
+		switch {
+		case !r.cfg.IsHostLocal(repo.Host()):
+		case repo.State == INDEXING:
+			since, ok := r.indexing[repo.Key]
+			if !ok {
+				since = r.now()
+			}
+			if startup || r.now().Sub(since) > r.cfg.GetTimeoutIndex() {
+				report.Stale = append(report.Stale, repo.Key)
+				r.delete(repo)
+			} else {
+				indexing[repo.Key] = since
+			}
+		default:
+			report.Checked++
+			r.check(repo, report)
+		}
+	}
+	r.indexing = indexing
+
+	report.Orphans = r.orphans(owned, startup)
+	if r.cfg.ReconcileRemoveOrphans {
+		for _, name := range report.Orphans {
+			if err := os.Remove(name); err != nil {
+				log.Warning("reconcile cannot remove %v: %v", name, err)
+			} else {
+				report.Removed = append(report.Removed, name)
+			}
+		}
+	}
+	report.Extractions = r.sweepArchives(archives, startup)
+	log.Info("reconcile %v", report)
+	return report
+}
+
+// check confirms the shards of the Repo can be opened, updating
+// its state, or deleting it, if necessary
+func (r *reconciler) check(repo *Repo, report *ReconcileReport) {
+	err := checkShards(repo)
+	switch {
+	case err != nil && r.cfg.DeleteRepoOnError:
+		log.Warning("reconcile repo [%v] unavailable, deleting: %v", repo.Key, err)
+		report.Broken[repo.Key] = err.Error()
+		report.Deleted = append(report.Deleted, repo.Key)
+		r.delete(repo)
+	case err != nil && repo.State == OK:
+		log.Warning("reconcile repo [%v] unavailable: %v", repo.Key, err)
+		report.Broken[repo.Key] = err.Error()
+		r.setState(repo, ERROR)
+	case err == nil && repo.State == ERROR && repo.NumShards > 0:
+		log.Info("reconcile repo [%v] available again", repo.Key)
+		report.Restored = append(report.Restored, repo.Key)
+		r.setState(repo, OK)
+	}
+}
+
+// setState replaces the Repo with a copy in the new state, unless
+// the Repo has been replaced since it was checked
+func (r *reconciler) setState(repo *Repo, state string) {
+	if r.repos.Get(repo.Key) != repo {
+		return
+	}
+	changed := *repo
+	changed.State = state
+	_ = r.repos.Set(repo.Key, &changed)
+}
+
+// delete deletes the Repo, unless it has been replaced, and removes
+// its snapshots
+func (r *reconciler) delete(repo *Repo) {
+	if r.repos.Get(repo.Key) != repo {
+		return
+	}
+	if err := r.repos.Delete(repo.Key); err != nil {
+		return
+	}
+	if err := repo.RemoveSnapshots(); err != nil {
+		log.Warning("reconcile repo [%v] cannot remove snapshots: %v", repo.Key, err)
+	}
+}
+
+// sweepArchives removes the extractions in the ArchiveCache of
+// archives other than those named. Unless startup is true, recently
+// modified extractions are left alone.
+func (r *reconciler) sweepArchives(archives []string, startup bool) []string {
+	before := r.now()
+	if !startup {
+		before = before.Add(-r.cfg.GetTimeoutIndex())
+	}
+	removed, err := archivefs.Sweep(r.cfg.GetArchiveCache(), archives, before)
+	if err != nil {
+		log.Warning("reconcile cannot sweep the archive cache: %v", err)
+	}
+	return removed
+}
+
+// checkShards returns an error if any of the Repo's shards is
+// missing or cannot be opened
+func checkShards(repo *Repo) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupt index: %v", r)
+		}
+	}()
+	if repo.NumShards == 0 {
+		return fmt.Errorf("no index shards")
+	}
+	for _, name := range repo.Shards() {
+		if _, err = os.Stat(name); err != nil {
+			return err
+		}
+		if _, err = index.Open(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repoIndexFiles returns the names of the index files a Repo owns,
+// including those of its snapshots
+func repoIndexFiles(repo *Repo) []string {
+	names := append(repo.Shards(), manifestName(repo.IndexPath, repo.Key))
+	if repo.Symbols {
+		names = append(names, symbolsName(repo.IndexPath, repo.Key))
+	}
+	return append(names, snapshotFiles(repo)...)
+}
+
+// orphans returns the index files under IndexRoot not owned by any
+// Repo. Unless startup is true, recently modified files are ignored.
+func (r *reconciler) orphans(owned map[string]bool, startup bool) []string {
+	if r.cfg.IndexRoot == "" {
+		return nil
+	}
+	orphans := []string{}
+	recent := r.now().Add(-r.cfg.GetTimeoutIndex())
+	_ = filepath.Walk(r.cfg.IndexRoot,
+		func(name string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return nil
+			}
+			if !strings.HasSuffix(name, indexPathSuffix) &&
+				!strings.HasSuffix(name, manifestSuffix) &&
+				!strings.HasSuffix(name, symbolsSuffix) {
+				return nil
+			}
+			if owned[filepath.Clean(name)] {
+				return nil
+			}
+			if !startup && fi.ModTime().After(recent) {
+				return nil
+			}
+			orphans = append(orphans, name)
+			return nil
+		})
+	sort.Strings(orphans)
+	return orphans
+}
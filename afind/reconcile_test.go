@@ -0,0 +1,153 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andaru/afind/archivefs"
+)
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_reconcile")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{IndexRoot: dir, RepoMeta: Meta{"host": "here"},
+		ArchiveCache: path.Join(dir, "cache")}
+
+	// writes the Repo's shards and manifest
+	newIndexedRepo := func(key, state string) *Repo {
+		repo := newRepo(key)
+		repo.SetHost("here")
+		repo.IndexPath = path.Join(dir, key)
+		repo.NumShards = 2
+		repo.State = state
+		_ = os.MkdirAll(repo.IndexPath, 0755)
+		for _, name := range repoIndexFiles(repo) {
+			_ = ioutil.WriteFile(name, []byte("a.go\n"), 0644)
+		}
+		return repo
+	}
+	repos := newDb()
+	okRepo := newIndexedRepo("ok", OK)
+	okRepo.Root = path.Join(dir, "ok.tgz")
+	_ = repos.Set("ok", okRepo)
+	// archives extracted for the ok Repo, and for a deleted Repo
+	for _, name := range []string{okRepo.Root, path.Join(dir, "gone.tgz")} {
+		writeTestArchive(t, name, map[string]string{"a.go": "package a\n"})
+		a, err := archivefs.Open(name, cfg.ArchiveCache)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		_ = a.Close()
+	}
+	missing := newIndexedRepo("missing", OK)
+	_ = os.Remove(missing.Shards()[1])
+	_ = repos.Set("missing", missing)
+	_ = repos.Set("restored", newIndexedRepo("restored", ERROR))
+	crashed := &Repo{Key: "crashed", State: INDEXING, IndexPath: path.Join(dir, "crashed")}
+	_ = repos.Set("crashed", crashed)
+	// left by an earlier Repo of the same key
+	_ = os.MkdirAll(path.Join(snapshotsPath(crashed.IndexPath, "crashed"), "1"), 0755)
+	remote := newRepo("remote")
+	remote.SetHost("there")
+	remote.NumShards = 1
+	_ = repos.Set("remote", remote)
+	remoteIndexing := newRepo("remote_indexing")
+	remoteIndexing.SetHost("there")
+	remoteIndexing.State = INDEXING
+	_ = repos.Set("remote_indexing", remoteIndexing)
+	// orphans, including a shard beyond the Repo's number of shards
+	orphans := []string{
+		path.Join(dir, "gone", shardName("gone", 0)),
+		path.Join(dir, "gone", manifestName("", "gone")),
+		path.Join(dir, "ok", shardName("ok", 2)),
+		path.Join(dir, "ok", shardTempName("ok", 0)),
+	}
+	_ = os.MkdirAll(path.Join(dir, "gone"), 0755)
+	old := time.Now().Add(-2 * cfg.GetTimeoutIndex())
+	for _, name := range orphans {
+		_ = ioutil.WriteFile(name, []byte{}, 0644)
+		_ = os.Chtimes(name, old, old)
+	}
+	_ = ioutil.WriteFile(path.Join(dir, "gone", "README"), []byte{}, 0644)
+
+	rc := NewReconciler(cfg, repos)
+	report := rc.Reconcile()
+	eq(t, 3, report.Checked)
+	eq(t, 1, len(report.Broken))
+	_, ok := report.Broken["missing"]
+	eq(t, true, ok)
+	eq(t, ERROR, repos.Get("missing").(*Repo).State)
+	eq(t, "restored", report.Restored[0])
+	eq(t, OK, repos.Get("restored").(*Repo).State)
+	eq(t, "crashed", report.Stale[0])
+	eq(t, nil, repos.Get("crashed"))
+	if _, err = os.Stat(snapshotsPath(crashed.IndexPath, "crashed")); !os.IsNotExist(err) {
+		t.Error("want the stale Repo's snapshots removed, got", err)
+	}
+	eq(t, OK, repos.Get("ok").(*Repo).State)
+	eq(t, OK, repos.Get("remote").(*Repo).State)
+	eq(t, INDEXING, repos.Get("remote_indexing").(*Repo).State)
+	eq(t, len(orphans), len(report.Orphans))
+	eq(t, 0, len(report.Removed))
+	eq(t, 1, len(report.Extractions))
+	extracted, _ := filepath.Glob(path.Join(cfg.ArchiveCache, "*"))
+	eq(t, 1, len(extracted))
+	if a, err := archivefs.Open(okRepo.Root, cfg.ArchiveCache); err != nil {
+		t.Error("unexpected error:", err)
+	} else {
+		_ = a.Close()
+	}
+	if now, _ := filepath.Glob(path.Join(cfg.ArchiveCache, "*")); len(now) != 1 || now[0] != extracted[0] {
+		t.Error("want the ok Repo's extraction kept, got", now)
+	}
+
+	// After startup, Repo are only stale once indexing for longer
+	// than the index timeout, and recent files are not orphans
+	now := time.Now()
+	rc.now = func() time.Time { return now }
+	_ = repos.Set("indexing", &Repo{Key: "indexing", State: INDEXING})
+	_ = ioutil.WriteFile(path.Join(dir, shardName("new", 0)), []byte{}, 0644)
+	report = rc.Reconcile()
+	eq(t, 0, len(report.Stale))
+	eq(t, len(orphans), len(report.Orphans))
+	now = now.Add(cfg.GetTimeoutIndex() + time.Second)
+	report = rc.Reconcile()
+	eq(t, "indexing", report.Stale[0])
+	eq(t, len(orphans)+1, len(report.Orphans))
+
+	// Broken Repo are deleted and orphans removed if configured
+	cfg.DeleteRepoOnError = true
+	cfg.ReconcileRemoveOrphans = true
+	_ = os.MkdirAll(path.Join(snapshotsPath(missing.IndexPath, "missing"), "1"), 0755)
+	report = rc.Reconcile()
+	if eq(t, 1, len(report.Deleted)) {
+		eq(t, "missing", report.Deleted[0])
+	}
+	eq(t, nil, repos.Get("missing"))
+	if _, err = os.Stat(snapshotsPath(missing.IndexPath, "missing")); !os.IsNotExist(err) {
+		t.Error("want the deleted Repo's snapshots removed, got", err)
+	}
+	eq(t, OK, repos.Get("ok").(*Repo).State)
+	eq(t, len(orphans)+1, len(report.Removed))
+	for _, name := range orphans {
+		if _, err = os.Stat(name); err == nil {
+			t.Error("want orphan removed:", name)
+		}
+	}
+	// the deleted Repo's remaining shard and manifest are orphans now
+	report = rc.Reconcile()
+	eq(t, 2, len(report.Removed))
+	report = rc.Reconcile()
+	eq(t, 0, len(report.Removed))
+	if _, err = os.Stat(path.Join(dir, "gone", "README")); err != nil {
+		t.Error("want other files left alone, got", err)
+	}
+	eq(t, 4, repos.Size())
+}
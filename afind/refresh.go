@@ -0,0 +1,254 @@
+package afind
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+// Scheduled re-indexing.
+//
+// A Repo whose Meta has a "refresh" interval (e.g., "6h") is updated
+// by the server that often, as if by an IndexQuery with Update set.
+// The first refresh is due one interval after the Repo was last
+// updated, and each refresh is delayed by a random jitter of up to a
+// tenth of the interval, so that Repo indexed together are not all
+// refreshed together. No more than the server's RefreshParallel
+// refreshes run at once, the most overdue running first.
+//
+// A failed refresh leaves the Repo as it was, and is retried after a
+// delay starting at refreshRetry and doubling with each failure, to
+// at most refreshMaxBackoff. The time of the next refresh and any
+// failures are recorded on the Repo.
+
+const (
+	// the shortest refresh interval permitted
+	minRefresh = time.Minute
+	// how often the scheduler looks for Repo due a refresh
+	refreshTick = 30 * time.Second
+	// the delay before the first retry of a failed refresh
+	refreshRetry = time.Minute
+	// the longest delay before retrying a failed refresh
+	refreshMaxBackoff = 6 * time.Hour
+
+	defaultRefreshParallel = 2
+)
+
+// Refresh returns the `refresh` key from the metadata as a duration,
+// or 0 if it is not set or not valid. Repo with a refresh interval
+// are periodically re-indexed.
+func (m Meta) Refresh() time.Duration {
+	d, err := time.ParseDuration(m["refresh"])
+	if err != nil || d < minRefresh {
+		return 0
+	}
+	return d
+}
+
+// validateRefresh returns an error if the metadata's refresh
+// interval is set but not valid
+func (m Meta) validateRefresh() error {
+	if s, ok := m["refresh"]; ok && s != "" && m.Refresh() == 0 {
+		return fmt.Errorf("refresh %q must be a duration of at least %v", s, minRefresh)
+	}
+	return nil
+}
+
+// refreshState is the schedule of a single Repo
+type refreshState struct {
+	interval time.Duration
+	next     time.Time
+	failures int
+	err      string
+	running  bool
+}
+
+// refresher re-indexes Repo on their schedules
+type refresher struct {
+	cfg     *Config
+	repos   KeyValueStorer
+	indexer Indexer
+	ctx     context.Context // the parent of index request contexts
+
+	mu      *sync.Mutex
+	state   map[string]*refreshState
+	running int
+	rand    *rand.Rand
+	wg      *sync.WaitGroup
+}
+
+// NewRefresher returns a scheduler re-indexing Repo of the store
+// with the indexer, once Run
+func NewRefresher(cfg *Config, repos KeyValueStorer, indexer Indexer) *refresher {
+	return &refresher{
+		cfg:     cfg,
+		repos:   repos,
+		indexer: indexer,
+		ctx:     context.Background(),
+		mu:      &sync.Mutex{},
+		state:   make(map[string]*refreshState),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		wg:      &sync.WaitGroup{},
+	}
+}
+
+// Run starts refreshes as they fall due, until quit is closed
+func (r *refresher) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			r.poll(now)
+		}
+	}
+}
+
+// poll starts the refreshes due at time now, returning their keys
+func (r *refresher) poll(now time.Time) []string {
+	repos := map[string]*Repo{}
+	r.repos.ForEach(func(key string, value interface{}) bool {
+		repo := value.(*Repo)
+		if (repo.State == OK || repo.State == ERROR) &&
+			repo.Meta.Refresh() > 0 && r.cfg.IsHostLocal(repo.Host()) {
+			repos[key] = repo
+		}
+		return true
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, st := range r.state {
+		if _, ok := repos[key]; !ok && !st.running {
+			delete(r.state, key)
+		}
+	}
+	due := []string{}
+	for key, repo := range repos {
+		st := r.state[key]
+		if interval := repo.Meta.Refresh(); st == nil || st.interval != interval {
+			last := repo.TimeUpdated
+			if last.IsZero() {
+				last = now
+			}
+			st = &refreshState{interval: interval}
+			st.next = r.schedule(last, interval)
+			r.state[key] = st
+			r.publish(repo, st)
+		}
+		if !st.running && !now.Before(st.next) {
+			due = append(due, key)
+		}
+	}
+	// most overdue first
+	sort.Sort(keysByNext{due, r.state})
+	started := []string{}
+	for _, key := range due {
+		if r.running >= r.cfg.GetRefreshParallel() {
+			log.Debug("refresh %d repos waiting for %d running",
+				len(due)-len(started), r.running)
+			break
+		}
+		r.state[key].running = true
+		r.running++
+		started = append(started, key)
+		r.wg.Add(1)
+		go r.refresh(repos[key])
+	}
+	return started
+}
+
+// schedule returns the time one interval, plus jitter, after last
+func (r *refresher) schedule(last time.Time, interval time.Duration) time.Time {
+	jitter := time.Duration(r.rand.Int63n(int64(interval/10) + 1))
+	return last.Add(interval + jitter)
+}
+
+// backoff returns the delay before retrying after failures
+func backoff(failures int) time.Duration {
+	delay := refreshRetry
+	for n := 1; n < failures && delay < refreshMaxBackoff; n++ {
+		delay *= 2
+	}
+	if delay > refreshMaxBackoff {
+		delay = refreshMaxBackoff
+	}
+	return delay
+}
+
+// publish records the schedule on a copy of the Repo, if changed.
+// Caller must hold the mutex.
+func (r *refresher) publish(repo *Repo, st *refreshState) {
+	if repo.NextRefresh.Equal(st.next) && repo.RefreshFailures == st.failures &&
+		repo.RefreshError == st.err {
+		return
+	}
+	changed := *repo
+	changed.NextRefresh = st.next
+	changed.RefreshFailures = st.failures
+	changed.RefreshError = st.err
+	if r.repos.Get(repo.Key) == repo {
+		_ = r.repos.Set(repo.Key, &changed)
+	}
+}
+
+// refresh updates the Repo, then schedules its next refresh
+func (r *refresher) refresh(repo *Repo) {
+	defer r.wg.Done()
+	log.Info("refresh [%v] starting", repo.Key)
+	req := NewIndexQuery(repo.Key)
+	req.Update = true
+	req.Inherit(repo)
+	ctx, cancel := context.WithTimeout(r.ctx, r.cfg.GetTimeoutIndex())
+	resp, err := r.indexer.Index(ctx, req)
+	cancel()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	} else if err == nil && (resp.Repo == nil || resp.Repo.State != OK) {
+		err = fmt.Errorf("indexing did not complete")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running--
+	st := r.state[repo.Key]
+	st.running = false
+	now := time.Now()
+	current, _ := r.repos.Get(repo.Key).(*Repo)
+	if err == nil {
+		st.failures, st.err = 0, ""
+		st.next = r.schedule(now, st.interval)
+		log.Info("refresh [%v] ok, next at %v", repo.Key, st.next)
+		if current != nil {
+			resp.Repo.NextRefresh = st.next
+			_ = r.repos.Set(repo.Key, resp.Repo)
+		}
+		return
+	}
+	st.failures++
+	st.err = err.Error()
+	st.next = now.Add(backoff(st.failures))
+	log.Warning("refresh [%v] failed (%d times): %v, retry at %v",
+		repo.Key, st.failures, err, st.next)
+	if current != nil {
+		r.publish(current, st)
+	}
+}
+
+// keysByNext sorts Repo keys by the time of their next refresh
+type keysByNext struct {
+	keys  []string
+	state map[string]*refreshState
+}
+
+func (s keysByNext) Len() int      { return len(s.keys) }
+func (s keysByNext) Swap(i, j int) { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s keysByNext) Less(i, j int) bool {
+	return s.state[s.keys[i]].next.Before(s.state[s.keys[j]].next)
+}
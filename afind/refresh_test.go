@@ -0,0 +1,132 @@
+package afind
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+// testRefreshIndexer records update requests, failing those for
+// keys in fail
+type testRefreshIndexer struct {
+	mu      *sync.Mutex
+	updated []string
+	fail    map[string]bool
+	block   chan struct{}
+}
+
+func (ix *testRefreshIndexer) Index(ctx context.Context, req IndexQuery) (*IndexResult, error) {
+	if ix.block != nil {
+		<-ix.block
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.updated = append(ix.updated, req.Key)
+	resp := NewIndexResult()
+	if ix.fail[req.Key] {
+		return resp, errors.New("no such directory")
+	}
+	if !req.Update || req.Root != "/src/"+req.Key {
+		return resp, errors.New("want an update of the existing repo")
+	}
+	resp.Repo = newRepoFromQuery(&req, "/ix")
+	resp.Repo.State = OK
+	resp.Repo.TimeUpdated = time.Now()
+	return resp, nil
+}
+
+func TestMetaRefresh(t *testing.T) {
+	eq(t, time.Duration(0), Meta{}.Refresh())
+	eq(t, 6*time.Hour, Meta{"refresh": "6h"}.Refresh())
+	eq(t, time.Duration(0), Meta{"refresh": "1s"}.Refresh())
+	eq(t, time.Duration(0), Meta{"refresh": "daily"}.Refresh())
+
+	query := NewIndexQuery("key")
+	query.Root = "/"
+	query.Dirs = []string{"."}
+	query.Meta["refresh"] = "10s"
+	if err := query.Normalize(); err == nil {
+		t.Error("want error for short refresh interval, got none")
+	}
+	query.Meta["refresh"] = "1h"
+	if err := query.Normalize(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	eq(t, refreshRetry, backoff(1))
+	eq(t, 2*refreshRetry, backoff(2))
+	eq(t, 8*refreshRetry, backoff(4))
+	eq(t, refreshMaxBackoff, backoff(100))
+}
+
+func TestRefresher(t *testing.T) {
+	ix := &testRefreshIndexer{mu: &sync.Mutex{}, fail: map[string]bool{"bad": true}}
+	repos := newDb()
+	cfg := &Config{RepoMeta: Meta{"host": "here"}, RefreshParallel: 2}
+	start := time.Now()
+	add := func(key, refresh string, age time.Duration) {
+		repo := newRepo(key)
+		repo.Root = "/src/" + key
+		repo.Dirs = []string{"/"}
+		repo.State = OK
+		repo.TimeUpdated = start.Add(-age)
+		repo.Meta["refresh"] = refresh
+		_ = repos.Set(key, repo)
+	}
+	add("hourly", "1h", 2*time.Hour)
+	add("daily", "24h", 2*time.Hour)
+	add("bad", "1h", 3*time.Hour)
+	add("manual", "", 48*time.Hour)
+	add("overdue", "1h", 4*time.Hour)
+
+	rf := NewRefresher(cfg, repos, ix)
+	// the most overdue first, no more than RefreshParallel at once
+	started := rf.poll(start)
+	eq(t, 2, len(started))
+	eq(t, "overdue", started[0])
+	eq(t, "bad", started[1])
+	rf.wg.Wait()
+
+	// each Repo records its schedule
+	daily := repos.Get("daily").(*Repo)
+	if daily.NextRefresh.Before(daily.TimeUpdated.Add(24*time.Hour)) ||
+		daily.NextRefresh.After(daily.TimeUpdated.Add(24*time.Hour+144*time.Minute)) {
+		t.Error("want daily refresh within jitter of a day, got", daily.NextRefresh)
+	}
+	eq(t, true, repos.Get("manual").(*Repo).NextRefresh.IsZero())
+
+	// the updated Repo replaces the old, and the failed one is
+	// left as it was, retried after a delay
+	overdue := repos.Get("overdue").(*Repo)
+	eq(t, true, overdue.TimeUpdated.After(start))
+	eq(t, true, overdue.NextRefresh.After(start.Add(time.Hour)))
+	bad := repos.Get("bad").(*Repo)
+	eq(t, OK, bad.State)
+	eq(t, 1, bad.RefreshFailures)
+	eq(t, "no such directory", bad.RefreshError)
+
+	started = rf.poll(start.Add(time.Second))
+	eq(t, 1, len(started))
+	eq(t, "hourly", started[0])
+	rf.wg.Wait()
+	eq(t, 0, len(rf.poll(start.Add(2*time.Second))))
+
+	// after the backoff, the failed Repo is retried
+	started = rf.poll(start.Add(refreshRetry + time.Second))
+	eq(t, 1, len(started))
+	rf.wg.Wait()
+	eq(t, 2, repos.Get("bad").(*Repo).RefreshFailures)
+
+	// a refresh is not started again while running
+	ix.block = make(chan struct{})
+	started = rf.poll(start.Add(5 * refreshRetry))
+	eq(t, 1, len(started))
+	eq(t, 0, len(rf.poll(start.Add(6*refreshRetry))))
+	close(ix.block)
+	rf.wg.Wait()
+}
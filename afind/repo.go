@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,11 +28,41 @@ type Repo struct {
 	Meta      Meta   `json:"meta"`       // Metadata for this Repo
 	State     string `json:"state"`      // Current repository indexing state
 
+	// The sub directories and files of Root indexed, used
+	// when the Repo is updated
+	Dirs      []string    `json:"dirs,omitempty"`
+	Files     []string    `json:"files,omitempty"`
+	FilesFrom string      `json:"files_from,omitempty"`
+	Rules     *IndexRules `json:"rules,omitempty"`
+
+	// The git revision indexed, if the files were read from the
+	// git repository at Root. The commit indexed is in Meta.
+	Ref string `json:"ref,omitempty"`
+
 	// Metadata produced during indexing
 	NumFiles  int      `json:"num_files"`  // Number of files indexed
 	SizeIndex ByteSize `json:"size_index"` // Size of index
 	SizeData  ByteSize `json:"size_data"`  // Size of the source data
 
+	// Number of files not indexed by category (e.g., binary),
+	// and a sample of their names
+	SkippedFiles  map[string]int      `json:"skipped_files,omitempty"`
+	SkippedSample map[string][]string `json:"skipped_sample,omitempty"`
+
+	// Number of files indexed of each language detected
+	Languages map[string]int `json:"languages,omitempty"`
+
+	// If true, the symbols defined in the files are recorded for
+	// symbol searches, and NumSymbols were found
+	Symbols    bool `json:"symbols,omitempty"`
+	NumSymbols int  `json:"num_symbols,omitempty"`
+
+	// The snapshots kept of the Repo's index, oldest first, and
+	// for Repo in search results, the snapshot searched, if any
+	// (see snapshot.go)
+	Snapshots []Snapshot `json:"snapshots,omitempty"`
+	Snapshot  *Snapshot  `json:"snapshot,omitempty"`
+
 	// Number of separate index files (shards) used for this repo
 	NumShards int `json:"num_shards"`
 
@@ -40,6 +71,13 @@ type Repo struct {
 
 	// When the repo was last updated (used for repo database aging)
 	TimeUpdated time.Time `json:"time_updated"`
+
+	// For Repo with a refresh interval, when the Repo will next be
+	// re-indexed, and the number and last error of failed attempts
+	// since the last success (see refresh.go)
+	NextRefresh     time.Time `json:"next_refresh,omitempty"`
+	RefreshFailures int       `json:"refresh_failures,omitempty"`
+	RefreshError    string    `json:"refresh_error,omitempty"`
 }
 
 // SetMeta updates the Repo's Meta first from defaults, then replace.
@@ -95,6 +133,17 @@ func (m Meta) SetHost(host string) {
 	m["host"] = host
 }
 
+// Priority returns the `priority` key from the metadata as a number,
+// or 0 if it is not set or not a number. Search results from Repo
+// with a higher priority are ranked ahead of those with a lower one.
+func (m Meta) Priority() float64 {
+	p, err := strconv.ParseFloat(m["priority"], 64)
+	if err != nil {
+		return 0
+	}
+	return p
+}
+
 // Matches checks whether some other metadata matches this.
 // Each key in the local object is scanned, and a match occurs either
 // when the key does not exist in the other object, or the key does
@@ -158,6 +207,15 @@ func newRepoFromQuery(q *IndexQuery, ixpath string) *Repo {
 	repo.Key = q.Key
 	repo.Root = q.Root
 	repo.IndexPath = ixpath
+	repo.Dirs = append(repo.Dirs, q.Dirs...)
+	repo.Files = append(repo.Files, q.Files...)
+	repo.FilesFrom = q.FilesFrom
+	repo.Ref = q.Ref
+	repo.Symbols = q.Symbols
+	if !q.IndexRules.IsEmpty() {
+		rules := q.IndexRules
+		repo.Rules = &rules
+	}
 	for k, v := range q.Meta {
 		repo.Meta[k] = v
 	}
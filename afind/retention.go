@@ -0,0 +1,202 @@
+package afind
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andaru/afind/errs"
+)
+
+// Repo retention.
+//
+// The server's Retention rules limit the Repo kept on this host.
+// Each rule applies to the Repo whose metadata has every key and
+// value of the rule's Meta (all Repo, if Meta is empty), and evicts
+// those last updated longer than MaxAge ago, then the least recently
+// updated until no more than MaxRepos remain, and their total index
+// size is no more than MaxSize. Evicted Repo are deleted from the
+// repo database and their index files removed.
+//
+// Only OK and ERROR Repo on this host are evicted; Repo presently
+// indexing, and those indexed on other hosts, are left alone.
+
+// RetentionRule limits the Repo matching Meta. Zero limits are unset.
+type RetentionRule struct {
+	Meta     Meta          `json:"meta,omitempty"`
+	MaxAge   time.Duration `json:"max_age,omitempty"`
+	MaxRepos int           `json:"max_repos,omitempty"`
+	MaxSize  ByteSize      `json:"max_size,omitempty"`
+}
+
+// Reasons Repo are evicted
+const (
+	expiredMaxAge   = "max_age"
+	expiredMaxRepos = "max_repos"
+	expiredMaxSize  = "max_size"
+)
+
+// ParseRetentionRule parses a rule of comma separated limits and
+// metadata, e.g., "max_age=72h,max_size=10GB,meta.ci=true"
+func ParseRetentionRule(s string) (rule RetentionRule, err error) {
+	rule.Meta = make(Meta)
+	for _, kv := range strings.Split(s, ",") {
+		f := strings.SplitN(kv, "=", 2)
+		if len(f) != 2 {
+			return rule, errs.NewValueError("retention", kv+": must be key=value")
+		}
+		switch k, v := f[0], f[1]; {
+		case k == "max_age":
+			rule.MaxAge, err = time.ParseDuration(v)
+		case k == "max_repos":
+			rule.MaxRepos, err = strconv.Atoi(v)
+		case k == "max_size":
+			rule.MaxSize, err = ParseByteSize(v)
+		case strings.HasPrefix(k, "meta.") && len(k) > len("meta."):
+			rule.Meta[k[len("meta."):]] = v
+		default:
+			return rule, errs.NewValueError("retention", kv+": unknown limit")
+		}
+		if err != nil {
+			return rule, errs.NewValueError("retention", kv+": "+err.Error())
+		}
+	}
+	if rule.MaxAge <= 0 && rule.MaxRepos <= 0 && rule.MaxSize <= 0 {
+		return rule, errs.NewValueError("retention", s+": no limit set")
+	}
+	return rule, nil
+}
+
+// selects returns true if the rule applies to the Repo
+func (r RetentionRule) selects(repo *Repo) bool {
+	for k, v := range r.Meta {
+		if rv, ok := repo.Meta[k]; !ok || rv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ExpiredRepo is a Repo evicted by a retention rule
+type ExpiredRepo struct {
+	Key         string    `json:"key"`
+	Reason      string    `json:"reason"`
+	TimeUpdated time.Time `json:"time_updated"`
+	SizeIndex   ByteSize  `json:"size_index"`
+}
+
+// ExpiryReport lists the Repo evicted, or which would be evicted
+// if DryRun is set
+type ExpiryReport struct {
+	DryRun    bool          `json:"dry_run"`
+	Expired   []ExpiredRepo `json:"expired"`
+	SizeIndex ByteSize      `json:"size_index"` // the total index size freed
+}
+
+// ExpireRepos evicts the Repo beyond the server's retention rules.
+// If dryRun is true, the Repo to evict are only reported.
+func ExpireRepos(cfg *Config, repos KeyValueStorer, dryRun bool) *ExpiryReport {
+	return expireRepos(cfg, repos, time.Now(), dryRun)
+}
+
+func expireRepos(cfg *Config, repos KeyValueStorer, now time.Time,
+	dryRun bool) *ExpiryReport {
+
+	report := &ExpiryReport{DryRun: dryRun, Expired: []ExpiredRepo{}}
+	if len(cfg.Retention) == 0 {
+		return report
+	}
+	candidates := []*Repo{}
+	repos.ForEach(func(key string, value interface{}) bool {
+		r := value.(*Repo)
+		if (r.State == OK || r.State == ERROR) && cfg.IsHostLocal(r.Host()) {
+			candidates = append(candidates, r)
+		}
+		return true
+	})
+	// least recently updated first
+	sort.Sort(reposByAge(candidates))
+
+	evicted := make(map[string]bool)
+	evict := func(r *Repo, reason string) {
+		evicted[r.Key] = true
+		report.Expired = append(report.Expired, ExpiredRepo{
+			Key:         r.Key,
+			Reason:      reason,
+			TimeUpdated: r.TimeUpdated,
+			SizeIndex:   r.SizeIndex,
+		})
+		report.SizeIndex += r.SizeIndex
+		if !dryRun {
+			evictRepo(repos, r, reason)
+		}
+	}
+	for _, rule := range cfg.Retention {
+		selected := []*Repo{}
+		var size ByteSize
+		for _, r := range candidates {
+			if evicted[r.Key] || !rule.selects(r) {
+				continue
+			}
+			if rule.MaxAge > 0 && !r.TimeUpdated.IsZero() &&
+				now.Sub(r.TimeUpdated) > rule.MaxAge {
+				evict(r, expiredMaxAge)
+				continue
+			}
+			selected = append(selected, r)
+			size += r.SizeIndex
+		}
+		count := len(selected)
+		for _, r := range selected {
+			switch {
+			case rule.MaxRepos > 0 && count > rule.MaxRepos:
+				evict(r, expiredMaxRepos)
+			case rule.MaxSize > 0 && size > rule.MaxSize:
+				evict(r, expiredMaxSize)
+			default:
+				continue
+			}
+			count--
+			size -= r.SizeIndex
+		}
+	}
+	if len(report.Expired) > 0 {
+		log.Info("expire %d repos (%v index) dry_run=%v",
+			len(report.Expired), report.SizeIndex, dryRun)
+	}
+	return report
+}
+
+// evictRepo deletes the Repo, unless it has been replaced, and
+// removes its index files
+func evictRepo(repos KeyValueStorer, r *Repo, reason string) {
+	if repos.Get(r.Key) != r {
+		return
+	}
+	log.Info("expire repo [%v] %v (updated %v)", r.Key, reason, r.TimeUpdated)
+	if err := repos.Delete(r.Key); err != nil {
+		log.Warning("expire repo [%v] cannot delete: %v", r.Key, err)
+		return
+	}
+	for _, name := range repoIndexFiles(r) {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Warning("expire repo [%v] cannot remove %v: %v", r.Key, name, err)
+		}
+	}
+	_ = r.RemoveSnapshots()
+}
+
+// reposByAge sorts Repo by the time they were last updated, oldest
+// first
+type reposByAge []*Repo
+
+func (s reposByAge) Len() int      { return len(s) }
+func (s reposByAge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s reposByAge) Less(i, j int) bool {
+	if !s[i].TimeUpdated.Equal(s[j].TimeUpdated) {
+		return s[i].TimeUpdated.Before(s[j].TimeUpdated)
+	}
+	return s[i].Key < s[j].Key
+}
@@ -0,0 +1,103 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	rule, err := ParseRetentionRule("max_age=72h,max_repos=5,max_size=1GB,meta.ci=true")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 72*time.Hour, rule.MaxAge)
+	eq(t, 5, rule.MaxRepos)
+	eq(t, GB, rule.MaxSize)
+	eq(t, "true", rule.Meta["ci"])
+
+	for _, s := range []string{"", "meta.ci=true", "max_age", "max_age=3",
+		"max_repos=x", "max_size=1XB", "max_files=3", "meta.=x,max_repos=1"} {
+		if _, err = ParseRetentionRule(s); err == nil {
+			t.Errorf("rule %q: want error, got none", s)
+		}
+	}
+}
+
+func TestExpireRepos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_retention")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	repos := newDb()
+	add := func(key string, age time.Duration, size ByteSize, ci bool) *Repo {
+		r := newRepo(key)
+		r.SetHost("here")
+		r.State = OK
+		r.IndexPath = dir
+		r.NumShards = 1
+		r.SizeIndex = size
+		r.TimeUpdated = now.Add(-age)
+		if ci {
+			r.Meta["ci"] = "true"
+		}
+		_ = ioutil.WriteFile(r.Shards()[0], []byte{}, 0644)
+		_ = repos.Set(key, r)
+		return r
+	}
+	add("ci1", 5*time.Hour, 10, true)
+	add("ci2", 4*time.Hour, 10, true)
+	add("ci3", 3*time.Hour, 10, true)
+	add("ci4", 2*time.Hour, 10, true)
+	add("old", 48*time.Hour, 50, false)
+	add("new", time.Hour, 80, false)
+	add("unknown", 0, 1, false).TimeUpdated = time.Time{}
+	remote := add("remote", 100*time.Hour, 10, true)
+	remote.SetHost("there")
+	_ = repos.Set("indexing", &Repo{Key: "indexing", State: INDEXING, Meta: Meta{}})
+
+	cfg := &Config{RepoMeta: Meta{"host": "here"}}
+	report := expireRepos(cfg, repos, now, false)
+	eq(t, 0, len(report.Expired))
+
+	cfg.Retention = []RetentionRule{
+		{Meta: Meta{"ci": "true"}, MaxAge: 4*time.Hour + time.Minute, MaxRepos: 2},
+		{MaxSize: 100},
+	}
+	report = expireRepos(cfg, repos, now, true)
+	want := []ExpiredRepo{
+		{Key: "ci1", Reason: expiredMaxAge},
+		{Key: "ci2", Reason: expiredMaxRepos},
+		// Repo of unknown age are never too old, but are the
+		// first evicted for space
+		{Key: "unknown", Reason: expiredMaxSize},
+		{Key: "old", Reason: expiredMaxSize},
+	}
+	eq(t, len(want), len(report.Expired))
+	for n := range want {
+		eq(t, want[n].Key, report.Expired[n].Key)
+		eq(t, want[n].Reason, report.Expired[n].Reason)
+	}
+	eq(t, ByteSize(71), report.SizeIndex)
+	eq(t, 9, repos.Size())
+
+	report = expireRepos(cfg, repos, now, false)
+	eq(t, false, report.DryRun)
+	eq(t, 4, len(report.Expired))
+	eq(t, 5, repos.Size())
+	for _, key := range []string{"ci1", "ci2", "old"} {
+		eq(t, nil, repos.Get(key))
+		if _, err = os.Stat(path.Join(dir, shardName(key, 0))); err == nil {
+			t.Error("want index files removed for", key)
+		}
+	}
+	if _, err = os.Stat(path.Join(dir, shardName("ci3", 0))); err != nil {
+		t.Error("want index files kept for ci3, got", err)
+	}
+	eq(t, 0, len(expireRepos(cfg, repos, now, false).Expired))
+}
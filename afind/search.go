@@ -2,6 +2,7 @@ package afind
 
 import (
 	"os"
+	"strconv"
 	"time"
 
 	"code.google.com/p/go.net/context"
@@ -41,8 +42,33 @@ type SearchQuery struct {
 	Re string `json:"re"`
 	// a regular expression to match filenames with search matches
 	PathRe string `json:"path_re"`
+	// files with names matching any of these regular expressions
+	// are not searched
+	ExcludePathRe []string `json:"exclude_path_re,omitempty"`
 	// if true, perform case insensitive searches
 	IgnoreCase bool `json:"i"`
+	// if true, Re is a fixed string rather than a regular expression
+	Literal bool `json:"literal,omitempty"`
+	// if true, Re must match whole words
+	Word bool `json:"word,omitempty"`
+	// if true, perform case insensitive searches unless Re
+	// contains an uppercase letter
+	SmartCase bool `json:"smart_case,omitempty"`
+	// A boolean query combining regular expression terms, file
+	// name, Repo and metadata qualifiers (see query.go). If set,
+	// Re is ignored.
+	Query string `json:"query,omitempty"`
+
+	// Search only files of these languages (e.g., "go"), if not
+	// empty (see language.go)
+	Languages []string `json:"languages,omitempty"`
+
+	// If set, search the snapshot of each Repo with this label (or
+	// whose git commit begins with it) rather than its current
+	// index, or if AsOf is set, the last snapshot taken at or
+	// before then (see snapshot.go)
+	Snapshot string    `json:"snapshot,omitempty"`
+	AsOf     time.Time `json:"as_of,omitempty"`
 
 	// Repository filtering attributes
 	// Search only these repositories if not empty
@@ -54,12 +80,15 @@ type SearchQuery struct {
 	MetaRegexpMatch bool `json:"meta_use_regexp,omitempty"`
 	// Metadata based replica detection. Repo are considered
 	// replica if their values of this Meta key equal. Meta
-	// without this key are never considered replicas.
-	MetaReplicaKey string
+	// without this key are never considered replicas. Each
+	// group of replicas is searched as one logical source,
+	// preferring the least loaded and fastest replica, and
+	// failing over to another replica if one is unavailable.
+	MetaReplicaKey string `json:"meta_replica_key,omitempty"`
 	// The maximum number of replicas to query when a
 	// MetaReplicaKey is provided. If 0, all available replicas
 	// are queried.
-	MetaReplicaMax int
+	MetaReplicaMax int `json:"meta_replica_max,omitempty"`
 
 	// Search context (number of lines ahead, behind or both)
 	Context SearchContext `json:"context"`
@@ -67,6 +96,19 @@ type SearchQuery struct {
 	// Maximum number of matches to return
 	MaxMatches uint64 `json:"max_matches"`
 
+	// The Next cursor of the previous page of results, to
+	// continue the search from where that page ended
+	Cursor string `json:"cursor,omitempty"`
+
+	// If true, report the position of each match and submatch
+	// within the matching lines in the result's Positions.
+	Positions bool `json:"positions,omitempty"`
+
+	// If true, files with identical contents are searched and
+	// reported separately, rather than once with the others
+	// listed in the result's Duplicates (see dedup.go).
+	NoDedup bool `json:"no_dedup,omitempty"`
+
 	// Override the 30 second default request timeout
 	Timeout time.Duration `json:"timeout"`
 
@@ -79,11 +121,44 @@ type SearchQuery struct {
 
 // SearchContext provides options around the lines of context
 // surrounding the match text. By default, no additional context is
-// supplied.
+// supplied. As with grep, Pre and Post take precedence over Both
+// for the leading and trailing context respectively, if non-zero or
+// if PreSet or PostSet is true (so that an explicit zero applies).
 type SearchContext struct {
-	Both int `json:"both"`
-	Pre  int `json:"pre"`
-	Post int `json:"post"`
+	Both    int  `json:"both"`
+	Pre     int  `json:"pre"`
+	Post    int  `json:"post"`
+	PreSet  bool `json:"pre_set,omitempty"`
+	PostSet bool `json:"post_set,omitempty"`
+}
+
+// Lines returns the number of lines of leading and trailing context
+// to report.
+func (c SearchContext) Lines() (npre, npost int) {
+	npre, npost = c.Both, c.Both
+	if c.Pre > 0 || c.PreSet {
+		npre = c.Pre
+	}
+	if c.Post > 0 || c.PostSet {
+		npost = c.Post
+	}
+	return
+}
+
+// MatchPosition is the location of a match, or of a submatch of a
+// capture group, within a matching line. Start and End are byte
+// offsets and RuneStart and RuneEnd are rune (character) offsets
+// from the start of the line, with End and RuneEnd exclusive.
+type MatchPosition struct {
+	// The capture group index; 0 is the whole match
+	Group int `json:"group"`
+	// The capture group name, if the group is named
+	Name string `json:"name,omitempty"`
+
+	Start     int `json:"start"`
+	End       int `json:"end"`
+	RuneStart int `json:"rune_start"`
+	RuneEnd   int `json:"rune_end"`
 }
 
 // NewSearchQuery returns a SearchQuery value given the parameters
@@ -113,12 +188,36 @@ type matchMap map[string]repoMatchMap
 // A search Result.
 // The same SearchResult struct is used throughout the searcher so that
 // pipelines and context can be used to easily manage and merge
-// concurrent results. The results are unranked.
+// concurrent results. The files with matches are ranked once all
+// results have been merged, see Rank.
 type SearchResult struct {
 	// Matches per file, repo key and line number to text of lines matching.
 	// This can be populated even if Errors, below, does contain values.
 	Matches map[string]map[string]map[string]string `json:"matches"`
 
+	// Context lines surrounding the matches, keyed as for Matches.
+	// Lines which match are never reported as context.
+	Context map[string]map[string]map[string]string `json:"context,omitempty"`
+
+	// Positions of the matches and submatches in each matching
+	// line, keyed as for Matches. Only populated if the query
+	// requested Positions.
+	Positions map[string]map[string]map[string][]MatchPosition `json:"positions,omitempty"`
+
+	// The sums of the contents of the files in Matches, keyed by
+	// file and Repo key. Files with equal sums have identical
+	// contents. Files changed since they were indexed have none.
+	Sums map[string]map[string]string `json:"sums,omitempty"`
+
+	// The symbols defined on the lines in Matches, keyed as for
+	// Positions. Only populated for symbol searches.
+	Symbols map[string]map[string]map[string][]Symbol `json:"symbols,omitempty"`
+
+	// The other files with the contents and lines of a file in
+	// Matches, keyed as for Matches. Unless the query had NoDedup
+	// set, these files are not in Matches themselves.
+	Duplicates map[string]map[string][]FileRef `json:"duplicates,omitempty"`
+
 	// Per repo (or hostname) keys. Errors due to network
 	// connection or errors reported by remote afindd instances.
 	Errors map[string]*errs.StructError `json:"errors,omitempty"`
@@ -137,6 +236,18 @@ type SearchResult struct {
 
 	// Query time information.
 	Durations SearchDurations `json:"durations"`
+
+	// The files in Matches, ordered from best to worst rank
+	Ranked []RankedFile `json:"ranked,omitempty"`
+
+	// The cursor to pass in the query for the next page of
+	// results, if there may be more
+	Next string `json:"next,omitempty"`
+
+	// The position reached in each shard searched, and where in
+	// the shards each file was found, used to produce Next
+	Progress Cursor                           `json:"-"`
+	Sources  map[string]map[string]FileSource `json:"-"`
 }
 
 type SearchDurations struct {
@@ -148,13 +259,34 @@ type SearchDurations struct {
 	CombinedSearch       time.Duration `json:"combined_total"`
 }
 
+// SearchFrame is one frame of a streaming search response. Each
+// frame but the last holds the lines found in one file of one
+// Repo. The last frame holds only the Summary of the search.
+type SearchFrame struct {
+	File      string                     `json:"file,omitempty"`
+	RepoKey   string                     `json:"repo_key,omitempty"`
+	Matches   map[string]string          `json:"matches,omitempty"`
+	Context   map[string]string          `json:"context,omitempty"`
+	Positions map[string][]MatchPosition `json:"positions,omitempty"`
+	Sum       string                     `json:"sum,omitempty"`
+	Symbols   map[string][]Symbol        `json:"symbols,omitempty"`
+
+	// The search errors, Repos, durations and total match
+	// count, without any matches. Set on the final frame only.
+	Summary *SearchResult `json:"summary,omitempty"`
+}
+
 // Returns a pointer to an initialized search Result.
 func NewSearchResult() *SearchResult {
 	return &SearchResult{
 		Matches:   make(map[string]map[string]map[string]string),
+		Context:   make(map[string]map[string]map[string]string),
+		Positions: make(map[string]map[string]map[string][]MatchPosition),
 		Errors:    make(map[string]*errs.StructError),
 		Repos:     make(map[string]*Repo),
 		Durations: SearchDurations{},
+		Progress:  Cursor{},
+		Sources:   make(map[string]map[string]FileSource),
 	}
 }
 
@@ -183,6 +315,104 @@ func (r *SearchResult) Update(other *SearchResult) {
 			r.AddFileRepoMatches(file, repo, matches)
 		}
 	}
+	for file, rcontext := range other.Context {
+		for repo, context := range rcontext {
+			r.AddFileRepoContext(file, repo, context)
+		}
+	}
+	for file, rpositions := range other.Positions {
+		for repo, positions := range rpositions {
+			r.AddFileRepoPositions(file, repo, positions)
+		}
+	}
+	for file, rsymbols := range other.Symbols {
+		for repo, symbols := range rsymbols {
+			r.AddFileRepoSymbols(file, repo, symbols)
+		}
+	}
+	for file, rsums := range other.Sums {
+		for repo, sum := range rsums {
+			r.addFileRepoSum(file, repo, sum)
+		}
+	}
+	for file, rdups := range other.Duplicates {
+		for repo, dups := range rdups {
+			r.addFileRepoDuplicates(file, repo, dups)
+		}
+	}
+	if r.Progress == nil {
+		r.Progress = Cursor{}
+	}
+	r.Progress.Update(other.Progress)
+	for file, rsources := range other.Sources {
+		for repo, source := range rsources {
+			r.addFileRepoSource(file, repo, source)
+		}
+	}
+}
+
+// Frames returns the matches in the result as one SearchFrame per
+// file and Repo.
+func (r *SearchResult) Frames() []*SearchFrame {
+	frames := make([]*SearchFrame, 0, len(r.Matches))
+	for file, rmatches := range r.Matches {
+		for repo, matches := range rmatches {
+			frames = append(frames, &SearchFrame{
+				File:      file,
+				RepoKey:   repo,
+				Matches:   matches,
+				Context:   r.Context[file][repo],
+				Positions: r.Positions[file][repo],
+				Sum:       r.Sums[file][repo],
+				Symbols:   r.Symbols[file][repo],
+			})
+		}
+	}
+	return frames
+}
+
+// Truncated returns a copy of the frame keeping only its first max
+// matching lines. Context lines after the last line kept are
+// dropped along with the matching lines removed.
+func (f *SearchFrame) Truncated(max int) *SearchFrame {
+	lines := sortedLines(f.Matches)
+	if max >= len(lines) {
+		return f
+	}
+	first, _ := strconv.Atoi(lines[max])
+	t := *f
+	t.Matches = make(map[string]string)
+	t.Context = make(map[string]string)
+	t.Positions = make(map[string][]MatchPosition)
+	t.Symbols = make(map[string][]Symbol)
+	for _, lineno := range lines[:max] {
+		t.Matches[lineno] = f.Matches[lineno]
+		if pos, ok := f.Positions[lineno]; ok {
+			t.Positions[lineno] = pos
+		}
+		if syms, ok := f.Symbols[lineno]; ok {
+			t.Symbols[lineno] = syms
+		}
+	}
+	for lineno, text := range f.Context {
+		if n, err := strconv.Atoi(lineno); err == nil && n < first {
+			t.Context[lineno] = text
+		}
+	}
+	return &t
+}
+
+// Summary returns a copy of the result without its matches
+func (r *SearchResult) Summary() *SearchResult {
+	summary := NewSearchResult()
+	summary.Errors = r.Errors
+	summary.Error = r.Error
+	summary.NumMatches = r.NumMatches
+	summary.Repos = r.Repos
+	summary.MaxMatches = r.MaxMatches
+	summary.Durations = r.Durations
+	summary.Next = r.Next
+	return summary
 }
 
 func (r *SearchResult) enoughResults() bool {
@@ -214,6 +444,61 @@ func (r *SearchResult) AddFileRepoMatches(
 	}
 }
 
+// AddFileRepoContext adds context lines for the file in the repo.
+// Context lines do not count towards NumMatches.
+func (r *SearchResult) AddFileRepoContext(
+	fname, repokey string,
+	context fileMap) {
+
+	if len(context) == 0 {
+		return
+	}
+	if r.Context == nil {
+		r.Context = make(map[string]map[string]map[string]string)
+	}
+	if _, ok := r.Context[fname]; !ok {
+		r.Context[fname] = make(map[string]map[string]string)
+	}
+	if _, ok := r.Context[fname][repokey]; !ok {
+		r.Context[fname][repokey] = make(fileMap)
+	}
+	for k, v := range context {
+		r.Context[fname][repokey][k] = v
+	}
+}
+
+// AddFileRepoPositions adds match positions for the file in the repo.
+func (r *SearchResult) AddFileRepoPositions(
+	fname, repokey string,
+	positions map[string][]MatchPosition) {
+
+	if len(positions) == 0 {
+		return
+	}
+	if r.Positions == nil {
+		r.Positions = make(map[string]map[string]map[string][]MatchPosition)
+	}
+	if _, ok := r.Positions[fname]; !ok {
+		r.Positions[fname] = make(map[string]map[string][]MatchPosition)
+	}
+	if _, ok := r.Positions[fname][repokey]; !ok {
+		r.Positions[fname][repokey] = make(map[string][]MatchPosition)
+	}
+	for k, v := range positions {
+		r.Positions[fname][repokey][k] = v
+	}
+}
+
+func (r *SearchResult) addFileRepoSource(fname, repokey string, source FileSource) {
+	if r.Sources == nil {
+		r.Sources = make(map[string]map[string]FileSource)
+	}
+	if _, ok := r.Sources[fname]; !ok {
+		r.Sources[fname] = make(map[string]FileSource)
+	}
+	r.Sources[fname][repokey] = source
+}
+
 // The Searcher implementation
 type searcher struct {
 	cfg   *Config
@@ -248,6 +533,7 @@ func (s searcher) Search(ctx context.Context, query SearchQuery) (
 		irepo      interface{}
 		waitingFor int
 		ch         chan *SearchResult
+		cursor     Cursor
 	)
 	resp = NewSearchResult()
 
@@ -269,6 +555,10 @@ func (s searcher) Search(ctx context.Context, query SearchQuery) (
 	}
 	repo = irepo.(*Repo)
 	resp.Repos[repokey] = repo
+	if cursor, err = DecodeCursor(query.Cursor); err != nil {
+		resp.SetError(err)
+		goto done
+	}
 
 	if repo.State == INDEXING {
 		// The repo is (con)currently indexing
@@ -283,19 +573,42 @@ func (s searcher) Search(ctx context.Context, query SearchQuery) (
 		goto done
 	}
 
+	if snap := query.searchedRepo(repo); snap != nil && snap != repo {
+		// search the snapshot's shards in place of the Repo's
+		repo = snap
+		resp.Repos[repokey] = repo
+	}
+	if err = cursor.checkGeneration(repo); err != nil {
+		resp.SetError(err)
+		goto done
+	}
 	shards = repo.Shards()
+	if !query.MayMatchRepo(repo) {
+		// nothing in this repo can match the query
+		for n := range shards {
+			resp.Progress.Set(repokey, n, ShardPosition{Id: lastPostingId})
+		}
+		goto done
+	}
 	waitingFor = len(shards)
 	ch = make(chan *SearchResult, waitingFor+1)
-	defer close(ch)
 
-	for _, shard := range shards {
-		go func(r *Repo, fname string) {
-			sr, e := searchLocal(ctx, query, r, fname)
+	for n, shard := range shards {
+		pos := cursor.Position(repokey, n)
+		if pos.Done() {
+			// nothing more to return from this shard
+			resp.Progress.Set(repokey, n, pos)
+			waitingFor--
+			continue
+		}
+		go func(r *Repo, fname string, n int, pos ShardPosition) {
+			sr, e := searchLocal(ctx, s.cfg, query, r, fname, n, pos)
 			sr.Repos[r.Key] = r
 			if e != nil {
 				// Report the error, possibly marking the repo as unavailable
 				// and if so, potentially deleting it if configured to do so.
-				if os.IsNotExist(e) || os.IsPermission(e) {
+				// A snapshot's missing shards leave the Repo available.
+				if (os.IsNotExist(e) || os.IsPermission(e)) && r.Snapshot == nil {
 					log.Warning("repo [%s] not available error: %v", r.Key, e)
 					r.State = ERROR
 					sr.Errors[r.Key] = errs.NewStructError(
@@ -312,26 +625,27 @@ func (s searcher) Search(ctx context.Context, query SearchQuery) (
 			}
 			select {
 			case <-ctx.Done():
-				// Report the timeout
-				resp.Errors[repokey] = kSearchTimeoutError
 			default:
 				ch <- sr
 			}
 
-		}(repo, shard)
+		}(repo, shard, n, pos)
 	}
 
 	// Await goroutine completion either in error or otherwise
 	for waitingFor > 0 {
 		select {
 		case <-ctx.Done():
-			break
+			// Report the timeout
+			resp.Errors[repokey] = kSearchTimeoutError
+			waitingFor = 0
 		case in := <-ch:
 			log.Debug("got one %q", in)
 			resp.Update(in)
 			waitingFor--
 		}
 	}
+	resp.Progress.setGeneration(repokey, repo.generation())
 done:
 	resp.Durations.Search = sw.Stop("total")
 	log.Info("search [%s] [path %s] local done %d matches errors=%v (%v)",
@@ -340,21 +654,74 @@ done:
 }
 
 // search an individiaul afindex search for the repo for the request
-func searchLocal(ctx context.Context, req SearchQuery, repo *Repo, fname string) (
-	resp *SearchResult, err error) {
-	sr, err := newGrep(fname, repo.Root, getFileSystem(ctx, repo.Root)).search(ctx, req)
+func searchLocal(ctx context.Context, cfg *Config, req SearchQuery, repo *Repo,
+	fname string, shard int, pos ShardPosition) (resp *SearchResult, err error) {
+	fs, release, err := repoFileSystem(ctx, cfg, repo)
+	if err != nil {
+		return NewSearchResult(), err
+	}
+	defer release()
+	g := newGrep(fname, repo.Root, fs)
+	g.repo = repo
+	g.greps = searchDedup(ctx)
+	if _, ok := req.symbolName(); ok {
+		sr, err := g.searchSymbols(ctx, req, shard, pos)
+		sr.Repos[repo.Key] = repo
+		return sr, err
+	}
+	sr, err := g.search(ctx, req, shard, pos)
 	sr.Repos[repo.Key] = repo
 	return sr, err
 }
 
 func (q *SearchQuery) Normalize() error {
 	// Validate
-	if len(q.Re) < 3 {
+	if q.Query != "" {
+		if _, err := parseQuery(q.Query,
+			q.Literal, q.Word, q.IgnoreCase, q.SmartCase); err != nil {
+			return err
+		}
+	} else if len(q.Re) < 3 {
 		return errs.NewValueError("re", "must be at least 3 characters")
+	} else if name, ok := q.symbolName(); ok && name == "" {
+		return errs.NewValueError("re", "must name the symbols to find after "+symbolPrefix)
+	}
+	if q.Snapshot != "" && !q.AsOf.IsZero() {
+		return errs.NewValueError("snapshot", "must not be set with as_of")
+	}
+	if _, err := excludeRegexp(q.ExcludePathRe); err != nil {
+		return err
+	}
+	if _, err := newLanguageSet(q.Languages); err != nil {
+		return err
+	}
+	if _, err := DecodeCursor(q.Cursor); err != nil {
+		return err
 	}
 	return nil
 }
 
+// MayMatchRepo returns false if the query's qualifiers or languages
+// exclude all files in the Repo, the query is a symbol search and
+// the Repo has no symbols recorded, or the query targets a snapshot
+// the Repo does not have.
+func (q *SearchQuery) MayMatchRepo(repo *Repo) bool {
+	if repo = q.searchedRepo(repo); repo == nil {
+		return false
+	}
+	if _, ok := q.symbolName(); ok && repo.NumSymbols == 0 {
+		return false
+	}
+	if langs, err := newLanguageSet(q.Languages); err == nil && !langs.mayMatchRepo(repo) {
+		return false
+	}
+	if q.Query == "" {
+		return true
+	}
+	bq, err := parseQuery(q.Query, q.Literal, q.Word, q.IgnoreCase, q.SmartCase)
+	return err != nil || bq.eval(queryEnv{repo: repo}) != tsFalse
+}
+
 // SetError sets the Error attribute appropriately
 func (sr *SearchResult) SetError(err error) {
 	if e, ok := err.(*errs.StructError); ok {
@@ -1,6 +1,9 @@
 package afind
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"testing"
 
 	"code.google.com/p/go.net/context"
@@ -17,6 +20,34 @@ func TestSearchQuery(t *testing.T) {
 	eq(t, "", nokeys.firstKey())
 }
 
+func TestSearchContextLines(t *testing.T) {
+	// -A 0 -C 3 survives the trip over RPC
+	var buf bytes.Buffer
+	sent := SearchContext{Both: 3, PostSet: true}
+	if err := gob.NewEncoder(&buf).Encode(sent); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var got SearchContext
+	if err := gob.NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	npre, npost := got.Lines()
+	eq(t, 3, npre)
+	eq(t, 0, npost)
+
+	// zero Pre and Post of older clients use Both
+	got = SearchContext{}
+	_ = json.Unmarshal([]byte(`{"both": 2, "pre": 0, "post": 0}`), &got)
+	npre, npost = got.Lines()
+	eq(t, 2, npre)
+	eq(t, 2, npost)
+	got = SearchContext{}
+	_ = json.Unmarshal([]byte(`{"both": 2, "pre": 1}`), &got)
+	npre, npost = got.Lines()
+	eq(t, 1, npre)
+	eq(t, 2, npost)
+}
+
 func TestSearchResult(t *testing.T) {
 	r := NewSearchResult()
 	// these will panic with an uninit map error if
@@ -32,6 +63,26 @@ func TestSearchResult(t *testing.T) {
 	eq(t, text+"2", r.Matches["filename.txt"]["key1"]["2"])
 }
 
+func TestSearchFrameTruncated(t *testing.T) {
+	f := &SearchFrame{
+		File:      "f.go",
+		Matches:   map[string]string{"2": "two\n", "10": "ten\n", "5": "five\n"},
+		Context:   map[string]string{"1": "one\n", "3": "three\n", "11": "eleven\n"},
+		Positions: map[string][]MatchPosition{"10": {{Start: 0, End: 3}}},
+	}
+	eq(t, f, f.Truncated(3))
+	tf := f.Truncated(2)
+	eq(t, "f.go", tf.File)
+	eq(t, 2, len(tf.Matches))
+	eq(t, "five\n", tf.Matches["5"])
+	eq(t, 0, len(tf.Positions))
+	eq(t, 2, len(tf.Context))
+	eq(t, "", tf.Context["11"])
+	// the frame itself is unchanged
+	eq(t, 3, len(f.Matches))
+	eq(t, 3, len(f.Context))
+}
+
 type _testContext struct {
 	ix     indexer
 	sr     searcher
@@ -121,4 +172,27 @@ func TestSearch(t *testing.T) {
 	if len(sr.Matches) != 3 {
 		t.Error("want 3 files matched, got", len(sr.Matches))
 	}
+
+	// Positions are only reported when requested
+	if len(sr.Positions) != 0 {
+		t.Error("want no positions, got", len(sr.Positions))
+	}
+	query.Positions = true
+	sr, err = test.sr.Search(test.ctx, query)
+	if err != nil {
+		t.Error("search unexpected error:", err)
+	}
+	pos := sr.Positions["src/hasbar/bar1.go"][kixKey1]["2"]
+	if len(pos) != 1 || pos[0].Start != 13 || pos[0].End != 16 {
+		t.Errorf("unexpected positions %#v", pos)
+	}
+}
+
+func TestSearchResultSummary(t *testing.T) {
+	r := NewSearchResult()
+	r.AddFileRepoMatches("f.txt", "key1", map[string]string{"1": "one"})
+	r.Next = "cursor"
+	summary := r.Summary()
+	eq(t, 0, len(summary.Matches))
+	eq(t, "cursor", summary.Next)
 }
@@ -0,0 +1,380 @@
+package afind
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andaru/afind/utils"
+)
+
+// Index snapshots.
+//
+// A Repo whose Meta has a "snapshots" count (e.g., "10") keeps up to
+// that many snapshots of its index. Each time the Repo is indexed or
+// updated, its shards and manifest are linked (or copied, where they
+// cannot be linked) into a directory of their own beside the Repo's
+// index files, and the snapshot is recorded in the Repo's Snapshots,
+// oldest first. As updates replace shards by renaming new files over
+// them, a snapshot keeps the shards as they were. Updates changing no
+// shards take no snapshot, unless given a label.
+//
+// Snapshots are labelled by the IndexQuery's Snapshot, or else by the
+// commit indexed, for Repo indexed from git, or else by the time. A
+// snapshot replaces any other with the same label. The oldest
+// snapshots are removed until no more than the count remain, as are
+// those taken longer ago than the Meta's "snapshot_max_age" (e.g.,
+// "720h") when the Repo is next indexed, though the newest is always
+// kept. Indexing a Repo afresh, rather than updating it, starts its
+// snapshots anew, as does deleting it.
+//
+// A SearchQuery with a Snapshot label, or an AsOf time, searches the
+// snapshot of each Repo with that label, or the last one taken at or
+// before that time, in place of its current index. Repo without such
+// a snapshot are not searched. Files indexed from git are read from
+// the snapshot's commit. Others are read as they are now, so files
+// changed since the snapshot was taken are skipped, rather than
+// reporting content the snapshot never held.
+
+const (
+	// the suffix of the directory holding a Repo's snapshots
+	snapshotsSuffix = ".snapshots"
+	// the length of the commit ids labelling snapshots by default
+	snapshotCommitLength = 12
+	// the shortest commit id prefix finding a snapshot
+	minSnapshotCommitPrefix = 7
+)
+
+// A Snapshot is a generation of a Repo's index kept for searching
+type Snapshot struct {
+	ID     int       `json:"id"`               // Numbers the snapshot's directory
+	Label  string    `json:"label"`            // Unique within the Repo
+	Time   time.Time `json:"time"`             // When the generation was indexed
+	Commit string    `json:"commit,omitempty"` // The git commit indexed, if any
+
+	// The Repo's index when the snapshot was taken
+	NumShards  int            `json:"num_shards"`
+	NumFiles   int            `json:"num_files"`
+	SizeIndex  ByteSize       `json:"size_index"`
+	SizeData   ByteSize       `json:"size_data"`
+	Symbols    bool           `json:"symbols,omitempty"`
+	NumSymbols int            `json:"num_symbols,omitempty"`
+	Languages  map[string]int `json:"languages,omitempty"`
+}
+
+// Snapshots returns the `snapshots` key from the metadata as a
+// number, or 0 if it is not set or not valid. Repo with a number of
+// snapshots keep that many snapshots of their index.
+func (m Meta) Snapshots() int {
+	n, err := strconv.Atoi(m["snapshots"])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// SnapshotMaxAge returns the `snapshot_max_age` key from the metadata
+// as a duration, or 0 if it is not set or not valid
+func (m Meta) SnapshotMaxAge() time.Duration {
+	d, err := time.ParseDuration(m["snapshot_max_age"])
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// validateSnapshots returns an error if the metadata's snapshot
+// limits are set but not valid
+func (m Meta) validateSnapshots() error {
+	if s, ok := m["snapshots"]; ok && s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 0 {
+			return fmt.Errorf("snapshots %q must be a number of snapshots to keep", s)
+		}
+	}
+	if s, ok := m["snapshot_max_age"]; ok && s != "" && m.SnapshotMaxAge() == 0 {
+		return fmt.Errorf("snapshot_max_age %q must be a positive duration", s)
+	}
+	return nil
+}
+
+// snapshotsPath returns the directory holding the snapshots of the
+// Repo key whose index files are in ixpath
+func snapshotsPath(ixpath, key string) string {
+	return path.Join(ixpath, key+snapshotsSuffix)
+}
+
+// snapshotPath returns the directory holding the Repo's snapshot
+func snapshotPath(repo *Repo, id int) string {
+	return path.Join(snapshotsPath(repo.IndexPath, repo.Key), strconv.Itoa(id))
+}
+
+// newSnapshot returns the snapshot of the Repo just indexed, with
+// the label, numbered after the Repo's earlier snapshots prev
+func newSnapshot(repo *Repo, label string, prev []Snapshot) Snapshot {
+	s := Snapshot{
+		ID:         1,
+		Label:      label,
+		Time:       repo.TimeUpdated,
+		Commit:     repo.Meta.GitCommit(),
+		NumShards:  repo.NumShards,
+		NumFiles:   repo.NumFiles,
+		SizeIndex:  repo.SizeIndex,
+		SizeData:   repo.SizeData,
+		Symbols:    repo.Symbols,
+		NumSymbols: repo.NumSymbols,
+		Languages:  repo.Languages,
+	}
+	for _, p := range prev {
+		if p.ID >= s.ID {
+			s.ID = p.ID + 1
+		}
+	}
+	if s.Label != "" {
+		return s
+	} else if s.Commit != "" {
+		s.Label = s.Commit[:utils.MinInt(len(s.Commit), snapshotCommitLength)]
+	} else {
+		s.Label = s.Time.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// takeSnapshot links the Repo's index files into the directory of
+// the snapshot
+func takeSnapshot(repo *Repo, s Snapshot) error {
+	dir := snapshotPath(repo, s.ID)
+	// a directory left by a Repo of the same key, since deleted
+	_ = os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names := append(repo.Shards(), manifestName(repo.IndexPath, repo.Key))
+	if repo.Symbols {
+		names = append(names, symbolsName(repo.IndexPath, repo.Key))
+	}
+	for _, name := range names {
+		if err := linkFile(name, path.Join(dir, path.Base(name))); err != nil {
+			_ = os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// linkFile hard links the file src to dst, or copies it if it
+// cannot be linked
+func linkFile(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// addSnapshot appends the snapshot s, returning the snapshots kept
+// and those it replaces, having the same label
+func addSnapshot(snaps []Snapshot, s Snapshot) (kept, dropped []Snapshot) {
+	kept = make([]Snapshot, 0, len(snaps)+1)
+	for _, p := range snaps {
+		if p.Label == s.Label {
+			dropped = append(dropped, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	return append(kept, s), dropped
+}
+
+// pruneSnapshots returns the snapshots kept within the limits of no
+// more than max snapshots, none older than maxAge (if non-zero)
+// but the newest, and those dropped.
+func pruneSnapshots(snaps []Snapshot, max int, maxAge time.Duration,
+	now time.Time) (kept, dropped []Snapshot) {
+
+	kept = make([]Snapshot, 0, len(snaps))
+	for n, s := range snaps {
+		newest := n == len(snaps)-1
+		switch {
+		case len(snaps)-n > max:
+			dropped = append(dropped, s)
+		case maxAge > 0 && now.Sub(s.Time) > maxAge && !newest:
+			dropped = append(dropped, s)
+		default:
+			kept = append(kept, s)
+		}
+	}
+	return kept, dropped
+}
+
+// snapshot records a snapshot of the Repo just indexed, unless the
+// update changed nothing, and removes the snapshots beyond the
+// Repo's limits. The Repo's earlier snapshots are those of the Repo
+// updated.
+func (i indexer) snapshot(repo *Repo, req *IndexQuery, changed bool) {
+	var prev []Snapshot
+	if old, ok := i.repos.Get(req.Key).(*Repo); ok && req.Update {
+		prev = old.Snapshots
+	} else if err := repo.RemoveSnapshots(); err != nil {
+		// those of a Repo of the same key indexed before
+		log.Warning("index [%v] cannot remove old snapshots: %v", req.Key, err)
+	}
+	max := repo.Meta.Snapshots()
+	if max == 0 && len(prev) == 0 {
+		return
+	}
+	snaps, dropped := prev, []Snapshot(nil)
+	if max > 0 && (changed || req.Snapshot != "" || len(prev) == 0) {
+		s := newSnapshot(repo, req.Snapshot, prev)
+		if err := takeSnapshot(repo, s); err != nil {
+			log.Warning("index [%v] cannot take snapshot %v: %v", req.Key, s.Label, err)
+		} else {
+			log.Info("index [%v] snapshot %v", req.Key, s.Label)
+			snaps, dropped = addSnapshot(snaps, s)
+		}
+	}
+	snaps, expired := pruneSnapshots(snaps, max, repo.Meta.SnapshotMaxAge(), time.Now())
+	for _, s := range append(dropped, expired...) {
+		log.Info("index [%v] removing snapshot %v", req.Key, s.Label)
+		if err := os.RemoveAll(snapshotPath(repo, s.ID)); err != nil {
+			log.Warning("index [%v] cannot remove snapshot %v: %v", req.Key, s.Label, err)
+		}
+	}
+	if len(snaps) > 0 {
+		repo.Snapshots = snaps
+	}
+}
+
+// snapshotFiles returns the names of the index files of the Repo's
+// snapshots
+func snapshotFiles(repo *Repo) []string {
+	names := []string{}
+	for _, s := range repo.Snapshots {
+		dir := snapshotPath(repo, s.ID)
+		for n := 0; n < s.NumShards; n++ {
+			names = append(names, path.Join(dir, shardName(repo.Key, n)))
+		}
+		names = append(names, manifestName(dir, repo.Key))
+		if s.Symbols {
+			names = append(names, symbolsName(dir, repo.Key))
+		}
+	}
+	return names
+}
+
+// findSnapshot returns the Repo's snapshot with the label, or else
+// the newest whose git commit begins with it
+func (r *Repo) findSnapshot(label string) (Snapshot, bool) {
+	for n := len(r.Snapshots) - 1; n >= 0; n-- {
+		if r.Snapshots[n].Label == label {
+			return r.Snapshots[n], true
+		}
+	}
+	if len(label) < minSnapshotCommitPrefix {
+		return Snapshot{}, false
+	}
+	for n := len(r.Snapshots) - 1; n >= 0; n-- {
+		if strings.HasPrefix(r.Snapshots[n].Commit, label) {
+			return r.Snapshots[n], true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// snapshotAsOf returns the Repo's last snapshot taken at or before t
+func (r *Repo) snapshotAsOf(t time.Time) (Snapshot, bool) {
+	for n := len(r.Snapshots) - 1; n >= 0; n-- {
+		if !r.Snapshots[n].Time.After(t) {
+			return r.Snapshots[n], true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// atSnapshot returns a copy of the Repo whose index is the snapshot
+func (r *Repo) atSnapshot(s Snapshot) *Repo {
+	c := *r
+	c.IndexPath = snapshotPath(r, s.ID)
+	c.NumShards = s.NumShards
+	c.NumFiles = s.NumFiles
+	c.SizeIndex = s.SizeIndex
+	c.SizeData = s.SizeData
+	c.Symbols = s.Symbols
+	c.NumSymbols = s.NumSymbols
+	c.Languages = s.Languages
+	c.TimeUpdated = s.Time
+	c.Meta = make(Meta)
+	c.Meta.Update(r.Meta)
+	if s.Commit != "" {
+		c.Meta["git_commit"] = s.Commit
+	}
+	c.Snapshots = nil
+	c.Snapshot = &s
+	return &c
+}
+
+// RemoveSnapshots removes the files of the Repo's snapshots, and
+// any left by an earlier Repo of the same key
+func (r *Repo) RemoveSnapshots() error {
+	if r.IndexPath == "" {
+		return nil
+	}
+	return os.RemoveAll(snapshotsPath(r.IndexPath, r.Key))
+}
+
+// targetsSnapshot returns true if the query searches snapshots
+func (q *SearchQuery) targetsSnapshot() bool {
+	return q.Snapshot != "" || !q.AsOf.IsZero()
+}
+
+// searchedRepo returns the Repo as searched by the query: the Repo
+// itself, or the snapshot of it the query targets, or nil if the
+// Repo has no such snapshot
+func (q *SearchQuery) searchedRepo(repo *Repo) *Repo {
+	if !q.targetsSnapshot() || repo.Snapshot != nil {
+		return repo
+	}
+	var s Snapshot
+	var ok bool
+	if q.Snapshot != "" {
+		s, ok = repo.findSnapshot(q.Snapshot)
+	} else {
+		s, ok = repo.snapshotAsOf(q.AsOf)
+	}
+	if !ok {
+		return nil
+	}
+	return repo.atSnapshot(s)
+}
+
+// changedSinceSnapshot returns true if the grep searches a snapshot
+// not taken of a git commit, and the file has changed since the
+// snapshot was taken
+func (s *grep) changedSinceSnapshot(name string) bool {
+	if s.repo == nil || s.repo.Snapshot == nil || s.repo.Snapshot.Commit != "" {
+		return false
+	}
+	stamp, ok := s.stamp(name)
+	if !ok {
+		return true
+	}
+	fi, err := s.fs.Lstat(name)
+	return err != nil || stamp.changed(newFileStamp(fi))
+}
@@ -0,0 +1,268 @@
+package afind
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+func TestSnapshotSearch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "afind_snapshot")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	first := gitCommit(t, src, map[string]string{
+		"config.yaml": "replicas: 3\n",
+		"main.go":     "package main\n",
+	})
+
+	c := &Config{IndexRoot: filepath.Join(dir, "ix"), NumShards: 2}
+	repos := newDb()
+	index := func(label string, update bool) *Repo {
+		query := NewIndexQuery("cfg")
+		query.Snapshot = label
+		if query.Update = update; update {
+			query.Inherit(repos.Get("cfg").(*Repo))
+		} else {
+			query.Root = src
+			query.Dirs = []string{"."}
+			query.Ref = "HEAD"
+			query.Meta["snapshots"] = "2"
+		}
+		resp, err := NewIndexer(c, repos).Index(context.Background(), query)
+		if err != nil || resp.Error != nil {
+			t.Fatal("unexpected error:", err, resp.Error)
+		}
+		_ = repos.Set("cfg", resp.Repo)
+		return resp.Repo
+	}
+	labels := func(repo *Repo) string {
+		s := []string{}
+		for _, snap := range repo.Snapshots {
+			s = append(s, snap.Label)
+		}
+		return strings.Join(s, " ")
+	}
+	repo := index("build-1", false)
+	eq(t, "build-1", labels(repo))
+	second := gitCommit(t, src, map[string]string{"config.yaml": "replicas: 5\n"})
+	repo = index("", true)
+	eq(t, "build-1 "+second[:snapshotCommitLength], labels(repo))
+	eq(t, first, repo.Snapshots[0].Commit)
+	eq(t, 2, repo.Snapshots[0].NumFiles)
+
+	search := func(q SearchQuery) (string, *SearchResult) {
+		q.RepoKeys = []string{"cfg"}
+		sr, err := NewSearcher(c, repos).Search(context.Background(), q)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		} else if len(sr.Errors) > 0 {
+			t.Fatal("unexpected errors:", sr.Errors)
+		}
+		return strings.TrimSpace(sr.Matches["config.yaml"]["cfg"]["1"]), sr
+	}
+	// the current index, and the snapshots by label, commit and time
+	sq := NewSearchQuery("replicas", "", false, nil)
+	text, _ := search(sq)
+	eq(t, "replicas: 5", text)
+	sq.Snapshot = "build-1"
+	text, sr := search(sq)
+	eq(t, "replicas: 3", text)
+	eq(t, "build-1", sr.Repos["cfg"].Snapshot.Label)
+	eq(t, first, sr.Repos["cfg"].Meta.GitCommit())
+	sq.Snapshot = first[:minSnapshotCommitPrefix]
+	text, _ = search(sq)
+	eq(t, "replicas: 3", text)
+	sq.Snapshot, sq.AsOf = "", repo.Snapshots[0].Time
+	text, _ = search(sq)
+	eq(t, "replicas: 3", text)
+	sq.AsOf = repo.Snapshots[1].Time.Add(time.Hour)
+	text, _ = search(sq)
+	eq(t, "replicas: 5", text)
+
+	// Repo without the snapshot are not searched
+	sq.AsOf = repo.Snapshots[0].Time.Add(-time.Second)
+	eq(t, false, sq.MayMatchRepo(repo))
+	_, sr = search(sq)
+	eq(t, uint64(0), sr.NumMatches)
+	sq.AsOf, sq.Snapshot = time.Time{}, "build-2"
+	eq(t, false, sq.MayMatchRepo(repo))
+	sq.AsOf = time.Now()
+	if err := sq.Normalize(); err == nil {
+		t.Error("want error for a query with snapshot and as_of, got none")
+	}
+
+	// the snapshots' files are owned by the Repo
+	files := repoIndexFiles(repo)
+	eq(t, 3+3+3, len(files))
+	for _, name := range files {
+		if _, err := os.Stat(name); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+
+	// updates changing nothing take no snapshot, and the oldest
+	// snapshots are removed
+	repo = index("", true)
+	eq(t, 2, len(repo.Snapshots))
+	third := gitCommit(t, src, map[string]string{"config.yaml": "replicas: 7\n"})
+	repo = index("", true)
+	eq(t, second[:snapshotCommitLength]+" "+third[:snapshotCommitLength], labels(repo))
+	if _, err := os.Stat(snapshotPath(repo, 1)); !os.IsNotExist(err) {
+		t.Error("want the removed snapshot's files removed, got", err)
+	}
+	sq = NewSearchQuery("replicas", "", false, nil)
+	sq.Snapshot = second[:snapshotCommitLength]
+	text, _ = search(sq)
+	eq(t, "replicas: 5", text)
+
+	// indexing afresh starts the snapshots anew
+	repo = index("build-2", false)
+	eq(t, "build-2", labels(repo))
+	dirs, _ := ioutil.ReadDir(snapshotsPath(repo.IndexPath, repo.Key))
+	eq(t, 1, len(dirs))
+
+	// as does deleting the Repo
+	eq(t, nil, repo.RemoveSnapshots())
+	if _, err := os.Stat(snapshotsPath(repo.IndexPath, repo.Key)); !os.IsNotExist(err) {
+		t.Error("want the snapshots removed, got", err)
+	}
+}
+
+func TestSnapshotSearchLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_snapshot")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(src, 0755)
+	write := func(name, content string, mtime time.Time) {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+		_ = os.Chtimes(filepath.Join(src, name), mtime, mtime)
+	}
+	then := time.Now().Add(-time.Hour)
+	write("a.yaml", "replicas: 3\n", then)
+	write("b.yaml", "replicas: 4\n", then)
+
+	c := &Config{IndexRoot: filepath.Join(dir, "ix"), NumShards: 1}
+	repos := newDb()
+	index := func(label string, update bool) *Repo {
+		query := NewIndexQuery("local")
+		query.Snapshot = label
+		if query.Update = update; update {
+			query.Inherit(repos.Get("local").(*Repo))
+		} else {
+			query.Root = src
+			query.Dirs = []string{"."}
+			query.Meta["snapshots"] = "2"
+		}
+		resp, err := NewIndexer(c, repos).Index(context.Background(), query)
+		if err != nil || resp.Error != nil {
+			t.Fatal("unexpected error:", err, resp.Error)
+		}
+		_ = repos.Set("local", resp.Repo)
+		return resp.Repo
+	}
+	repo := index("", false)
+	eq(t, 1, len(repo.Snapshots))
+	// labelled by the time
+	label := repo.Snapshots[0].Label
+	eq(t, repo.Snapshots[0].Time.UTC().Format(time.RFC3339), label)
+
+	write("a.yaml", "replicas: 5\n", time.Now())
+	repo = index("changed", true)
+	eq(t, 2, len(repo.Snapshots))
+
+	// the first snapshot finds the unchanged file, but not the file
+	// changed since it was taken
+	sq := NewSearchQuery("replicas", "", false, []string{"local"})
+	sq.Snapshot = label
+	sr, err := NewSearcher(c, repos).Search(context.Background(), sq)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "replicas: 4\n", sr.Matches["b.yaml"]["local"]["1"])
+	sq.Snapshot = ""
+	if sr, err = NewSearcher(c, repos).Search(context.Background(), sq); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, uint64(2), sr.NumMatches)
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	now := time.Now()
+	snaps := []Snapshot{}
+	for n, age := range []time.Duration{72, 48, 24, 1} {
+		snaps = append(snaps, Snapshot{ID: n + 1, Label: fmt.Sprint(n + 1),
+			Time: now.Add(-age * time.Hour)})
+	}
+	ids := func(snaps []Snapshot) string {
+		s := []string{}
+		for _, snap := range snaps {
+			s = append(s, snap.Label)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, tc := range []struct {
+		max           int
+		maxAge        time.Duration
+		kept, dropped string
+	}{
+		{10, 0, "1,2,3,4", ""},
+		{2, 0, "3,4", "1,2"},
+		{10, 36 * time.Hour, "3,4", "1,2"},
+		{3, 36 * time.Hour, "3,4", "1,2"},
+		{1, 36 * time.Hour, "4", "1,2,3"},
+		{10, time.Minute, "4", "1,2,3"},
+		{0, 0, "", "1,2,3,4"},
+	} {
+		kept, dropped := pruneSnapshots(snaps, tc.max, tc.maxAge, now)
+		if ids(kept) != tc.kept || ids(dropped) != tc.dropped {
+			t.Errorf("max %d max_age %v: want kept %q dropped %q, got %q %q",
+				tc.max, tc.maxAge, tc.kept, tc.dropped, ids(kept), ids(dropped))
+		}
+	}
+
+	// a snapshot replaces those with the same label
+	kept, dropped := addSnapshot(snaps, Snapshot{ID: 5, Label: "2"})
+	eq(t, "1,3,4,2", ids(kept))
+	eq(t, "2", ids(dropped))
+}
+
+func TestIndexQuerySnapshot(t *testing.T) {
+	q := NewIndexQuery("key")
+	q.Root = "/src"
+	q.Dirs = []string{"."}
+	q.Snapshot = "build-1"
+	if err := q.Normalize(); err == nil {
+		t.Error("want error for a snapshot of a Repo keeping none, got none")
+	}
+	q.Meta["snapshots"] = "3"
+	if err := q.Normalize(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	for _, meta := range []Meta{
+		{"snapshots": "many"},
+		{"snapshots": "-1"},
+		{"snapshots": "1", "snapshot_max_age": "a month"},
+	} {
+		q.Meta = meta
+		if err := q.Normalize(); err == nil {
+			t.Errorf("want error for metadata %v, got none", meta)
+		}
+	}
+}
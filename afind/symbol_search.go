@@ -0,0 +1,258 @@
+package afind
+
+import (
+	"bufio"
+	"io"
+	"os"
+	stdregexp "regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/errs"
+	"github.com/andaru/afind/stopwatch"
+	"github.com/andaru/codesearch/index"
+	"github.com/andaru/codesearch/regexp"
+)
+
+// Symbol searches.
+//
+// A search whose Re begins with "sym:" finds the definitions of the
+// symbols whose names match the rest of Re, in the Repo indexed with
+// a symbol index (see symbols.go). The query's Word, IgnoreCase and
+// SmartCase options apply to the name, with Word matching whole
+// names. Literal searches are never symbol searches, and find the
+// text "sym:" itself. The lines defining the symbols are reported
+// in the result's Matches, with the symbols in its Symbols, and are
+// merged, ranked and paged as for other searches. Files whose name
+// or content cannot match are skipped using the index, as for other
+// searches.
+
+const (
+	symbolPrefix = "sym:"
+)
+
+// symbolName returns the pattern matching the names of the symbols
+// searched for, and true, if the query is a symbol search
+func (q *SearchQuery) symbolName() (string, bool) {
+	if q.Query == "" && !q.Literal && strings.HasPrefix(q.Re, symbolPrefix) {
+		return q.Re[len(symbolPrefix):], true
+	}
+	return "", false
+}
+
+// AddFileRepoSymbols adds the symbols defined on the lines of the
+// file in the repo, keyed by line number.
+func (r *SearchResult) AddFileRepoSymbols(
+	fname, repokey string,
+	symbols map[string][]Symbol) {
+
+	if len(symbols) == 0 {
+		return
+	}
+	if r.Symbols == nil {
+		r.Symbols = make(map[string]map[string]map[string][]Symbol)
+	}
+	if _, ok := r.Symbols[fname]; !ok {
+		r.Symbols[fname] = make(map[string]map[string][]Symbol)
+	}
+	if _, ok := r.Symbols[fname][repokey]; !ok {
+		r.Symbols[fname][repokey] = make(map[string][]Symbol)
+	}
+	for k, v := range symbols {
+		r.Symbols[fname][repokey][k] = v
+	}
+}
+
+// searchSymbols searches the symbols of the files in the index shard
+// number shard, from the position pos reached by the previous page
+// of results.
+func (s *grep) searchSymbols(ctx context.Context, query SearchQuery,
+	shard int, pos ShardPosition) (resp *SearchResult, err error) {
+
+	sw := stopwatch.New()
+	resp = NewSearchResult()
+	key := query.firstKey()
+	s.shard = shard
+	name, _ := query.symbolName()
+	var (
+		namere, posre *stdregexp.Regexp
+		re, pathre    *regexp.Regexp
+		ix            *index.Index
+		post          []uint32
+		defs          map[string][]Symbol
+	)
+
+	if s.exclude, err = excludeRegexp(query.ExcludePathRe); err != nil {
+		goto done
+	}
+	if s.langs, err = newLanguageSet(query.Languages); err != nil {
+		goto done
+	}
+	namere, err = stdregexp.Compile(buildPattern(name,
+		false, query.Word, query.IgnoreCase, query.SmartCase))
+	if err != nil {
+		goto done
+	}
+	// the names are in the files' content, so the index finds
+	// the files which may define them
+	re, err = regexp.Compile(buildPattern(name,
+		false, false, query.IgnoreCase, query.SmartCase))
+	if err != nil {
+		goto done
+	}
+	if query.PathRe != "" {
+		if pathre, err = regexp.Compile(query.PathRe); err != nil {
+			goto done
+		}
+	}
+	if query.Positions {
+		posre = namere
+	}
+	if ix, err = index.Open(s.filename); err != nil {
+		log.Debug("grep error opening index %v: %v", s.filename, err)
+		goto done
+	}
+
+	if defs = shardSymbols(s.repo, shard); len(defs) == 0 {
+		goto finished
+	}
+
+	sw.Start("posting")
+	post = ix.PostingQuery(index.RegexpQuery(re.Syntax))
+	resp.Durations.PostingQuery = sw.Stop("posting")
+	s.searchContext = query.Context
+
+	for _, id_ := range post {
+		select {
+		case <-ctx.Done():
+			err = errs.NewTimeoutError("search")
+			goto done
+		default:
+		}
+		returned := pos.returned(id_)
+		if returned == allLines {
+			continue
+		}
+		fname := ix.Name(id_)
+		if pathre != nil && pathre.MatchString(fname, true, true) < 0 {
+			continue
+		} else if s.exclude != nil && s.exclude.MatchString(fname, true, true) >= 0 {
+			continue
+		} else if lang := s.language(fname); s.langs != nil && !s.langs[*lang] {
+			continue
+		}
+		if s.changedSinceSnapshot(fname) {
+			continue
+		}
+		symbols := matchingSymbols(defs[fname], namere, returned)
+		if len(symbols) == 0 {
+			continue
+		}
+		matches, context, e := s.symbolLines(fname, symbols)
+		if e != nil && !os.IsNotExist(e) && !os.IsPermission(e) {
+			err = e
+			continue
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		for lineno := range symbols {
+			if _, ok := matches[lineno]; !ok {
+				delete(symbols, lineno)
+			}
+		}
+		resp.AddFileRepoMatches(fname, key, matches)
+		resp.AddFileRepoContext(fname, key, context)
+		resp.AddFileRepoSymbols(fname, key, symbols)
+		if posre != nil {
+			resp.AddFileRepoPositions(fname, key, matchPositions(posre, matches))
+		}
+		resp.addFileRepoSource(fname, key, FileSource{shard, id_})
+	}
+finished:
+	resp.Progress.Set(key, shard, ShardPosition{Id: lastPostingId})
+
+done:
+	return
+}
+
+// matchingSymbols returns the symbols defined after the line
+// returned with names matching namere, keyed by line number
+func matchingSymbols(syms []Symbol, namere *stdregexp.Regexp,
+	returned int) map[string][]Symbol {
+
+	var symbols map[string][]Symbol
+	for _, sym := range syms {
+		if sym.Line <= returned || !namere.MatchString(sym.Name) {
+			continue
+		}
+		if symbols == nil {
+			symbols = make(map[string][]Symbol)
+		}
+		lineno := strconv.Itoa(sym.Line)
+		symbols[lineno] = append(symbols[lineno], sym)
+	}
+	return symbols
+}
+
+// symbolLines reads the lines defining the symbols from the file,
+// with the lines of context around them
+func (s *grep) symbolLines(name string, symbols map[string][]Symbol) (
+	map[string]string, map[string]string, error) {
+
+	npre, npost := s.searchContext.Lines()
+	defs := make(map[int]bool, len(symbols))
+	lines := []int{}
+	for lineno := range symbols {
+		n, _ := strconv.Atoi(lineno)
+		defs[n] = true
+		lines = append(lines, n)
+	}
+	sort.Ints(lines)
+	want := func(n int) bool {
+		i := sort.SearchInts(lines, n-npost)
+		return i < len(lines) && lines[i] <= n+npre
+	}
+
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	matches := make(map[string]string)
+	context := make(map[string]string)
+	r := bufio.NewReader(f)
+	last := lines[len(lines)-1] + npost
+	for n := 1; n <= last; n++ {
+		text, rerr := r.ReadString('\n')
+		if text != "" && want(n) {
+			if defs[n] {
+				matches[strconv.Itoa(n)] = text
+			} else {
+				context[strconv.Itoa(n)] = text
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return matches, context, rerr
+		}
+	}
+	return matches, context, nil
+}
+
+// shardSymbols returns the symbols of the files in the Repo's shard
+func shardSymbols(repo *Repo, shard int) map[string][]Symbol {
+	if repo == nil {
+		return nil
+	}
+	m := searchSymbols.get(repo)
+	if m == nil || shard >= len(m.Shards) {
+		return nil
+	}
+	return m.Shards[shard].Symbols
+}
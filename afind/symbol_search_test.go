@@ -0,0 +1,143 @@
+package afind
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+func TestSymbolSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_symbols")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	_ = os.MkdirAll(src, 0755)
+	for name, content := range map[string]string{
+		"index.go": "package afind\n\n// NewIndexer returns an indexer\n" +
+			"func NewIndexer() *Indexer {\n\treturn &Indexer{}\n}\n\n" +
+			"type Indexer struct{}\n\nfunc (i *Indexer) Index() {}\n",
+		"main.go":    "package main\n\nfunc main() {\n\tafind.NewIndexer().Index()\n}\n",
+		"indexer.py": "class Indexer:\n    def index(self):\n        pass\n",
+	} {
+		_ = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+	}
+	ctx := context.WithValue(context.Background(), "FileSystem",
+		walkablefs.New(vfs.OS(src)))
+	c := &Config{IndexRoot: filepath.Join(dir, "ix"), NumShards: 1}
+	repos := newDb()
+	index := func(key string, symbols, update bool) *Repo {
+		query := NewIndexQuery(key)
+		query.Root = src
+		query.Dirs = []string{"."}
+		query.Symbols = symbols
+		if query.Update = update; update {
+			// as the server does
+			query.Inherit(repos.Get(key).(*Repo))
+		}
+		resp, err := NewIndexer(c, repos).Index(ctx, query)
+		if err != nil || resp.Error != nil {
+			t.Fatal("unexpected error:", err, resp.Error)
+		}
+		_ = repos.Set(key, resp.Repo)
+		return resp.Repo
+	}
+	repo := index("syms", true, false)
+	eq(t, true, repo.Symbols)
+	// NewIndexer, Indexer, Index, main, Indexer, index
+	eq(t, 6, repo.NumSymbols)
+	// the symbols are kept apart from the manifest
+	m, err := readManifest(repo.IndexPath, repo.Key)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, true, m.Symbols)
+	eq(t, 0, len(m.Shards[0].Symbols))
+	if m, err = readSymbols(repo.IndexPath, repo.Key); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	eq(t, 3, len(m.Shards[0].Symbols))
+
+	search := func(q SearchQuery) *SearchResult {
+		sr, err := NewSearcher(c, repos).Search(ctx, q)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		} else if sr.Error != "" {
+			t.Fatal("unexpected error:", sr.Error)
+		}
+		return sr
+	}
+	// the definition is found, and not the call or comment
+	sq := NewSearchQuery("sym:NewIndexer", "", false, []string{"syms"})
+	sr := search(sq)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "func NewIndexer() *Indexer {\n", sr.Matches["index.go"]["syms"]["4"])
+	eq(t, "[{NewIndexer func afind 4}]", fmt.Sprint(sr.Symbols["index.go"]["syms"]["4"]))
+	_, ok := sr.Matches["main.go"]
+	eq(t, false, ok)
+
+	// literal searches find the text itself
+	sq.Literal = true
+	eq(t, uint64(0), search(sq).NumMatches)
+	_ = ioutil.WriteFile(filepath.Join(src, "notes.txt"), []byte("see sym:NewIndexer\n"), 0644)
+	repo = index("syms", true, true)
+	sr = search(sq)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, 0, len(sr.Symbols))
+	_ = os.Remove(filepath.Join(src, "notes.txt"))
+	repo = index("syms", true, true)
+	sq.Literal = false
+
+	// names are matched as regular expressions, or whole with -w
+	sq.Re = "sym:^Index"
+	eq(t, uint64(3), search(sq).NumMatches)
+	sq.Re, sq.Word = "sym:Indexer", true
+	sr = search(sq)
+	eq(t, uint64(2), sr.NumMatches)
+	eq(t, "[{Indexer type  1}]", fmt.Sprint(sr.Symbols["indexer.py"]["syms"]["1"]))
+	sq.Languages = []string{"go"}
+	sq.Context.Pre = 1
+	sr = search(sq)
+	eq(t, uint64(1), sr.NumMatches)
+	eq(t, "\n", sr.Context["index.go"]["syms"]["7"])
+	eq(t, "[{Indexer type afind 8}]", fmt.Sprint(sr.Symbols["index.go"]["syms"]["8"]))
+
+	// methods are found with their type
+	sr = search(NewSearchQuery("sym:(?i)^index$", "", false, []string{"syms"}))
+	eq(t, uint64(2), sr.NumMatches)
+	eq(t, "[{Index method Indexer 10}]", fmt.Sprint(sr.Symbols["index.go"]["syms"]["10"]))
+	eq(t, "[{index method Indexer 2}]", fmt.Sprint(sr.Symbols["indexer.py"]["syms"]["2"]))
+
+	// lines not kept by Truncate lose their symbols
+	sr.Rank()
+	sr.Truncate(1, Cursor{})
+	eq(t, 1, len(sr.Symbols))
+
+	// Repo without symbols are not searched for them
+	plain := index("plain", false, false)
+	eq(t, 0, plain.NumSymbols)
+	if _, err = os.Stat(symbolsName(plain.IndexPath, plain.Key)); !os.IsNotExist(err) {
+		t.Error("want no symbols file, got", err)
+	}
+	sq = NewSearchQuery("sym:NewIndexer", "", false, []string{"plain"})
+	eq(t, false, sq.MayMatchRepo(plain))
+	eq(t, true, sq.MayMatchRepo(repo))
+	sq.Re = "sym:"
+	if err := sq.Normalize(); err == nil {
+		t.Error("want error for symbol search without a name, got none")
+	}
+
+	// updates keep the symbol index
+	_ = ioutil.WriteFile(filepath.Join(src, "main.go"),
+		[]byte("package main\n\nfunc main() {}\n\nfunc other() {}\n"), 0644)
+	repo = index("syms", false, true)
+	eq(t, 7, repo.NumSymbols)
+	eq(t, uint64(1), search(NewSearchQuery("sym:other", "", false, []string{"syms"})).NumMatches)
+}
@@ -0,0 +1,546 @@
+package afind
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// Symbol index.
+//
+// A Repo indexed with its IndexQuery's Symbols set also records the
+// definitions found in each file in its symbols file, beside its
+// manifest (see manifest.go): the functions, methods, types,
+// variables and constants, with the scope enclosing each and the
+// line it is defined on. Go files are parsed with
+// go/parser. Files of other languages are scanned line by line for
+// definitions, as ctags does, with the patterns for their language
+// below, following blocks by their braces or indentation to find
+// the type or module enclosing each definition. Searches whose Re
+// begins with "sym:" find the definitions of the symbols with names
+// matching the rest of Re (see symbol_search.go).
+
+const (
+	// the largest file whose symbols are recorded
+	maxSymbolFileSize = 4 << 20
+)
+
+// Symbol kinds
+const (
+	symFunc   = "func"
+	symMethod = "method"
+	symType   = "type"
+	symVar    = "var"
+	symConst  = "const"
+	symField  = "field"
+	symMacro  = "macro"
+	symModule = "module"
+)
+
+// Symbol is the definition of a name. Kind is one of func, method,
+// type, var, const, field, macro or module. Scope names the type or
+// module the symbol is defined in, or for top level Go symbols, the
+// package.
+type Symbol struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Scope string `json:"scope,omitempty"`
+	Line  int    `json:"line"`
+}
+
+// extractSymbols returns the definitions in the content of the file
+// of the language
+func extractSymbols(name, lang string, content []byte) []Symbol {
+	if lang == "go" {
+		return goSymbols(name, content)
+	}
+	if sl, ok := symbolLanguages[lang]; ok {
+		return sl.scan(content)
+	}
+	return nil
+}
+
+// goSymbols returns the definitions of the Go source file, of as
+// much of the file as parses
+func goSymbols(name string, content []byte) []Symbol {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, name, content, 0)
+	if f == nil || f.Name == nil {
+		return nil
+	}
+	pkg := f.Name.Name
+	syms := []Symbol{}
+	add := func(id *ast.Ident, kind, scope string) {
+		if id != nil && id.Name != "_" {
+			syms = append(syms, Symbol{id.Name, kind, scope, fset.Position(id.Pos()).Line})
+		}
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				add(d.Name, symMethod, receiverName(d.Recv.List[0].Type))
+			} else {
+				add(d.Name, symFunc, pkg)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name, symType, pkg)
+					var fields []*ast.Field
+					kind := symField
+					switch t := s.Type.(type) {
+					case *ast.StructType:
+						fields = t.Fields.List
+					case *ast.InterfaceType:
+						fields, kind = t.Methods.List, symMethod
+					}
+					for _, field := range fields {
+						// embedded fields and types have no names
+						for _, id := range field.Names {
+							add(id, kind, s.Name.Name)
+						}
+					}
+				case *ast.ValueSpec:
+					kind := symVar
+					if d.Tok == token.CONST {
+						kind = symConst
+					}
+					for _, id := range s.Names {
+						add(id, kind, pkg)
+					}
+				}
+			}
+		}
+	}
+	return syms
+}
+
+// receiverName returns the name of the type of a method receiver,
+// e.g., T for *T or T[K]
+func receiverName(expr ast.Expr) string {
+	name := ""
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && name == "" {
+			name = id.Name
+		}
+		return name == ""
+	})
+	return name
+}
+
+// symbolPattern finds a definition on a line. The submatch named
+// "name" is the name defined, and "scope", if any, names the scope
+// it is defined in (e.g., the class of a C++ method defined outside
+// of the class).
+type symbolPattern struct {
+	re *regexp.Regexp
+	// the kind of symbol, or "" if the line opens the scope of a
+	// type without defining a symbol (e.g., Rust's impl)
+	kind string
+	// if true, the definitions in the block the line opens are
+	// within the scope of the name
+	encloses bool
+	// if true, the pattern only applies outside of any block but
+	// those of modules, or if member is true, directly within a
+	// type
+	topLevel bool
+	member   bool
+}
+
+// symbolLanguage holds the patterns finding definitions in the
+// files of a language. Functions found within a type are methods.
+// Blocks are found by their braces, unless indented is
+// true, when they are found by their indentation.
+type symbolLanguage struct {
+	indented bool
+	patterns []symbolPattern
+}
+
+// symbolScope is an enclosing scope found in a file
+type symbolScope struct {
+	name   string
+	kind   string // of the symbol defining it
+	line   int    // the line defining it
+	depth  int    // the depth or indentation of that line
+	opened bool   // true once its block has been entered
+}
+
+// scan returns the definitions found in the content
+func (sl *symbolLanguage) scan(content []byte) []Symbol {
+	syms := []Symbol{}
+	scopes := []symbolScope{}
+	depth := 0
+	var bs braceScanner
+	for n, b := range bytes.Split(content, nl) {
+		line := strings.TrimRight(string(b), "\r")
+		trimmed := strings.TrimSpace(line)
+		if sl.indented {
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			depth = indentation(line)
+			for len(scopes) > 0 && scopes[len(scopes)-1].depth >= depth {
+				scopes = scopes[:len(scopes)-1]
+			}
+		}
+		if !bs.inComment {
+			if s, ok := sl.match(line, sl.atTopLevel(scopes, depth),
+				sl.inMember(scopes, depth)); ok {
+				enclosing := scopeName(scopes)
+				if s.scope != "" {
+					// e.g., a C++ method defined outside its class
+					s.kind = methodKind(s.kind)
+					if enclosing != "" {
+						s.scope = enclosing + "." + s.scope
+					}
+				} else {
+					s.scope = enclosing
+					if len(scopes) > 0 && isTypeScope(scopes[len(scopes)-1]) {
+						s.kind = methodKind(s.kind)
+					}
+				}
+				if s.kind != "" {
+					syms = append(syms, Symbol{s.name, s.kind, s.scope, n + 1})
+				}
+				if s.encloses {
+					scopes = append(scopes, symbolScope{
+						name: s.name, kind: s.kind, line: n, depth: depth})
+				}
+			}
+		}
+		if sl.indented {
+			continue
+		}
+		bs.scan(line, &depth)
+		// Close the scopes whose blocks have ended. Scopes whose
+		// block is not opened on the line defining them or the
+		// next had none (e.g., forward declarations).
+		for len(scopes) > 0 {
+			top := &scopes[len(scopes)-1]
+			if !top.opened && depth > top.depth {
+				top.opened = true
+			} else if top.opened && depth <= top.depth ||
+				!top.opened && (n > top.line || strings.HasSuffix(trimmed, ";")) {
+				scopes = scopes[:len(scopes)-1]
+				continue
+			}
+			break
+		}
+	}
+	return syms
+}
+
+// methodKind returns the kind of a symbol defined in a type
+func methodKind(kind string) string {
+	if kind == symFunc {
+		return symMethod
+	}
+	return kind
+}
+
+// isTypeScope returns true if the scope is a type, or adds to one
+// (e.g., Rust's impl)
+func isTypeScope(scope symbolScope) bool {
+	return scope.kind == symType || scope.kind == ""
+}
+
+// within returns true if the line at depth is directly within the
+// innermost scope
+func (sl *symbolLanguage) within(scopes []symbolScope, depth int) bool {
+	top := scopes[len(scopes)-1]
+	if sl.indented {
+		return depth > top.depth
+	}
+	return top.opened && depth == top.depth+1
+}
+
+// atTopLevel returns true if the line at depth is outside of any
+// block but those of modules (e.g., C++ namespaces)
+func (sl *symbolLanguage) atTopLevel(scopes []symbolScope, depth int) bool {
+	if len(scopes) == 0 {
+		return depth == 0
+	}
+	for _, scope := range scopes {
+		if scope.kind != symModule {
+			return false
+		}
+	}
+	return sl.within(scopes, depth)
+}
+
+// inMember returns true if the line at depth is directly within the
+// innermost scope, a type
+func (sl *symbolLanguage) inMember(scopes []symbolScope, depth int) bool {
+	return len(scopes) > 0 && isTypeScope(scopes[len(scopes)-1]) &&
+		sl.within(scopes, depth)
+}
+
+// symbolMatch is a definition found on a line
+type symbolMatch struct {
+	name, scope, kind string
+	encloses          bool
+}
+
+// match returns the definition on the line found by the first
+// pattern matching it
+func (sl *symbolLanguage) match(line string, topLevel, member bool) (symbolMatch, bool) {
+	for _, p := range sl.patterns {
+		if !(p.topLevel && topLevel || p.member && member || !p.topLevel && !p.member) {
+			continue
+		}
+		m := p.re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		s := symbolMatch{kind: p.kind, encloses: p.encloses}
+		for i, group := range p.re.SubexpNames() {
+			switch group {
+			case "name":
+				s.name = m[i]
+			case "scope":
+				s.scope = m[i]
+			}
+		}
+		if s.name != "" {
+			return s, true
+		}
+	}
+	return symbolMatch{}, false
+}
+
+// scopeName returns the name of the innermost scope, qualified by
+// those enclosing it
+func scopeName(scopes []symbolScope) string {
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = s.name
+	}
+	return strings.Join(names, ".")
+}
+
+// indentation returns the width of the line's leading white space,
+// with tabs to the next multiple of eight
+func indentation(line string) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 8 - n%8
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// braceScanner follows the depth of braces over the lines of a
+// file, ignoring those in strings and comments
+type braceScanner struct {
+	inComment bool // within a /* */ comment
+}
+
+// scan updates depth with the braces on the line
+func (bs *braceScanner) scan(line string, depth *int) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if bs.inComment {
+			if c == '*' && i+1 < len(line) && line[i+1] == '/' {
+				bs.inComment = false
+				i++
+			}
+			continue
+		}
+		switch c {
+		case '/':
+			if i+1 < len(line) && line[i+1] == '/' {
+				return
+			} else if i+1 < len(line) && line[i+1] == '*' {
+				bs.inComment = true
+				i++
+			}
+		case '"', '`':
+			i = skipQuoted(line, i)
+		case '\'':
+			// character literals; a lone quote may be, e.g.,
+			// a Rust lifetime
+			if end := skipQuoted(line, i); end-i <= 3 || line[i+1] == '\\' && end-i <= 8 {
+				i = end
+			}
+		case '{':
+			*depth++
+		case '}':
+			if *depth > 0 {
+				*depth--
+			}
+		}
+	}
+}
+
+// skipQuoted returns the index of the quote closing the string
+// starting at i, or the end of the line if it is not closed
+func skipQuoted(line string, i int) int {
+	q := line[i]
+	for j := i + 1; j < len(line); j++ {
+		switch line[j] {
+		case '\\':
+			j++
+		case q:
+			return j
+		}
+	}
+	return len(line)
+}
+
+// symbolPattern flags
+const (
+	symEncloses = 1 << iota
+	symTopLevel
+	symMember
+)
+
+func newSymbolPattern(pattern, kind string, flags int) symbolPattern {
+	return symbolPattern{
+		re:       regexp.MustCompile(pattern),
+		kind:     kind,
+		encloses: flags&symEncloses != 0,
+		topLevel: flags&symTopLevel != 0,
+		member:   flags&symMember != 0,
+	}
+}
+
+// patterns shared by the C family of languages
+var (
+	cDefinePattern = newSymbolPattern(
+		`^\s*#\s*define\s+(?P<name>\w+)`, symMacro, 0)
+	cTypePattern = newSymbolPattern(
+		`^\s*(?:typedef\s+)?(?:struct|union|enum)\s+(?P<name>\w+)\s*(?:\{.*)?$`, symType, symEncloses)
+	cTypedefPattern = newSymbolPattern(
+		`^\s*typedef\b[^;{]*\b(?P<name>\w+)\s*;`, symType, 0)
+	cFuncPattern = newSymbolPattern(
+		`^(?:[A-Za-z_][\w\s*&:<>,]*[\s*&])?(?P<name>[A-Za-z_]\w*)\s*\([^;]*(?:\{.*)?$`,
+		symFunc, symTopLevel)
+	cppMethodPattern = newSymbolPattern(
+		`^(?:[A-Za-z_][\w\s*&:<>,]*[\s*&])?(?P<scope>[A-Za-z_]\w*)::(?P<name>~?[A-Za-z_]\w*)\s*\([^;]*(?:\{.*)?$`,
+		symMethod, symTopLevel)
+	cppClassPattern = newSymbolPattern(
+		`^\s*(?:template\s*<.*>\s*)?(?:class|struct|union)\s+(?:\w+\s+)*?(?P<name>[A-Za-z_]\w*)\s*(?:final\s*)?(?::[^;{]*)?(?:\{.*)?$`,
+		symType, symEncloses)
+	cppNamespacePattern = newSymbolPattern(
+		`^\s*namespace\s+(?P<name>[\w:]+)\s*(?:\{.*)?$`, symModule, symEncloses)
+	cppMemberPattern = newSymbolPattern(
+		`^\s*(?:(?:virtual|static|inline|explicit|constexpr|friend)\s+)*(?:[A-Za-z_][\w\s*&:<>,]*[\s*&])?(?P<name>~?[A-Za-z_]\w*)\s*\([^;]*\)\s*(?:const\s*)?(?:override\s*)?(?:=\s*0\s*)?(?:;|\{.*)?$`,
+		symFunc, symMember)
+
+	javaTypePattern = newSymbolPattern(
+		`^\s*(?:@\w+\s+)*(?:(?:public|protected|private|internal|static|abstract|final|sealed|partial|strictfp)\s+)*(?:class|interface|enum|record|struct|@interface)\s+(?P<name>\w+)`,
+		symType, symEncloses)
+	javaMethodPattern = newSymbolPattern(
+		`^\s*(?:@\w+(?:\([^)]*\))?\s+)*(?:(?:public|protected|private|internal|static|abstract|final|sealed|synchronized|native|default|virtual|override|async|extern|unsafe|new)\s+)*(?:<[^>]+>\s+)?[\w<>\[\],.?]+\s+(?P<name>\w+)\s*\(`,
+		symFunc, symMember)
+	javaFieldPattern = newSymbolPattern(
+		`^\s*(?:(?:public|protected|private|internal|static|final|readonly|const|volatile|transient)\s+)*[\w<>\[\],.?]+\s+(?P<name>\w+)\s*(?:=|;)`,
+		symField, symMember)
+
+	jsClassPattern = newSymbolPattern(
+		`^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+(?P<name>[\w$]+)`, symType, symEncloses)
+	jsFuncPattern = newSymbolPattern(
+		`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(?P<name>[\w$]+)`, symFunc, 0)
+	jsArrowPattern = newSymbolPattern(
+		`^\s*(?:export\s+)?(?:const|let|var)\s+(?P<name>[\w$]+)\s*=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*=>|[\w$]+\s*=>)`,
+		symFunc, symTopLevel)
+	jsVarPattern = newSymbolPattern(
+		`^\s*(?:export\s+)?(?:const|let|var)\s+(?P<name>[\w$]+)`, symVar, symTopLevel)
+	jsMethodPattern = newSymbolPattern(
+		`^\s*(?:(?:static|async|get|set|public|private|protected|readonly|override|abstract)\s+)*\*?(?P<name>[\w$]+)\s*\([^)]*\)\s*(?::[^{]*)?\{`,
+		symFunc, symMember)
+)
+
+// the languages whose symbols are found by their patterns
+var symbolLanguages = map[string]*symbolLanguage{
+	"c": {patterns: []symbolPattern{
+		cDefinePattern, cTypePattern, cTypedefPattern, cFuncPattern,
+	}},
+	"cpp": {patterns: []symbolPattern{
+		cDefinePattern, cppNamespacePattern, cppClassPattern, cTypePattern,
+		cTypedefPattern, cppMethodPattern, cFuncPattern, cppMemberPattern,
+	}},
+	"objc": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*@(?:interface|implementation|protocol)\s+(?P<name>\w+)`, symType, 0),
+		cDefinePattern, cTypePattern, cTypedefPattern, cFuncPattern,
+	}},
+	"java": {patterns: []symbolPattern{
+		javaTypePattern, javaMethodPattern, javaFieldPattern,
+	}},
+	"csharp": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*namespace\s+(?P<name>[\w.]+)`, symModule, symEncloses),
+		javaTypePattern, javaMethodPattern, javaFieldPattern,
+	}},
+	"kotlin": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:\w+\s+)*(?:class|interface|object)\s+(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:\w+\s+)*fun\s+(?:<[^>]+>\s*)?(?:[\w.]+\.)?(?P<name>\w+)\s*\(`, symFunc, 0),
+		newSymbolPattern(`^\s*(?:\w+\s+)*(?:val|var)\s+(?P<name>\w+)`, symVar, symTopLevel),
+	}},
+	"scala": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:\w+\s+)*(?:class|trait|object)\s+(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:\w+\s+)*def\s+(?P<name>\w+)`, symFunc, 0),
+		newSymbolPattern(`^\s*(?:\w+\s+)*(?:val|var)\s+(?P<name>\w+)`, symVar, symTopLevel),
+	}},
+	"swift": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:\w+\s+)*(?:class|struct|protocol|enum|actor)\s+(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:\w+\s+)*extension\s+(?P<name>\w+)`, "", symEncloses),
+		newSymbolPattern(`^\s*(?:\w+\s+)*func\s+(?P<name>\w+)`, symFunc, 0),
+		newSymbolPattern(`^\s*(?:\w+\s+)*(?:let|var)\s+(?P<name>\w+)`, symVar, symTopLevel),
+	}},
+	"rust": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:(?:async|const|unsafe|extern(?:\s+"[^"]*")?)\s+)*fn\s+(?P<name>\w+)`, symFunc, 0),
+		newSymbolPattern(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:unsafe\s+)?(?:struct|enum|union|trait)\s+(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:pub(?:\([^)]*\))?\s+)?type\s+(?P<name>\w+)`, symType, 0),
+		newSymbolPattern(`^\s*(?:unsafe\s+)?impl\b(?:\s*<[^>]*>)?\s+(?:[\w:<>, ]+\s+for\s+)?(?:\w+::)*(?P<name>\w+)`, "", symEncloses),
+		newSymbolPattern(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:const|static)\s+(?:mut\s+)?(?P<name>\w+)\s*:`, symConst, 0),
+		newSymbolPattern(`^\s*(?:pub(?:\([^)]*\))?\s+)?mod\s+(?P<name>\w+)`, symModule, symEncloses),
+		newSymbolPattern(`^\s*macro_rules!\s*(?P<name>\w+)`, symMacro, 0),
+	}},
+	"javascript": {patterns: []symbolPattern{
+		jsClassPattern, jsFuncPattern, jsArrowPattern, jsVarPattern, jsMethodPattern,
+	}},
+	"typescript": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:export\s+)?(?:declare\s+)?interface\s+(?P<name>[\w$]+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:export\s+)?(?:declare\s+)?type\s+(?P<name>[\w$]+)\s*(?:<[^>]*>)?\s*=`, symType, 0),
+		newSymbolPattern(`^\s*(?:export\s+)?(?:declare\s+)?(?:const\s+)?enum\s+(?P<name>[\w$]+)`, symType, 0),
+		newSymbolPattern(`^\s*(?:export\s+)?(?:declare\s+)?(?:namespace|module)\s+(?P<name>[\w$.]+)`, symModule, symEncloses),
+		jsClassPattern, jsFuncPattern, jsArrowPattern, jsVarPattern, jsMethodPattern,
+	}},
+	"php": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:(?:abstract|final|readonly)\s+)*(?:class|interface|trait|enum)\s+(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:(?:public|protected|private|static|abstract|final)\s+)*function\s+&?(?P<name>\w+)`, symFunc, 0),
+	}},
+	"shell": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:function\s+)?(?P<name>[\w.:-]+)\s*\(\)`, symFunc, 0),
+		newSymbolPattern(`^\s*function\s+(?P<name>[\w.:-]+)`, symFunc, 0),
+	}},
+	"perl": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*sub\s+(?P<name>\w+)`, symFunc, 0),
+		newSymbolPattern(`^\s*package\s+(?P<name>[\w:]+)`, symModule, 0),
+	}},
+	"lua": {patterns: []symbolPattern{
+		newSymbolPattern(`^\s*(?:local\s+)?function\s+(?:(?P<scope>[\w.]+)[.:])?(?P<name>\w+)`, symFunc, 0),
+	}},
+	"python": {indented: true, patterns: []symbolPattern{
+		newSymbolPattern(`^\s*class\s+(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*(?:async\s+)?def\s+(?P<name>\w+)`, symFunc, symEncloses),
+		newSymbolPattern(`^(?P<name>[A-Za-z_]\w*)\s*(?::[^=]+)?=[^=]`, symVar, symTopLevel),
+	}},
+	"ruby": {indented: true, patterns: []symbolPattern{
+		newSymbolPattern(`^\s*class\s+(?:\w+::)*(?P<name>\w+)`, symType, symEncloses),
+		newSymbolPattern(`^\s*module\s+(?:\w+::)*(?P<name>\w+)`, symModule, symEncloses),
+		newSymbolPattern(`^\s*def\s+(?:self\.)?(?P<name>[\w?!=]+)`, symFunc, symEncloses),
+		newSymbolPattern(`^\s*(?P<name>[A-Z]\w*)\s*=[^=]`, symConst, 0),
+	}},
+}
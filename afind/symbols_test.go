@@ -0,0 +1,169 @@
+package afind
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// symbolsString formats the symbols as name/kind/scope@line
+func symbolsString(syms []Symbol) string {
+	s := make([]string, len(syms))
+	for i, sym := range syms {
+		s[i] = fmt.Sprintf("%s/%s/%s@%d", sym.Name, sym.Kind, sym.Scope, sym.Line)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestExtractSymbols(t *testing.T) {
+	for _, tc := range []struct {
+		name, lang, src, want string
+	}{
+		{"a.go", "go", `package foo
+
+type T struct {
+	A int
+	io.Reader
+}
+
+type I interface {
+	M() error
+}
+
+func (t *T) Get() int { return t.A }
+
+func New() *T { return nil }
+
+var (
+	x, _ = 1, 2
+)
+
+const C = 1
+`, "T/type/foo@3 A/field/T@4 I/type/foo@8 M/method/I@9 Get/method/T@12 " +
+			"New/func/foo@14 x/var/foo@17 C/const/foo@20"},
+		{"a.py", "python", `import os
+
+MAX = 3
+
+class Foo(Base):
+# a comment
+    def bar(self):
+        x = 1
+        def inner():
+            pass
+
+    async def baz(self):
+        pass
+
+def top():
+    pass
+`, "MAX/var/@3 Foo/type/@5 bar/method/Foo@7 inner/func/Foo.bar@9 " +
+			"baz/method/Foo@12 top/func/@15"},
+		{"a.cc", "cpp", `#define MAX 3
+namespace ns {
+class Foo : public Bar {
+ public:
+  Foo();
+  virtual int get() const override;
+  void set(int v) { if (v) { x = v; } }
+ private:
+  int x;
+};
+
+int Foo::get() const {
+  return x;
+}
+
+static int helper(int a)
+{
+  return a;
+}
+}  // namespace ns
+struct Fwd;
+struct S { int a; };
+typedef unsigned long ulong;
+`, "MAX/macro/@1 ns/module/@2 Foo/type/ns@3 Foo/method/ns.Foo@5 " +
+			"get/method/ns.Foo@6 set/method/ns.Foo@7 get/method/ns.Foo@12 " +
+			"helper/func/ns@16 S/type/@22 ulong/type/@23"},
+		{"a.c", "c", `struct point {
+  int x;
+};
+
+static int
+main(int argc, char **argv)
+{
+  printf("{");
+  return 0;
+}
+/* int commented(void) {
+   int inside(void) {
+*/
+`, "point/type/@1 main/func/@6"},
+		{"a.rs", "rust", `pub struct Foo<'a> {
+    x: &'a str,
+}
+
+impl<'a> Display for Foo<'a> {
+    fn fmt(&self) -> String {
+        let c = '{';
+        String::new()
+    }
+}
+
+pub fn top() {}
+const MAX: u32 = 3;
+`, "Foo/type/@1 fmt/method/Foo@6 top/func/@12 MAX/const/@13"},
+		{"a.js", "javascript", `export class Foo extends Bar {
+  constructor(x) {
+    super(x);
+    if (x) {
+      y();
+    }
+  }
+  async get(a) {
+    return a;
+  }
+}
+
+function top() {}
+const handler = async (req) => {
+  const inner = 1;
+};
+export const VERSION = '1';
+`, "Foo/type/@1 constructor/method/Foo@2 get/method/Foo@8 top/func/@13 " +
+			"handler/func/@14 VERSION/var/@17"},
+		{"A.java", "java", `package a;
+
+public class Foo {
+    private static final int MAX = 3;
+    public Foo() {}
+    @Override
+    public String toString() {
+        return "}";
+    }
+    interface Inner {
+        void run();
+    }
+}
+`, "Foo/type/@3 MAX/field/Foo@4 Foo/method/Foo@5 toString/method/Foo@7 " +
+			"Inner/type/Foo@10 run/method/Foo.Inner@11"},
+		{"a.rb", "ruby", `module A
+  class Foo < Bar
+    MAX = 3
+    def self.make
+    end
+  end
+end
+`, "A/module/@1 Foo/type/A@2 MAX/const/A.Foo@3 make/method/A.Foo@4"},
+		{"a.lua", "lua", "local function helper() end\nfunction M.run(x) end\n",
+			"helper/func/@1 run/method/M@2"},
+		{"a.sh", "shell", "usage() {\n  echo\n}\nfunction main {\n}\n",
+			"usage/func/@1 main/func/@4"},
+		{"README", "", "func NotCode() {}\n", ""},
+	} {
+		got := symbolsString(extractSymbols(tc.name, tc.lang, []byte(tc.src)))
+		if got != tc.want {
+			t.Errorf("%s: want symbols\n%s\ngot\n%s", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package afind
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// Watch mode.
+//
+// A Repo on this host whose Meta has "watch" set to true is updated
+// as files under its Root change. The directories of the Repo are
+// watched for changes (with inotify, on Linux), skipping those the
+// Repo's index rules exclude. Changes are batched until none have
+// been seen for watchQuiet, or for at most watchMaxDelay, and then
+// the Repo is updated as if by an IndexQuery with Update set, listing
+// the files changed, so that only they are scanned and only the
+// shards holding them rebuilt. Shards are swapped
+// into place atomically, so searches running during an update see
+// either the old or the new shard.
+//
+// If changes cannot be watched (e.g., the system's limit of watches
+// is reached, or the Repo's files come from a FilesFrom list or a
+// git revision), the Repo is instead updated every WatchRescan,
+// which finds changed files by comparing them against the Repo's
+// manifest.
+
+const (
+	// changes are batched until none are seen for this long
+	watchQuiet = 2 * time.Second
+	// or at most this long after the first change
+	watchMaxDelay = 30 * time.Second
+	// how often Repo are checked for their watch metadata
+	watchPoll = 10 * time.Second
+
+	defaultWatchRescan = 5 * time.Minute
+)
+
+var (
+	errNoNotify   = errors.New("file change notification not supported")
+	errWatchLimit = errors.New("file change watch limit reached")
+)
+
+// Watch returns true if the `watch` key of the metadata is true.
+// Repo being watched are re-indexed as their files change.
+func (m Meta) Watch() bool {
+	watch, _ := strconv.ParseBool(m["watch"])
+	return watch
+}
+
+// notifyEvent is a change to a file or directory
+type notifyEvent struct {
+	Name     string // the absolute path of the changed file
+	IsDir    bool
+	Created  bool
+	Overflow bool // events were lost
+}
+
+// fileNotifier reports changes to files in the directories added.
+// Directories are not watched recursively.
+type fileNotifier interface {
+	Add(dir string) error
+	Events() <-chan notifyEvent
+	Close() error
+}
+
+// newFileNotifier returns the platform's fileNotifier
+var newFileNotifier = func() (fileNotifier, error) {
+	return nil, errNoNotify
+}
+
+// watcher keeps the Repo in watch mode up to date
+type watcher struct {
+	cfg     *Config
+	repos   KeyValueStorer
+	indexer Indexer
+	ctx     context.Context // the parent of index request contexts
+
+	quiet    time.Duration
+	maxDelay time.Duration
+
+	mu      *sync.Mutex
+	watches map[string]*repoWatch
+	wg      *sync.WaitGroup
+}
+
+// repoWatch watches the files of a single Repo
+type repoWatch struct {
+	key      string
+	root     string
+	filter   *indexFilter
+	notifier fileNotifier // nil if rescanning
+	quit     chan struct{}
+}
+
+// NewWatcher returns a watcher updating Repo of the store in watch
+// mode with the indexer, once Run
+func NewWatcher(cfg *Config, repos KeyValueStorer, indexer Indexer) *watcher {
+	return &watcher{
+		cfg:      cfg,
+		repos:    repos,
+		indexer:  indexer,
+		ctx:      context.Background(),
+		quiet:    watchQuiet,
+		maxDelay: watchMaxDelay,
+		mu:       &sync.Mutex{},
+		watches:  make(map[string]*repoWatch),
+		wg:       &sync.WaitGroup{},
+	}
+}
+
+// Run watches Repo as they are put in and taken out of watch mode,
+// until quit is closed
+func (w *watcher) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(watchPoll)
+	defer ticker.Stop()
+	w.sync()
+	for {
+		select {
+		case <-quit:
+			w.stopAll()
+			return
+		case <-ticker.C:
+			w.sync()
+		}
+	}
+}
+
+// sync starts watching the Repo newly in watch mode, and stops
+// watching those no longer in watch mode
+func (w *watcher) sync() {
+	repos := map[string]*Repo{}
+	w.repos.ForEach(func(key string, value interface{}) bool {
+		repo := value.(*Repo)
+		if repo.State == OK && repo.Meta.Watch() && w.cfg.IsHostLocal(repo.Host()) {
+			repos[key] = repo
+		}
+		return true
+	})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, rw := range w.watches {
+		if _, ok := repos[key]; !ok {
+			log.Info("watch [%v] stopped", key)
+			close(rw.quit)
+			delete(w.watches, key)
+		}
+	}
+	for key, repo := range repos {
+		if _, ok := w.watches[key]; !ok {
+			w.watches[key] = w.start(repo)
+		}
+	}
+}
+
+func (w *watcher) stopAll() {
+	w.mu.Lock()
+	for key, rw := range w.watches {
+		close(rw.quit)
+		delete(w.watches, key)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// start watches the Repo's files, or if they cannot be watched,
+// rescans them periodically
+func (w *watcher) start(repo *Repo) *repoWatch {
+	rw := &repoWatch{key: repo.Key, root: repo.Root, quit: make(chan struct{})}
+	rules := IndexRules{}
+	if repo.Rules != nil {
+		rules = *repo.Rules
+	}
+	fs := walkablefs.New(vfs.OS(repo.Root))
+	filter, err := newIndexFilter(w.cfg, rules, fs)
+	if err == nil && repo.FilesFrom != "" {
+		err = errors.New("files are listed in " + repo.FilesFrom)
+	} else if err == nil && repo.Ref != "" {
+		err = errors.New("files are read from git revision " + repo.Ref)
+	} else if err == nil && isArchive(repo.Root) {
+		err = errors.New("files are read from archive " + repo.Root)
+	}
+	if err == nil {
+		rw.filter = filter
+		rw.notifier, err = newFileNotifier()
+	}
+	if err == nil {
+		err = rw.addRepo(repo)
+	}
+	if err != nil {
+		log.Info("watch [%v] rescanning every %v: %v",
+			repo.Key, w.cfg.GetWatchRescan(), err)
+		rw.stopNotifier()
+	} else {
+		log.Info("watch [%v] watching %v", repo.Key, repo.Root)
+	}
+	w.wg.Add(1)
+	go w.run(rw)
+	return rw
+}
+
+// addRepo watches the directories of the Repo's Dirs and Files
+func (rw *repoWatch) addRepo(repo *Repo) error {
+	for _, dir := range repo.Dirs {
+		if err := rw.addTree(filepath.Join(rw.root, dir)); err != nil {
+			return err
+		}
+	}
+	added := map[string]bool{}
+	for _, name := range repo.Files {
+		dir := filepath.Join(rw.root, path.Dir(name))
+		if !added[dir] {
+			if err := rw.notifier.Add(dir); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			added[dir] = true
+		}
+	}
+	return nil
+}
+
+// addTree watches the directory and those beneath it, except any
+// excluded from the Repo
+func (rw *repoWatch) addTree(dir string) error {
+	return filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			// the directory has since been removed
+			return nil
+		}
+		if rel, err := filepath.Rel(rw.root, name); err == nil && rw.filter.skip(rel, true) {
+			return filepath.SkipDir
+		}
+		return rw.notifier.Add(name)
+	})
+}
+
+func (rw *repoWatch) stopNotifier() {
+	if rw.notifier != nil {
+		_ = rw.notifier.Close()
+		rw.notifier = nil
+	}
+}
+
+// changed returns the name, relative to Root, of the file of the
+// Repo the event is for, or "" if the event is not for one of the
+// Repo's files, that is, if it or any directory above it is skipped.
+func (rw *repoWatch) changed(ev notifyEvent) string {
+	rel, err := filepath.Rel(rw.root, ev.Name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	rel = filepath.ToSlash(rel)
+	for i, c := range rel {
+		if c == '/' && rw.filter.skip(rel[:i], true) {
+			return ""
+		}
+	}
+	if rw.filter.skip(rel, ev.IsDir) {
+		return ""
+	}
+	return rel
+}
+
+// run batches the changes to a Repo's files, updating the Repo once
+// they have stopped
+func (w *watcher) run(rw *repoWatch) {
+	defer w.wg.Done()
+	defer rw.stopNotifier()
+
+	var events <-chan notifyEvent
+	var rescan <-chan time.Time
+	var rescanTicker *time.Ticker
+	rescanning := func() {
+		rescanTicker = time.NewTicker(w.cfg.GetWatchRescan())
+		rescan = rescanTicker.C
+	}
+	defer func() {
+		if rescanTicker != nil {
+			rescanTicker.Stop()
+		}
+	}()
+	if rw.notifier != nil {
+		events = rw.notifier.Events()
+	} else {
+		rescanning()
+	}
+	tick := time.NewTicker(w.quiet / 2)
+	defer tick.Stop()
+
+	var first, last time.Time
+	dirty := false
+	// the files changed, unless all must be scanned for changes
+	changed := make(map[string]bool)
+	all := false
+	for {
+		select {
+		case <-rw.quit:
+			return
+		case ev, ok := <-events:
+			if !ok {
+				log.Warning("watch [%v] notification failed, rescanning", rw.key)
+				events = nil
+				rw.stopNotifier()
+				rescanning()
+				continue
+			}
+			if ev.IsDir && ev.Created {
+				if err := rw.addTree(ev.Name); err != nil {
+					log.Warning("watch [%v] rescanning every %v: %v",
+						rw.key, w.cfg.GetWatchRescan(), err)
+					events = nil
+					rw.stopNotifier()
+					rescanning()
+				}
+			}
+			name := ""
+			if ev.Overflow {
+				all = true
+			} else if name = rw.changed(ev); name != "" {
+				changed[name] = true
+			}
+			if ev.Overflow || name != "" {
+				now := time.Now()
+				if !dirty {
+					first = now
+				}
+				dirty, last = true, now
+			}
+		case <-rescan:
+			dirty, first, last = true, time.Time{}, time.Time{}
+			all = true
+		case now := <-tick.C:
+			if dirty && (now.Sub(last) >= w.quiet || now.Sub(first) >= w.maxDelay) {
+				var names []string
+				if !all {
+					for name := range changed {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+				}
+				if w.update(rw.key, names) {
+					dirty, all = false, false
+					changed = make(map[string]bool)
+				} else {
+					// try again once quiet again
+					last = now
+				}
+			}
+		}
+	}
+}
+
+// update updates the Repo, scanning only the changed files unless
+// changed is empty, returning false if it should be retried
+func (w *watcher) update(key string, changed []string) bool {
+	repo, ok := w.repos.Get(key).(*Repo)
+	if !ok {
+		return true
+	} else if repo.State != OK {
+		return false
+	}
+	req := NewIndexQuery(key)
+	req.Update = true
+	req.Changed = changed
+	req.Inherit(repo)
+	ctx, cancel := context.WithTimeout(w.ctx, w.cfg.GetTimeoutIndex())
+	resp, err := w.indexer.Index(ctx, req)
+	cancel()
+	if err == nil && resp.Error != nil {
+		err = resp.Error
+	}
+	if err != nil || resp.Repo == nil || resp.Repo.State != OK {
+		log.Warning("watch [%v] update failed: %v", key, err)
+		return false
+	}
+	if w.repos.Get(key) != nil {
+		_ = w.repos.Set(key, resp.Repo)
+	}
+	return true
+}
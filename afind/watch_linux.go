@@ -0,0 +1,107 @@
+package afind
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotify is the Linux fileNotifier
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+type inotify struct {
+	fd     int
+	file   *os.File // for reading fd without blocking Close
+	mu     *sync.Mutex
+	dirs   map[int32]string // watched directories by watch descriptor
+	events chan notifyEvent
+	done   chan struct{}
+}
+
+func init() {
+	newFileNotifier = newInotify
+}
+
+func newInotify() (fileNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotify{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		mu:     &sync.Mutex{},
+		dirs:   make(map[int32]string),
+		events: make(chan notifyEvent, 100),
+		done:   make(chan struct{}),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotify) Add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err == syscall.ENOSPC {
+		return errWatchLimit
+	} else if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	n.mu.Lock()
+	n.dirs[int32(wd)] = dir
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotify) Events() <-chan notifyEvent {
+	return n.events
+}
+
+func (n *inotify) Close() error {
+	close(n.done)
+	return n.file.Close()
+}
+
+// read sends the events read until the notifier is closed
+func (n *inotify) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		k, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= k; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(raw.Len)]), "\x00")
+			off += int(raw.Len)
+
+			n.mu.Lock()
+			dir := n.dirs[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				// the watch was removed with its directory
+				delete(n.dirs, raw.Wd)
+				n.mu.Unlock()
+				continue
+			}
+			n.mu.Unlock()
+			ev := notifyEvent{
+				Name:     filepath.Join(dir, name),
+				IsDir:    raw.Mask&syscall.IN_ISDIR != 0,
+				Created:  raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+				Overflow: raw.Mask&syscall.IN_Q_OVERFLOW != 0,
+			}
+			select {
+			case n.events <- ev:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "afind_inotify")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	n, err := newInotify()
+	if err != nil {
+		t.Skip("inotify not available:", err)
+	}
+	if err = n.Add(dir); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = n.Add(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+
+	next := func() notifyEvent {
+		select {
+		case ev := <-n.Events():
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("want event, got none")
+		}
+		return notifyEvent{}
+	}
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ev := next()
+	eq(t, filepath.Join(dir, "sub"), ev.Name)
+	eq(t, true, ev.IsDir)
+	eq(t, true, ev.Created)
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644)
+	ev = next()
+	eq(t, filepath.Join(dir, "a.go"), ev.Name)
+	eq(t, false, ev.IsDir)
+
+	// closing stops the events
+	_ = n.Close()
+	for range n.Events() {
+	}
+}
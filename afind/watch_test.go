@@ -0,0 +1,168 @@
+package afind
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+)
+
+// testNotifier is a fileNotifier sending events given to it
+type testNotifier struct {
+	mu     *sync.Mutex
+	dirs   []string
+	limit  int
+	events chan notifyEvent
+}
+
+func (n *testNotifier) Add(dir string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.dirs) >= n.limit {
+		return errWatchLimit
+	}
+	n.dirs = append(n.dirs, dir)
+	return nil
+}
+
+func (n *testNotifier) Events() <-chan notifyEvent { return n.events }
+func (n *testNotifier) Close() error               { return nil }
+
+// testUpdateIndexer counts the updates of each Repo, and records
+// the files changed in the last
+type testUpdateIndexer struct {
+	mu      *sync.Mutex
+	updates map[string]int
+	changed []string
+}
+
+func (ix *testUpdateIndexer) Index(ctx context.Context, req IndexQuery) (*IndexResult, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.updates[req.Key]++
+	ix.changed = req.Changed
+	resp := NewIndexResult()
+	resp.Repo = newRepoFromQuery(&req, "/ix")
+	resp.Repo.State = OK
+	return resp, nil
+}
+
+func (ix *testUpdateIndexer) count(key string) int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.updates[key]
+}
+
+// waitFor waits a short while for cond to become true
+func waitFor(cond func() bool) bool {
+	for n := 0; n < 200; n++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func testWatchSetup(t *testing.T, limit int) (*watcher, *testNotifier, *testUpdateIndexer, string) {
+	dir, err := ioutil.TempDir("", "afind_watch")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, sub := range []string{"src/pkg", ".git/objects", "build"} {
+		_ = os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+	notifier := &testNotifier{mu: &sync.Mutex{}, limit: limit, events: make(chan notifyEvent)}
+	newFileNotifier = func() (fileNotifier, error) { return notifier, nil }
+
+	repos := newDb()
+	repo := newRepo("watched")
+	repo.Root = dir
+	repo.Dirs = []string{"/"}
+	repo.Rules = &IndexRules{Exclude: []string{"build/"}}
+	repo.State = OK
+	repo.Meta["watch"] = "true"
+	_ = repos.Set("watched", repo)
+	_ = repos.Set("other", newRepo("other"))
+
+	ix := &testUpdateIndexer{mu: &sync.Mutex{}, updates: map[string]int{}}
+	cfg := &Config{RepoMeta: Meta{"host": "here"}, WatchRescan: 50 * time.Millisecond}
+	w := NewWatcher(cfg, repos, ix)
+	w.quiet, w.maxDelay = 20*time.Millisecond, time.Second
+	return w, notifier, ix, dir
+}
+
+func TestWatcher(t *testing.T) {
+	defer func(f func() (fileNotifier, error)) { newFileNotifier = f }(newFileNotifier)
+	w, notifier, ix, dir := testWatchSetup(t, 100)
+	defer os.RemoveAll(dir)
+
+	w.sync()
+	eq(t, 1, len(w.watches))
+	// excluded directories are not watched
+	notifier.mu.Lock()
+	dirs := []string{}
+	for _, d := range notifier.dirs {
+		rel, _ := filepath.Rel(dir, d)
+		dirs = append(dirs, rel)
+	}
+	notifier.mu.Unlock()
+	sort.Strings(dirs)
+	eq(t, ". src src/pkg", strings.Join(dirs, " "))
+
+	// changes to excluded files do not cause an update
+	notifier.events <- notifyEvent{Name: filepath.Join(dir, "build/x.o")}
+	time.Sleep(5 * w.quiet)
+	eq(t, 0, ix.count("watched"))
+
+	// a batch of changes causes a single update
+	for _, name := range []string{"src/a.go", "src/b.go", "src/pkg/c.go"} {
+		notifier.events <- notifyEvent{Name: filepath.Join(dir, name)}
+	}
+	if !waitFor(func() bool { return ix.count("watched") == 1 }) {
+		t.Error("want an update, got", ix.count("watched"))
+	}
+	time.Sleep(5 * w.quiet)
+	eq(t, 1, ix.count("watched"))
+	ix.mu.Lock()
+	eq(t, "src/a.go src/b.go src/pkg/c.go", strings.Join(ix.changed, " "))
+	ix.mu.Unlock()
+
+	// new directories are watched
+	_ = os.MkdirAll(filepath.Join(dir, "src/new/sub"), 0755)
+	notifier.events <- notifyEvent{Name: filepath.Join(dir, "src/new"), IsDir: true, Created: true}
+	if !waitFor(func() bool { return ix.count("watched") == 2 }) {
+		t.Error("want another update, got", ix.count("watched"))
+	}
+	notifier.mu.Lock()
+	eq(t, 5, len(notifier.dirs))
+	notifier.mu.Unlock()
+
+	// Repo taken out of watch mode are no longer watched
+	_ = w.repos.Delete("watched")
+	w.sync()
+	eq(t, 0, len(w.watches))
+	w.stopAll()
+	eq(t, 0, ix.count("other"))
+}
+
+func TestWatcherRescan(t *testing.T) {
+	defer func(f func() (fileNotifier, error)) { newFileNotifier = f }(newFileNotifier)
+	// the watch limit is reached, so the Repo is rescanned
+	w, _, ix, dir := testWatchSetup(t, 2)
+	defer os.RemoveAll(dir)
+
+	w.sync()
+	if !waitFor(func() bool { return ix.count("watched") >= 2 }) {
+		t.Error("want periodic updates, got", ix.count("watched"))
+	}
+	w.stopAll()
+	// rescans look for changes to every file
+	eq(t, 0, len(ix.changed))
+}
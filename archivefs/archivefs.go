@@ -0,0 +1,317 @@
+// Package archivefs presents the files of zip and tar archives as
+// read-only walkablefs.WalkableFileSystems, without unpacking them.
+//
+// Zip files and uncompressed tar files are read in place: the
+// archive's entries are listed when it is opened, and the content of
+// each file read directly from its offset in the archive. Compressed
+// tar files cannot be read at random, so they are first decompressed
+// to an uncompressed tar file in a cache directory, which is reused
+// while the archive is unchanged.
+package archivefs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// kind is a kind of archive
+type kind int
+
+const (
+	kindZip kind = iota
+	kindTar
+	kindTarGz
+	kindTarBz2
+)
+
+// the kinds of archive, by file name suffix
+var suffixes = []struct {
+	suffix string
+	kind   kind
+}{
+	{".zip", kindZip},
+	{".jar", kindZip},
+	{".tar", kindTar},
+	{".tar.gz", kindTarGz},
+	{".tgz", kindTarGz},
+	{".tar.bz2", kindTarBz2},
+	{".tbz2", kindTarBz2},
+}
+
+const (
+	// the most symbolic links followed looking up a path
+	maxSymlinks = 40
+)
+
+var (
+	errNotArchive = errors.New("not a supported archive")
+	errIsDir      = errors.New("is a directory")
+	errNotDir     = errors.New("not a directory")
+	errIrregular  = errors.New("not a regular file")
+)
+
+func archiveKind(name string) (kind, bool) {
+	lower := strings.ToLower(name)
+	for _, s := range suffixes {
+		if strings.HasSuffix(lower, s.suffix) {
+			return s.kind, true
+		}
+	}
+	return 0, false
+}
+
+// IsArchive returns true if the file name has the suffix of a
+// supported archive (.zip, .jar, .tar, .tar.gz, .tgz, .tar.bz2 or
+// .tbz2)
+func IsArchive(name string) bool {
+	_, ok := archiveKind(name)
+	return ok
+}
+
+// An Archive is an open archive file. Its files may be read
+// concurrently.
+type Archive struct {
+	name   string
+	file   *os.File // the archive, or its decompressed tar file
+	root   *node
+	mtime  time.Time // of directories not in the archive
+	opener func(n *node) (vfs.ReadSeekCloser, error)
+}
+
+// Open opens the archive file name. Compressed tar files are
+// decompressed into cacheDir, unless already there.
+func Open(name, cacheDir string) (*Archive, error) {
+	k, ok := archiveKind(name)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errNotArchive}
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{name: name, mtime: fi.ModTime()}
+	a.root = a.newDir("")
+	switch k {
+	case kindZip:
+		err = a.openZip()
+	case kindTar:
+		err = a.openTar(name)
+	default:
+		var tarName string
+		if tarName, err = extract(name, fi, k, cacheDir); err == nil {
+			err = a.openTar(tarName)
+		}
+	}
+	if err != nil {
+		if a.file != nil {
+			_ = a.file.Close()
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close closes the archive
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+// FileSystem returns the files of the archive as a file system
+func (a *Archive) FileSystem() walkablefs.WalkableFileSystem {
+	return walkablefs.New(a)
+}
+
+// node is a file or directory of the archive
+type node struct {
+	name     string
+	mode     os.FileMode
+	size     int64
+	mtime    time.Time
+	children map[string]*node // of directories
+	link     string           // the target of symbolic links
+
+	// where to find the file's content
+	offset int64       // in a tar file
+	data   interface{} // e.g., the *zip.File
+}
+
+func (a *Archive) newDir(name string) *node {
+	return &node{
+		name:     name,
+		mode:     os.ModeDir | 0555,
+		mtime:    a.mtime,
+		children: make(map[string]*node),
+	}
+}
+
+// cleanName returns the archive member's path relative to the root
+// of the archive, or false if it refers outside of the archive.
+// Leading slashes are removed, as tar does.
+func cleanName(name string) (string, bool) {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// add adds the node at the path, creating the directories above it.
+// A directory entry replaces a directory already implied by another
+// entry, but keeps its children.
+func (a *Archive) add(name string, n *node) {
+	elems := strings.Split(name, "/")
+	dir := a.root
+	for _, elem := range elems[:len(elems)-1] {
+		child, ok := dir.children[elem]
+		if !ok || !child.mode.IsDir() {
+			child = a.newDir(elem)
+			dir.children[elem] = child
+		}
+		dir = child
+	}
+	base := elems[len(elems)-1]
+	n.name = base
+	if old, ok := dir.children[base]; ok && old.mode.IsDir() && n.mode.IsDir() {
+		n.children = old.children
+	}
+	dir.children[base] = n
+}
+
+// lookup returns the node at the path, following symbolic links in
+// its directories, and in its last element if follow is true
+func (a *Archive) lookup(name string, follow bool) (*node, error) {
+	name = path.Clean("/" + name)
+	for links := 0; ; links++ {
+		n, target, err := a.walk(name, follow)
+		if err != nil || target == "" {
+			return n, err
+		}
+		if links >= maxSymlinks {
+			return nil, errors.New("too many levels of symbolic links")
+		}
+		name = target
+	}
+}
+
+// walk looks up the path. If it passes through a symbolic link, the
+// path with the link replaced by its target is returned instead.
+func (a *Archive) walk(name string, follow bool) (*node, string, error) {
+	n := a.root
+	elems := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if name == "/" {
+		return n, "", nil
+	}
+	dir := "/"
+	for i, elem := range elems {
+		if !n.mode.IsDir() {
+			return nil, "", os.ErrNotExist
+		}
+		child, ok := n.children[elem]
+		if !ok {
+			return nil, "", os.ErrNotExist
+		}
+		n = child
+		last := i == len(elems)-1
+		if n.mode&os.ModeSymlink != 0 && (!last || follow) {
+			if path.IsAbs(n.link) {
+				// links out of the archive lead nowhere
+				return nil, "", os.ErrNotExist
+			}
+			return nil, path.Join(dir, n.link, path.Join(elems[i+1:]...)), nil
+		}
+		dir = path.Join(dir, elem)
+	}
+	return n, "", nil
+}
+
+func (a *Archive) String() string {
+	return "archive(" + a.name + ")"
+}
+
+func (a *Archive) RootType(string) vfs.RootType {
+	return ""
+}
+
+// fileInfo describes a node
+type fileInfo struct {
+	*node
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (a *Archive) stat(op, name string, follow bool) (os.FileInfo, error) {
+	n, err := a.lookup(name, follow)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return fileInfo{n}, nil
+}
+
+// Lstat returns the FileInfo of the path, not following a final
+// symbolic link
+func (a *Archive) Lstat(name string) (os.FileInfo, error) {
+	return a.stat("lstat", name, false)
+}
+
+// Stat returns the FileInfo of the path
+func (a *Archive) Stat(name string) (os.FileInfo, error) {
+	return a.stat("stat", name, true)
+}
+
+// ReadDir returns the entries of the directory
+func (a *Archive) ReadDir(name string) ([]os.FileInfo, error) {
+	n, err := a.lookup(name, true)
+	if err == nil && !n.mode.IsDir() {
+		err = errNotDir
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	fis := make([]os.FileInfo, 0, len(n.children))
+	for _, child := range n.children {
+		fis = append(fis, fileInfo{child})
+	}
+	return fis, nil
+}
+
+// Open returns a reader of the file's content
+func (a *Archive) Open(name string) (vfs.ReadSeekCloser, error) {
+	n, err := a.lookup(name, true)
+	if err == nil && n.mode.IsDir() {
+		err = errIsDir
+	} else if err == nil && !n.mode.IsRegular() {
+		err = errIrregular
+	}
+	var r vfs.ReadSeekCloser
+	if err == nil {
+		r, err = a.opener(n)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return r, nil
+}
+
+// readSeekNopCloser adds a no-op Close to a ReadSeeker
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+func bytesReader(b []byte) vfs.ReadSeekCloser {
+	return readSeekNopCloser{bytes.NewReader(b)}
+}
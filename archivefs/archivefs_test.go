@@ -0,0 +1,230 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMtime = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// testMember is a member of a test archive
+type testMember struct {
+	name    string
+	content string
+	link    string // for symbolic links
+}
+
+var testMembers = []testMember{
+	{name: "README", content: "readme\n"},
+	{name: "src/"},
+	{name: "src/a.go", content: "package a\n"},
+	{name: "./src/lib/b.go", content: "package b\n"},
+	{name: "link.go", link: "src/a.go"},
+	{name: "libdir", link: "src/lib"},
+	{name: "../evil", content: "outside\n"},
+}
+
+func writeTar(t *testing.T, w io.Writer, members []testMember) {
+	tw := tar.NewWriter(w)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, ModTime: testMtime,
+			Size: int64(len(m.content)), Typeflag: tar.TypeReg}
+		switch {
+		case m.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, m.link, 0
+		case strings.HasSuffix(m.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, _ = tw.Write([]byte(m.content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func writeZip(t *testing.T, w io.Writer, members []testMember) {
+	zw := zip.NewWriter(w)
+	for _, m := range members {
+		hdr := &zip.FileHeader{Name: m.name, Method: zip.Deflate, Modified: testMtime}
+		content := m.content
+		if m.link != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			content = m.link
+		}
+		f, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		_, _ = f.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+// writeArchive writes an archive of the members in dir, of the kind
+// named by its suffix
+func writeArchive(t *testing.T, dir, name string, members []testMember) string {
+	name = filepath.Join(dir, name)
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer f.Close()
+	switch k, _ := archiveKind(name); k {
+	case kindZip:
+		writeZip(t, f, members)
+	case kindTar:
+		writeTar(t, f, members)
+	case kindTarGz:
+		gz := gzip.NewWriter(f)
+		writeTar(t, gz, members)
+		_ = gz.Close()
+	}
+	return name
+}
+
+func TestIsArchive(t *testing.T) {
+	for _, name := range []string{"a.zip", "a.JAR", "a.tar", "/x/a.tar.gz",
+		"a.tgz", "a.tar.bz2", "a.tbz2"} {
+		if !IsArchive(name) {
+			t.Error("want", name, "an archive")
+		}
+	}
+	for _, name := range []string{"a.gz", "a", "/src/zip", "a.tar.xz"} {
+		if IsArchive(name) {
+			t.Error("want", name, "not an archive")
+		}
+	}
+}
+
+func TestArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.zip", "a.tar", "a.tar.gz"} {
+		a, err := Open(writeArchive(t, dir, name, testMembers), filepath.Join(dir, "cache"))
+		if err != nil {
+			t.Fatal(name, "unexpected error:", err)
+		}
+		testArchive(t, name, a)
+		_ = a.Close()
+	}
+}
+
+func testArchive(t *testing.T, kind string, a *Archive) {
+	fs := a.FileSystem()
+	walked := []string{}
+	_ = fs.Walk("/", func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			t.Error(kind, "unexpected error:", err)
+		} else if fi.Mode().IsRegular() {
+			walked = append(walked, name)
+		}
+		return nil
+	})
+	sort.Strings(walked)
+	want := "/README /src/a.go /src/lib/b.go"
+	if got := strings.Join(walked, " "); got != want {
+		t.Error(kind, "want", want, "got", got)
+	}
+
+	read := func(name string) string {
+		f, err := fs.Open(name)
+		if err != nil {
+			return err.Error()
+		}
+		defer f.Close()
+		b, _ := ioutil.ReadAll(f)
+		return string(b)
+	}
+	for name, want := range map[string]string{
+		"README":        "readme\n",
+		"/src/a.go":     "package a\n",
+		"src/lib/b.go":  "package b\n",
+		"link.go":       "package a\n",
+		"libdir/b.go":   "package b\n",
+		"evil":          "open evil: file does not exist",
+		"src":           "open src: is a directory",
+		"README/x":      "open README/x: file does not exist",
+		"src/../README": "readme\n",
+	} {
+		if got := read(name); got != want {
+			t.Errorf("%s: %s: want %q, got %q", kind, name, want, got)
+		}
+	}
+
+	// files may be read concurrently, and seek
+	f1, _ := fs.Open("src/a.go")
+	f2, _ := fs.Open("src/a.go")
+	_, _ = f1.Seek(8, os.SEEK_SET)
+	b1, _ := ioutil.ReadAll(f1)
+	b2, _ := ioutil.ReadAll(f2)
+	if string(b1) != "a\n" || string(b2) != "package a\n" {
+		t.Errorf("%s: got %q and %q", kind, b1, b2)
+	}
+
+	fi, err := fs.Lstat("src/a.go")
+	if err != nil || fi.Name() != "a.go" || fi.Size() != 10 || !fi.Mode().IsRegular() ||
+		!fi.ModTime().Equal(testMtime) {
+		t.Errorf("%s: unexpected file info %v %v", kind, fi, err)
+	}
+	if fi, err = fs.Lstat("link.go"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error(kind, "want a symlink, got", fi, err)
+	}
+	if fi, err = fs.Stat("link.go"); err != nil || !fi.Mode().IsRegular() {
+		t.Error(kind, "want the linked file, got", fi, err)
+	}
+	if _, err = fs.Stat("missing"); !os.IsNotExist(err) {
+		t.Error(kind, "want not exist error, got", err)
+	}
+	fis, err := fs.ReadDir("src")
+	if err != nil {
+		t.Fatal(kind, "unexpected error:", err)
+	}
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "a.go lib" {
+		t.Error(kind, "want a.go lib, got", got)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"bad.zip", "bad.tar.gz"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, name), []byte("not an archive"), 0644)
+		if _, err := Open(filepath.Join(dir, name), dir); err == nil {
+			t.Error("want error opening", name)
+		}
+	}
+	if _, err := Open(filepath.Join(dir, "missing.zip"), dir); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+	if _, err := Open(filepath.Join(dir, "file.txt"), dir); err == nil {
+		t.Error("want error opening a file which is not an archive")
+	}
+}
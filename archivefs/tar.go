@@ -0,0 +1,219 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// countingReader counts the offset into the tar file, so that the
+// offset of each member's content is known
+type countingReader struct {
+	r io.ReadSeeker
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Seek lets the tar reader skip the content of members
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := c.r.Seek(offset, whence)
+	if err == nil {
+		c.n = n
+	}
+	return n, err
+}
+
+// openTar lists the members of the uncompressed tar file, recording
+// the offset of each regular file's content
+func (a *Archive) openTar(name string) (err error) {
+	if a.file, err = os.Open(name); err != nil {
+		return err
+	}
+	cr := &countingReader{r: a.file}
+	tr := tar.NewReader(cr)
+	links := map[string]string{} // hard links to their targets
+	files := map[string]*node{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return &os.PathError{Op: "open", Path: a.name, Err: err}
+		}
+		name, ok := cleanName(hdr.Name)
+		if !ok {
+			continue
+		}
+		n := &node{
+			mode:   hdr.FileInfo().Mode(),
+			size:   hdr.Size,
+			mtime:  hdr.ModTime,
+			offset: cr.n,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			n = a.newDir("")
+			n.mtime = hdr.ModTime
+		case tar.TypeReg, tar.TypeRegA:
+			files[name] = n
+		case tar.TypeSymlink:
+			n.link = hdr.Linkname
+		case tar.TypeLink:
+			if target, ok := cleanName(hdr.Linkname); ok {
+				links[name] = target
+			}
+			continue
+		default:
+			// devices, fifos and sparse files are not read
+			n.mode |= os.ModeIrregular
+			n.size = 0
+		}
+		a.add(name, n)
+	}
+	// hard links share the content of their target
+	for name, target := range links {
+		if t, ok := files[target]; ok {
+			n := *t
+			a.add(name, &n)
+		}
+	}
+	a.opener = a.openTarFile
+	return nil
+}
+
+func (a *Archive) openTarFile(n *node) (vfs.ReadSeekCloser, error) {
+	return readSeekNopCloser{io.NewSectionReader(a.file, n.offset, n.size)}, nil
+}
+
+// extract decompresses the archive into cacheDir, returning the name
+// of the uncompressed tar file. The tar file is named for the
+// archive's path, size and modification time, so is reused until the
+// archive changes; extractions of earlier versions of the archive
+// are then removed.
+func extract(name string, fi os.FileInfo, k kind, cacheDir string) (string, error) {
+	prefix, err := extractPrefix(name)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(cacheDir, prefix+
+		strconv.FormatInt(fi.Size(), 10)+"-"+
+		strconv.FormatInt(fi.ModTime().UnixNano(), 10)+".tar")
+	if _, err = os.Stat(target); err == nil {
+		return target, nil
+	}
+
+	if err = os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	var r io.Reader
+	switch k {
+	case kindTarGz:
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		r = gz
+	case kindTarBz2:
+		r = bzip2.NewReader(in)
+	default:
+		return "", errNotArchive
+	}
+	// write to a temporary file first, so that concurrent openers
+	// never see a partial extraction
+	tmp, err := ioutil.TempFile(cacheDir, prefix+"tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", fmt.Errorf("%s: extracting: %v", name, err)
+	}
+
+	old, _ := filepath.Glob(filepath.Join(cacheDir, prefix+"*.tar"))
+	for _, o := range old {
+		if o != target {
+			_ = os.Remove(o)
+		}
+	}
+	return target, nil
+}
+
+// extractPrefix returns the prefix of the names of the archive's
+// extractions, and its temporary files
+func extractPrefix(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(abs))
+	return hex.EncodeToString(sum[:8]) + "-", nil
+}
+
+// Sweep removes the extractions in cacheDir of archives other than
+// those named, ignoring files modified since before, which may be
+// in use by an archive being opened. The names of the files removed
+// are returned.
+func Sweep(cacheDir string, archives []string, before time.Time) ([]string, error) {
+	keep := make(map[string]bool)
+	for _, name := range archives {
+		prefix, err := extractPrefix(name)
+		if err != nil {
+			return nil, err
+		}
+		keep[prefix] = true
+	}
+	infos, err := ioutil.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, fi := range infos {
+		i := strings.IndexByte(fi.Name(), '-')
+		if i < 0 || !fi.Mode().IsRegular() || keep[fi.Name()[:i+1]] ||
+			fi.ModTime().After(before) {
+			continue
+		}
+		name := filepath.Join(cacheDir, fi.Name())
+		if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
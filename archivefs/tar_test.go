@@ -0,0 +1,150 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTarHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	f, _ := os.Create(filepath.Join(dir, "a.tar"))
+	writeTarWith(t, f)
+	_ = f.Close()
+
+	a, err := Open(filepath.Join(dir, "a.tar"), dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer a.Close()
+	r, err := a.Open("hard")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "content\n" {
+		t.Errorf("want content, got %q", b)
+	}
+	if fi, err := a.Lstat("fifo"); err != nil || fi.Mode().IsRegular() {
+		t.Error("want an irregular file, got", fi, err)
+	}
+	if _, err := a.Open("fifo"); err == nil {
+		t.Error("want error opening a fifo")
+	}
+}
+
+func TestExtractionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "cache")
+	name := writeArchive(t, dir, "a.tgz", testMembers)
+
+	a, err := Open(name, cache)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_ = a.Close()
+	extracted, _ := filepath.Glob(filepath.Join(cache, "*.tar"))
+	if len(extracted) != 1 {
+		t.Fatal("want 1 extracted file, got", extracted)
+	}
+	fi, _ := os.Stat(extracted[0])
+
+	// the extraction is reused while the archive is unchanged
+	if a, err = Open(name, cache); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_ = a.Close()
+	if fi2, _ := os.Stat(extracted[0]); fi2 == nil || !fi2.ModTime().Equal(fi.ModTime()) {
+		t.Error("want the extraction reused")
+	}
+
+	// and replaced once the archive changes
+	name = writeArchive(t, dir, "a.tgz", testMembers[:1])
+	_ = os.Chtimes(name, time.Now(), time.Now().Add(time.Hour))
+	if a, err = Open(name, cache); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer a.Close()
+	if _, err := a.Stat("src/a.go"); !os.IsNotExist(err) {
+		t.Error("want the new archive's files, got", err)
+	}
+	now, _ := filepath.Glob(filepath.Join(cache, "*"))
+	if len(now) != 1 || now[0] == extracted[0] {
+		t.Error("want only the new extraction, got", now)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "cache")
+	a := writeArchive(t, dir, "a.tgz", testMembers)
+	b := writeArchive(t, dir, "b.tgz", testMembers)
+	for _, name := range []string{a, b} {
+		ar, err := Open(name, cache)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		_ = ar.Close()
+	}
+	extracted, _ := filepath.Glob(filepath.Join(cache, "*.tar"))
+	if len(extracted) != 2 {
+		t.Fatal("want 2 extracted files, got", extracted)
+	}
+
+	// recent extractions are left alone
+	removed, err := Sweep(cache, []string{a}, time.Now().Add(-time.Hour))
+	if err != nil || len(removed) != 0 {
+		t.Error("want nothing removed, got", removed, err)
+	}
+	// only the extraction of b is unreferenced
+	removed, err = Sweep(cache, []string{a}, time.Now().Add(time.Hour))
+	if err != nil || len(removed) != 1 {
+		t.Fatal("want 1 file removed, got", removed, err)
+	}
+	if _, err = os.Stat(removed[0]); !os.IsNotExist(err) {
+		t.Error("want the extraction removed, got", err)
+	}
+	now, _ := filepath.Glob(filepath.Join(cache, "*"))
+	if len(now) != 1 || now[0] == removed[0] {
+		t.Error("want only the extraction of a, got", now)
+	}
+
+	// a missing cache has nothing to sweep
+	if removed, err = Sweep(filepath.Join(dir, "none"), nil, time.Now()); err != nil || len(removed) != 0 {
+		t.Error("want nothing removed, got", removed, err)
+	}
+}
+
+// writeTarWith writes a tar file with a hard link and a fifo
+func writeTarWith(t *testing.T, w io.Writer) {
+	tw := tar.NewWriter(w)
+	for _, hdr := range []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeReg, Size: 8, Mode: 0644},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "file"},
+		{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if hdr.Size > 0 {
+			_, _ = tw.Write([]byte("content\n"))
+		}
+	}
+	_ = tw.Close()
+}
@@ -0,0 +1,84 @@
+package archivefs
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// openZip lists the members of the zip file from its central
+// directory. Members are read directly from their offsets in the
+// file, decompressing them whole as the compressed stream cannot be
+// read from the middle.
+func (a *Archive) openZip() (err error) {
+	if a.file, err = os.Open(a.name); err != nil {
+		return err
+	}
+	fi, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(a.file, fi.Size())
+	if err != nil {
+		return &os.PathError{Op: "open", Path: a.name, Err: err}
+	}
+	for _, zf := range zr.File {
+		name, ok := cleanName(zf.Name)
+		if !ok {
+			continue
+		}
+		zfi := zf.FileInfo()
+		n := &node{
+			mode:  zfi.Mode(),
+			size:  zfi.Size(),
+			mtime: zf.Modified,
+			data:  zf,
+		}
+		if n.mtime.IsZero() {
+			n.mtime = zf.ModTime()
+		}
+		switch {
+		case zfi.IsDir() || strings.HasSuffix(zf.Name, "/"):
+			n = a.newDir("")
+			n.mtime = zf.Modified
+		case n.mode&os.ModeSymlink != 0:
+			if n.link, err = readZipFile(zf); err != nil {
+				return err
+			}
+		}
+		a.add(name, n)
+	}
+	a.opener = openZipFile
+	return nil
+}
+
+func openZipFile(n *node) (vfs.ReadSeekCloser, error) {
+	zf := n.data.(*zip.File)
+	r, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytesReader(b), nil
+}
+
+func readZipFile(zf *zip.File) (string, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
@@ -0,0 +1,44 @@
+package archivefs
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a.jar")
+	f, _ := os.Create(name)
+	zw := zip.NewWriter(f)
+	// a stored file, then an entry for its directory
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "META-INF/MANIFEST.MF", Method: zip.Store})
+	_, _ = w.Write([]byte("Manifest-Version: 1.0\n"))
+	_, _ = zw.Create("META-INF/")
+	_ = zw.Close()
+	_ = f.Close()
+
+	a, err := Open(name, dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer a.Close()
+	fis, err := a.ReadDir("META-INF")
+	if err != nil || len(fis) != 1 || fis[0].Name() != "MANIFEST.MF" {
+		t.Fatal("want MANIFEST.MF, got", fis, err)
+	}
+	r, err := a.Open("META-INF/MANIFEST.MF")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "Manifest-Version: 1.0\n" {
+		t.Errorf("got %q", b)
+	}
+}
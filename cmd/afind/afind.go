@@ -15,6 +15,7 @@ import (
 	"code.google.com/p/go.net/context"
 	"github.com/andaru/afind/afind"
 	"github.com/andaru/afind/afind/api"
+	"github.com/andaru/afind/archivefs"
 	"github.com/andaru/afind/errs"
 	"github.com/andaru/afind/flags"
 	"github.com/andaru/afind/utils"
@@ -38,11 +39,31 @@ var (
 		"Search only in file names matching this regexp")
 	flagSearchInsens = flagSetSearch.Bool("i", false,
 		"Case insensitive search")
-	flagMaxMatches = flagSetSearch.Uint64("n", 100, "Limit results to NUM matches")
+	flagSearchLiteral = flagSetSearch.Bool("F", false,
+		"Search for a fixed string rather than a regular expression")
+	flagSearchWord = flagSetSearch.Bool("w", false,
+		"Match only whole words")
+	flagSearchSmartCase = flagSetSearch.Bool("S", false,
+		"Case insensitive search unless the query contains an uppercase letter")
+	flagSearchQuery = flagSetSearch.Bool("Q", false,
+		"Treat the argument as a boolean query (e.g., 'foo -bar file:\\.go$')")
+	flagSearchNoDedup = flagSetSearch.Bool("nodedup", false,
+		"Report files with identical contents separately")
+	flagMaxMatches   = flagSetSearch.Uint64("n", 100, "Limit results to NUM matches")
+	flagSearchCursor = flagSetSearch.String("cursor", "",
+		"Continue a search from the cursor printed by the previous search")
+	flagSearchSnapshot = flagSetSearch.String("snapshot", "",
+		"Search the snapshot of each repo with this label (or git commit)")
+	flagSearchAsOf = flagSetSearch.String("as_of", "",
+		"Search the snapshot of each repo current at this time (e.g., 2015-06-01T12:00:00Z)")
 
 	// -key 1,2 -key 3 : one or more comma separated groups of keys
 	flagKeys flags.StringSlice
 	flagMeta = make(flags.SSMap)
+	// -x _test\.go$ -x ^vendor/ : exclude files matching any regexp
+	flagSearchExclude flags.StringList
+	// -lang go,python : search only files of these languages
+	flagSearchLang flags.StringSlice
 
 	// context, -An, -Bn, -Cn
 	flagContextPost = flagSetSearch.Int("A", 0, "Print NUM lines of trailing context")
@@ -50,12 +71,31 @@ var (
 	flagContextBoth = flagSetSearch.Int("C", 0, "Print NUM lines of output context")
 
 	// Index flagset
-	flagSetIndex = flag.NewFlagSet("index", flag.ExitOnError)
+	flagSetIndex    = flag.NewFlagSet("index", flag.ExitOnError)
+	flagIndexUpdate = flagSetIndex.Bool("u", false,
+		"Update an existing Repo, re-indexing only changed files")
+	flagIndexNoIgnore = flagSetIndex.Bool("noignore", false,
+		"Do not honor .gitignore and .ignore files")
+	flagIndexFilesFrom = flagSetIndex.String("files_from", "",
+		"Also index the files of root listed in this file, one per line")
+	flagIndexRef = flagSetIndex.String("ref", "",
+		"Index this revision (branch, tag or commit) of the git repository at root")
+	flagIndexSymbols = flagSetIndex.Bool("symbols", false,
+		"Also index the symbols defined, for 'sym:' searches")
+	flagIndexSnapshot = flagSetIndex.String("snapshot", "",
+		"Label the snapshot taken of a repo keeping snapshots")
+	// -x '*.o' -x build/ : exclude files matching any glob
+	flagIndexExclude flags.StringList
+	flagIndexInclude flags.StringList
 
 	// Repos flagset
 	flagSetRepos   = flag.NewFlagSet("repos", flag.ExitOnError)
 	flagRepoDelete = flagSetRepos.Bool("D", false,
 		"Delete a single repo if selected")
+	flagRepoVerbose = flagSetRepos.Bool("v", false,
+		"Show the kinds and a sample of files not indexed")
+	flagRepoExpire = flagSetRepos.Bool("expire", false,
+		"Show the repos beyond the server's retention rules (with -D, expire them)")
 	flagTimeoutSearch = flag.Duration("timeout", 30*time.Second,
 		"Set the search timeout in seconds")
 
@@ -87,6 +127,8 @@ func usageIndex() {
 
 Usage:
   afind index [options] <key> <root> <dirN> [dirN..]
+  afind index -u <key> [<root> <dirN> [dirN..]]
+  afind index -files_from <list> <key> <root> [dirN..]
 
 Where:
   key     Unique key for this Repo
@@ -94,6 +136,12 @@ Where:
   dirN    One or more sub directories of root.
           To index everything under root, just use '.'
 
+When updating an existing Repo with -u, the root and sub directories
+default to those the Repo was created with.
+
+Files matched by .gitignore and .ignore files are not indexed, unless
+-noignore is given.
+
 Options:`)
 	flagSetIndex.PrintDefaults()
 }
@@ -102,12 +150,18 @@ func usageRepos() {
 	fmt.Fprintln(os.Stderr, `afind repos : display and delete repositories
 
 Usage:
-  afind repos [-D] [key] [key..]
+  afind repos [-D] [-v] [key] [key..]
+  afind repos -expire [-D]
 
 If a single key only is provided, -D will delete that repository.
 Otherwise, details about the one repository are displayed.  If key is
 not provided, -D is not available and details of all repositories are
-printed.
+printed. With -v, the number of files not indexed of each kind (e.g.,
+binary or generated files) and a sample of their names are shown, as
+are the snapshots kept of each repository.
+
+With -expire, the repositories the server would evict under its
+retention rules are shown, and with -D, evicted.
 
 Options:`)
 	flagSetRepos.PrintDefaults()
@@ -117,12 +171,21 @@ func usageSearch() {
 	fmt.Fprintln(os.Stderr, `afind search : search repositories for text
 
 Usage:
-  afind search [-i] [-f pathre] <regular expression>
+  afind search [-i] [-f pathre] [-x pathre ...] <regular expression>
 
 Examples:
   Search for 'this thing' or 'that thing':
   $ afind search -i "(this thing|that thing)"
 
+  Search for 'foo' outside of tests and vendored code:
+  $ afind search -x '_test\.go$' -x '^vendor/' foo
+
+  Find where NewIndexer is defined, in repos indexed with -symbols:
+  $ afind search -w sym:NewIndexer
+
+  Search the config as it was at a time, in repos keeping snapshots:
+  $ afind search -as_of 2015-06-01T12:00:00Z 'replicas:'
+
 Options:`)
 	flagSetSearch.PrintDefaults()
 }
@@ -132,8 +195,16 @@ func init() {
 		"Search just this comma-separated list of repository keys")
 	flagSetSearch.Var(&flagMeta, "m",
 		"A key value pair found in Repo to search")
+	flagSetSearch.Var(&flagSearchExclude, "x",
+		"Do not search file names matching this regexp (may be repeated)")
+	flagSetSearch.Var(&flagSearchLang, "lang",
+		"Search only files of this comma-separated list of languages (e.g., go,python)")
 	flagSetIndex.Var(&flagMeta, "m",
 		"A key value pair added to merge with query Repo metadata when indexed")
+	flagSetIndex.Var(&flagIndexExclude, "x",
+		"Do not index files matching this glob (may be repeated)")
+	flagSetIndex.Var(&flagIndexInclude, "include",
+		"Index only files matching this glob (may be repeated)")
 	flag.Usage = usage
 	flagSetSearch.Usage = usageSearch
 	flagSetIndex.Usage = usageIndex
@@ -193,12 +264,19 @@ func newContext() *ctx {
 	return context
 }
 
+// getSearchContext returns the lines of context requested. -A and
+// -B are marked set when given, so that even -A 0 overrides -C.
 func getSearchContext() afind.SearchContext {
-	return afind.SearchContext{
-		Both: *flagContextBoth,
-		Pre:  *flagContextPre,
-		Post: *flagContextPost,
-	}
+	sc := afind.SearchContext{Both: *flagContextBoth}
+	flagSetSearch.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "A":
+			sc.Post, sc.PostSet = *flagContextPost, true
+		case "B":
+			sc.Pre, sc.PreSet = *flagContextPre, true
+		}
+	})
+	return sc
 }
 
 func search(c *ctx, query string) error {
@@ -206,16 +284,37 @@ func search(c *ctx, query string) error {
 		Re:         query,
 		PathRe:     *flagSearchPath,
 		IgnoreCase: *flagSearchInsens,
+		Literal:    *flagSearchLiteral,
+		Word:       *flagSearchWord,
+		SmartCase:  *flagSearchSmartCase,
 		RepoKeys:   flagKeys,
 		Meta:       afind.Meta(flagMeta),
 		MaxMatches: *flagMaxMatches,
 		Recurse:    true,
 		Timeout:    *flagTimeoutSearch,
+		Cursor:     *flagSearchCursor,
+		NoDedup:    *flagSearchNoDedup,
+		Snapshot:   *flagSearchSnapshot,
 	}
+	if *flagSearchAsOf != "" {
+		asOf, err := time.Parse(time.RFC3339, *flagSearchAsOf)
+		if err != nil {
+			return err
+		}
+		request.AsOf = asOf
+	}
+	if *flagSearchQuery {
+		request.Re, request.Query = "", query
+	}
+	request.ExcludePathRe = flagSearchExclude
+	request.Languages = flagSearchLang
 	request.Context = getSearchContext()
 	sr, err := c.searcher.Search(context.Background(), request)
 	// now print the matches
 	printMatches(sr)
+	if sr.Next != "" {
+		fmt.Fprintf(os.Stderr, "More results available with -cursor=%s\n", sr.Next)
+	}
 	// print per repo errors, if any were found
 	printErrors(sr)
 	if *flagVerbose {
@@ -236,8 +335,29 @@ func index(c *ctx, key, root string, dirsOrFiles []string) error {
 		Dirs:    []string{},
 		Files:   []string{},
 		Meta:    afind.Meta(flagMeta),
+		Update:  *flagIndexUpdate,
 		Recurse: true,
 	}
+	if *flagIndexFilesFrom != "" {
+		// the list is read by the server
+		name, err := filepath.Abs(*flagIndexFilesFrom)
+		if err != nil {
+			return err
+		}
+		request.FilesFrom = name
+	}
+	request.Exclude = flagIndexExclude
+	request.Include = flagIndexInclude
+	request.NoIgnoreFiles = *flagIndexNoIgnore
+	request.Ref = *flagIndexRef
+	request.Symbols = *flagIndexSymbols
+	request.Snapshot = *flagIndexSnapshot
+	if request.Ref != "" || archivefs.IsArchive(root) {
+		// the files are in the repository or archive, not on disk;
+		// walking a file finds just that file
+		request.Dirs = append(request.Dirs, dirsOrFiles...)
+		dirsOrFiles = nil
+	}
 	// Scan the dirsOrFiles to see which are which, and add them
 	// appropriately to the request
 	for _, path := range dirsOrFiles {
@@ -264,6 +384,11 @@ func index(c *ctx, key, root string, dirsOrFiles []string) error {
 	if ir.Error != (*errs.StructError)(nil) {
 		return ir.Error
 	}
+	if *flagVerbose {
+		for rule, n := range ir.Skipped {
+			fmt.Printf("index [%s] skipped %d by %s\n", key, n, rule)
+		}
+	}
 	return nil
 }
 
@@ -283,10 +408,107 @@ func repoAsString(r *afind.Repo) string {
 		fmt.Sprintf("  indexed in:   %v\n", r.ElapsedIndexing) +
 		fmt.Sprintf("  state:        %s\n", r.State) +
 		fmt.Sprintf("  root path:    %v\n", r.Root) +
+		repoGitAsString(r) +
 		fmt.Sprintf("  data size:    %s\n", r.SizeData) +
 		fmt.Sprintf("  index size:   %s\n", r.SizeIndex) +
 		fmt.Sprintf("  files:        %d\n", r.NumFiles) +
-		fmt.Sprintf("  metadata:     %v\n", meta))
+		repoSymbolsAsString(r) +
+		fmt.Sprintf("  metadata:     %v\n", meta) +
+		repoRefreshAsString(r) +
+		repoSnapshotAsString(r))
+}
+
+// repoSnapshotAsString describes the snapshot searched, or the
+// number of snapshots kept, if any
+func repoSnapshotAsString(r *afind.Repo) string {
+	if r.Snapshot != nil {
+		return fmt.Sprintf("  snapshot:     %s (%v)\n", r.Snapshot.Label, r.Snapshot.Time)
+	} else if len(r.Snapshots) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("  snapshots:    %d\n", len(r.Snapshots))
+}
+
+// repoSnapshotsAsString lists the snapshots kept of the Repo
+func repoSnapshotsAsString(r *afind.Repo) string {
+	s := ""
+	for _, snap := range r.Snapshots {
+		s += fmt.Sprintf("  snapshot %s: %v (%d files, %s index)\n",
+			snap.Label, snap.Time, snap.NumFiles, snap.SizeIndex)
+	}
+	return s
+}
+
+// repoGitAsString describes the git revision indexed, if any
+func repoGitAsString(r *afind.Repo) string {
+	if r.Ref == "" {
+		return ""
+	}
+	return fmt.Sprintf("  git revision: %s (commit %s)\n", r.Ref, r.Meta.GitCommit())
+}
+
+// repoSymbolsAsString describes the Repo's symbol index, if any
+func repoSymbolsAsString(r *afind.Repo) string {
+	if !r.Symbols {
+		return ""
+	}
+	return fmt.Sprintf("  symbols:      %d\n", r.NumSymbols)
+}
+
+// repoRefreshAsString describes the Repo's re-indexing schedule, if any
+func repoRefreshAsString(r *afind.Repo) string {
+	if r.NextRefresh.IsZero() {
+		return ""
+	}
+	s := fmt.Sprintf("  next refresh: %v (every %s)\n", r.NextRefresh, r.Meta["refresh"])
+	if r.RefreshFailures > 0 {
+		s += fmt.Sprintf("  refresh failed %d times: %s\n", r.RefreshFailures, r.RefreshError)
+	}
+	return s
+}
+
+// repoSkippedAsString describes the files not indexed in the Repo
+func repoSkippedAsString(r *afind.Repo) string {
+	reasons := []string{}
+	for reason := range r.SkippedFiles {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	s := ""
+	for _, reason := range reasons {
+		s += fmt.Sprintf("  skipped %s: %d\n", reason, r.SkippedFiles[reason])
+		for _, name := range r.SkippedSample[reason] {
+			s += fmt.Sprintf("    %s\n", name)
+		}
+	}
+	return s
+}
+
+// repoLanguagesAsString counts the files of each language in the Repo
+func repoLanguagesAsString(r *afind.Repo) string {
+	if len(r.Languages) == 0 {
+		return ""
+	}
+	langs := []string{}
+	for lang := range r.Languages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	counts := make([]string, len(langs))
+	for i, lang := range langs {
+		counts[i] = fmt.Sprintf("%s %d", lang, r.Languages[lang])
+	}
+	return "  languages: " + strings.Join(counts, ", ") + "\n"
+}
+
+func printRepo(r *afind.Repo) {
+	s := repoAsString(r)
+	if *flagVerbose || *flagRepoVerbose {
+		s += repoLanguagesAsString(r)
+		s += repoSkippedAsString(r)
+		s += repoSnapshotsAsString(r)
+	}
+	fmt.Println(s)
 }
 
 func repos(c *ctx, key string) error {
@@ -299,7 +521,7 @@ func repos(c *ctx, key string) error {
 			return allerr
 		}
 		for _, v := range repos {
-			fmt.Println(repoAsString(v))
+			printRepo(v)
 		}
 	} else {
 		// or just one by argument
@@ -307,7 +529,7 @@ func repos(c *ctx, key string) error {
 			repos, err := c.repos.Get(key)
 			if err == nil {
 				for _, repo := range repos {
-					fmt.Println(repoAsString(repo))
+					printRepo(repo)
 				}
 			}
 		} else {
@@ -318,6 +540,23 @@ func repos(c *ctx, key string) error {
 	return err
 }
 
+func expire(c *ctx, evict bool) error {
+	report, err := c.repos.Expire(!evict)
+	if err != nil {
+		return err
+	}
+	verb := "would expire"
+	if evict {
+		verb = "expired"
+	}
+	for _, r := range report.Expired {
+		fmt.Printf("%s repo %s [%s] (updated %v, %v index)\n",
+			verb, r.Key, r.Reason, r.TimeUpdated, r.SizeIndex)
+	}
+	fmt.Printf("%s %d repos, %v index\n", verb, len(report.Expired), report.SizeIndex)
+	return nil
+}
+
 func doAfind() error {
 	var err error
 
@@ -335,14 +574,21 @@ func doAfind() error {
 		args := flagSetIndex.Args()
 		// arguments, must have at least 1 subdir
 		// <key> <rootdir> <subdir> [subdir...]
-		if len(args) < 3 {
+		// or when updating, just the key is required
+		// <key> [<rootdir> <subdir> [subdir...]]
+		var key, root string
+		var dirsOrFiles []string
+		if *flagIndexUpdate && len(args) == 1 {
+			key = args[0]
+		} else if len(args) < 3 && !(len(args) == 2 && *flagIndexFilesFrom != "") {
 			// usage
 			flagSetIndex.Usage()
 			return nil
+		} else {
+			key = args[0]
+			root = args[1]
+			dirsOrFiles = args[2:]
 		}
-		key := args[0]
-		root := args[1]
-		dirsOrFiles := args[2:]
 		fmt.Printf("%v %v %v\n", key, root, dirsOrFiles)
 		if err = setupContext(context); err == nil {
 			return index(context, key, root, dirsOrFiles)
@@ -371,7 +617,9 @@ func doAfind() error {
 		if err = setupContext(context); err != nil {
 			return err
 		}
-		if len(args) == 0 {
+		if *flagRepoExpire {
+			err = expire(context, *flagRepoDelete)
+		} else if len(args) == 0 {
 			err = repos(context, "")
 		} else if len(args) > 0 {
 			for _, arg := range args {
@@ -383,24 +631,58 @@ func doAfind() error {
 }
 
 func printMatches(sr *afind.SearchResult) {
-	for name, repos := range sr.Matches {
-		for repo, matches := range repos {
+	// Print files in rank order, ranking them here if the server
+	// did not
+	if len(sr.Ranked) == 0 {
+		sr.Rank()
+	}
+	for _, rf := range sr.Ranked {
+		name, repo := rf.File, rf.RepoKey
+		if matches, ok := sr.Matches[name][repo]; ok {
+			context := sr.Context[name][repo]
 			nums := make([]int, 0)
-			for l, _ := range matches {
-				if linenum, err := strconv.Atoi(l); err == nil {
-					nums = append(nums, linenum)
+			for _, lines := range []map[string]string{matches, context} {
+				for l, _ := range lines {
+					if linenum, err := strconv.Atoi(l); err == nil {
+						nums = append(nums, linenum)
+					}
 				}
 			}
 			sort.Ints(nums)
-			for _, linenum := range nums {
+			// As with grep, matches are separated from their
+			// context with ':' and context with '-', and
+			// non-contiguous groups of lines are separated by "--"
+			for i, linenum := range nums {
+				if i > 0 && linenum > nums[i-1]+1 {
+					fmt.Println("--")
+				}
 				textlinenum := strconv.Itoa(linenum)
-				fmt.Printf("%s:%s:%s:%s",
-					repo, name, textlinenum, matches[textlinenum])
+				if text, ok := matches[textlinenum]; ok {
+					for _, sym := range sr.Symbols[name][repo][textlinenum] {
+						fmt.Printf("%s:%s:%s: %s %s\n",
+							repo, name, textlinenum, sym.Kind, symbolName(sym))
+					}
+					fmt.Printf("%s:%s:%s:%s", repo, name, textlinenum, text)
+				} else {
+					fmt.Printf("%s:%s-%s-%s",
+						repo, name, textlinenum, context[textlinenum])
+				}
+			}
+			for _, d := range sr.Duplicates[name][repo] {
+				fmt.Printf("%s:%s= same as %s:%s\n", d.RepoKey, d.File, repo, name)
 			}
 		}
 	}
 }
 
+// symbolName returns the name of the symbol qualified by its scope
+func symbolName(sym afind.Symbol) string {
+	if sym.Scope == "" {
+		return sym.Name
+	}
+	return sym.Scope + "." + sym.Name
+}
+
 func printErrors(sr *afind.SearchResult) {
 	first := true
 	pfirst := func() {
@@ -31,6 +31,12 @@ func init() {
 	// which will default to the hostname reported by the kernel.
 	flag.Var(&flagMeta, "D",
 		"A key=value metadata attribute to write on all indexed repos")
+	flag.Var(&flagNoIndex, "noindex",
+		"A regexp matching file names to skip for indexing (may be repeated)")
+	flag.Var(&flagNoIndexGlob, "noindex_glob",
+		"A glob matching file names to skip for indexing (may be repeated)")
+	flag.Var(&flagRetain, "retain",
+		"A retention rule, e.g. max_age=72h,max_repos=100,max_size=10GB,meta.ci=true (may be repeated)")
 	flag.Usage = usage
 }
 
@@ -52,6 +58,25 @@ func getConfig() afind.Config {
 		MaxSearchRepo:       *flagSearchRepo,
 		MaxSearchReqBe:      *flagSearchReqBe,
 		DeleteRepoOnError:   *flagDeleteRepoOnError,
+		IndexExclude:        flagNoIndex,
+		IndexExcludeGlob:    flagNoIndexGlob,
+		IndexMaxFileSize:    afind.ByteSize(*flagIndexMaxFileSize),
+		IndexGenerated:      *flagIndexGenerated,
+		FilesFromDir:        *flagFilesFromDir,
+		ReconcileInterval:   *flagReconcileInterval,
+		RetentionInterval:   *flagRetentionInterval,
+		RefreshParallel:     *flagRefreshParallel,
+		WatchRescan:         *flagWatchRescan,
+		ArchiveCache:        *flagArchiveCache,
+	}
+	c.ReconcileRemoveOrphans = *flagReconcileGC
+	for _, s := range flagRetain {
+		rule, err := afind.ParseRetentionRule(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -retain:", err)
+			os.Exit(2)
+		}
+		c.Retention = append(c.Retention, rule)
 	}
 	c.SetVerbose(*flagVerbose)
 	c.Host()
@@ -63,8 +88,12 @@ var (
 		"index_root", "/tmp/afind", "Index file path")
 	flagIndexInRepo = flag.Bool("index_in_repo", true,
 		"Write indices to -index_root if false, else in repository root path")
-	flagNoIndex = flag.String("noindex", "",
-		"A regexp matching file names to skip for indexing")
+	flagIndexMaxFileSize = flag.Int64("index_max_file_size", 0,
+		"Do not index files larger than this many bytes (0 for the index limit of 1GB)")
+	flagIndexGenerated = flag.Bool("index_generated", false,
+		"Index generated and minified files, which are skipped otherwise")
+	flagFilesFromDir = flag.String("files_from_dir", "",
+		"Directory holding the lists of files named by index requests' files_from (empty to refuse them)")
 	flagRPCBind = flag.String("rpc", ":30800",
 		"Run RPC server on this address:port")
 	flagHTTPBind = flag.String("http", "",
@@ -74,7 +103,22 @@ var (
 	flagNumShards = flag.Int("nshards", 4,
 		"Number of file shards created per Repo indexing request")
 	flagDbFile = flag.String("dbfile", "",
-		"The Repo persistent storage backing (JSON)")
+		"The Repo persistent storage backing file")
+	flagDbBackend = flag.String("db_backend", afind.DbBackendJson,
+		"The -dbfile format: json (rewritten on each change) or log (appended to)")
+	flagReconcileInterval = flag.Duration("reconcile_interval", 0,
+		"Also reconcile the Repo database with index files this often (0 for startup only)")
+	flagReconcileGC = flag.Bool("reconcile_gc", false,
+		"Remove index files under -index_root belonging to no Repo when reconciling")
+	flagRefreshParallel = flag.Int("refresh_parallel", 2,
+		"Maximum scheduled re-indexing (Repo with 'refresh' metadata) at any one time")
+	flagRetentionInterval = flag.Duration("retention_interval", 10*time.Minute,
+		"How often Repo beyond the -retain rules are expired")
+	flagWatchRescan = flag.Duration("watch_rescan", 5*time.Minute,
+		"How often Repo in watch mode are rescanned when their files cannot be watched")
+	flagArchiveCache = flag.String("archive_cache", "",
+		"Directory compressed tar archives are decompressed to for indexing "+
+			"(default: afind_archives in the temporary directory)")
 	flagVerbose = flag.Bool("v", false,
 		"Log verbosely")
 	flagTimeoutIndex = flag.Duration("timeout_index", defaultTimeoutIndex,
@@ -96,6 +140,10 @@ var (
 	flagDeleteRepoOnError = flag.Bool("delete_repo_on_error", true,
 		"Delete Repo from storage if their state changes to ERROR")
 	flagMeta = make(flags.SSMap)
+	// -noindex '\.min\.js$' -noindex_glob 'node_modules/'
+	flagNoIndex     flags.StringList
+	flagNoIndexGlob flags.StringList
+	flagRetain      flags.StringList
 
 	log *logging.Logger
 )
@@ -133,21 +181,27 @@ type system struct {
 	finder   afind.Finder
 	config   afind.Config
 
+	reconciler afind.Reconciler
+
 	quit chan struct{}
 }
 
-func newAfind(cfg afind.Config) system {
+func newAfind(cfg afind.Config) (system, error) {
 	sys := system{config: cfg}
-	if *flagDbFile != "" {
-		sys.repos = afind.NewJsonBackedDb(*flagDbFile)
-	} else {
+	if *flagDbFile == "" {
 		log.Warning("no repo backing store - repos will be lost at process exit")
-		sys.repos = afind.NewDb()
 	}
+	repos, err := afind.OpenDb(*flagDbBackend, *flagDbFile)
+	if err != nil {
+		return sys, err
+	}
+	sys.repos = repos
+	sys.reconciler = afind.NewReconciler(&sys.config, sys.repos)
+	sys.reconciler.Reconcile()
 	sys.indexer = afind.NewIndexer(&sys.config, sys.repos)
 	sys.searcher = afind.NewSearcher(&sys.config, sys.repos)
 	sys.finder = afind.NewFinder(&sys.config, sys.repos)
-	return sys
+	return sys, nil
 }
 
 func main() {
@@ -155,7 +209,27 @@ func main() {
 	cfg := getConfig()
 	setupLogging()
 	log.Info("afindd daemon starting")
-	af := newAfind(cfg)
+	af, err := newAfind(cfg)
+	if err != nil {
+		crit(err)
+		os.Exit(1)
+	}
+	if cfg.ReconcileInterval > 0 {
+		go func() {
+			for _ = range time.Tick(cfg.ReconcileInterval) {
+				af.reconciler.Reconcile()
+			}
+		}()
+	}
+	go afind.NewRefresher(&af.config, af.repos, af.indexer).Run(af.quit)
+	go afind.NewWatcher(&af.config, af.repos, af.indexer).Run(af.quit)
+	if len(cfg.Retention) > 0 && cfg.RetentionInterval > 0 {
+		go func() {
+			for _ = range time.Tick(cfg.RetentionInterval) {
+				afind.ExpireRepos(&af.config, af.repos, false)
+			}
+		}()
+	}
 	server := api.NewServer(af.repos, af.indexer, af.searcher, af.finder, &cfg)
 
 	// setup quit signal channel (aka handler)
@@ -30,6 +30,26 @@ func IsRepoExistsError(e error) bool {
 	return false
 }
 
+// Repo is currently being indexed, and cannot be indexed concurrently
+type RepoIndexingError struct {
+	key string
+}
+
+func NewRepoIndexingError(key string) *RepoIndexingError {
+	return &RepoIndexingError{key: key}
+}
+
+func (e *RepoIndexingError) Error() string {
+	return "Repository with key '" + e.key + "' is already being indexed"
+}
+
+func IsRepoIndexingError(e error) bool {
+	if _, ok := e.(*RepoIndexingError); ok {
+		return true
+	}
+	return false
+}
+
 // There was an error regarding the value of some argunent
 type ValueError struct {
 	arg string
@@ -194,6 +214,8 @@ func NewStructError(e error) *StructError {
 		return &StructError{"no_repo_found", e.Error()}
 	case *RepoExistsError:
 		return &StructError{"repo_exists", e.Error()}
+	case *RepoIndexingError:
+		return &StructError{"repo_indexing", e.Error()}
 	case *ValueError:
 		return &StructError{"value_error", e.Error()}
 	default:
@@ -21,6 +21,7 @@ func TestStructErrorType(t *testing.T) {
 	check(NewRepoUnavailableError(), "no_repo_found")
 	check(NewNoRpcClientError(), "rpc_client_unavailable")
 	check(NewRepoExistsError("repo_key"), "repo_exists")
+	check(NewRepoIndexingError("repo_key"), "repo_indexing")
 	check(NewValueError("argument", "msg"), "value_error")
 	check(errors.New("yeehaw"), "unknown_error")
 }
@@ -28,6 +28,19 @@ func (ss *StringSlice) AsSliceOfString() []string {
 	return *ss
 }
 
+// Repeatable string flag. Unlike StringSlice, values are not split
+// on commas, so may hold regular expressions.
+type StringList []string
+
+func (sl *StringList) String() string {
+	return fmt.Sprint(*sl)
+}
+
+func (sl *StringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 // String/string map flag
 // This is used for user defined repo metadata by afind and afindd
 type SSMap map[string]string
@@ -0,0 +1,272 @@
+package gitfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andaru/afind/walkablefs"
+	"golang.org/x/tools/godoc/vfs"
+)
+
+const (
+	// the most symbolic links followed looking up a path
+	maxSymlinks = 40
+)
+
+var (
+	errIsDir = errors.New("is a directory")
+)
+
+// treeFS is the read-only file system of a commit's tree. Files
+// have the commit's time as their modification time, and their blob
+// id as their FileInfo's Sys(). Submodules are not included.
+type treeFS struct {
+	repo   *Repository
+	commit ID
+	root   ID
+	mtime  time.Time
+
+	mu    *sync.Mutex
+	trees map[ID][]treeEntry // the trees read so far
+}
+
+// FileSystem returns the tree of the commit as a file system
+func (r *Repository) FileSystem(commit ID) (walkablefs.WalkableFileSystem, error) {
+	t, data, err := r.object(commit)
+	if err != nil {
+		return nil, err
+	} else if t != typeCommit {
+		return nil, errors.New(commit.String() + " is a " + t.String() + ", not a commit")
+	}
+	c, err := parseCommit(commit, data)
+	if err != nil {
+		return nil, err
+	}
+	return walkablefs.New(&treeFS{
+		repo:   r,
+		commit: commit,
+		root:   c.tree,
+		mtime:  time.Unix(c.time, 0).UTC(),
+		mu:     &sync.Mutex{},
+		trees:  make(map[ID][]treeEntry),
+	}), nil
+}
+
+func (fs *treeFS) String() string {
+	return "git(" + fs.repo.dir + "@" + fs.commit.String() + ")"
+}
+
+func (fs *treeFS) RootType(string) vfs.RootType {
+	return ""
+}
+
+// tree returns the entries of the tree, reading it if necessary
+func (fs *treeFS) tree(id ID) ([]treeEntry, error) {
+	fs.mu.Lock()
+	entries, ok := fs.trees[id]
+	fs.mu.Unlock()
+	if ok {
+		return entries, nil
+	}
+	t, data, err := fs.repo.object(id)
+	if err != nil {
+		return nil, err
+	} else if t != typeTree {
+		return nil, errors.New(id.String() + " is a " + t.String() + ", not a tree")
+	}
+	if entries, err = parseTree(id, data); err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	fs.trees[id] = entries
+	fs.mu.Unlock()
+	return entries, nil
+}
+
+// lookup returns the tree entry at the path, following symbolic
+// links in its directories, and in its last element if follow is
+// true. The root has an entry with an empty name.
+func (fs *treeFS) lookup(name string, follow bool) (treeEntry, error) {
+	name = path.Clean("/" + name)
+	links := 0
+	for {
+		e, target, err := fs.walk(name, follow)
+		if err != nil || target == "" {
+			return e, err
+		}
+		if links++; links > maxSymlinks {
+			return e, errors.New("too many levels of symbolic links")
+		}
+		name = target
+	}
+}
+
+// walk looks up the path. If it passes through a symbolic link, the
+// path with the link replaced by its target is returned instead.
+func (fs *treeFS) walk(name string, follow bool) (treeEntry, string, error) {
+	e := treeEntry{mode: modeDir, id: fs.root}
+	if name == "/" {
+		return e, "", nil
+	}
+	dir := "/"
+	elems := splitPath(name)
+	for i, elem := range elems {
+		if e.mode != modeDir {
+			return e, "", os.ErrNotExist
+		}
+		entries, err := fs.tree(e.id)
+		if err != nil {
+			return e, "", err
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.name == elem && entry.mode != modeGitlink {
+				e, found = entry, true
+				break
+			}
+		}
+		if !found {
+			return e, "", os.ErrNotExist
+		}
+		last := i == len(elems)-1
+		if e.mode == modeSymlink && (!last || follow) {
+			_, target, err := fs.repo.object(e.id)
+			if err != nil {
+				return e, "", err
+			}
+			rest := path.Join(elems[i+1:]...)
+			if bytes.HasPrefix(target, []byte("/")) {
+				// links out of the tree lead nowhere
+				return e, "", os.ErrNotExist
+			}
+			return e, path.Join(dir, string(target), rest), nil
+		}
+		dir = path.Join(dir, elem)
+	}
+	return e, "", nil
+}
+
+func splitPath(name string) []string {
+	elems := []string{}
+	for _, elem := range strings.Split(name, "/") {
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// fileInfo describes an entry of the tree
+type fileInfo struct {
+	name  string
+	mode  os.FileMode
+	size  int64
+	mtime time.Time
+	id    ID
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+
+// Sys returns the ID of the file's blob or directory's tree
+func (fi *fileInfo) Sys() interface{} { return fi.id }
+
+func (fs *treeFS) info(name string, e treeEntry) (os.FileInfo, error) {
+	fi := &fileInfo{name: name, mtime: fs.mtime, id: e.id}
+	switch e.mode {
+	case modeDir:
+		fi.mode = os.ModeDir | 0555
+		return fi, nil
+	case modeSymlink:
+		fi.mode = os.ModeSymlink | 0777
+	case modeExec:
+		fi.mode = 0555
+	default:
+		fi.mode = 0444
+	}
+	_, size, err := fs.repo.size(e.id)
+	if err != nil {
+		return nil, err
+	}
+	fi.size = size
+	return fi, nil
+}
+
+func (fs *treeFS) stat(op, name string, follow bool) (os.FileInfo, error) {
+	e, err := fs.lookup(name, follow)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = fs.info(path.Base(path.Clean("/"+name)), e); err == nil {
+			return fi, nil
+		}
+	}
+	return nil, &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Lstat returns the FileInfo of the path, not following a final
+// symbolic link
+func (fs *treeFS) Lstat(name string) (os.FileInfo, error) {
+	return fs.stat("lstat", name, false)
+}
+
+// Stat returns the FileInfo of the path
+func (fs *treeFS) Stat(name string) (os.FileInfo, error) {
+	return fs.stat("stat", name, true)
+}
+
+// ReadDir returns the entries of the directory, sorted by name
+func (fs *treeFS) ReadDir(name string) ([]os.FileInfo, error) {
+	e, err := fs.lookup(name, true)
+	if err == nil && e.mode != modeDir {
+		err = errors.New("not a directory")
+	}
+	var entries []treeEntry
+	if err == nil {
+		entries, err = fs.tree(e.id)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.mode == modeGitlink {
+			continue
+		}
+		fi, err := fs.info(entry.name, entry)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+// Open returns a reader of the file's content
+func (fs *treeFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	e, err := fs.lookup(name, true)
+	if err == nil && e.mode == modeDir {
+		err = errIsDir
+	}
+	var data []byte
+	if err == nil {
+		_, data, err = fs.repo.object(e.id)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,121 @@
+package gitfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSystem(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	r.write("README", "readme\n")
+	r.write("src/main.go", "package main\n")
+	r.write("src/lib/lib.go", "package lib\n")
+	_ = os.Symlink("lib/lib.go", filepath.Join(r.dir, "src/link.go"))
+	_ = os.Symlink("src/lib", filepath.Join(r.dir, "libdir"))
+	_ = os.Symlink("/etc/passwd", filepath.Join(r.dir, "outside"))
+	first := r.commit("first")
+	r.write("src/main.go", "package main // changed\n")
+	r.write("new.txt", "new\n")
+	r.commit("second")
+
+	repo, err := Open(r.dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer repo.Close()
+	id, _ := ParseID(first)
+	fs, err := repo.FileSystem(id)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// the tree is of the commit, not the work tree
+	walked := []string{}
+	_ = fs.Walk("/", func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			t.Error("unexpected error:", err)
+		} else if fi.Mode()&os.ModeType == 0 {
+			walked = append(walked, name)
+		}
+		return nil
+	})
+	sort.Strings(walked)
+	want := "/README /src/lib/lib.go /src/main.go"
+	if got := strings.Join(walked, " "); got != want {
+		t.Error("want", want, "got", got)
+	}
+
+	read := func(name string) string {
+		f, err := fs.Open(name)
+		if err != nil {
+			return err.Error()
+		}
+		defer f.Close()
+		b, _ := ioutil.ReadAll(f)
+		return string(b)
+	}
+	for name, want := range map[string]string{
+		"src/main.go":     "package main\n",
+		"/src/main.go":    "package main\n",
+		"src/link.go":     "package lib\n",
+		"libdir/lib.go":   "package lib\n",
+		"src/../README":   "readme\n",
+		"new.txt":         "open new.txt: file does not exist",
+		"outside":         "open outside: file does not exist",
+		"src":             "open src: is a directory",
+		"README/x":        "open README/x: file does not exist",
+		"libdir/../../..": "open libdir/../../..: is a directory",
+	} {
+		if got := read(name); got != want {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+
+	fi, err := fs.Lstat("src/main.go")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	blob := r.git("rev-parse", first+":src/main.go")
+	if fi.Name() != "main.go" || fi.Size() != 13 || fi.IsDir() ||
+		!fi.ModTime().Equal(time.Unix(1400000000, 0)) ||
+		fi.Sys().(ID).String() != blob {
+		t.Errorf("unexpected file info %#v", fi)
+	}
+	if fi, err = fs.Lstat("src/link.go"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("want a symlink, got", fi, err)
+	}
+	if fi, err = fs.Stat("src/link.go"); err != nil || fi.Mode()&os.ModeType != 0 ||
+		fi.Size() != 12 {
+		t.Error("want the linked file, got", fi, err)
+	}
+	if _, err = fs.Stat("missing"); !os.IsNotExist(err) {
+		t.Error("want not exist error, got", err)
+	}
+
+	fis, err := fs.ReadDir("/src")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if got := strings.Join(names, " "); got != "lib link.go main.go" {
+		t.Error("want lib link.go main.go, got", got)
+	}
+	if _, err = fs.ReadDir("README"); err == nil {
+		t.Error("want error reading a file as a directory")
+	}
+
+	// a blob is not a commit
+	id, _ = ParseID(blob)
+	if _, err = repo.FileSystem(id); err == nil {
+		t.Error("want error for the file system of a blob")
+	}
+}
@@ -0,0 +1,400 @@
+// Package gitfs reads files from the object database of a git
+// repository, bare or otherwise, without a checkout.
+//
+// A Repository resolves revisions (branches, tags and commit ids) to
+// commits, and presents the tree of a commit as a read-only
+// walkablefs.WalkableFileSystem. Loose objects and version 1 and 2
+// pack files (including deltified objects), packed and symbolic refs
+// and alternate object directories are supported.
+package gitfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ID is the SHA-1 name of a git object
+type ID [20]byte
+
+// String returns the id in hexadecimal
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseID parses a full hexadecimal object id
+func ParseID(s string) (id ID, err error) {
+	if len(s) != 2*len(id) {
+		return id, fmt.Errorf("invalid object id %q", s)
+	}
+	if _, err = hex.Decode(id[:], []byte(s)); err != nil {
+		return id, fmt.Errorf("invalid object id %q", s)
+	}
+	return id, nil
+}
+
+// objectType is the type of a git object, as numbered in pack files
+type objectType int
+
+const (
+	typeCommit   objectType = 1
+	typeTree     objectType = 2
+	typeBlob     objectType = 3
+	typeTag      objectType = 4
+	typeOfsDelta objectType = 6
+	typeRefDelta objectType = 7
+)
+
+var typeNames = map[objectType]string{
+	typeCommit: "commit",
+	typeTree:   "tree",
+	typeBlob:   "blob",
+	typeTag:    "tag",
+}
+
+func (t objectType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "type " + strconv.Itoa(int(t))
+}
+
+func parseType(name string) (objectType, error) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown object type %q", name)
+}
+
+var (
+	errNotFound = errors.New("object not found")
+	errNotGit   = errors.New("not a git repository")
+)
+
+// A Repository is a git repository's object database and refs. It
+// is safe for concurrent use.
+type Repository struct {
+	dir     string   // the git directory
+	objects []string // object directories, the repository's first
+
+	mu    *sync.Mutex
+	packs []*pack
+	names map[string]bool // the pack index files opened
+}
+
+// Open opens the git repository at path, which may be a bare
+// repository, or the top directory of a work tree
+func Open(path string) (*Repository, error) {
+	dir, err := gitDir(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repository{
+		dir:   dir,
+		mu:    &sync.Mutex{},
+		names: make(map[string]bool),
+	}
+	r.objects = objectDirs(filepath.Join(dir, "objects"), 0)
+	if err = r.loadPacks(); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// gitDir returns the git directory of the repository at path
+func gitDir(path string) (string, error) {
+	dotgit := filepath.Join(path, ".git")
+	if fi, err := os.Stat(dotgit); err == nil && fi.IsDir() {
+		path = dotgit
+	} else if err == nil {
+		// a "gitdir: <path>" file, as used by linked work trees
+		b, err := ioutil.ReadFile(dotgit)
+		if err != nil {
+			return "", err
+		}
+		s := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(s, "gitdir: ") {
+			return "", fmt.Errorf("%s: %v", path, errNotGit)
+		}
+		path = strings.TrimPrefix(s, "gitdir: ")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(dotgit), path)
+		}
+	}
+	for _, name := range []string{"HEAD", "objects"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+			return "", fmt.Errorf("%s: %v", path, errNotGit)
+		}
+	}
+	return path, nil
+}
+
+// objectDirs returns the object directory and its alternates
+func objectDirs(dir string, depth int) []string {
+	dirs := []string{dir}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if err != nil || depth >= 5 {
+		return dirs
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		dirs = append(dirs, objectDirs(line, depth+1)...)
+	}
+	return dirs
+}
+
+// Dir returns the repository's git directory
+func (r *Repository) Dir() string {
+	return r.dir
+}
+
+// Close closes the repository's pack files
+func (r *Repository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.packs {
+		_ = p.close()
+	}
+	r.packs = nil
+	r.names = make(map[string]bool)
+	return nil
+}
+
+// loadPacks opens any pack files not already open, such as those
+// written since the repository was opened
+func (r *Repository) loadPacks() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dir := range r.objects {
+		names, _ := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+		sort.Strings(names)
+		for _, name := range names {
+			if r.names[name] {
+				continue
+			}
+			p, err := openPack(name)
+			if err != nil {
+				return err
+			}
+			r.names[name] = true
+			r.packs = append(r.packs, p)
+		}
+	}
+	return nil
+}
+
+func (r *Repository) getPacks() []*pack {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.packs
+}
+
+// object returns the type and content of the object
+func (r *Repository) object(id ID) (objectType, []byte, error) {
+	return r.readObject(id, 0)
+}
+
+func (r *Repository) readObject(id ID, depth int) (objectType, []byte, error) {
+	for retry := false; ; retry = true {
+		for _, p := range r.getPacks() {
+			if offset, ok := p.find(id); ok {
+				return p.read(r, offset, depth)
+			}
+		}
+		t, data, err := r.readLoose(id)
+		if err != errNotFound || retry {
+			return t, data, err
+		}
+		// the object may have been packed since the packs were loaded
+		if err = r.loadPacks(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// size returns the type and size of the object, without reading all
+// of its content where possible
+func (r *Repository) size(id ID) (objectType, int64, error) {
+	return r.objectSize(id, 0)
+}
+
+func (r *Repository) objectSize(id ID, depth int) (objectType, int64, error) {
+	for _, p := range r.getPacks() {
+		if offset, ok := p.find(id); ok {
+			return p.size(r, offset, depth)
+		}
+	}
+	f, err := r.openLoose(id)
+	if err != nil {
+		if err == errNotFound {
+			t, data, err := r.object(id)
+			return t, int64(len(data)), err
+		}
+		return 0, 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("object %v: %v", id, err)
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	hdr := make([]byte, 32)
+	n, err := io.ReadFull(zr, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, 0, fmt.Errorf("object %v: %v", id, err)
+	}
+	t, size, _, err := parseLooseHeader(hdr[:n])
+	if err != nil {
+		return 0, 0, fmt.Errorf("object %v: %v", id, err)
+	}
+	return t, size, nil
+}
+
+func (r *Repository) openLoose(id ID) (*os.File, error) {
+	hex := id.String()
+	for _, dir := range r.objects {
+		f, err := os.Open(filepath.Join(dir, hex[:2], hex[2:]))
+		if err == nil {
+			return f, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, errNotFound
+}
+
+// readLoose reads a zlib compressed loose object
+func (r *Repository) readLoose(id ID) (objectType, []byte, error) {
+	f, err := r.openLoose(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %v: %v", id, err)
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %v: %v", id, err)
+	}
+	t, size, n, err := parseLooseHeader(b)
+	if err == nil && int64(len(b)-n) != size {
+		err = fmt.Errorf("size %d, want %d", len(b)-n, size)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %v: %v", id, err)
+	}
+	return t, b[n:], nil
+}
+
+// parseLooseHeader parses the "<type> <size>\x00" header of a loose
+// object, returning the length of the header
+func parseLooseHeader(b []byte) (t objectType, size int64, n int, err error) {
+	end := bytes.IndexByte(b, 0)
+	sp := bytes.IndexByte(b, ' ')
+	if end < 0 || sp < 0 || sp > end {
+		return 0, 0, 0, errors.New("invalid object header")
+	}
+	if t, err = parseType(string(b[:sp])); err != nil {
+		return 0, 0, 0, err
+	}
+	if size, err = strconv.ParseInt(string(b[sp+1:end]), 10, 64); err != nil {
+		return 0, 0, 0, errors.New("invalid object size")
+	}
+	return t, size, end + 1, nil
+}
+
+// commit is the part of a commit object used here
+type commit struct {
+	tree ID
+	time int64 // the committer's timestamp
+}
+
+func parseCommit(id ID, data []byte) (c commit, err error) {
+	tree := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			// the end of the headers
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, "tree "):
+			c.tree, err = ParseID(line[len("tree "):])
+			tree = err == nil
+		case strings.HasPrefix(line, "committer "):
+			f := strings.Fields(line)
+			if len(f) >= 2 {
+				c.time, _ = strconv.ParseInt(f[len(f)-2], 10, 64)
+			}
+		}
+	}
+	if !tree {
+		return c, fmt.Errorf("commit %v: no tree", id)
+	}
+	return c, nil
+}
+
+// treeEntry is an entry of a tree object
+type treeEntry struct {
+	name string
+	mode uint32
+	id   ID
+}
+
+// Tree entry modes
+const (
+	modeDir     = 040000
+	modeFile    = 0100644
+	modeExec    = 0100755
+	modeSymlink = 0120000
+	modeGitlink = 0160000 // a submodule's commit
+)
+
+func parseTree(id ID, data []byte) ([]treeEntry, error) {
+	entries := []treeEntry{}
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		end := bytes.IndexByte(data, 0)
+		if sp < 0 || end < sp || len(data) < end+1+len(ID{}) {
+			return nil, fmt.Errorf("tree %v: invalid entry", id)
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("tree %v: invalid mode", id)
+		}
+		e := treeEntry{name: string(data[sp+1 : end]), mode: uint32(mode)}
+		copy(e.id[:], data[end+1:])
+		entries = append(entries, e)
+		data = data[end+1+len(ID{}):]
+	}
+	return entries, nil
+}
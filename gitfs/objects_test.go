@@ -0,0 +1,136 @@
+package gitfs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRepo is a git repository made with the git command
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "gitfs")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	r := &testRepo{t, dir}
+	r.git("init", "-q")
+	return r
+}
+
+func (r *testRepo) remove() {
+	_ = os.RemoveAll(r.dir)
+}
+
+// git runs the git command in the work tree, returning its output
+func (r *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+		"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com",
+		"GIT_AUTHOR_DATE=1400000000 +0000", "GIT_COMMITTER_DATE=1400000000 +0000",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+r.dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (r *testRepo) write(name, content string) {
+	name = filepath.Join(r.dir, name)
+	_ = os.MkdirAll(filepath.Dir(name), 0755)
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		r.t.Fatal("unexpected error:", err)
+	}
+}
+
+// commit commits all changes, returning the commit id
+func (r *testRepo) commit(msg string) string {
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", msg)
+	return r.git("rev-parse", "HEAD")
+}
+
+func TestParseID(t *testing.T) {
+	s := "0123456789abcdef0123456789abcdef01234567"
+	id, err := ParseID(s)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if id.String() != s {
+		t.Error("want", s, "got", id.String())
+	}
+	for _, bad := range []string{"", "0123", s + "0", s[:39] + "g"} {
+		if _, err := ParseID(bad); err == nil {
+			t.Error("want error parsing", bad)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	r.write("a.txt", "hello\n")
+	r.commit("first")
+
+	// a work tree, its git directory, and a bare clone
+	bare := filepath.Join(r.dir, "bare.git")
+	r.git("clone", "-q", "--bare", r.dir, bare)
+	for _, path := range []string{r.dir, filepath.Join(r.dir, ".git"), bare} {
+		repo, err := Open(path)
+		if err != nil {
+			t.Error("unexpected error opening", path, err)
+			continue
+		}
+		if _, err = repo.Resolve("HEAD"); err != nil {
+			t.Error("unexpected error resolving HEAD in", path, err)
+		}
+		_ = repo.Close()
+	}
+	if _, err := Open(filepath.Join(r.dir, "missing")); err == nil {
+		t.Error("want error opening a missing directory")
+	}
+	if _, err := Open(os.TempDir()); err == nil {
+		t.Error("want error opening a directory which is not a repository")
+	}
+}
+
+func TestLooseObjects(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	r.write("a.txt", "hello\n")
+	r.commit("first")
+	repo, err := Open(r.dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer repo.Close()
+
+	id, _ := ParseID(r.git("rev-parse", "HEAD:a.txt"))
+	typ, data, err := repo.object(id)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if typ != typeBlob || string(data) != "hello\n" {
+		t.Errorf("want blob hello, got %v %q", typ, data)
+	}
+	typ, size, err := repo.size(id)
+	if err != nil || typ != typeBlob || size != 6 {
+		t.Errorf("want blob of 6 bytes, got %v %d %v", typ, size, err)
+	}
+	if _, _, err = repo.object(ID{}); err != errNotFound {
+		t.Error("want errNotFound, got", err)
+	}
+}
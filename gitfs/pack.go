@@ -0,0 +1,363 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Pack files.
+//
+// A pack file holds many objects, each compressed, and possibly
+// stored as a delta against another object: either one earlier in
+// the same pack (an offset delta), or one named by id (a ref delta).
+// The pack's index file maps object ids to their offsets in the
+// pack, and is read into memory when the pack is opened.
+
+const (
+	// the deepest chain of deltas followed
+	maxDeltaDepth = 1000
+)
+
+var (
+	idxMagic = []byte{0xff, 't', 'O', 'c'}
+
+	errDelta = errors.New("invalid delta")
+)
+
+// pack is an open pack file and its index
+type pack struct {
+	name    string
+	file    *os.File
+	length  int64    // of the pack file
+	fanout  []uint32 // the number of ids with each first byte or less
+	ids     []byte   // the sorted ids of the pack's objects
+	offsets []uint64 // the offset of each object in the pack file
+}
+
+// openPack opens the pack of the index file idxName
+func openPack(idxName string) (*pack, error) {
+	b, err := ioutil.ReadFile(idxName)
+	if err != nil {
+		return nil, err
+	}
+	p := &pack{name: strings.TrimSuffix(idxName, ".idx") + ".pack"}
+	if err = p.parseIndex(b); err != nil {
+		return nil, fmt.Errorf("%s: %v", idxName, err)
+	}
+	if p.file, err = os.Open(p.name); err != nil {
+		return nil, err
+	}
+	fi, err := p.file.Stat()
+	if err != nil {
+		_ = p.file.Close()
+		return nil, err
+	}
+	p.length = fi.Size()
+	return p, nil
+}
+
+func (p *pack) close() error {
+	return p.file.Close()
+}
+
+// parseIndex reads a version 1 or 2 pack index
+func (p *pack) parseIndex(b []byte) error {
+	version := 1
+	if bytes.HasPrefix(b, idxMagic) {
+		if len(b) < 8 {
+			return errors.New("truncated index")
+		}
+		version = int(binary.BigEndian.Uint32(b[4:]))
+		if version != 2 {
+			return fmt.Errorf("unsupported index version %d", version)
+		}
+		b = b[8:]
+	}
+	if len(b) < 256*4 {
+		return errors.New("truncated index")
+	}
+	p.fanout = make([]uint32, 256)
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	b = b[256*4:]
+	n := int(p.fanout[255])
+	idlen := len(ID{})
+	p.offsets = make([]uint64, n)
+
+	if version == 1 {
+		// entries of a 4 byte offset and the id
+		if len(b) < n*(4+idlen) {
+			return errors.New("truncated index")
+		}
+		p.ids = make([]byte, 0, n*idlen)
+		for i := 0; i < n; i++ {
+			e := b[i*(4+idlen):]
+			p.offsets[i] = uint64(binary.BigEndian.Uint32(e))
+			p.ids = append(p.ids, e[4:4+idlen]...)
+		}
+		return nil
+	}
+
+	// the ids, their CRCs, their 4 byte offsets, then 8 byte offsets
+	// for those offsets with the high bit set
+	if len(b) < n*(idlen+8) {
+		return errors.New("truncated index")
+	}
+	p.ids = b[:n*idlen]
+	small := b[n*(idlen+4):]
+	large := small[n*4:]
+	for i := 0; i < n; i++ {
+		off := binary.BigEndian.Uint32(small[i*4:])
+		if off&0x80000000 == 0 {
+			p.offsets[i] = uint64(off)
+			continue
+		}
+		j := int(off & 0x7fffffff)
+		if len(large) < (j+1)*8 {
+			return errors.New("truncated index")
+		}
+		p.offsets[i] = binary.BigEndian.Uint64(large[j*8:])
+	}
+	return nil
+}
+
+func (p *pack) id(i int) []byte {
+	idlen := len(ID{})
+	return p.ids[i*idlen : (i+1)*idlen]
+}
+
+// find returns the offset of the object in the pack, if present
+func (p *pack) find(id ID) (int64, bool) {
+	lo := 0
+	if id[0] > 0 {
+		lo = int(p.fanout[id[0]-1])
+	}
+	hi := int(p.fanout[id[0]])
+	i := lo + sort.Search(hi-lo, func(n int) bool {
+		return bytes.Compare(p.id(lo+n), id[:]) >= 0
+	})
+	if i < hi && bytes.Equal(p.id(i), id[:]) {
+		return int64(p.offsets[i]), true
+	}
+	return 0, false
+}
+
+// findPrefix returns the ids of the pack's objects beginning with
+// the hexadecimal prefix
+func (p *pack) findPrefix(prefix string) []ID {
+	ids := []ID{}
+	n := int(p.fanout[255])
+	i := sort.Search(n, func(i int) bool {
+		return hex.EncodeToString(p.id(i)) >= prefix
+	})
+	for ; i < n; i++ {
+		var id ID
+		copy(id[:], p.id(i))
+		if !strings.HasPrefix(id.String(), prefix) {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// entry is the header of an object in the pack
+type entry struct {
+	typ    objectType
+	size   int64 // of the object, or the delta
+	base   int64 // for offset deltas, the offset of the base object
+	baseID ID    // for ref deltas, the base object
+	r      *bufio.Reader
+}
+
+// entry reads the header of the object at offset
+func (p *pack) entry(offset int64) (*entry, error) {
+	if offset < 0 || offset >= p.length {
+		return nil, fmt.Errorf("%s: invalid offset %d", p.name, offset)
+	}
+	r := bufio.NewReader(io.NewSectionReader(p.file, offset, p.length-offset))
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{typ: objectType(c >> 4 & 7), size: int64(c & 0x0f), r: r}
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		e.size |= int64(c&0x7f) << shift
+	}
+	switch e.typ {
+	case typeOfsDelta:
+		if c, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return nil, err
+			}
+			rel = (rel+1)<<7 | int64(c&0x7f)
+		}
+		e.base = offset - rel
+	case typeRefDelta:
+		if _, err = io.ReadFull(r, e.baseID[:]); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// data decompresses the entry's object or delta data
+func (e *entry) data() ([]byte, error) {
+	zr, err := zlib.NewReader(e.r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	b := make([]byte, e.size)
+	if _, err = io.ReadFull(zr, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// read returns the type and content of the object at offset,
+// applying any deltas
+func (p *pack) read(r *Repository, offset int64, depth int) (objectType, []byte, error) {
+	e, err := p.entry(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := e.data()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: offset %d: %v", p.name, offset, err)
+	}
+	if e.typ != typeOfsDelta && e.typ != typeRefDelta {
+		return e.typ, data, nil
+	}
+	if depth >= maxDeltaDepth {
+		return 0, nil, fmt.Errorf("%s: offset %d: delta chain too long", p.name, offset)
+	}
+	var t objectType
+	var base []byte
+	if e.typ == typeOfsDelta {
+		t, base, err = p.read(r, e.base, depth+1)
+	} else {
+		t, base, err = r.readObject(e.baseID, depth+1)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if data, err = applyDelta(base, data); err != nil {
+		return 0, nil, fmt.Errorf("%s: offset %d: %v", p.name, offset, err)
+	}
+	return t, data, nil
+}
+
+// size returns the type and size of the object at offset. For
+// deltas, only the delta and the type of its base are read.
+func (p *pack) size(r *Repository, offset int64, depth int) (objectType, int64, error) {
+	e, err := p.entry(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	if e.typ != typeOfsDelta && e.typ != typeRefDelta {
+		return e.typ, e.size, nil
+	}
+	if depth >= maxDeltaDepth {
+		return 0, 0, fmt.Errorf("%s: offset %d: delta chain too long", p.name, offset)
+	}
+	delta, err := e.data()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: offset %d: %v", p.name, offset, err)
+	}
+	// the delta starts with the sizes of the base and the result
+	_, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return 0, 0, errDelta
+	}
+	size, n := binary.Uvarint(delta[n:])
+	if n <= 0 {
+		return 0, 0, errDelta
+	}
+	var t objectType
+	if e.typ == typeOfsDelta {
+		t, _, err = p.size(r, e.base, depth+1)
+	} else {
+		t, _, err = r.objectSize(e.baseID, depth+1)
+	}
+	return t, int64(size), err
+}
+
+// applyDelta returns the object made by applying the delta to base
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, n := binary.Uvarint(delta)
+	if n <= 0 || srcSize != uint64(len(base)) {
+		return nil, errDelta
+	}
+	delta = delta[n:]
+	dstSize, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, errDelta
+	}
+	delta = delta[n:]
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			// copy from base; the bits of op say which bytes of the
+			// offset and size follow
+			var off, size uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, errDelta
+				}
+				if i < 4 {
+					off |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > uint64(len(base)) {
+				return nil, errDelta
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0:
+			// insert the next op bytes
+			if int(op) > len(delta) {
+				return nil, errDelta
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, errDelta
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, errDelta
+	}
+	return out, nil
+}
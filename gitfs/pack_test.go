@@ -0,0 +1,107 @@
+package gitfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello, world\n")
+	delta := []byte{
+		13, 14, // the base and result sizes
+		0x91, 7, 5, // copy "world" from offset 7
+		3, ' ', 'o', 'f', // insert " of"
+		0x90, 6, // copy "hello," from offset 0
+	}
+	out, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if string(out) != "world ofhello," {
+		t.Errorf("got %q", out)
+	}
+	for _, bad := range [][]byte{
+		{12, 5, 3, 'a', 'b', 'c'},    // wrong base size
+		{13, 5, 0},                   // reserved op
+		{13, 5, 0x91, 10, 5},         // copy beyond the base
+		{13, 5, 9, 'a'},              // insert beyond the delta
+		{13, 6, 3, 'a', 'b', 'c', 0}, // wrong result size
+	} {
+		if _, err := applyDelta(base, bad); err == nil {
+			t.Errorf("want error applying %v", bad)
+		}
+	}
+}
+
+func TestPackedObjects(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	// many similar revisions of a file, so that the pack has deltas
+	lines := []string{}
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line %d of the file", i))
+	}
+	revs := []string{}
+	for i := 0; i < 10; i++ {
+		lines[i*20] = fmt.Sprintf("changed in revision %d", i)
+		r.write("file.txt", strings.Join(lines, "\n"))
+		r.commit(fmt.Sprintf("revision %d", i))
+		revs = append(revs, strings.Join(lines, "\n"))
+	}
+	r.git("gc", "-q", "--aggressive")
+	if !strings.HasPrefix(r.git("count-objects", "-v"), "count: 0\n") {
+		t.Fatal("want all objects packed")
+	}
+	packs, _ := filepath.Glob(filepath.Join(r.dir, ".git/objects/pack/*.idx"))
+	if len(packs) != 1 || !strings.Contains(r.git("verify-pack", "-v", packs[0]), "chain length") {
+		t.Fatal("want a pack with deltas")
+	}
+
+	repo, err := Open(r.dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer repo.Close()
+	if len(repo.getPacks()) == 0 {
+		t.Fatal("want a pack")
+	}
+	for i, want := range revs {
+		id, _ := ParseID(r.git("rev-parse", fmt.Sprintf("HEAD~%d:file.txt", 9-i)))
+		typ, data, err := repo.object(id)
+		if err != nil {
+			t.Error("unexpected error:", err)
+			continue
+		}
+		if typ != typeBlob || string(data) != want {
+			t.Errorf("revision %d: want blob %q, got %v %q", i, want[:20], typ, data)
+		}
+		if typ, size, err := repo.size(id); err != nil || typ != typeBlob ||
+			size != int64(len(want)) {
+			t.Errorf("revision %d: want blob of %d bytes, got %v %d %v",
+				i, len(want), typ, size, err)
+		}
+	}
+}
+
+func TestPacksReloaded(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	r.write("a.txt", "one\n")
+	r.commit("first")
+	repo, err := Open(r.dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer repo.Close()
+
+	// objects packed after the repository was opened are found
+	r.write("a.txt", "two\n")
+	second := r.commit("second")
+	r.git("gc", "-q")
+	id, err := repo.Resolve("HEAD")
+	if err != nil || id.String() != second {
+		t.Error("want", second, "got", id, err)
+	}
+}
@@ -0,0 +1,227 @@
+package gitfs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// the most symbolic refs and tags followed to find a commit
+	maxRefDepth = 10
+	// the shortest abbreviated object id resolved
+	minAbbrev = 4
+)
+
+// CheckRefName returns an error if name cannot be a git revision:
+// a ref, such as refs/heads/master, a short name, such as master or
+// v1.0, or a full or abbreviated commit id.
+func CheckRefName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("revision must not be empty")
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") ||
+		strings.HasPrefix(name, "-") || strings.HasSuffix(name, ".lock"):
+		return fmt.Errorf("invalid revision %q", name)
+	case strings.Contains(name, "..") || strings.Contains(name, "//") ||
+		strings.Contains(name, "@{"):
+		return fmt.Errorf("invalid revision %q", name)
+	}
+	for _, c := range name {
+		if c < ' ' || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return fmt.Errorf("invalid revision %q", name)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the id of the commit named by rev. As with git
+// rev-parse, rev may be a full or abbreviated commit id, a full ref
+// name, or a name resolved (in order) as a ref, a tag, a branch, a
+// remote or a remote's HEAD. Tags are followed to the commit tagged.
+func (r *Repository) Resolve(rev string) (ID, error) {
+	if err := CheckRefName(rev); err != nil {
+		return ID{}, err
+	}
+	id, err := r.resolveRef(rev)
+	if err == errNotFound && isHex(rev) {
+		id, err = r.resolveID(rev)
+	}
+	if err == errNotFound {
+		return id, fmt.Errorf("unknown revision %q", rev)
+	} else if err != nil {
+		return id, err
+	}
+	return r.peel(id)
+}
+
+// resolveRef returns the object a ref name refers to
+func (r *Repository) resolveRef(rev string) (ID, error) {
+	for _, name := range []string{
+		rev,
+		"refs/" + rev,
+		"refs/tags/" + rev,
+		"refs/heads/" + rev,
+		"refs/remotes/" + rev,
+		"refs/remotes/" + rev + "/HEAD",
+	} {
+		if name == rev && !strings.HasPrefix(rev, "refs/") &&
+			strings.ToUpper(rev) != rev {
+			// only names such as HEAD are found directly in the git
+			// directory, not arbitrary files
+			continue
+		}
+		id, err := r.readRef(name, 0)
+		if err != errNotFound {
+			return id, err
+		}
+	}
+	return ID{}, errNotFound
+}
+
+// readRef reads a loose or packed ref, following symbolic refs
+func (r *Repository) readRef(name string, depth int) (ID, error) {
+	if depth >= maxRefDepth {
+		return ID{}, fmt.Errorf("ref %s: too many levels of symbolic refs", name)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) || isDirError(err) {
+		return r.packedRef(name)
+	} else if err != nil {
+		return ID{}, err
+	}
+	s := strings.TrimSpace(string(b))
+	if strings.HasPrefix(s, "ref: ") {
+		target := strings.TrimPrefix(s, "ref: ")
+		if CheckRefName(target) != nil {
+			return ID{}, fmt.Errorf("ref %s: invalid target %q", name, target)
+		}
+		return r.readRef(target, depth+1)
+	}
+	id, err := ParseID(s)
+	if err != nil {
+		return id, fmt.Errorf("ref %s: %v", name, err)
+	}
+	return id, nil
+}
+
+func isDirError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		if fi, serr := os.Stat(pe.Path); serr == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// packedRef looks up the ref in the packed-refs file
+func (r *Repository) packedRef(name string) (ID, error) {
+	f, err := os.Open(filepath.Join(r.dir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return ID{}, errNotFound
+	} else if err != nil {
+		return ID{}, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		f := strings.SplitN(line, " ", 2)
+		if len(f) == 2 && f[1] == name {
+			return ParseID(f[0])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return ID{}, err
+	}
+	return ID{}, errNotFound
+}
+
+// resolveID finds the object with the full or abbreviated id
+func (r *Repository) resolveID(prefix string) (ID, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) == 2*len(ID{}) {
+		id, err := ParseID(prefix)
+		if err != nil {
+			return id, err
+		}
+		if _, _, err = r.size(id); err != nil {
+			return id, errNotFound
+		}
+		return id, nil
+	}
+	if len(prefix) < minAbbrev {
+		return ID{}, errNotFound
+	}
+	found := map[ID]bool{}
+	for _, p := range r.getPacks() {
+		for _, id := range p.findPrefix(prefix) {
+			found[id] = true
+		}
+	}
+	for _, dir := range r.objects {
+		names, _ := filepath.Glob(filepath.Join(dir, prefix[:2], prefix[2:]+"*"))
+		for _, name := range names {
+			if id, err := ParseID(prefix[:2] + filepath.Base(name)); err == nil {
+				found[id] = true
+			}
+		}
+	}
+	ids := []string{}
+	var id ID
+	for id = range found {
+		ids = append(ids, id.String())
+	}
+	switch len(ids) {
+	case 0:
+		return ID{}, errNotFound
+	case 1:
+		return id, nil
+	}
+	sort.Strings(ids)
+	return ID{}, fmt.Errorf("abbreviated id %s is ambiguous (%s)",
+		prefix, strings.Join(ids, ", "))
+}
+
+// peel follows tags to the commit tagged
+func (r *Repository) peel(id ID) (ID, error) {
+	for depth := 0; depth < maxRefDepth; depth++ {
+		t, data, err := r.object(id)
+		if err != nil {
+			return id, err
+		}
+		switch t {
+		case typeCommit:
+			return id, nil
+		case typeTag:
+			line := strings.SplitN(string(data), "\n", 2)[0]
+			if !strings.HasPrefix(line, "object ") {
+				return id, fmt.Errorf("tag %v: no object", id)
+			}
+			if id, err = ParseID(strings.TrimPrefix(line, "object ")); err != nil {
+				return id, err
+			}
+		default:
+			return id, fmt.Errorf("%v is a %v, not a commit", id, t)
+		}
+	}
+	return id, fmt.Errorf("%v: too many levels of tags", id)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
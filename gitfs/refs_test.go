@@ -0,0 +1,75 @@
+package gitfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRefName(t *testing.T) {
+	for _, ok := range []string{"master", "refs/heads/master", "v1.0",
+		"feature/foo", "HEAD", "0123abcd"} {
+		if err := CheckRefName(ok); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	for _, bad := range []string{"", "/etc/passwd", "../config", "a/../b",
+		"-x", "a b", "a~1", "HEAD^", "a:b", "a/", "x.lock", "a//b", "@{1}"} {
+		if err := CheckRefName(bad); err == nil {
+			t.Error("want error for", bad)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	r.write("a.txt", "one\n")
+	first := r.commit("first")
+	r.git("tag", "light")
+	r.git("tag", "-a", "-m", "annotated", "v1.0")
+	r.git("branch", "-M", "main")
+	r.write("a.txt", "two\n")
+	second := r.commit("second")
+	r.git("branch", "old", first)
+
+	repo, err := Open(r.dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer repo.Close()
+
+	check := func(rev, want string) {
+		id, err := repo.Resolve(rev)
+		if err != nil {
+			t.Error("unexpected error resolving", rev, err)
+		} else if id.String() != want {
+			t.Error("resolving", rev, "want", want, "got", id)
+		}
+	}
+	tests := func() {
+		check("HEAD", second)
+		check("main", second)
+		check("refs/heads/main", second)
+		check("heads/old", first)
+		check("old", first)
+		check("light", first)
+		check("v1.0", first)
+		check("refs/tags/v1.0", first)
+		check(first, first)
+		check(strings.ToUpper(second[:10]), second)
+		for _, rev := range []string{"missing", "config", "0000000", "../HEAD"} {
+			if _, err := repo.Resolve(rev); err == nil {
+				t.Error("want error resolving", rev)
+			}
+		}
+		// a tree is not a commit
+		tree := r.git("rev-parse", "HEAD^{tree}")
+		if _, err := repo.Resolve(tree); err == nil {
+			t.Error("want error resolving a tree")
+		}
+	}
+	tests()
+	// and once the refs are packed
+	r.git("pack-refs", "--all")
+	tests()
+}